@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	ErrConnectionNotFound = errors.New("connection not found")
+	ErrBadAdminToken      = errors.New("wrong admin token")
+)
+
+// Read the server config file - no path gives an empty config
+func LoadServerConfig(path string) (ServerConfig, error) {
+	var config ServerConfig
+	if path == "" {
+		return config, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	err = json.Unmarshal(data, &config)
+	return config, err
+}
+
+// Apply the server config - the admins are replaced and the log level is changed when it's set.
+// Every admin needs a token, so being signed in under an admin's name is never enough.
+func (s *Server) ApplyConfig(config ServerConfig) error {
+	var level slog.Level
+	if config.LogLevel != "" {
+		if err := level.UnmarshalText([]byte(config.LogLevel)); err != nil {
+			return err
+		}
+	}
+
+	admins := make(map[string]string)
+	for _, admin := range config.Admins {
+		if admin.User == "" || admin.Token == "" {
+			return fmt.Errorf("admin [%s] needs a user and a token", admin.User)
+		}
+		admins[admin.User] = admin.Token
+	}
+
+	s.configMu.Lock()
+	s.admins = admins
+	s.configMu.Unlock()
+	if config.LogLevel != "" && s.logLevel != nil {
+		s.logLevel.Set(level)
+	}
+
+	slog.Info("Applied server config", "admins", len(admins), "log_level", config.LogLevel)
+	return nil
+}
+
+// Check whether a user is a server admin
+func (s *Server) IsAdmin(user string) bool {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	_, ok := s.admins[user]
+	return ok
+}
+
+// Check a token against the admin's token in the config
+func (s *Server) AdminTokenMatches(user string, token string) bool {
+	s.configMu.RLock()
+	defer s.configMu.RUnlock()
+	want, ok := s.admins[user]
+	return ok && token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(want)) == 1
+}
+
+// Only let signed in server admins that presented their admin token call admin methods. The token is
+// checked against the config on every call, so reloading the config revokes it.
+func (s *Server) AdminMiddleware(next RequestHandler) RequestHandler {
+	return func(ctx context.Context, request JsonRpcRequest) JsonRpcResponse {
+		if !strings.HasPrefix(request.Method, AdminNamespace) {
+			return next(ctx, request)
+		}
+
+		connection, ok := ConnectionFromContext(ctx)
+		if !ok {
+			return NewServiceErrorResponse(request, ErrPermissionDenied)
+		}
+		user, ok := s.userService.UserForConnection(connection.id)
+		if !ok {
+			return NewServiceErrorResponse(request, ErrNotSignedIn)
+		}
+		if request.Method == AdminAuthenticateRpcMethod {
+			return next(ctx, request)
+		}
+		if !s.AdminTokenMatches(user, connection.AdminToken()) {
+			LoggerFromContext(ctx).Warn("Admin method called without an admin token")
+			return NewServiceErrorResponse(request, ErrPermissionDenied)
+		}
+
+		return next(ctx, request)
+	}
+}
+
+// Check the admin token of the connection's user and remember it for the admin methods that follow
+func (s *Server) AdminAuthenticateHandler(ctx context.Context, params AdminAuthenticateParams) (SuccessResult, error) {
+	connection, ok := ConnectionFromContext(ctx)
+	if !ok {
+		return SuccessResult{}, ErrNoConnection
+	}
+	user, _ := s.userService.UserForConnection(connection.id)
+	if !s.AdminTokenMatches(user, params.Token) {
+		LoggerFromContext(ctx).Warn("Wrong admin token", "user", user)
+		return SuccessResult{}, ErrBadAdminToken
+	}
+
+	connection.SetAdminToken(params.Token)
+	return SuccessResult{Success: true}, nil
+}
+
+// List every connection with its user and traffic
+func (s *Server) AdminListConnectionsHandler(ctx context.Context, params NoParams) (ListConnectionsResult, error) {
+	connections := make([]ConnectionInfo, 0)
+	for _, c := range s.connectionService.ListConnections() {
+		info := ConnectionInfo{Id: c.id, ConnectedAt: c.connectedAt, BytesIn: c.bytesIn.Load(), BytesOut: c.bytesOut.Load()}
+		if addr := c.RemoteAddr(); addr != nil {
+			info.RemoteAddr = addr.String()
+		}
+		info.User, _ = s.userService.UserForConnection(c.id)
+		connections = append(connections, info)
+	}
+
+	return ListConnectionsResult{Connections: connections}, nil
+}
+
+// Forcibly disconnect a connection
+func (s *Server) AdminDisconnectHandler(ctx context.Context, params DisconnectParams) (bool, error) {
+	connection, ok := s.connectionService.GetConnection(params.ConnectionId)
+	if !ok {
+		return false, ErrConnectionNotFound
+	}
+
+	LoggerFromContext(ctx).Info("Admin disconnecting connection", "target", connection.id)
+	s.CloseConnection(connection)
+	return true, nil
+}
+
+// Send an announcement to every connection
+func (s *Server) AdminAnnounceHandler(ctx context.Context, params AnnounceParams) (Announcement, error) {
+	if strings.TrimSpace(params.Msg) == "" {
+		return Announcement{}, NewInvalidParamsError(FieldError{Field: "msg", Message: "is required"})
+	}
+
+	announcement := Announcement{From: s.callerIdentity(ctx), Msg: params.Msg, Time: time.Now().UTC()}
+	s.Broadcast(AnnouncementRpcMethod, announcement, nil)
+	return announcement, nil
+}
+
+// Read the server config file again and apply it - the result leaves out the admin tokens, link secrets and key paths
+func (s *Server) AdminReloadConfigHandler(ctx context.Context, params NoParams) (ReloadConfigResult, error) {
+	config, err := LoadServerConfig(s.configPath)
+	if err == nil {
+		err = s.ApplyConfig(config)
+	}
+	if err != nil {
+		LoggerFromContext(ctx).Error("Failed to reload server config", "path", s.configPath, "error", err)
+		return ReloadConfigResult{}, &JsonRpcError{Code: -32603, Message: "Failed to reload config: " + err.Error()}
+	}
+
+	result := ReloadConfigResult{Admins: make([]string, 0, len(config.Admins)), LogLevel: config.LogLevel}
+	for _, admin := range config.Admins {
+		result.Admins = append(result.Admins, admin.User)
+	}
+	if federation := config.Federation; federation != nil {
+		result.Federation = &FederationConfigSummary{ServerId: federation.ServerId, Listen: federation.Listen, Links: make([]FederationLinkSummary, 0, len(federation.Links))}
+		for _, link := range federation.Links {
+			result.Federation.Links = append(result.Federation.Links, FederationLinkSummary{ServerId: link.ServerId, Address: link.Address, Rooms: link.Rooms})
+		}
+	}
+	return result, nil
+}
+
+// Dump the full state of every room
+func (s *Server) AdminDumpRoomsHandler(ctx context.Context, params NoParams) (DumpRoomsResult, error) {
+	return DumpRoomsResult{Rooms: s.roomService.DumpRooms()}, nil
+}
+
+// Ask a connection's client to describe itself
+func (s *Server) AdminClientInfoHandler(ctx context.Context, params ClientInfoParams) (ClientInfo, error) {
+	if caller, ok := ConnectionFromContext(ctx); ok && caller.id == params.ConnectionId {
+		return ClientInfo{}, NewInvalidParamsError(FieldError{Field: "connectionId", Message: "is the caller's own connection"})
+	}
+	connection, ok := s.connectionService.GetConnection(params.ConnectionId)
+	if !ok {
+		return ClientInfo{}, ErrConnectionNotFound
+	}
+
+	response, err := connection.Call(ClientInfoRpcMethod, nil, ClientRequestTimeout)
+	if err != nil {
+		return ClientInfo{}, err
+	}
+	if response.Error != nil {
+		return ClientInfo{}, response.Error
+	}
+
+	var info ClientInfo
+	if err := json.Unmarshal(response.Result, &info); err != nil {
+		return ClientInfo{}, &JsonRpcError{Code: -32603, Message: "Invalid client info: " + err.Error()}
+	}
+	return info, nil
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func AdminServerFixture(t testing.TB) (*Server, *Connection) {
+	t.Helper()
+	server := ServerFixture()
+	AssertErrorNotNil(t, server.ApplyConfig(ServerConfig{Admins: []AdminConfig{{User: "root", Token: "root-token"}}}))
+	admin, _ := AddFakeConnection(t, server, "root")
+	AssertSuccess(t, CallMethod(t, server, admin, AdminAuthenticateRpcMethod, AdminAuthenticateParams{Token: "root-token"}))
+	return server, admin
+}
+
+func TestAdminMiddleware(t *testing.T) {
+	t.Run("admin methods need a signed in admin", func(t *testing.T) {
+		server, _ := AdminServerFixture(t)
+		alice, _ := AddFakeConnection(t, server, "alice")
+		anonymous, _ := AddFakeConnection(t, server, "")
+
+		AssertErrorCode(t, CallMethod(t, server, alice, AdminDumpRoomsRpcMethod, nil), PermissionDeniedErrorCode)
+		AssertErrorCode(t, CallMethod(t, server, anonymous, AdminDumpRoomsRpcMethod, nil), NotSignedInErrorCode)
+	})
+
+	t.Run("admins need their token", func(t *testing.T) {
+		server, _ := AdminServerFixture(t)
+		root, _ := AddFakeConnection(t, server, "root")
+		alice, _ := AddFakeConnection(t, server, "alice")
+
+		AssertErrorCode(t, CallMethod(t, server, root, AdminDumpRoomsRpcMethod, nil), PermissionDeniedErrorCode)
+		AssertErrorCode(t, CallMethod(t, server, root, AdminAuthenticateRpcMethod, AdminAuthenticateParams{Token: "guess"}), BadAdminTokenErrorCode)
+		AssertErrorCode(t, CallMethod(t, server, root, AdminDumpRoomsRpcMethod, nil), PermissionDeniedErrorCode)
+		AssertErrorCode(t, CallMethod(t, server, alice, AdminAuthenticateRpcMethod, AdminAuthenticateParams{Token: "root-token"}), BadAdminTokenErrorCode)
+		AssertSuccess(t, CallMethod(t, server, root, AdminAuthenticateRpcMethod, AdminAuthenticateParams{Token: "root-token"}))
+		AssertSuccess(t, CallMethod(t, server, root, AdminDumpRoomsRpcMethod, nil))
+	})
+
+	t.Run("admins without a token are rejected", func(t *testing.T) {
+		server := ServerFixture()
+		if err := server.ApplyConfig(ServerConfig{Admins: []AdminConfig{{User: "root"}}}); err == nil {
+			t.Error("got an admin without a token applied")
+		}
+	})
+
+	t.Run("unknown admin methods aren't revealed to non-admins", func(t *testing.T) {
+		server, admin := AdminServerFixture(t)
+		alice, _ := AddFakeConnection(t, server, "alice")
+
+		AssertErrorCode(t, CallMethod(t, server, alice, "admin.nope", nil), PermissionDeniedErrorCode)
+		AssertErrorCode(t, CallMethod(t, server, admin, "admin.nope", nil), -32601)
+	})
+}
+
+func TestAdminHandlers(t *testing.T) {
+	t.Run("list connections", func(t *testing.T) {
+		server, admin := AdminServerFixture(t)
+		AddFakeConnection(t, server, "")
+
+		response := CallMethod(t, server, admin, AdminListConnectionsRpcMethod, nil)
+		AssertSuccess(t, response)
+
+		var result ListConnectionsResult
+		json.Unmarshal(response.Result, &result)
+		AssertNumberOfConnections(t, len(result.Connections), 2)
+		for _, c := range result.Connections {
+			if c.Id == admin.id && c.User != "root" {
+				t.Errorf("got user [%s] for the admin connection", c.User)
+			}
+			if c.ConnectedAt.IsZero() {
+				t.Errorf("got no connected at time for connection [%s]", c.Id)
+			}
+		}
+	})
+
+	t.Run("disconnect", func(t *testing.T) {
+		server, admin := AdminServerFixture(t)
+		alice, _ := AddFakeConnection(t, server, "alice")
+
+		AssertSuccess(t, CallMethod(t, server, admin, AdminDisconnectRpcMethod, DisconnectParams{ConnectionId: alice.id}))
+		if _, ok := server.connectionService.GetConnection(alice.id); ok {
+			t.Errorf("connection [%s] was not disconnected", alice.id)
+		}
+		AssertErrorCode(t, CallMethod(t, server, admin, AdminDisconnectRpcMethod, DisconnectParams{ConnectionId: alice.id}), ConnectionNotFoundErrorCode)
+	})
+
+	t.Run("announce to every connection", func(t *testing.T) {
+		server, admin := AdminServerFixture(t)
+		server.roomService.CreateRoom("ops", "bob")
+		_, bobConn := AddFakeConnection(t, server, "bob")
+		server.roomService.LeaveRoom(DefaultRoom, "bob")
+
+		AssertSuccess(t, CallMethod(t, server, admin, AdminAnnounceRpcMethod, AnnounceParams{Msg: "restarting soon"}))
+		AssertNumberOfConnections(t, CountNotifications(bobConn, AnnouncementRpcMethod), 1)
+		AssertErrorCode(t, CallMethod(t, server, admin, AdminAnnounceRpcMethod, AnnounceParams{Msg: " "}), -32602)
+	})
+
+	t.Run("reload config", func(t *testing.T) {
+		server, admin := AdminServerFixture(t)
+		server.logLevel = new(slog.LevelVar)
+		server.configPath = filepath.Join(t.TempDir(), "config.json")
+		os.WriteFile(server.configPath, []byte(`{"admins":[{"user":"root","token":"root-token"},{"user":"alice","token":"secret"}],"logLevel":"debug",
+			"federation":{"serverId":"a","keyFile":"/etc/chat/key.pem","links":[{"serverId":"b","address":"b.example:7000","secret":"secret","rooms":["lobby"]}]}}`), 0o600)
+
+		response := CallMethod(t, server, admin, AdminReloadConfigRpcMethod, nil)
+		AssertSuccess(t, response)
+		if strings.Contains(string(response.Result), "secret") || strings.Contains(string(response.Result), "key.pem") {
+			t.Errorf("got tokens, secrets or key paths in the result %s", response.Result)
+		}
+		var result ReloadConfigResult
+		json.Unmarshal(response.Result, &result)
+		if result.Federation == nil || len(result.Federation.Links) != 1 || result.Federation.Links[0].Address != "b.example:7000" {
+			t.Errorf("got reloaded config %+v", result)
+		}
+		if !server.IsAdmin("alice") {
+			t.Error("got alice not an admin after reloading config")
+		}
+		if server.logLevel.Level() != slog.LevelDebug {
+			t.Errorf("got log level [%s] but want [DEBUG]", server.logLevel.Level())
+		}
+
+		os.WriteFile(server.configPath, []byte(`{"admins":[{"user":"root","token":"root-token"}],"logLevel":"loud"}`), 0o600)
+		AssertErrorCode(t, CallMethod(t, server, admin, AdminReloadConfigRpcMethod, nil), -32603)
+		if !server.IsAdmin("alice") {
+			t.Error("got config applied from an invalid config file")
+		}
+
+		os.WriteFile(server.configPath, []byte(`{"admins":[{"user":"root","token":"rotated"}]}`), 0o600)
+		AssertSuccess(t, CallMethod(t, server, admin, AdminReloadConfigRpcMethod, nil))
+		AssertErrorCode(t, CallMethod(t, server, admin, AdminDumpRoomsRpcMethod, nil), PermissionDeniedErrorCode)
+	})
+
+	t.Run("client info is asked of the client", func(t *testing.T) {
+		server, admin := AdminServerFixture(t)
+		serverEnd, clientEnd := net.Pipe()
+		target := server.connectionService.AddConnection(serverEnd)
+		go server.HandleConnectionMessages(target)
+		defer clientEnd.Close()
+		go func() {
+			var request JsonRpcRequest
+			json.NewDecoder(clientEnd).Decode(&request)
+			response, _ := json.Marshal(NewResultResponse(request, ClientInfo{Name: "test", Methods: []string{request.Method}}))
+			clientEnd.Write(response)
+		}()
+
+		response := CallMethod(t, server, admin, AdminClientInfoRpcMethod, ClientInfoParams{ConnectionId: target.id})
+		AssertSuccess(t, response)
+
+		var info ClientInfo
+		json.Unmarshal(response.Result, &info)
+		if info.Name != "test" || len(info.Methods) != 1 || info.Methods[0] != ClientInfoRpcMethod {
+			t.Errorf("got client info %+v", info)
+		}
+	})
+
+	t.Run("client info isn't asked of the caller", func(t *testing.T) {
+		server, admin := AdminServerFixture(t)
+		AssertErrorCode(t, CallMethod(t, server, admin, AdminClientInfoRpcMethod, ClientInfoParams{ConnectionId: admin.id}), -32602)
+	})
+
+	t.Run("waiting on a client doesn't hold up the admin's later requests", func(t *testing.T) {
+		server, _ := AdminServerFixture(t)
+		targetEnd, targetClient := net.Pipe()
+		target := server.connectionService.AddConnection(targetEnd)
+		go server.HandleConnectionMessages(target)
+		defer targetClient.Close()
+
+		adminEnd, adminClient := net.Pipe()
+		admin := server.AcceptConnection(adminEnd)
+		defer adminClient.Close()
+		ctx := ContextWithConnection(context.Background(), admin)
+		if _, err := server.CreateUserHandler(ctx, CreateUserParams{Name: "root", Password: PasswordFor("root")}); err != nil {
+			t.Fatal(err)
+		}
+		AssertSuccess(t, CallMethod(t, server, admin, AdminAuthenticateRpcMethod, AdminAuthenticateParams{Token: "root-token"}))
+		go server.HandleConnectionMessages(admin)
+
+		go func() {
+			encoder := json.NewEncoder(adminClient)
+			infoParams, _ := json.Marshal(ClientInfoParams{ConnectionId: target.id})
+			encoder.Encode(JsonRpcRequest{JsonRpc: JsonRpcVersion, Id: "1", Method: AdminClientInfoRpcMethod, Params: infoParams})
+			encoder.Encode(JsonRpcRequest{JsonRpc: JsonRpcVersion, Id: "2", Method: AdminDumpRoomsRpcMethod})
+		}()
+
+		var response JsonRpcResponse
+		adminClient.SetReadDeadline(time.Now().Add(time.Second))
+		if err := json.NewDecoder(adminClient).Decode(&response); err != nil {
+			t.Fatalf("got no response while the client info was pending: %s", err)
+		}
+		if response.Id != "2" {
+			t.Errorf("got response [%v] first but want the dump rooms response", response.Id)
+		}
+	})
+
+	t.Run("dump rooms", func(t *testing.T) {
+		server, admin := AdminServerFixture(t)
+		server.roomService.CreateRoom("ops", "root")
+
+		response := CallMethod(t, server, admin, AdminDumpRoomsRpcMethod, nil)
+		AssertSuccess(t, response)
+
+		var result DumpRoomsResult
+		json.Unmarshal(response.Result, &result)
+		if len(result.Rooms) != 2 || result.Rooms[1].Name != "ops" || result.Rooms[1].Owner != "root" {
+			t.Errorf("got rooms %+v", result.Rooms)
+		}
+	})
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+)
+
+// Kinds of cluster events
+const (
+	EventNotification = "notification"
+	EventRoom         = "room"
+	EventPresence     = "presence"
+	EventMessage      = "message"
+	EventSync         = "sync"
+	EventUser         = "user"
+	EventWebhook      = "webhook"
+	EventNodeDown     = "nodeDown"
+	EventPing         = "ping"
+)
+
+// Audiences of cluster notifications
+const (
+	AudienceAll      = "all"
+	AudienceRoom     = "room"
+	AudienceIdentity = "identity"
+)
+
+// A notification for the connections of an audience on every node - To is the room or identity, and only
+// connections that negotiated the feature get it when one is given
+type ClusterNotification struct {
+	Audience string          `json:"audience"`
+	To       string          `json:"to,omitempty"`
+	Feature  string          `json:"feature,omitempty"`
+	Exclude  string          `json:"exclude,omitempty"`
+	Method   string          `json:"method"`
+	Params   json.RawMessage `json:"params"`
+}
+
+// A connection coming, going, or signing in as a user - User is the user's profile, without its credential, and
+// nil for anonymous connections
+type PresenceChange struct {
+	ConnectionId string `json:"connectionId"`
+	User         *User  `json:"user,omitempty"`
+	Online       bool   `json:"online"`
+}
+
+// State a node sends a peer when it connects - the peer merges the rooms, users and webhooks and replaces the
+// node's presence
+type ClusterSnapshot struct {
+	Rooms    []RoomState      `json:"rooms"`
+	Users    []*User          `json:"users"`
+	Webhooks []Webhook        `json:"webhooks"`
+	Presence []PresenceChange `json:"presence"`
+}
+
+// An event passed between the nodes of a cluster - Node is the node it comes from, or the node that went
+// down for nodeDown events
+type ClusterEvent struct {
+	Kind         string               `json:"kind"`
+	Node         string               `json:"node"`
+	Notification *ClusterNotification `json:"notification,omitempty"`
+	Room         *RoomChange          `json:"room,omitempty"`
+	Presence     *PresenceChange      `json:"presence,omitempty"`
+	Message      *Message             `json:"message,omitempty"`
+	User         *User                `json:"user,omitempty"`
+	Webhook      *WebhookChange       `json:"webhook,omitempty"`
+	Snapshot     *ClusterSnapshot     `json:"snapshot,omitempty"`
+}
+
+// Check that the event carries what its kind needs - events come off the network, so any of it can be missing
+func (e ClusterEvent) HasPayload() bool {
+	switch e.Kind {
+	case EventNotification:
+		return e.Notification != nil
+	case EventRoom:
+		return e.Room != nil
+	case EventPresence:
+		return e.Presence != nil
+	case EventMessage:
+		return e.Message != nil
+	case EventSync:
+		return e.Snapshot != nil
+	case EventUser:
+		return e.User != nil
+	case EventWebhook:
+		return e.Webhook != nil
+	}
+	return true
+}
+
+// Passes cluster events between nodes - every subscriber gets every event, its publisher included, in the
+// order they were published
+type Broker interface {
+	Publish(event ClusterEvent)
+	Subscribe(handler func(event ClusterEvent))
+	Close() error
+}
+
+// Broker within one process - events are queued and handed to the subscribers in order on a goroutine of
+// its own, so publishing never waits on a subscriber. Several servers can share one to run as a cluster.
+type LocalBroker struct {
+	handlers []func(event ClusterEvent)
+	queue    []ClusterEvent
+	busy     bool
+	closed   bool
+	wake     *sync.Cond
+	idle     *sync.Cond
+	mu       sync.Mutex
+}
+
+// Create a broker and start handing out its events
+func NewLocalBroker() *LocalBroker {
+	b := &LocalBroker{}
+	b.wake = sync.NewCond(&b.mu)
+	b.idle = sync.NewCond(&b.mu)
+	go b.run()
+	return b
+}
+
+// Queue an event for the subscribers
+func (b *LocalBroker) Publish(event ClusterEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return
+	}
+	b.queue = append(b.queue, event)
+	b.wake.Signal()
+}
+
+// Add a subscriber - it gets the events published from now on
+func (b *LocalBroker) Subscribe(handler func(event ClusterEvent)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.handlers = append(b.handlers, handler)
+}
+
+// Stop handing out events, dropping those still queued
+func (b *LocalBroker) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.queue = nil
+	b.wake.Signal()
+	b.idle.Broadcast()
+	return nil
+}
+
+// Wait until every event published so far has been handled
+func (b *LocalBroker) Flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for !b.closed && (len(b.queue) > 0 || b.busy) {
+		b.idle.Wait()
+	}
+}
+
+// Hand the queued events to the subscribers, one at a time
+func (b *LocalBroker) run() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for {
+		for !b.closed && len(b.queue) == 0 {
+			b.busy = false
+			b.idle.Broadcast()
+			b.wake.Wait()
+		}
+		if b.closed {
+			return
+		}
+		event := b.queue[0]
+		b.queue = b.queue[1:]
+		b.busy = true
+		handlers := b.handlers
+
+		b.mu.Unlock()
+		for _, handler := range handlers {
+			handler(event)
+		}
+		b.mu.Lock()
+	}
+}
+
+// Connections of other nodes, by connection id, with the node each is on
+type ClusterPresence struct {
+	nodes map[string]string
+	mu    sync.RWMutex
+}
+
+// Create an empty presence
+func NewClusterPresence() *ClusterPresence {
+	return &ClusterPresence{nodes: make(map[string]string)}
+}
+
+// Record a connection as being on a node
+func (p *ClusterPresence) Add(connectionId string, node string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.nodes[connectionId] = node
+}
+
+// Forget a connection
+func (p *ClusterPresence) Remove(connectionId string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.nodes, connectionId)
+}
+
+// Check whether a connection is on another node
+func (p *ClusterPresence) Has(connectionId string) bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	_, ok := p.nodes[connectionId]
+	return ok
+}
+
+// Forget every connection of a node, returning their ids
+func (p *ClusterPresence) DropNode(node string) []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	dropped := make([]string, 0)
+	for connectionId, connectionNode := range p.nodes {
+		if connectionNode == node {
+			dropped = append(dropped, connectionId)
+			delete(p.nodes, connectionId)
+		}
+	}
+	return dropped
+}
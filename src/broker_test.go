@@ -0,0 +1,60 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestLocalBroker(t *testing.T) {
+	t.Run("every subscriber gets every event in order", func(t *testing.T) {
+		broker := NewLocalBroker()
+		defer broker.Close()
+		got := make([][]string, 2)
+		for i := range got {
+			broker.Subscribe(func(event ClusterEvent) { got[i] = append(got[i], event.Node) })
+		}
+
+		for _, node := range []string{"a", "b", "c"} {
+			broker.Publish(ClusterEvent{Kind: EventPing, Node: node})
+		}
+		broker.Flush()
+		for i := range got {
+			if !slices.Equal(got[i], []string{"a", "b", "c"}) {
+				t.Errorf("subscriber %d got %v", i, got[i])
+			}
+		}
+	})
+
+	t.Run("subscribers can publish while they handle an event", func(t *testing.T) {
+		broker := NewLocalBroker()
+		defer broker.Close()
+		got := make([]string, 0)
+		broker.Subscribe(func(event ClusterEvent) {
+			got = append(got, event.Node)
+			if event.Node == "a" {
+				broker.Publish(ClusterEvent{Kind: EventPing, Node: "b"})
+			}
+		})
+
+		broker.Publish(ClusterEvent{Kind: EventPing, Node: "a"})
+		broker.Flush()
+		if !slices.Equal(got, []string{"a", "b"}) {
+			t.Errorf("got %v", got)
+		}
+	})
+}
+
+func TestClusterPresence(t *testing.T) {
+	presence := NewClusterPresence()
+	presence.Add("c1", "a")
+	presence.Add("c2", "b")
+	presence.Add("c3", "a")
+	presence.Remove("c3")
+
+	if dropped := presence.DropNode("a"); !slices.Equal(dropped, []string{"c1"}) {
+		t.Errorf("got dropped connections %v", dropped)
+	}
+	if presence.Has("c1") || !presence.Has("c2") {
+		t.Error("got the wrong connections after dropping node a")
+	}
+}
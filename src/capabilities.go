@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+)
+
+const (
+	ServerName    = "chat"
+	ServerVersion = "1.0.0"
+)
+
+// Largest message the server reads from a client - a connection sending a longer one is closed
+const MaxRequestBytes = 64 * 1024
+
+var ErrRequestTooLarge = errors.New("request too large")
+
+// Protocol versions the server speaks, newest first
+var SupportedProtocolVersions = []string{ProtocolVersion}
+
+// Features the server supports - batching and compression aren't supported yet
+var ServerFeatures = []string{FeatureBinary, FeatureThreads}
+
+// What a connection's client negotiated when it initialized - Limits are the client's
+type Capabilities struct {
+	ProtocolVersion string
+	Client          ClientInfo
+	Features        map[string]bool
+	Limits          ProtocolLimits
+}
+
+// Capabilities of a client that never initialized - it's assumed to speak the first protocol
+// version, which had every server feature, so clients from before the handshake keep working
+func LegacyCapabilities() Capabilities {
+	features := make(map[string]bool)
+	for _, feature := range ServerFeatures {
+		features[feature] = true
+	}
+	return Capabilities{ProtocolVersion: ProtocolVersion, Features: features}
+}
+
+// Store what the connection's client negotiated
+func (c *Connection) SetCapabilities(capabilities Capabilities) {
+	c.capabilities.Store(&capabilities)
+}
+
+// Get what the connection's client negotiated, or the legacy capabilities when it didn't initialize
+func (c *Connection) Capabilities() Capabilities {
+	if capabilities := c.capabilities.Load(); capabilities != nil {
+		return *capabilities
+	}
+	return LegacyCapabilities()
+}
+
+// Check whether the connection's client negotiated a feature
+func (c *Connection) HasFeature(feature string) bool {
+	return c.Capabilities().Features[feature]
+}
+
+// Keep the connections whose clients negotiated a feature
+func ConnectionsWithFeature(connections []*Connection, feature string) []*Connection {
+	filtered := make([]*Connection, 0, len(connections))
+	for _, c := range connections {
+		if c.HasFeature(feature) {
+			filtered = append(filtered, c)
+		}
+	}
+	return filtered
+}
+
+// Pick the supported protocol version with the same major version as the requested one
+func NegotiateProtocolVersion(requested string) (string, bool) {
+	major, _, _ := strings.Cut(requested, ".")
+	for _, version := range SupportedProtocolVersions {
+		if supportedMajor, _, _ := strings.Cut(version, "."); supportedMajor == major {
+			return version, true
+		}
+	}
+	return "", false
+}
+
+// Error for a method that needs a feature the client didn't negotiate
+func NewFeatureNotNegotiatedError(feature string) *JsonRpcError {
+	message := "Feature not negotiated: " + feature
+	return &JsonRpcError{Code: FeatureNotNegotiatedErrorCode, Message: message, Data: FeatureNotNegotiatedErrorData{Feature: feature}}
+}
+
+// Limits the server works within
+func (s *Server) Limits() ProtocolLimits {
+	return ProtocolLimits{
+		MaxMessageBytes:   MaxRequestBytes,
+		MaxPageSize:       min(MaxThreadPageSize, MaxSearchPageSize, MaxHistoryPageSize),
+		HeartbeatInterval: int(s.heartbeatConfig.Interval.Seconds()),
+	}
+}
+
+// Negotiate the protocol version and features with the client and store them on its connection
+func (s *Server) InitializeHandler(ctx context.Context, params InitializeParams) (InitializeResult, error) {
+	version, ok := NegotiateProtocolVersion(params.ProtocolVersion)
+	if !ok {
+		data := UnsupportedVersionErrorData{Supported: SupportedProtocolVersions}
+		return InitializeResult{}, &JsonRpcError{Code: UnsupportedVersionErrorCode, Message: "Unsupported protocol version", Data: data}
+	}
+
+	features := make([]string, 0)
+	negotiated := make(map[string]bool)
+	for _, feature := range ServerFeatures {
+		if slices.Contains(params.Features, feature) {
+			features = append(features, feature)
+			negotiated[feature] = true
+		}
+	}
+
+	connection, ok := ConnectionFromContext(ctx)
+	if !ok {
+		return InitializeResult{}, ErrNoConnection
+	}
+	connection.SetCapabilities(Capabilities{ProtocolVersion: version, Client: params.ClientInfo, Features: negotiated, Limits: params.Limits})
+	LoggerFromContext(ctx).Info("Negotiated protocol", "protocol_version", version, "features", features, "client", params.ClientInfo.Name)
+
+	return InitializeResult{ProtocolVersion: version, ServerInfo: ServerInfo{Name: ServerName, Version: ServerVersion}, Features: features, Limits: s.Limits()}, nil
+}
+
+// Reject methods that need a feature the connection's client didn't negotiate
+func (s *Server) FeatureMiddleware(next RequestHandler) RequestHandler {
+	return func(ctx context.Context, request JsonRpcRequest) JsonRpcResponse {
+		feature := s.dispatcher.methods[request.Method].Feature
+		connection, ok := ConnectionFromContext(ctx)
+		if feature == "" || !ok || connection.HasFeature(feature) {
+			return next(ctx, request)
+		}
+
+		return JsonRpcResponse{JsonRpc: request.JsonRpc, Id: request.Id, Error: NewFeatureNotNegotiatedError(feature)}
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+// Initialize a connection with the given features
+func Initialize(t testing.TB, server *Server, connection *Connection, features ...string) InitializeResult {
+	t.Helper()
+	response := CallMethod(t, server, connection, InitializeRpcMethod, InitializeParams{ProtocolVersion: ProtocolVersion, Features: features})
+	AssertSuccess(t, response)
+
+	var result InitializeResult
+	json.Unmarshal(response.Result, &result)
+	return result
+}
+
+func TestNegotiateProtocolVersion(t *testing.T) {
+	versions := map[string]bool{"1.0": true, "1.7": true, "1": true, "2.0": false, "": false}
+
+	for requested, want := range versions {
+		version, ok := NegotiateProtocolVersion(requested)
+		if ok != want || (ok && version != ProtocolVersion) {
+			t.Errorf("got version [%s] %t for [%s] but want %t", version, ok, requested, want)
+		}
+	}
+}
+
+func TestInitializeHandler(t *testing.T) {
+	t.Run("features both peers support are negotiated", func(t *testing.T) {
+		server := ServerFixture()
+		alice, _ := AddFakeConnection(t, server, "alice")
+
+		result := Initialize(t, server, alice, FeatureThreads, FeatureCompression, "telepathy")
+		if !reflect.DeepEqual(result.Features, []string{FeatureThreads}) {
+			t.Errorf("got features %v but want [%s]", result.Features, FeatureThreads)
+		}
+		if result.ProtocolVersion != ProtocolVersion || result.ServerInfo.Name != ServerName || result.Limits.MaxMessageBytes != MaxRequestBytes {
+			t.Errorf("got result %+v", result)
+		}
+		if !alice.HasFeature(FeatureThreads) || alice.HasFeature(FeatureBinary) {
+			t.Errorf("got capabilities %+v stored on the connection", alice.Capabilities())
+		}
+	})
+
+	t.Run("unsupported protocol versions are rejected", func(t *testing.T) {
+		server := ServerFixture()
+		alice, _ := AddFakeConnection(t, server, "alice")
+
+		response := CallMethod(t, server, alice, InitializeRpcMethod, InitializeParams{ProtocolVersion: "2.0"})
+		AssertErrorCode(t, response, UnsupportedVersionErrorCode)
+		if !alice.HasFeature(FeatureThreads) {
+			t.Error("got capabilities changed by a failed initialize")
+		}
+	})
+}
+
+func TestFeatureMiddleware(t *testing.T) {
+	t.Run("methods need their feature to be negotiated", func(t *testing.T) {
+		server := ServerFixture()
+		alice, _ := AddFakeConnection(t, server, "alice")
+		message, _ := server.messageService.AddMessage(DefaultRoom, "alice", []byte("root"), "")
+		Initialize(t, server, alice, FeatureBinary)
+
+		response := CallMethod(t, server, alice, GetThreadRpcMethod, GetThreadParams{RootId: message.Id})
+		AssertErrorCode(t, response, FeatureNotNegotiatedErrorCode)
+		response = CallMethod(t, server, alice, ChatRpcMethod, ChatRequestParams{Msg: []byte("reply"), ParentId: message.Id})
+		AssertErrorCode(t, response, FeatureNotNegotiatedErrorCode)
+		AssertSuccess(t, CallMethod(t, server, alice, ChatRpcMethod, ChatRequestParams{Msg: []byte("hi")}))
+	})
+
+	t.Run("clients that never initialize keep every feature", func(t *testing.T) {
+		server := ServerFixture()
+		alice, _ := AddFakeConnection(t, server, "alice")
+		message, _ := server.messageService.AddMessage(DefaultRoom, "alice", []byte("root"), "")
+
+		AssertSuccess(t, CallMethod(t, server, alice, GetThreadRpcMethod, GetThreadParams{RootId: message.Id}))
+	})
+
+	t.Run("thread updates only go to clients that negotiated threads", func(t *testing.T) {
+		server := ServerFixture()
+		alice, _ := AddFakeConnection(t, server, "alice")
+		bob, bobConn := AddFakeConnection(t, server, "bob")
+		carol, carolConn := AddFakeConnection(t, server, "carol")
+		Initialize(t, server, bob, FeatureThreads)
+		Initialize(t, server, carol)
+		message, _ := server.messageService.AddMessage(DefaultRoom, "alice", []byte("root"), "")
+
+		AssertSuccess(t, CallMethod(t, server, alice, ChatRpcMethod, ChatRequestParams{Msg: []byte("reply"), ParentId: message.Id}))
+		AssertNumberOfConnections(t, CountNotifications(bobConn, ThreadUpdatedRpcMethod), 1)
+		AssertNumberOfConnections(t, CountNotifications(carolConn, ThreadUpdatedRpcMethod), 0)
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"strings"
+)
+
+const adminUsage = `Usage: chat-admin [flags] <command> [args]
+
+Commands:
+  connections          list connections with their user and traffic
+  disconnect <id>      forcibly disconnect a connection
+  announce <message>   send an announcement to every connection
+  reload               reload the server config file
+  rooms                dump the state of every room
+  client-info <id>     ask a connection's client to describe itself
+
+Flags:
+`
+
+// Build the admin request for a command line
+func adminRequest(args []string) (string, any, error) {
+	if len(args) == 0 {
+		return "", nil, fmt.Errorf("missing command")
+	}
+
+	switch command := args[0]; {
+	case command == "connections" && len(args) == 1:
+		return AdminListConnectionsRpcMethod, nil, nil
+	case command == "disconnect" && len(args) == 2:
+		return AdminDisconnectRpcMethod, DisconnectParams{ConnectionId: args[1]}, nil
+	case command == "announce" && len(args) >= 2:
+		return AdminAnnounceRpcMethod, AnnounceParams{Msg: strings.Join(args[1:], " ")}, nil
+	case command == "reload" && len(args) == 1:
+		return AdminReloadConfigRpcMethod, nil, nil
+	case command == "rooms" && len(args) == 1:
+		return AdminDumpRoomsRpcMethod, nil, nil
+	case command == "client-info" && len(args) == 2:
+		return AdminClientInfoRpcMethod, ClientInfoParams{ConnectionId: args[1]}, nil
+	}
+	return "", nil, fmt.Errorf("unknown command [%s]", strings.Join(args, " "))
+}
+
+// Print an error response and exit
+func exitWithError(response JsonRpcResponse) {
+	fmt.Fprintf(os.Stderr, "error %d: %s\n", response.Error.Code, response.Error.Message)
+	os.Exit(1)
+}
+
+func main() {
+	address := flag.String("addr", "localhost:8080", "chat server address")
+	user := flag.String("user", os.Getenv("CHAT_ADMIN_USER"), "admin user to sign in as (defaults to $CHAT_ADMIN_USER)")
+	password := flag.String("password", os.Getenv("CHAT_ADMIN_PASSWORD"), "password of the admin user (defaults to $CHAT_ADMIN_PASSWORD)")
+	token := flag.String("token", os.Getenv("CHAT_ADMIN_TOKEN"), "admin token from the server config (defaults to $CHAT_ADMIN_TOKEN)")
+	verbose := flag.Bool("v", false, "log the JSON-RPC traffic")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), adminUsage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	method, params, err := adminRequest(flag.Args())
+	if err != nil || *user == "" || *token == "" {
+		if err == nil && *user == "" {
+			err = fmt.Errorf("missing admin user")
+		} else if err == nil {
+			err = fmt.Errorf("missing admin token")
+		}
+		fmt.Fprintln(os.Stderr, err)
+		flag.Usage()
+		os.Exit(2)
+	}
+	if !*verbose {
+		log.SetOutput(io.Discard)
+	}
+
+	conn, err := net.DialTimeout("tcp", *address, DialTimeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to connect:", err)
+		os.Exit(1)
+	}
+	defer conn.Close()
+
+	client := NewJsonRpcClient(conn, "")
+	go client.HandleServerMessages()
+
+	if response := client.Initialize(); response.Error != nil && response.Error.Code != -32601 {
+		exitWithError(response)
+	}
+	if response := client.SendCreateUserRequest(*user, *password); response.Error != nil {
+		exitWithError(response)
+	}
+	if response := client.Call(AdminAuthenticateRpcMethod, AdminAuthenticateParams{Token: *token}); response.Error != nil {
+		exitWithError(response)
+	}
+	response := client.Call(method, params)
+	if response.Error != nil {
+		exitWithError(response)
+	}
+	fmt.Println(formatJSON(response.Result))
+}
@@ -3,173 +3,228 @@ package main
 import (
 	"bufio"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net"
 	"os"
+	"regexp"
+	"strconv"
 	"strings"
-	"sync"
 	"time"
-
-	"github.com/google/uuid"
 )
 
-// JSON-RPC Client for sending and receiving messages - JSON-RPC is transport agnostic.
-type JsonRpcClient struct {
-	transport    io.ReadWriter
-	responseChan map[string]chan JsonRpcResponse
-	mu           sync.Mutex
-}
+const (
+	TerminalBell   = "\a"
+	HighlightStart = "\033[1;33m"
+	HighlightEnd   = "\033[0m"
+)
 
-// Build a JSON-RPC request
-func (c *JsonRpcClient) BuildRequest(params []byte, method string) JsonRpcRequest {
-	requestId := uuid.New().String()
-	request := JsonRpcRequest{Id: requestId, JsonRpc: "2.0", Method: method, Params: params}
+var clientMentionPattern = regexp.MustCompile(`@[A-Za-z0-9_.-]*[A-Za-z0-9_]`)
 
-	c.mu.Lock()
-	c.responseChan[requestId] = make(chan JsonRpcResponse, 1)
-	c.mu.Unlock()
-	return request
+// Highlight the @mentions in a chat message
+func HighlightMentions(text string) string {
+	return clientMentionPattern.ReplaceAllString(text, HighlightStart+"$0"+HighlightEnd)
 }
 
-// Send a JSON-RPC Request
-func (c *JsonRpcClient) Send(request JsonRpcRequest) error {
-	requestJson, err := json.Marshal(request)
-	if err != nil {
-		log.Println(err)
-		return err
+// Display a notification from the server
+func (c *JsonRpcClient) handleNotification(notification JsonRpcNotification) {
+	switch notification.Method {
+	case ChatNotificationRpcMethod:
+		var chat ChatMessageNotification
+		if err := json.Unmarshal(notification.Params, &chat); err != nil {
+			log.Println("Error deserializing chat notification", err)
+			return
+		}
+		c.rememberMessageId(chat.Id)
+		c.rememberLastSeen(chat.Room, chat.Id)
+		text := HighlightMentions(FormatChatMessage(chat.Author, string(chat.Msg)))
+		if chat.ParentId != "" {
+			log.Printf("[%s] #%s (reply to %s) %s\n", ShortId(chat.Id), chat.Room, ShortId(chat.ParentId), text)
+			return
+		}
+		log.Printf("[%s] #%s %s\n", ShortId(chat.Id), chat.Room, text)
+	case MentionedRpcMethod:
+		var mention Mention
+		if err := json.Unmarshal(notification.Params, &mention); err != nil {
+			log.Println("Error deserializing mention notification", err)
+			return
+		}
+		c.rememberMessageId(mention.MessageId)
+		fmt.Print(TerminalBell)
+		log.Printf("%s[%s] %s mentioned you in #%s%s: %s\n", HighlightStart, ShortId(mention.MessageId), mention.Author, mention.Room, HighlightEnd, HighlightMentions(string(mention.Msg)))
+	case ThreadUpdatedRpcMethod:
+		var thread Thread
+		if err := json.Unmarshal(notification.Params, &thread); err != nil {
+			log.Println("Error deserializing thread notification", err)
+			return
+		}
+		log.Printf("[%s] %d replies, last at %s\n", ShortId(thread.RootId), thread.ReplyCount, thread.LastReplyAt.Local().Format(time.Kitchen))
+	case ReadReceiptRpcMethod:
+		var receipt ReadReceipt
+		if err := json.Unmarshal(notification.Params, &receipt); err != nil {
+			log.Println("Error deserializing read receipt", err)
+			return
+		}
+		log.Printf("#%s %s read up to [%s]\n", receipt.Room, receipt.User, ShortId(receipt.MessageId))
+	case ModeratedRpcMethod:
+		var action ModerationAction
+		if err := json.Unmarshal(notification.Params, &action); err != nil {
+			log.Println("Error deserializing moderation notification", err)
+			return
+		}
+		log.Printf("#%s %s: %s %s %s\n", action.Room, action.Action, action.Actor, action.Role, action.Reason)
+	case DirectMessageNotificationRpcMethod:
+		var message DirectMessage
+		if err := json.Unmarshal(notification.Params, &message); err != nil {
+			log.Println("Error deserializing direct message", err)
+			return
+		}
+		fmt.Print(TerminalBell)
+		log.Printf("%s[private]%s %s\n", HighlightStart, HighlightEnd, FormatChatMessage(message.From, string(message.Msg)))
+	case TopicChangedRpcMethod:
+		var change TopicChange
+		if err := json.Unmarshal(notification.Params, &change); err != nil {
+			log.Println("Error deserializing topic change", err)
+			return
+		}
+		log.Printf("#%s %s set the topic: %s\n", change.Room, change.By, change.Topic)
+	case AnnouncementRpcMethod:
+		var announcement Announcement
+		if err := json.Unmarshal(notification.Params, &announcement); err != nil {
+			log.Println("Error deserializing announcement", err)
+			return
+		}
+		fmt.Print(TerminalBell)
+		log.Printf("%s[announcement from %s]%s %s\n", HighlightStart, announcement.From, HighlightEnd, announcement.Msg)
+	default:
+		log.Printf("Notification from server: %s \n", formatJSON(notification))
 	}
+}
 
-	log.Printf("Sending json-rpc request: %s \n", string(requestJson))
-	_, err = c.transport.Write(requestJson)
+// Read lines and run them one after another until exit or the end of the input -
+// for scripts and terminals the full-screen UI can't drive
+func (c *JsonRpcClient) RunLineMode(in io.Reader, commands *CommandRegistry) {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		msg := scanner.Text()
+		if strings.ToLower(msg) == "exit" {
+			log.Println("Exiting chat room")
+			return
+		}
 
-	if err != nil {
-		log.Printf("Failed to send json rpc request: %s \n", string(requestJson))
-		log.Println(err)
-		return err
+		command, response := commands.Run(c, msg)
+		if command != nil && command.Name == "quit" {
+			log.Println("Exiting chat room")
+			return
+		}
+		if response.Error != nil && response.Id == "" {
+			log.Println(response.Error.Message)
+		}
+		for _, line := range LocalResultLines(response) {
+			fmt.Println(line)
+		}
 	}
-
-	log.Println("Request successfully sent")
-	return nil
 }
 
-// Send a JSON-RPC Request and read the JSON-RPC Response from the server
-func (c *JsonRpcClient) SendAndRecv(request JsonRpcRequest) JsonRpcResponse {
-	err := c.Send(request)
-	if err != nil {
-		panic("Failed to send json-rpc request")
+// Sign in under the name and password given with -nick and -password
+func signIn(client *JsonRpcClient, nick string, password string) {
+	if nick == "" {
+		return
 	}
+	if response := client.SendCreateUserRequest(nick, password); response.Error != nil {
+		fmt.Fprintf(os.Stderr, "Failed to sign in as %s: %s\n", nick, response.Error.Message)
+		os.Exit(ExitError)
+	}
+}
 
-	c.mu.Lock()
-	responseChan := c.responseChan[request.Id]
-	c.mu.Unlock()
+// Check whether the file is an interactive terminal
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
 
-	timeout := time.After(5 * time.Second)
-	select {
-	case response := <-responseChan:
-		if response.Id == request.Id {
-			return response
-		}
-	case <-timeout:
-		panic("Timeout waiting for response")
+func main() {
+	address := flag.String("addr", "localhost:8080", "chat server address")
+	ui := flag.String("ui", "auto", "user interface: tui, line, raw to type JSON-RPC requests, or auto to use the tui on a terminal")
+	logPath := flag.String("log", "", "file to write the client log to (the tui and commands log nowhere by default)")
+	nick := flag.String("nick", "", "user name to sign in as")
+	password := flag.String("password", os.Getenv("CHAT_PASSWORD"), "password for -nick, set when the user is first created (defaults to $CHAT_PASSWORD)")
+	timeout := flag.Duration("timeout", ResponseTimeout, "how long to wait for each response from the server")
+	transcriptDir := flag.String("transcript", "", "directory to keep a daily transcript of the chat messages sent and received in")
+	transcriptFormat := flag.String("transcript-format", TranscriptText, "transcript format: txt, jsonl or md")
+	flag.Usage = func() {
+		fmt.Fprint(flag.CommandLine.Output(), clientUsage)
+		flag.PrintDefaults()
 	}
-	return JsonRpcResponse{}
-}
+	flag.Parse()
 
-// Handle Messages from the server
-func (c *JsonRpcClient) HandleServerMessages() {
-	decoder := json.NewDecoder(c.transport)
-	for {
-		var message json.RawMessage
-		if err := decoder.Decode(&message); err != nil {
-			if err == io.EOF {
-				log.Println("Connection closed by server")
-				return
-			}
-			log.Println("Error decoding message:", err)
-			continue
-		}
-
-		// Determine if it's a notification or response
-		var messageMap map[string]interface{}
-		if err := json.Unmarshal(message, &messageMap); err != nil {
-			log.Println("Error unmarshalling message:", err)
-			continue
-		}
-
-		if _, ok := messageMap["method"]; ok {
-			// Handle notification
-			var notification JsonRpcNotification
-			if err := json.Unmarshal(message, &notification); err != nil {
-				log.Println("Error deserializing notification", err)
-				continue
-			}
-			log.Printf("Notification from server: %s \n", formatJSON(notification))
-		} else {
-			// Handle response
-			var response JsonRpcResponse
-			if err := json.Unmarshal(message, &response); err != nil {
-				log.Println("Error deserializing response", err)
-				continue
-			}
-			log.Printf("Response from server: %s \n", formatJSON(response.Result))
-
-			c.mu.Lock()
-			if ch, ok := c.responseChan[response.Id]; ok {
-				ch <- response
-				close(ch)
-				delete(c.responseChan, response.Id)
-			}
-			c.mu.Unlock()
+	useTUI := *ui == "tui" || (*ui == "auto" && isTerminal(os.Stdin) && isTerminal(os.Stdout))
+	if *logPath != "" {
+		logFile, err := os.OpenFile(*logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err != nil {
+			log.Fatalln("Failed to open log file", err)
 		}
+		defer logFile.Close()
+		log.SetOutput(logFile)
+	} else if useTUI || *ui == "raw" || flag.NArg() > 0 {
+		log.SetOutput(io.Discard)
+	}
+	if flag.NArg() > 0 {
+		os.Exit(RunScript(*address, *nick, *password, *timeout, flag.Args()))
 	}
-}
 
-// Send a request to chat
-func (c *JsonRpcClient) SendChatRequest(msg []byte) JsonRpcResponse {
-	params, _ := json.Marshal(ChatRequestParams{Msg: msg})
-	request := c.BuildRequest(params, "chat")
-	response := c.SendAndRecv(request)
-	return response
-}
+	var transcript *TranscriptLogger
+	if *transcriptDir != "" {
+		var err error
+		if transcript, err = NewTranscriptLogger(*transcriptDir, *transcriptFormat); err != nil {
+			fmt.Fprintln(os.Stderr, "Failed to start the transcript:", err)
+			os.Exit(ExitUsage)
+		}
+		defer transcript.Close()
+	}
 
-// Connect to the chat server using a TCP socket
-func TCPConnect(host string, port int) net.Conn {
-	address := fmt.Sprintf("%s:%d", host, port)
-	log.Printf("Connecting to server [%s]\n", address)
-	conn, err := net.Dial("tcp", address)
+	host, portName, err := net.SplitHostPort(*address)
 	if err != nil {
-		log.Fatalln("Failed to connect to TCP server!", err)
+		log.Fatalln("Invalid server address", err)
 	}
-	log.Println("Connected")
-	return conn
-}
+	port, _ := strconv.Atoi(portName)
+	tcpConnection := TCPConnect(host, port)
+	client := NewJsonRpcClient(tcpConnection, *address)
+	client.SetResponseTimeout(*timeout)
+	if transcript != nil {
+		transcript.Follow(client)
+	}
+	defer func() {
+		if closer, ok := client.Transport().(io.Closer); ok {
+			closer.Close()
+		}
+	}()
 
-func formatJSON(v interface{}) string {
-	formatted, err := json.MarshalIndent(v, "", "  ")
-	if err != nil {
-		return fmt.Sprintf("Error formatting JSON: %v", err)
+	if *ui == "raw" {
+		repl := NewRawRepl(client, os.Stdout, os.Stderr)
+		go client.HandleServerMessages()
+		repl.Run(os.Stdin)
+		return
 	}
-	return string(formatted)
-}
 
-func main() {
-	tcpConnection := TCPConnect("localhost", 8080)
-	defer tcpConnection.Close()
-	client := &JsonRpcClient{transport: tcpConnection, responseChan: make(map[string]chan JsonRpcResponse)}
+	commands := DefaultCommands()
+	if !useTUI {
+		client.SetNotificationHandler(client.handleNotification)
+		go client.HandleServerMessages()
+		client.Initialize()
+		signIn(client, *nick, *password)
+		client.RunLineMode(os.Stdin, commands)
+		return
+	}
 
+	terminal := NewTerminalUI(client, commands, os.Stdin, os.Stdout)
 	go client.HandleServerMessages()
-	scanner := bufio.NewScanner(os.Stdin)
-
-	for {
-		scanner.Scan()
-		msg := scanner.Text()
-
-		if strings.ToLower(msg) == "exit" {
-			log.Println("Exiting chat room")
-			break
-		}
-		go client.SendChatRequest([]byte(msg))
+	client.Initialize()
+	signIn(client, *nick, *password)
+	if err := terminal.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to start the terminal UI, use -ui line:", err)
+		os.Exit(1)
 	}
 }
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+)
+
+// Join the server to a cluster through a broker, replaying room changes on the other nodes
+func (s *Server) JoinCluster(node string, broker Broker) {
+	s.node = node
+	s.presence = NewClusterPresence()
+	s.broker = broker
+	s.roomService.SetNode(node)
+	broker.Subscribe(s.HandleClusterEvent)
+	s.roomService.OnChange(func(change RoomChange) {
+		s.publish(ClusterEvent{Kind: EventRoom, Room: &change})
+	})
+	s.userService.OnChange(func(user *User) {
+		s.publish(ClusterEvent{Kind: EventUser, User: user})
+	})
+	s.webhookService.OnChange(func(change WebhookChange) {
+		s.publish(ClusterEvent{Kind: EventWebhook, Webhook: &change})
+	})
+}
+
+// Publish an event to the other nodes, delivering notifications to the local connections straight away
+func (s *Server) publish(event ClusterEvent) {
+	event.Node = s.node
+	if event.Kind == EventNotification {
+		s.deliver(*event.Notification)
+	}
+	if s.broker != nil {
+		s.broker.Publish(event)
+	}
+}
+
+// Apply an event from another node - the server's own events were handled when they were published
+func (s *Server) HandleClusterEvent(event ClusterEvent) {
+	if event.Node == s.node {
+		return
+	}
+	if !event.HasPayload() {
+		slog.Warn("Dropping cluster event without its payload", "kind", event.Kind, "node", event.Node)
+		return
+	}
+	switch event.Kind {
+	case EventNotification:
+		s.deliver(*event.Notification)
+	case EventRoom:
+		s.roomService.ApplyChange(*event.Room)
+		if event.Room.Op == RoomOpDelete {
+			s.webhookService.RemoveRoom(event.Room.Room)
+		}
+	case EventPresence:
+		s.applyPresence(event.Node, *event.Presence)
+	case EventMessage:
+		s.messageService.AddRemoteMessage(event.Message)
+	case EventUser:
+		s.applyUser(event.User)
+	case EventWebhook:
+		s.webhookService.ApplyChange(*event.Webhook)
+	case EventSync:
+		s.dropNode(event.Node)
+		s.roomService.ApplyStates(event.Snapshot.Rooms)
+		for _, user := range event.Snapshot.Users {
+			s.applyUser(user)
+		}
+		for _, webhook := range event.Snapshot.Webhooks {
+			s.webhookService.ApplyChange(WebhookChange{Webhook: webhook})
+		}
+		for _, change := range event.Snapshot.Presence {
+			s.applyPresence(event.Node, change)
+		}
+	case EventNodeDown:
+		s.dropNode(event.Node)
+	}
+}
+
+// Register a user of another node - local connections signed in as a user it displaced are signed out and closed
+func (s *Server) applyUser(user *User) {
+	if !s.userService.AddRemoteUser(user) {
+		return
+	}
+	slog.Warn("User registered on another node first, closing its connections here", "user", user.Name)
+	for _, connectionId := range s.userService.ConnectionsForUser(user.Name) {
+		if c, ok := s.connectionService.GetConnection(connectionId); ok {
+			s.userService.SignOut(c.id)
+			go s.CloseConnection(c)
+		}
+	}
+}
+
+// Track a connection of another node
+func (s *Server) applyPresence(node string, change PresenceChange) {
+	if s.presence == nil {
+		return
+	}
+	if !change.Online {
+		s.presence.Remove(change.ConnectionId)
+		s.userService.SignOut(change.ConnectionId)
+		return
+	}
+	s.presence.Add(change.ConnectionId, node)
+	if change.User != nil {
+		s.userService.AddRemoteSession(change.ConnectionId, change.User.Name)
+	}
+}
+
+// Forget the connections of a node that went down - its anonymous connections leave their rooms
+func (s *Server) dropNode(node string) {
+	if s.presence == nil {
+		return
+	}
+	for _, connectionId := range s.presence.DropNode(node) {
+		s.userService.SignOut(connectionId)
+		s.roomService.ApplyChange(RoomChange{Op: RoomOpRemove, Member: connectionId})
+	}
+}
+
+// State of the node for a peer that connects - its rooms, every user and webhook it knows and its connections
+func (s *Server) ClusterSnapshot() ClusterEvent {
+	snapshot := &ClusterSnapshot{Rooms: s.roomService.DumpRooms(), Users: s.userService.ListUsers(), Webhooks: s.webhookService.Subscriptions(s.roomService.ListRooms()), Presence: make([]PresenceChange, 0)}
+	for _, c := range s.connectionService.ListConnections() {
+		snapshot.Presence = append(snapshot.Presence, s.connectionPresence(c, true))
+	}
+	return ClusterEvent{Kind: EventSync, Node: s.node, Snapshot: snapshot}
+}
+
+// Presence of a local connection, with the profile of the user it's signed in as
+func (s *Server) connectionPresence(connection *Connection, online bool) PresenceChange {
+	change := PresenceChange{ConnectionId: connection.id, Online: online}
+	if name, ok := s.userService.UserForConnection(connection.id); ok && online {
+		if user, ok := s.userService.GetUser(name); ok {
+			change.User = user.Profile()
+		}
+	}
+	return change
+}
+
+// Tell the other nodes about a local connection
+func (s *Server) publishPresence(connection *Connection, online bool) {
+	change := s.connectionPresence(connection, online)
+	s.publish(ClusterEvent{Kind: EventPresence, Presence: &change})
+}
+
+// Send a notification to the connections of an audience across the cluster, except the excluded one
+func (s *Server) publishNotification(audience string, to string, feature string, method string, params any, exclude *Connection) {
+	paramsJson, err := json.Marshal(params)
+	if err != nil {
+		slog.Error("Failed serializing notification params", "method", method, "error", err)
+		return
+	}
+	notification := &ClusterNotification{Audience: audience, To: to, Feature: feature, Method: method, Params: paramsJson}
+	if exclude != nil {
+		notification.Exclude = exclude.id
+	}
+	s.publish(ClusterEvent{Kind: EventNotification, Notification: notification})
+}
+
+// Send a notification to the local connections of its audience
+func (s *Server) deliver(notification ClusterNotification) {
+	var connections []*Connection
+	switch notification.Audience {
+	case AudienceAll:
+		connections = s.connectionService.ListConnections()
+	case AudienceRoom:
+		connections = s.RoomConnections(notification.To)
+	case AudienceIdentity:
+		connections = s.IdentityConnections(notification.To)
+	}
+	if notification.Feature != "" {
+		connections = ConnectionsWithFeature(connections, notification.Feature)
+	}
+
+	receivers := make([]*Connection, 0, len(connections))
+	for _, c := range connections {
+		if c.id != notification.Exclude {
+			receivers = append(receivers, c)
+		}
+	}
+	s.Notify(receivers, notification.Method, notification.Params, nil)
+}
+
+// Check whether an identity is connected to any node - a signed in user name or an anonymous connection id
+func (s *Server) Online(identity string) bool {
+	if len(s.userService.ConnectionsForUser(identity)) > 0 {
+		return true
+	}
+	if c, ok := s.connectionService.GetConnection(identity); ok && s.userService.Identity(c) == identity {
+		return true
+	}
+	return s.presence != nil && s.presence.Has(identity)
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+)
+
+// Servers sharing a local broker as the nodes of one cluster
+func ClusterFixture(t testing.TB, nodes int) ([]*Server, *LocalBroker) {
+	t.Helper()
+	broker := NewLocalBroker()
+	t.Cleanup(func() { broker.Close() })
+	servers := make([]*Server, nodes)
+	for i := range servers {
+		servers[i] = ServerFixture()
+		servers[i].JoinCluster(fmt.Sprintf("node-%d", i), broker)
+	}
+	return servers, broker
+}
+
+func TestCluster(t *testing.T) {
+	t.Run("chat reaches room members on other nodes", func(t *testing.T) {
+		servers, broker := ClusterFixture(t, 2)
+		alice, aliceConn := AddFakeConnection(t, servers[0], "alice")
+		bob, bobConn := AddFakeConnection(t, servers[1], "bob")
+		broker.Flush()
+
+		AssertSuccess(t, CallMethod(t, servers[0], alice, ChatRpcMethod, ChatRequestParams{Msg: []byte("hello")}))
+		broker.Flush()
+		AssertNumberOfConnections(t, CountNotifications(bobConn, ChatNotificationRpcMethod), 1)
+		AssertNumberOfConnections(t, CountNotifications(aliceConn, ChatNotificationRpcMethod), 0)
+
+		response := CallMethod(t, servers[1], bob, GetHistoryRpcMethod, GetHistoryParams{Room: DefaultRoom})
+		var result GetHistoryResult
+		json.Unmarshal(response.Result, &result)
+		if len(result.Messages) != 1 || string(result.Messages[0].Msg) != "hello" {
+			t.Errorf("got history %+v on the other node", result)
+		}
+	})
+
+	t.Run("rooms are shared by every node", func(t *testing.T) {
+		servers, broker := ClusterFixture(t, 3)
+		alice, _ := AddFakeConnection(t, servers[0], "alice")
+		bob, _ := AddFakeConnection(t, servers[1], "bob")
+		_, carolConn := AddFakeConnection(t, servers[2], "carol")
+		broker.Flush()
+
+		AssertSuccess(t, CallMethod(t, servers[0], alice, CreateChatRoomRpcMethod, RoomParams{Room: "dev"}))
+		broker.Flush()
+		AssertSuccess(t, CallMethod(t, servers[1], bob, JoinChatRoomRpcMethod, RoomParams{Room: "dev"}))
+		broker.Flush()
+		AssertSuccess(t, CallMethod(t, servers[0], alice, ChatRpcMethod, ChatRequestParams{Room: "dev", Msg: []byte("hi")}))
+		broker.Flush()
+
+		for i, server := range servers {
+			if !server.roomService.IsMember("dev", "bob") {
+				t.Errorf("bob isn't a member of dev on node %d", i)
+			}
+		}
+		AssertNumberOfConnections(t, CountNotifications(carolConn, ChatNotificationRpcMethod), 0)
+	})
+
+	t.Run("direct messages reach users on other nodes", func(t *testing.T) {
+		servers, broker := ClusterFixture(t, 2)
+		alice, _ := AddFakeConnection(t, servers[0], "alice")
+		_, bobConn := AddFakeConnection(t, servers[1], "bob")
+		broker.Flush()
+
+		AssertSuccess(t, CallMethod(t, servers[0], alice, DirectMessageRpcMethod, DirectMessageParams{To: "bob", Msg: []byte("psst")}))
+		broker.Flush()
+		AssertNumberOfConnections(t, CountNotifications(bobConn, DirectMessageNotificationRpcMethod), 1)
+	})
+
+	t.Run("passwords are checked across the cluster", func(t *testing.T) {
+		servers, broker := ClusterFixture(t, 2)
+		AddFakeConnection(t, servers[0], "alice")
+		broker.Flush()
+
+		impostor, _ := AddFakeConnection(t, servers[1], "")
+		AssertErrorCode(t, CallMethod(t, servers[1], impostor, CreateUserRpcMethod, CreateUserParams{Name: "alice", Password: "not-her-password"}), BadCredentialsErrorCode)
+		AssertSuccess(t, CallMethod(t, servers[1], impostor, CreateUserRpcMethod, CreateUserParams{Name: "alice", Password: PasswordFor("alice")}))
+	})
+
+	t.Run("presence doesn't carry credentials", func(t *testing.T) {
+		servers, broker := ClusterFixture(t, 1)
+		var presence []PresenceChange
+		broker.Subscribe(func(event ClusterEvent) {
+			if event.Kind == EventPresence {
+				presence = append(presence, *event.Presence)
+			}
+		})
+		AddFakeConnection(t, servers[0], "alice")
+		broker.Flush()
+		snapshot := servers[0].ClusterSnapshot().Snapshot.Presence
+
+		for _, change := range append(presence, snapshot...) {
+			if change.User != nil && change.User.Credential != nil {
+				t.Errorf("got the credential of [%s] in its presence", change.User.Name)
+			}
+		}
+		if len(presence) == 0 || presence[len(presence)-1].User == nil {
+			t.Errorf("got presence %+v", presence)
+		}
+	})
+
+	t.Run("connections leave with their node", func(t *testing.T) {
+		servers, broker := ClusterFixture(t, 2)
+		anonymous, _ := AddFakeConnection(t, servers[1], "")
+		AddFakeConnection(t, servers[1], "bob")
+		broker.Flush()
+		if !servers[0].Online(anonymous.id) || !servers[0].Online("bob") {
+			t.Fatal("connections of the other node aren't online")
+		}
+
+		servers[0].HandleClusterEvent(ClusterEvent{Kind: EventNodeDown, Node: servers[1].node})
+		if servers[0].Online(anonymous.id) || servers[0].Online("bob") {
+			t.Error("connections of the node that went down are still online")
+		}
+		if servers[0].roomService.IsMember(DefaultRoom, anonymous.id) || !servers[0].roomService.IsMember(DefaultRoom, "bob") {
+			t.Error("got the wrong members after the node went down")
+		}
+	})
+
+	t.Run("events without their payload are dropped", func(t *testing.T) {
+		servers, _ := ClusterFixture(t, 1)
+		for _, kind := range []string{EventNotification, EventRoom, EventPresence, EventMessage, EventSync, EventUser, EventWebhook} {
+			servers[0].HandleClusterEvent(ClusterEvent{Kind: kind, Node: "other"})
+		}
+	})
+
+	t.Run("a node catches up from a snapshot", func(t *testing.T) {
+		servers, _ := ClusterFixture(t, 1)
+		AddFakeConnection(t, servers[0], "alice")
+		servers[0].roomService.CreateRoom("dev", "alice")
+		servers[0].roomService.SetTopic("dev", "builds")
+
+		late, _ := ClusterFixture(t, 1)
+		late[0].node = "late"
+		late[0].HandleClusterEvent(servers[0].ClusterSnapshot())
+		if !late[0].roomService.IsMember("dev", "alice") || !late[0].Online("alice") {
+			t.Error("the snapshot wasn't applied")
+		}
+	})
+
+	t.Run("users registered before a node joins can't be taken over on it", func(t *testing.T) {
+		servers, broker := ClusterFixture(t, 1)
+		alice, _ := AddFakeConnection(t, servers[0], "alice")
+		servers[0].CloseConnection(alice)
+		broker.Flush()
+
+		late, _ := ClusterFixture(t, 1)
+		late[0].node = "late"
+		late[0].HandleClusterEvent(servers[0].ClusterSnapshot())
+		impostor, _ := AddFakeConnection(t, late[0], "")
+		AssertErrorCode(t, CallMethod(t, late[0], impostor, CreateUserRpcMethod, CreateUserParams{Name: "alice", Password: "not-her-password"}), BadCredentialsErrorCode)
+	})
+
+	t.Run("new users reach every node", func(t *testing.T) {
+		servers, broker := ClusterFixture(t, 2)
+		bob, _ := AddFakeConnection(t, servers[0], "bob")
+		servers[0].CloseConnection(bob)
+		broker.Flush()
+
+		if user, ok := servers[1].userService.GetUser("bob"); !ok || user.Credential == nil {
+			t.Errorf("got user %+v on the other node", user)
+		}
+	})
+
+	t.Run("the user registered first keeps a name registered on two nodes", func(t *testing.T) {
+		first, _ := ClusterFixture(t, 1)
+		AddFakeConnection(t, first[0], "alice")
+		second, _ := ClusterFixture(t, 1)
+		second[0].node = "second"
+		impostor, _ := AddFakeConnection(t, second[0], "alice")
+
+		second[0].HandleClusterEvent(first[0].ClusterSnapshot())
+		first[0].HandleClusterEvent(second[0].ClusterSnapshot())
+		want, _ := first[0].userService.GetUser("alice")
+		if got, _ := second[0].userService.GetUser("alice"); got.Credential.Hash != want.Credential.Hash {
+			t.Error("the nodes didn't settle on the first alice")
+		}
+		if _, signedIn := second[0].userService.UserForConnection(impostor.id); signedIn {
+			t.Error("the later alice is still signed in")
+		}
+	})
+}
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Prefix of the lines the client runs as commands instead of sending them as chat messages
+const CommandPrefix = "/"
+
+// What the first argument of a command completes to
+const (
+	CompleteNothing = ""
+	CompleteRooms   = "rooms"
+	CompleteUsers   = "users"
+)
+
+// A slash command - Run gets the client and everything typed after the command name
+type Command struct {
+	Name        string
+	Args        string
+	Description string
+	MinArgs     int
+	Feature     string
+	Completes   string
+	Run         func(c *JsonRpcClient, args string) JsonRpcResponse
+}
+
+// Usage of a command, e.g. "/join <room>"
+func (c *Command) Usage() string {
+	return strings.TrimSpace(CommandPrefix + c.Name + " " + c.Args)
+}
+
+// Registry of the slash commands the client understands - new commands are registered here and
+// the line mode and terminal UI pick them up without changes
+type CommandRegistry struct {
+	commands map[string]*Command
+}
+
+// Create an empty command registry
+func NewCommandRegistry() *CommandRegistry {
+	return &CommandRegistry{commands: make(map[string]*Command)}
+}
+
+// Register a command, replacing any command with the same name
+func (r *CommandRegistry) Register(command Command) {
+	r.commands[command.Name] = &command
+}
+
+// Get a command by name
+func (r *CommandRegistry) Lookup(name string) (*Command, bool) {
+	command, ok := r.commands[strings.ToLower(name)]
+	return command, ok
+}
+
+// List the commands sorted by name
+func (r *CommandRegistry) Commands() []*Command {
+	commands := make([]*Command, 0, len(r.commands))
+	for _, command := range r.commands {
+		commands = append(commands, command)
+	}
+	slices.SortFunc(commands, func(a, b *Command) int { return strings.Compare(a.Name, b.Name) })
+	return commands
+}
+
+// Split a line into a command and its arguments. Lines that aren't commands are chat messages, and
+// a doubled prefix sends a chat message starting with the prefix, e.g. "//shrug".
+func ParseCommandLine(line string) (name string, args string, isCommand bool) {
+	if !strings.HasPrefix(line, CommandPrefix) || strings.HasPrefix(line, CommandPrefix+CommandPrefix) {
+		return "", strings.TrimPrefix(line, CommandPrefix), false
+	}
+	name, args, _ = strings.Cut(strings.TrimPrefix(line, CommandPrefix), " ")
+	return strings.ToLower(name), strings.TrimSpace(args), true
+}
+
+// Run a line typed by the user, returning the command that ran, or nil for a chat message
+func (r *CommandRegistry) Run(c *JsonRpcClient, line string) (*Command, JsonRpcResponse) {
+	name, args, isCommand := ParseCommandLine(line)
+	if !isCommand {
+		return nil, c.SendChatRequest([]byte(args))
+	}
+
+	command, ok := r.Lookup(name)
+	switch {
+	case !ok:
+		return nil, localErrorResponse(fmt.Sprintf("Unknown command %s%s, try /help", CommandPrefix, name))
+	case len(strings.Fields(args)) < command.MinArgs:
+		return command, localErrorResponse("Usage: " + command.Usage())
+	case command.Feature != "" && !c.HasFeature(command.Feature):
+		return command, localErrorResponse(fmt.Sprintf("The server doesn't support %s", command.Feature))
+	}
+	return command, command.Run(c, args)
+}
+
+// Complete the last word of a partly typed line - command names after the prefix, the rooms or users
+// a command's first argument takes, and users after an @ anywhere. The candidates replace the last word.
+func (r *CommandRegistry) Complete(line string, rooms []string, users []string) []string {
+	fields := strings.Fields(line)
+	word := ""
+	if len(fields) > 0 && !strings.HasSuffix(line, " ") {
+		word = fields[len(fields)-1]
+		fields = fields[:len(fields)-1]
+	}
+
+	candidates := make([]string, 0)
+	switch {
+	case len(fields) == 0 && strings.HasPrefix(word, CommandPrefix):
+		for _, command := range r.Commands() {
+			candidates = append(candidates, CommandPrefix+command.Name)
+		}
+	case strings.HasPrefix(word, "@"):
+		for _, user := range users {
+			candidates = append(candidates, "@"+user)
+		}
+	case len(fields) == 1 && strings.HasPrefix(fields[0], CommandPrefix):
+		command, ok := r.Lookup(strings.TrimPrefix(fields[0], CommandPrefix))
+		if ok && command.Completes == CompleteRooms {
+			candidates = append(candidates, rooms...)
+		}
+		if ok && command.Completes == CompleteUsers {
+			candidates = append(candidates, users...)
+		}
+	}
+
+	matches := make([]string, 0)
+	for _, candidate := range candidates {
+		if strings.HasPrefix(strings.ToLower(candidate), strings.ToLower(word)) && !slices.Contains(matches, candidate) {
+			matches = append(matches, candidate)
+		}
+	}
+	slices.Sort(matches)
+	return matches
+}
+
+// Longest prefix the words share
+func CommonPrefix(words []string) string {
+	if len(words) == 0 {
+		return ""
+	}
+	prefix := []rune(words[0])
+	for _, word := range words[1:] {
+		runes := []rune(word)
+		n := 0
+		for n < len(prefix) && n < len(runes) && prefix[n] == runes[n] {
+			n++
+		}
+		prefix = prefix[:n]
+	}
+	return string(prefix)
+}
+
+// Response for a command that failed before reaching the server
+func localErrorResponse(message string) JsonRpcResponse {
+	return JsonRpcResponse{JsonRpc: JsonRpcVersion, Error: &JsonRpcError{Code: -32602, Message: message}}
+}
+
+// Response for a command answered by the client itself, with lines of text to show
+func localResultResponse(lines ...string) JsonRpcResponse {
+	result, _ := json.Marshal(lines)
+	return JsonRpcResponse{JsonRpc: JsonRpcVersion, Result: result}
+}
+
+// Lines of text of a command answered by the client itself
+func LocalResultLines(response JsonRpcResponse) []string {
+	var lines []string
+	if response.Id != "" || json.Unmarshal(response.Result, &lines) != nil {
+		return nil
+	}
+	return lines
+}
+
+// Show a chat message, turning messages sent with /me into actions, e.g. "* alice waves"
+func FormatChatMessage(author string, msg string) string {
+	if action, ok := strings.CutPrefix(msg, ActionPrefix); ok {
+		return "* " + author + " " + action
+	}
+	return author + ": " + msg
+}
+
+// Resolve a short message id the client has seen
+func resolveMessageArg(c *JsonRpcClient, shortId string) (string, *JsonRpcResponse) {
+	id, ok := c.ResolveMessageId(shortId)
+	if !ok {
+		response := localErrorResponse(fmt.Sprintf("Unknown message id [%s]", shortId))
+		return "", &response
+	}
+	return id, nil
+}
+
+// The commands the chat client understands
+func DefaultCommands() *CommandRegistry {
+	r := NewCommandRegistry()
+	r.Register(Command{Name: "help", Args: "[command]", Description: "List the commands, or describe one", Run: func(c *JsonRpcClient, args string) JsonRpcResponse {
+		if command, ok := r.Lookup(strings.TrimPrefix(args, CommandPrefix)); ok {
+			return localResultResponse(command.Usage() + " - " + command.Description)
+		}
+		lines := make([]string, 0)
+		for _, command := range r.Commands() {
+			lines = append(lines, fmt.Sprintf("%-24s %s", command.Usage(), command.Description))
+		}
+		return localResultResponse(lines...)
+	}})
+	r.Register(Command{Name: "join", Args: "<room>", Description: "Join a room and make it the current room", MinArgs: 1, Completes: CompleteRooms, Run: func(c *JsonRpcClient, args string) JsonRpcResponse {
+		return c.JoinRoom(args)
+	}})
+	r.Register(Command{Name: "leave", Args: "[room]", Description: "Leave a room, the current room by default", Completes: CompleteRooms, Run: func(c *JsonRpcClient, args string) JsonRpcResponse {
+		if args == "" {
+			args = c.CurrentRoom()
+		}
+		return c.SendRoomRequest(LeaveChatRoomRpcMethod, args)
+	}})
+	r.Register(Command{Name: "create", Args: "<room>", Description: "Create a room", MinArgs: 1, Run: func(c *JsonRpcClient, args string) JsonRpcResponse {
+		return c.SendRoomRequest(CreateChatRoomRpcMethod, args)
+	}})
+	r.Register(Command{Name: "nick", Args: "<name> <password>", Description: "Sign in under a user name, claiming it with the password when it's new", MinArgs: 2, Run: func(c *JsonRpcClient, args string) JsonRpcResponse {
+		name, password, _ := strings.Cut(args, " ")
+		return c.SendCreateUserRequest(name, strings.TrimSpace(password))
+	}})
+	r.Register(Command{Name: "msg", Args: "<user> <message>", Description: "Send a private message to a user", MinArgs: 2, Completes: CompleteUsers, Run: func(c *JsonRpcClient, args string) JsonRpcResponse {
+		to, msg, _ := strings.Cut(args, " ")
+		return c.SendDirectMessageRequest(to, []byte(strings.TrimSpace(msg)))
+	}})
+	r.Register(Command{Name: "me", Args: "<action>", Description: "Send an action to the current room, e.g. /me waves", MinArgs: 1, Run: func(c *JsonRpcClient, args string) JsonRpcResponse {
+		return c.SendChatRequest([]byte(ActionPrefix + args))
+	}})
+	r.Register(Command{Name: "who", Args: "[room]", Description: "List the members of a room, the current room by default", Completes: CompleteRooms, Run: func(c *JsonRpcClient, args string) JsonRpcResponse {
+		if args == "" {
+			args = c.CurrentRoom()
+		}
+		return c.SendListMembersRequest(args)
+	}})
+	r.Register(Command{Name: "rooms", Description: "List the rooms", Run: func(c *JsonRpcClient, args string) JsonRpcResponse {
+		return c.SendListRoomsRequest()
+	}})
+	r.Register(Command{Name: "history", Args: "[count]", Description: "Show the latest messages of the current room", Run: func(c *JsonRpcClient, args string) JsonRpcResponse {
+		limit := 0
+		if args != "" {
+			count, err := strconv.Atoi(args)
+			if err != nil || count <= 0 {
+				return localErrorResponse("Usage: /history [count]")
+			}
+			limit = count
+		}
+		return c.SendGetHistoryRequest(c.CurrentRoom(), "", limit)
+	}})
+	r.Register(Command{Name: "export", Args: "<file> [room]", Description: "Save the history of a room to a file - .txt, .jsonl or .md", MinArgs: 1, Run: func(c *JsonRpcClient, args string) JsonRpcResponse {
+		path, room, _ := strings.Cut(args, " ")
+		if room = strings.TrimSpace(room); room == "" {
+			room = c.CurrentRoom()
+		}
+		count, err := ExportHistoryFile(c, room, path)
+		if err != nil {
+			return localErrorResponse(fmt.Sprintf("Failed to export #%s: %s", room, err))
+		}
+		return localResultResponse(fmt.Sprintf("Exported %d messages of #%s to %s", count, room, path))
+	}})
+	r.Register(Command{Name: "topic", Args: "[topic]", Description: "Show the topic of the current room, or set it", Run: func(c *JsonRpcClient, args string) JsonRpcResponse {
+		if args != "" {
+			return c.SendSetTopicRequest(c.CurrentRoom(), args)
+		}
+		response := c.SendListRoomsRequest()
+		var result ListRoomsResult
+		if response.Error != nil || json.Unmarshal(response.Result, &result) != nil {
+			return response
+		}
+		for _, room := range result.Rooms {
+			if room.Name == c.CurrentRoom() && room.Topic != "" {
+				return localResultResponse(fmt.Sprintf("#%s topic: %s", room.Name, room.Topic))
+			}
+		}
+		return localResultResponse(fmt.Sprintf("#%s has no topic", c.CurrentRoom()))
+	}})
+	r.Register(Command{Name: "reply", Args: "<id> <message>", Description: "Reply to a message in its thread", MinArgs: 2, Feature: FeatureThreads, Run: func(c *JsonRpcClient, args string) JsonRpcResponse {
+		shortId, msg, _ := strings.Cut(args, " ")
+		parentId, failed := resolveMessageArg(c, shortId)
+		if failed != nil {
+			return *failed
+		}
+		return c.SendReplyRequest(parentId, []byte(strings.TrimSpace(msg)))
+	}})
+	r.Register(Command{Name: "thread", Args: "<id>", Description: "Show a thread", MinArgs: 1, Feature: FeatureThreads, Run: func(c *JsonRpcClient, args string) JsonRpcResponse {
+		rootId, failed := resolveMessageArg(c, args)
+		if failed != nil {
+			return *failed
+		}
+		return c.SendGetThreadRequest(rootId, "")
+	}})
+	r.Register(Command{Name: "search", Args: "<query>", Description: "Search the message history", MinArgs: 1, Run: func(c *JsonRpcClient, args string) JsonRpcResponse {
+		return c.SendSearchRequest(SearchMessagesParams{Query: args})
+	}})
+	r.Register(Command{Name: "mentions", Description: "Show your unread mentions", Run: func(c *JsonRpcClient, args string) JsonRpcResponse {
+		return c.SendGetMentionsRequest()
+	}})
+	r.Register(Command{Name: "read", Description: "Mark the current room as read", Run: func(c *JsonRpcClient, args string) JsonRpcResponse {
+		return c.SendMarkReadRequest()
+	}})
+	r.Register(Command{Name: "quit", Description: "Leave the chat", Run: func(c *JsonRpcClient, args string) JsonRpcResponse {
+		return localResultResponse()
+	}})
+	return r
+}
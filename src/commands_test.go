@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Client connected to a fake server that answers every request with what the handler returns - a
+// *JsonRpcError is sent as the error of the response
+func FakeServerClient(t testing.TB, handle func(request JsonRpcRequest) any) *JsonRpcClient {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() {
+		clientConn.Close()
+		serverConn.Close()
+	})
+
+	go func() {
+		decoder := json.NewDecoder(serverConn)
+		for {
+			var request JsonRpcRequest
+			if decoder.Decode(&request) != nil {
+				return
+			}
+			answer := JsonRpcResponse{JsonRpc: JsonRpcVersion, Id: request.Id}
+			result := handle(request)
+			if rpcError, ok := result.(*JsonRpcError); ok {
+				answer.Error = rpcError
+			} else {
+				answer.Result, _ = json.Marshal(result)
+			}
+			response, _ := json.Marshal(answer)
+			serverConn.Write(response)
+		}
+	}()
+
+	client := NewJsonRpcClient(clientConn, "")
+	go client.HandleServerMessages()
+	return client
+}
+
+func TestSendReplyRequest(t *testing.T) {
+	client := FakeServerClient(t, func(request JsonRpcRequest) any {
+		return ChatResult{Success: true, MessageId: "reply-1", Room: "dev"}
+	})
+
+	client.SendReplyRequest("root-1", []byte("on it"))
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	if client.lastSeen["dev"] != "reply-1" {
+		t.Errorf("got last seen %v but wanted the reply in the thread's room", client.lastSeen)
+	}
+	if _, ok := client.lastSeen[DefaultRoom]; ok {
+		t.Errorf("got the reply marked as seen in the current room %v", client.lastSeen)
+	}
+}
+
+func TestParseCommandLine(t *testing.T) {
+	lines := map[string][3]any{
+		"/join dev":     {"join", "dev", true},
+		"/MSG bob  hi ": {"msg", "bob  hi", true},
+		"/who":          {"who", "", true},
+		"hello":         {"", "hello", false},
+		"//shrug":       {"", "/shrug", false},
+	}
+
+	for line, want := range lines {
+		name, args, isCommand := ParseCommandLine(line)
+		if got := [3]any{name, args, isCommand}; got != want {
+			t.Errorf("got %v for [%s] but want %v", got, line, want)
+		}
+	}
+}
+
+func TestCommandRegistry(t *testing.T) {
+	t.Run("commands are sent to the server", func(t *testing.T) {
+		var methods []string
+		client := FakeServerClient(t, func(request JsonRpcRequest) any {
+			methods = append(methods, request.Method)
+			return SuccessResult{Success: true}
+		})
+
+		command, response := DefaultCommands().Run(client, "/join dev")
+		if response.Error != nil || command.Name != "join" || client.CurrentRoom() != "dev" {
+			t.Errorf("got command %s and current room [%s]", command.Name, client.CurrentRoom())
+		}
+		DefaultCommands().Run(client, "hello")
+		if !reflect.DeepEqual(methods, []string{JoinChatRoomRpcMethod, ChatRpcMethod}) {
+			t.Errorf("got methods %v", methods)
+		}
+	})
+
+	t.Run("mistyped commands never reach the server", func(t *testing.T) {
+		client := FakeServerClient(t, func(request JsonRpcRequest) any {
+			t.Errorf("got request %s", request.Method)
+			return nil
+		})
+
+		_, response := DefaultCommands().Run(client, "/frobnicate")
+		if response.Error == nil || !strings.Contains(response.Error.Message, "Unknown command") {
+			t.Errorf("got response %+v for an unknown command", response)
+		}
+		_, response = DefaultCommands().Run(client, "/msg bob")
+		if response.Error == nil || response.Error.Message != "Usage: /msg <user> <message>" {
+			t.Errorf("got response %+v for missing arguments", response)
+		}
+	})
+
+	t.Run("new commands can be registered", func(t *testing.T) {
+		commands := NewCommandRegistry()
+		commands.Register(Command{Name: "ping", Description: "Answer pong", Run: func(c *JsonRpcClient, args string) JsonRpcResponse {
+			return localResultResponse("pong " + args)
+		}})
+
+		_, response := commands.Run(nil, "/ping again")
+		if lines := LocalResultLines(response); !reflect.DeepEqual(lines, []string{"pong again"}) {
+			t.Errorf("got lines %v", lines)
+		}
+	})
+}
+
+func TestCompleteCommands(t *testing.T) {
+	commands := DefaultCommands()
+	rooms := []string{"general", "dev", "design"}
+	users := []string{"alice", "bob"}
+
+	completions := map[string][]string{
+		"/jo":          {"/join"},
+		"/join de":     {"design", "dev"},
+		"/msg b":       {"bob"},
+		"hi @a":        {"@alice"},
+		"/who ":        {"design", "dev", "general"},
+		"/nick al":     {},
+		"just talking": {},
+	}
+
+	for line, want := range completions {
+		if got := commands.Complete(line, rooms, users); !reflect.DeepEqual(got, want) {
+			t.Errorf("got completions %v for [%s] but want %v", got, line, want)
+		}
+	}
+	if prefix := CommonPrefix([]string{"design", "dev"}); prefix != "de" {
+		t.Errorf("got common prefix [%s]", prefix)
+	}
+}
+
+func TestFormatChatMessage(t *testing.T) {
+	if text := FormatChatMessage("alice", "/me waves"); text != "* alice waves" {
+		t.Errorf("got action [%s]", text)
+	}
+	if text := FormatChatMessage("alice", "hello"); text != "alice: hello" {
+		t.Errorf("got message [%s]", text)
+	}
+}
+
+func TestClientMessageLimit(t *testing.T) {
+	var methods []string
+	client := FakeServerClient(t, func(request JsonRpcRequest) any {
+		methods = append(methods, request.Method)
+		if request.Method == InitializeRpcMethod {
+			return InitializeResult{ProtocolVersion: ProtocolVersion, Features: ClientFeatures, Limits: ProtocolLimits{MaxMessageBytes: 512}}
+		}
+		return ChatResult{Success: true}
+	})
+	if response := client.Initialize(); response.Error != nil {
+		t.Fatalf("got error %v initializing", response.Error)
+	}
+
+	response := client.Call(ChatRpcMethod, ChatRequestParams{Msg: []byte(strings.Repeat("a", 512))})
+	if response.Error == nil || response.Error.Code != MessageTooLargeErrorCode {
+		t.Errorf("got response %+v to a message over the server's limit", response)
+	}
+	if response := client.Call(ChatRpcMethod, ChatRequestParams{Msg: []byte("hi")}); response.Error != nil {
+		t.Errorf("got error %v sending a short message", response.Error)
+	}
+	if strings.Join(methods, ",") != InitializeRpcMethod+","+ChatRpcMethod {
+		t.Errorf("got methods %v sent", methods)
+	}
+}
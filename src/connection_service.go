@@ -1,16 +1,36 @@
 package main
 
 import (
-	"log"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
 	"net"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/google/uuid"
 )
 
-// Connection wrapped with an ID
+var ErrNoConnection = errors.New("no connection in the request context")
+
+// How long the server waits for a client to answer a request it sent
+const ClientRequestTimeout = 10 * time.Second
+
+// Connection wrapped with an ID - writes go through the outbound queue once it's started
 type Connection struct {
 	id string
 	net.Conn
+	outbound     atomic.Pointer[OutboundQueue]
+	lastSeen     atomic.Int64
+	connectedAt  time.Time
+	bytesIn      atomic.Int64
+	bytesOut     atomic.Int64
+	metrics      *Metrics
+	pending      PendingRequests
+	capabilities atomic.Pointer[Capabilities]
+	adminToken   atomic.Pointer[string]
 }
 
 // Return the connectionId as the string
@@ -18,6 +38,151 @@ func (c *Connection) String() string {
 	return c.id
 }
 
+// Remember the admin token the client presented
+func (c *Connection) SetAdminToken(token string) {
+	c.adminToken.Store(&token)
+}
+
+// Get the admin token the client presented, if any
+func (c *Connection) AdminToken() string {
+	if token := c.adminToken.Load(); token != nil {
+		return *token
+	}
+	return ""
+}
+
+// Record that the client was heard from
+func (c *Connection) Touch() {
+	c.lastSeen.Store(time.Now().UnixNano())
+}
+
+// Get the last time the client was heard from
+func (c *Connection) LastSeen() time.Time {
+	return time.Unix(0, c.lastSeen.Load())
+}
+
+// Queue writes to the connection instead of writing them directly
+func (c *Connection) StartOutboundQueue(config OutboundQueueConfig, onSlowConsumer func()) {
+	c.outbound.Store(NewOutboundQueue(c.Conn, config, c.metrics, onSlowConsumer))
+}
+
+// Write to the outbound queue if it's started, otherwise directly to the connection
+func (c *Connection) Write(b []byte) (int, error) {
+	n, err := c.write(b)
+	c.bytesOut.Add(int64(n))
+	if c.metrics != nil {
+		c.metrics.AddBytesOut(n)
+	}
+	return n, err
+}
+
+// Write a response or request, which the outbound queue never drops
+func (c *Connection) WriteResponse(b []byte) (int, error) {
+	n, err := c.writeResponse(b)
+	c.bytesOut.Add(int64(n))
+	if c.metrics != nil {
+		c.metrics.AddBytesOut(n)
+	}
+	return n, err
+}
+
+// Read from the connection, counting the bytes read
+func (c *Connection) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.bytesIn.Add(int64(n))
+	if c.metrics != nil {
+		c.metrics.AddBytesIn(n)
+	}
+	return n, err
+}
+
+func (c *Connection) write(b []byte) (int, error) {
+	queue := c.outbound.Load()
+	if queue == nil {
+		return c.Conn.Write(b)
+	}
+
+	message := make([]byte, len(b))
+	copy(message, b)
+	if err := queue.Enqueue(message); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *Connection) writeResponse(b []byte) (int, error) {
+	queue := c.outbound.Load()
+	if queue == nil {
+		return c.Conn.Write(b)
+	}
+
+	message := make([]byte, len(b))
+	copy(message, b)
+	if err := queue.EnqueueResponse(message); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush the outbound queue and close the connection - requests still waiting for the client fail
+func (c *Connection) Close() error {
+	c.pending.CloseAll()
+	if queue := c.outbound.Load(); queue != nil {
+		queue.Close()
+	}
+	return c.Conn.Close()
+}
+
+// Send a request to the client and wait for its response. The client's response is read by the connection's
+// read loop, so it must not be awaited by a handler of a request from the same connection.
+func (c *Connection) Call(method string, params any, timeout time.Duration) (JsonRpcResponse, error) {
+	request := JsonRpcRequest{Id: uuid.New().String(), JsonRpc: JsonRpcVersion, Method: method}
+	if params != nil {
+		paramsJson, err := json.Marshal(params)
+		if err != nil {
+			return JsonRpcResponse{}, err
+		}
+		request.Params = paramsJson
+	}
+	requestJson, err := json.Marshal(request)
+	if err != nil {
+		return JsonRpcResponse{}, err
+	}
+
+	c.pending.Add(request.Id)
+	if _, err := c.WriteResponse(requestJson); err != nil {
+		c.pending.Forget(request.Id)
+		return JsonRpcResponse{}, err
+	}
+	return c.pending.Await(request.Id, timeout)
+}
+
+// Deliver a response from the client to the request waiting for it
+func (c *Connection) Resolve(response JsonRpcResponse) bool {
+	return c.pending.Resolve(response)
+}
+
+// Get the outbound queue metrics of the connection
+func (c *Connection) OutboundStats() OutboundQueueStats {
+	if queue := c.outbound.Load(); queue != nil {
+		return queue.Stats()
+	}
+	return OutboundQueueStats{}
+}
+
+type connectionContextKey struct{}
+
+// Attach the connection a request arrived on to the context
+func ContextWithConnection(ctx context.Context, connection *Connection) context.Context {
+	return context.WithValue(ctx, connectionContextKey{}, connection)
+}
+
+// Get the connection a request arrived on from the context
+func ConnectionFromContext(ctx context.Context) (*Connection, bool) {
+	connection, ok := ctx.Value(connectionContextKey{}).(*Connection)
+	return connection, ok
+}
+
 // Connection Data store Interface
 type ConnectionStore interface {
 	Add(connection *Connection)
@@ -31,6 +196,7 @@ type ConnectionStore interface {
 type InMemoryConnectionStore struct {
 	connections map[string]*Connection
 	count       int
+	mu          sync.RWMutex
 }
 
 // Create a new in-memory connection store
@@ -41,11 +207,15 @@ func NewConnectionStore() *InMemoryConnectionStore {
 
 // Get the number of connections
 func (s *InMemoryConnectionStore) Count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	return s.count
 }
 
 // Get a connection by ID
 func (s *InMemoryConnectionStore) Get(connectionId string) (*Connection, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	connection, ok := s.connections[connectionId]
 	if !ok {
 		return nil, false
@@ -55,6 +225,8 @@ func (s *InMemoryConnectionStore) Get(connectionId string) (*Connection, bool) {
 
 // List all connections
 func (s *InMemoryConnectionStore) List() []*Connection {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	connectionList := make([]*Connection, 0)
 
 	for _, c := range s.connections {
@@ -66,44 +238,52 @@ func (s *InMemoryConnectionStore) List() []*Connection {
 
 // Remove a connection from the map
 func (s *InMemoryConnectionStore) Delete(connectionId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.connections[connectionId]; !ok {
+		return
+	}
 	delete(s.connections, connectionId)
 	s.count--
 }
 
 // Insert a connection into the map
 func (s *InMemoryConnectionStore) Add(connection *Connection) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.connections[connection.id] = connection
 	s.count++
 }
 
 // Connection Service for interfacing with connections
 type ConnectionService struct {
-	store ConnectionStore
+	store   ConnectionStore
+	metrics *Metrics
 }
 
 // Add a new connection (wrapped net.Conn)
-func (s *ConnectionService) AddConnection(conn net.Conn) {
+func (s *ConnectionService) AddConnection(conn net.Conn) *Connection {
 	connectionId := uuid.New().String()
-	log.Printf("Adding new connection: [%s]\n", connectionId)
+	slog.Info("Adding new connection", "connection_id", connectionId, "remote_addr", conn.RemoteAddr())
 
-	connection := Connection{id: connectionId, Conn: conn}
+	connection := Connection{id: connectionId, Conn: conn, connectedAt: time.Now().UTC(), metrics: s.metrics}
+	connection.Touch()
 	s.store.Add(&connection)
+	return &connection
 }
 
 // Delete a connection
 func (s *ConnectionService) DeleteConnection(connectionId string) {
-	log.Printf("Deleting connection: [%s]\n", connectionId)
+	slog.Info("Deleting connection", "connection_id", connectionId)
 	s.store.Delete(connectionId)
 }
 
 // List all connections
 func (s *ConnectionService) ListConnections() []*Connection {
-	log.Println("Listing all connections")
 	return s.store.List()
 }
 
 // Get a connection
 func (s *ConnectionService) GetConnection(connectionId string) (*Connection, bool) {
-	log.Printf("Getting connection: [%s]\n", connectionId)
 	return s.store.Get(connectionId)
 }
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"net"
 	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
@@ -11,9 +14,13 @@ const ConnectionCount = 20
 
 type FakeNetConn struct {
 	messagesWrote []string
+	remoteAddr    net.Addr
+	mu            sync.Mutex
 }
 
 func (f *FakeNetConn) Read(b []byte) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	messageCount := len(f.messagesWrote)
 	if messageCount == 0 {
 		return 0, nil
@@ -25,6 +32,8 @@ func (f *FakeNetConn) Read(b []byte) (n int, err error) {
 }
 
 func (f *FakeNetConn) Write(b []byte) (n int, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
 	f.messagesWrote = append(f.messagesWrote, string(b))
 	return len(b), nil
 }
@@ -38,7 +47,7 @@ func (f *FakeNetConn) LocalAddr() net.Addr {
 }
 
 func (f *FakeNetConn) RemoteAddr() net.Addr {
-	return nil
+	return f.remoteAddr
 }
 
 func (f *FakeNetConn) SetDeadline(t time.Time) error {
@@ -140,3 +149,56 @@ func TestGetConnection(t *testing.T) {
 
 	})
 }
+
+// Answer the requests written to the client end of a pipe with the handler's result, delivering
+// the responses straight to the connection
+func AnswerRequests(client net.Conn, connection *Connection, handler func(JsonRpcRequest) any) {
+	decoder := json.NewDecoder(client)
+	for {
+		var request JsonRpcRequest
+		if err := decoder.Decode(&request); err != nil {
+			return
+		}
+		connection.Resolve(NewResultResponse(request, handler(request)))
+	}
+}
+
+func TestConnectionCall(t *testing.T) {
+	t.Run("call waits for the client's response", func(t *testing.T) {
+		serverEnd, clientEnd := net.Pipe()
+		connection := &Connection{id: "1", Conn: serverEnd}
+		go AnswerRequests(clientEnd, connection, func(request JsonRpcRequest) any { return request.Method })
+
+		response, err := connection.Call("echo", nil, time.Second)
+		AssertErrorNotNil(t, err)
+		if string(response.Result) != `"echo"` {
+			t.Errorf("got result %s but want \"echo\"", response.Result)
+		}
+	})
+
+	t.Run("call times out when the client doesn't answer", func(t *testing.T) {
+		serverEnd, clientEnd := net.Pipe()
+		connection := &Connection{id: "1", Conn: serverEnd}
+		go json.NewDecoder(clientEnd).Decode(&JsonRpcRequest{})
+
+		if _, err := connection.Call("echo", nil, 10*time.Millisecond); !errors.Is(err, ErrResponseTimeout) {
+			t.Errorf("got error [%v] but want [%v]", err, ErrResponseTimeout)
+		}
+		if connection.Resolve(JsonRpcResponse{Id: "late"}) {
+			t.Error("got a late response delivered")
+		}
+	})
+
+	t.Run("closing the connection fails waiting calls", func(t *testing.T) {
+		serverEnd, clientEnd := net.Pipe()
+		connection := &Connection{id: "1", Conn: serverEnd}
+		go func() {
+			json.NewDecoder(clientEnd).Decode(&JsonRpcRequest{})
+			connection.Close()
+		}()
+
+		if _, err := connection.Call("echo", nil, time.Second); !errors.Is(err, ErrPeerClosed) {
+			t.Errorf("got error [%v] but want [%v]", err, ErrPeerClosed)
+		}
+	})
+}
@@ -0,0 +1,726 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// Links send a ping this often, and a link that hears nothing for three times as long is down
+	FederationPingInterval     = 10 * time.Second
+	FederationHandshakeTimeout = 10 * time.Second
+	FederationMaxBackoff       = 30 * time.Second
+	// Frames queued for a link before new ones are dropped
+	FederationQueueSize = 256
+	// Message ids remembered to drop copies that arrive over a second path
+	FederationSeenSize = 10000
+)
+
+// States of a federation link
+const (
+	FederationLinkDown       = "down"
+	FederationLinkConnecting = "connecting"
+	FederationLinkUp         = "up"
+)
+
+// Types of frames sent over federation links
+const (
+	federationHello   = "hello"
+	federationAuth    = "auth"
+	federationWelcome = "welcome"
+	federationChat    = "chat"
+	federationDirect  = "direct"
+	federationPing    = "ping"
+)
+
+var (
+	ErrServerUnreachable = errors.New("server unreachable")
+	ErrFederationAuth    = errors.New("federation authentication failed")
+)
+
+// A chat message in a bridged room, or a direct message to a user of the receiving server. Authors are
+// addressed as user@server, and Via lists the servers the message has passed through so it's never sent back.
+type FederatedMessage struct {
+	Id        string    `json:"id"`
+	Origin    string    `json:"origin"`
+	Via       []string  `json:"via"`
+	Room      string    `json:"room,omitempty"`
+	To        string    `json:"to,omitempty"`
+	Author    string    `json:"author"`
+	Msg       []byte    `json:"msg"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// A frame of the federation protocol - newline-delimited JSON, starting with the hello, auth and welcome handshake.
+// On links with a secret, the frames after the handshake carry a sequence number and a MAC.
+type federationFrame struct {
+	Type    string            `json:"type"`
+	Server  string            `json:"server,omitempty"`
+	Nonce   string            `json:"nonce,omitempty"`
+	Proof   string            `json:"proof,omitempty"`
+	Message *FederatedMessage `json:"message,omitempty"`
+	Seq     uint64            `json:"seq,omitempty"`
+	Mac     string            `json:"mac,omitempty"`
+}
+
+// MACs of the frames one server sends over a link. The handshake only proves who connected, so without TLS
+// every frame after it is signed with a key derived from the secret and both handshake nonces. The sequence
+// number keeps frames from being replayed or reordered, and the sending server's id keeps them from being
+// reflected back. Links without a secret have no key and rely on TLS.
+type frameMac struct {
+	key    []byte
+	server string
+	seq    uint64
+}
+
+// Key of a connection's frame MACs - nil without a secret
+func sessionKey(secret string, dialerNonce string, acceptorNonce string) []byte {
+	if secret == "" {
+		return nil
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("session|" + dialerNonce + "|" + acceptorNonce))
+	return mac.Sum(nil)
+}
+
+// MAC of a frame with its sequence number set and its MAC empty
+func (m *frameMac) sum(frame federationFrame) string {
+	frame.Mac = ""
+	data, _ := json.Marshal(frame)
+	mac := hmac.New(sha256.New, m.key)
+	mac.Write([]byte(m.server + "|"))
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Number and sign a frame before it's sent
+func (m *frameMac) seal(frame *federationFrame) {
+	if m.key == nil {
+		return
+	}
+	m.seq++
+	frame.Seq = m.seq
+	frame.Mac = m.sum(*frame)
+}
+
+// Check that a received frame is the next one the other server signed
+func (m *frameMac) open(frame federationFrame) error {
+	if m.key == nil {
+		return nil
+	}
+	m.seq++
+	if frame.Seq != m.seq || !hmac.Equal([]byte(frame.Mac), []byte(m.sum(frame))) {
+		return fmt.Errorf("%w: frame %d from [%s] has a bad MAC", ErrFederationAuth, m.seq, m.server)
+	}
+	return nil
+}
+
+// Link to another server - dialed when it has an address, otherwise the other server dials in
+type federationLink struct {
+	config    FederationLinkConfig
+	conn      net.Conn
+	out       chan federationFrame
+	state     string
+	since     time.Time
+	lastError string
+	sent      int
+	received  int
+	dropped   int
+	mu        sync.Mutex
+}
+
+// Federation with other servers over authenticated links, bridging rooms and passing direct messages.
+// A link authenticates the other server by a shared secret, by its TLS certificate, or by both.
+type FederationService struct {
+	config   FederationConfig
+	tls      *tls.Config
+	listener net.Listener
+	links    map[string]*federationLink
+	seen     map[string]bool
+	order    []string
+	receive  func(message FederatedMessage)
+	closed   bool
+	done     chan struct{}
+	mu       sync.Mutex
+}
+
+// Read the certificate, key and certificate authority of a federation config - nil when it has no certificate
+func LoadFederationTLS(config FederationConfig) (*tls.Config, error) {
+	if config.CertFile == "" {
+		return nil, nil
+	}
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	ca, err := os.ReadFile(config.CAFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(ca) {
+		return nil, fmt.Errorf("no certificates in %s", config.CAFile)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, RootCAs: pool, ClientCAs: pool, ClientAuth: tls.RequireAndVerifyClientCert, MinVersion: tls.VersionTLS12}, nil
+}
+
+// Start federating - listen for the linked servers when the config has an address and dial those with
+// one. Messages from other servers are passed to receive.
+func NewFederationService(config FederationConfig, receive func(message FederatedMessage)) (*FederationService, error) {
+	if !userNamePattern.MatchString(config.ServerId) {
+		return nil, fmt.Errorf("invalid federation server id [%s]", config.ServerId)
+	}
+	tlsConfig, err := LoadFederationTLS(config)
+	if err != nil {
+		return nil, err
+	}
+
+	f := &FederationService{config: config, tls: tlsConfig, links: make(map[string]*federationLink), seen: make(map[string]bool), receive: receive, done: make(chan struct{})}
+	for _, linkConfig := range config.Links {
+		if !userNamePattern.MatchString(linkConfig.ServerId) || linkConfig.ServerId == config.ServerId {
+			return nil, fmt.Errorf("invalid federation link server id [%s]", linkConfig.ServerId)
+		}
+		if linkConfig.Secret == "" && tlsConfig == nil {
+			return nil, fmt.Errorf("federation link to [%s] needs a secret or a certificate", linkConfig.ServerId)
+		}
+		f.links[linkConfig.ServerId] = &federationLink{config: linkConfig, state: FederationLinkDown, since: time.Now().UTC()}
+	}
+
+	if config.Listen != "" {
+		if tlsConfig != nil {
+			f.listener, err = tls.Listen("tcp", config.Listen, tlsConfig)
+		} else {
+			f.listener, err = net.Listen("tcp", config.Listen)
+		}
+		if err != nil {
+			return nil, err
+		}
+		go f.accept()
+		slog.Info("Federation listening", "server", config.ServerId, "address", f.listener.Addr().String())
+	}
+	for _, link := range f.links {
+		if link.config.Address != "" {
+			go f.dial(link)
+		}
+	}
+	return f, nil
+}
+
+// Id of this server
+func (f *FederationService) ServerId() string {
+	return f.config.ServerId
+}
+
+// Address the service listens on, empty when it only dials
+func (f *FederationService) Addr() string {
+	if f.listener == nil {
+		return ""
+	}
+	return f.listener.Addr().String()
+}
+
+// Rooms bridged with any linked server
+func (f *FederationService) BridgedRooms() []string {
+	rooms := make([]string, 0)
+	for _, link := range f.links {
+		for _, room := range link.config.Rooms {
+			if !slices.Contains(rooms, room) {
+				rooms = append(rooms, room)
+			}
+		}
+	}
+	slices.Sort(rooms)
+	return rooms
+}
+
+// Stop listening and close every link
+func (f *FederationService) Close() error {
+	f.mu.Lock()
+	if f.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	f.closed = true
+	close(f.done)
+	f.mu.Unlock()
+
+	var err error
+	if f.listener != nil {
+		err = f.listener.Close()
+	}
+	for _, link := range f.links {
+		link.mu.Lock()
+		if link.conn != nil {
+			link.conn.Close()
+		}
+		link.mu.Unlock()
+	}
+	return err
+}
+
+// State of every link, sorted by server
+func (f *FederationService) Links() []FederationLinkState {
+	states := make([]FederationLinkState, 0, len(f.links))
+	for _, link := range f.links {
+		link.mu.Lock()
+		states = append(states, FederationLinkState{Server: link.config.ServerId, Address: link.config.Address, Rooms: link.config.Rooms, State: link.state, Since: link.since,
+			LastError: link.lastError, Sent: link.sent, Received: link.received, Dropped: link.dropped})
+		link.mu.Unlock()
+	}
+	slices.SortFunc(states, func(a, b FederationLinkState) int { return strings.Compare(a.Server, b.Server) })
+	return states
+}
+
+// Send a chat message sent on this server to the linked servers bridging its room
+func (f *FederationService) Forward(message FederatedMessage) {
+	f.markSeen(message)
+	f.relay(message)
+}
+
+// Send a chat message to the linked servers bridging its room, except those it has already been through
+func (f *FederationService) relay(message FederatedMessage) {
+	message.Via = append(slices.Clone(message.Via), f.config.ServerId)
+	for _, link := range f.links {
+		if link.config.ServerId == message.Origin || slices.Contains(message.Via, link.config.ServerId) || !slices.Contains(link.config.Rooms, message.Room) {
+			continue
+		}
+		link.send(federationFrame{Type: federationChat, Message: &message})
+	}
+}
+
+// Send a direct message to a user of a linked server, addressed as user@server
+func (f *FederationService) SendDirect(message FederatedMessage, server string) error {
+	link, ok := f.links[server]
+	if !ok || !link.send(federationFrame{Type: federationDirect, Message: &message}) {
+		return ErrServerUnreachable
+	}
+	return nil
+}
+
+// Remember a message, returning whether it's new
+func (f *FederationService) markSeen(message FederatedMessage) bool {
+	key := message.Origin + "/" + message.Id
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.seen[key] {
+		return false
+	}
+	f.seen[key] = true
+	f.order = append(f.order, key)
+	if len(f.order) > FederationSeenSize {
+		delete(f.seen, f.order[0])
+		f.order = f.order[1:]
+	}
+	return true
+}
+
+// Check that a linked server could have sent a message. A direct message comes from the linked server
+// itself, while chat may be relayed - Via then starts at the origin and ends at the linked server. Either
+// way the author is a user of the origin.
+func validFederatedMessage(link *federationLink, message FederatedMessage) error {
+	server := link.config.ServerId
+	if message.Room != "" {
+		if len(message.Via) == 0 || message.Via[0] != message.Origin || message.Via[len(message.Via)-1] != server {
+			return fmt.Errorf("chat from [%s] didn't come by way of [%s]", message.Origin, server)
+		}
+	} else if message.Origin != server {
+		return fmt.Errorf("direct message from [%s] sent by [%s]", message.Origin, server)
+	}
+	user, ok := strings.CutSuffix(message.Author, "@"+message.Origin)
+	if !ok || !userNamePattern.MatchString(user) {
+		return fmt.Errorf("author [%s] isn't a user of [%s]", message.Author, message.Origin)
+	}
+	return nil
+}
+
+// Handle a message from a linked server - chat is dropped unless the link bridges its room, and messages
+// the linked server couldn't have sent are dropped
+func (f *FederationService) handle(link *federationLink, message FederatedMessage) {
+	if message.Origin == f.config.ServerId {
+		return
+	}
+	if err := validFederatedMessage(link, message); err != nil {
+		slog.Warn("Dropping federated message", "server", link.config.ServerId, "message_id", message.Id, "error", err)
+		return
+	}
+	switch {
+	case message.Room != "":
+		if !slices.Contains(link.config.Rooms, message.Room) || !f.markSeen(message) {
+			return
+		}
+		f.receive(message)
+		f.relay(message)
+	case message.To != "":
+		f.receive(message)
+	}
+}
+
+// Accept connections from linked servers
+func (f *FederationService) accept() {
+	for {
+		conn, err := f.listener.Accept()
+		if err != nil {
+			select {
+			case <-f.done:
+				return
+			default:
+			}
+			slog.Warn("Error accepting federation connection", "error", err)
+			continue
+		}
+		go func() {
+			link, key, err := f.acceptHandshake(conn)
+			if err != nil {
+				slog.Warn("Federation handshake failed", "remote_addr", conn.RemoteAddr().String(), "error", err)
+				conn.Close()
+				return
+			}
+			f.serve(link, conn, key)
+		}()
+	}
+}
+
+// Keep a link to a server up, redialing with backoff until the service is closed
+func (f *FederationService) dial(link *federationLink) {
+	backoff := time.Second
+	for {
+		link.setState(FederationLinkConnecting, nil)
+		conn, key, err := f.connect(link)
+		if err == nil {
+			backoff = time.Second
+			f.serve(link, conn, key)
+		} else {
+			link.setState(FederationLinkDown, err)
+			slog.Warn("Federation link failed", "server", link.config.ServerId, "error", err)
+		}
+
+		select {
+		case <-f.done:
+			return
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, FederationMaxBackoff)
+	}
+}
+
+// Dial a server and authenticate each other, returning the key of the connection's frame MACs
+func (f *FederationService) connect(link *federationLink) (net.Conn, []byte, error) {
+	dialer := &net.Dialer{Timeout: FederationHandshakeTimeout}
+	var conn net.Conn
+	var err error
+	if f.tls != nil {
+		config := f.tls.Clone()
+		config.ServerName = link.config.ServerId
+		conn, err = tls.DialWithDialer(dialer, "tcp", link.config.Address, config)
+	} else {
+		conn, err = dialer.Dial("tcp", link.config.Address)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	conn.SetDeadline(time.Now().Add(FederationHandshakeTimeout))
+	encoder, decoder := json.NewEncoder(conn), json.NewDecoder(conn)
+	nonce := newNonce()
+	var hello, welcome federationFrame
+	err = encoder.Encode(federationFrame{Type: federationHello, Server: f.config.ServerId, Nonce: nonce})
+	if err == nil {
+		err = decoder.Decode(&hello)
+	}
+	if err == nil && (hello.Type != federationHello || hello.Server != link.config.ServerId || !validProof(link.config.Secret, hello.Server, nonce, hello.Proof)) {
+		err = ErrFederationAuth
+	}
+	if err == nil {
+		err = encoder.Encode(federationFrame{Type: federationAuth, Proof: proof(link.config.Secret, f.config.ServerId, hello.Nonce)})
+	}
+	if err == nil {
+		err = decoder.Decode(&welcome)
+	}
+	if err == nil && welcome.Type != federationWelcome {
+		err = ErrFederationAuth
+	}
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, sessionKey(link.config.Secret, nonce, hello.Nonce), nil
+}
+
+// Authenticate a server that dialed in, returning its link and the key of the connection's frame MACs
+func (f *FederationService) acceptHandshake(conn net.Conn) (*federationLink, []byte, error) {
+	conn.SetDeadline(time.Now().Add(FederationHandshakeTimeout))
+	encoder, decoder := json.NewEncoder(conn), json.NewDecoder(conn)
+	var hello, auth federationFrame
+	if err := decoder.Decode(&hello); err != nil {
+		return nil, nil, err
+	}
+	link, ok := f.links[hello.Server]
+	if hello.Type != federationHello || !ok {
+		return nil, nil, fmt.Errorf("%w: unknown server [%s]", ErrFederationAuth, hello.Server)
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		certs := tlsConn.ConnectionState().PeerCertificates
+		if len(certs) == 0 || certs[0].VerifyHostname(hello.Server) != nil {
+			return nil, nil, fmt.Errorf("%w: certificate isn't for [%s]", ErrFederationAuth, hello.Server)
+		}
+	}
+
+	nonce := newNonce()
+	if err := encoder.Encode(federationFrame{Type: federationHello, Server: f.config.ServerId, Nonce: nonce, Proof: proof(link.config.Secret, f.config.ServerId, hello.Nonce)}); err != nil {
+		return nil, nil, err
+	}
+	if err := decoder.Decode(&auth); err != nil {
+		return nil, nil, err
+	}
+	if auth.Type != federationAuth || !validProof(link.config.Secret, hello.Server, nonce, auth.Proof) {
+		return nil, nil, fmt.Errorf("%w: wrong secret from [%s]", ErrFederationAuth, hello.Server)
+	}
+	if err := encoder.Encode(federationFrame{Type: federationWelcome}); err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return link, sessionKey(link.config.Secret, hello.Nonce, nonce), nil
+}
+
+// Run an authenticated connection until it fails - it replaces any connection the link had. A frame with a
+// bad MAC fails the connection.
+func (f *FederationService) serve(link *federationLink, conn net.Conn, key []byte) {
+	out := link.attach(conn)
+	slog.Info("Federation link up", "server", link.config.ServerId, "remote_addr", conn.RemoteAddr().String())
+	go writeFederationFrames(conn, out, &frameMac{key: key, server: f.config.ServerId})
+
+	decoder := json.NewDecoder(conn)
+	received := &frameMac{key: key, server: link.config.ServerId}
+	var err error
+	for {
+		conn.SetReadDeadline(time.Now().Add(3 * FederationPingInterval))
+		var frame federationFrame
+		if err = decoder.Decode(&frame); err != nil {
+			break
+		}
+		if err = received.open(frame); err != nil {
+			break
+		}
+		if frame.Message != nil && (frame.Type == federationChat || frame.Type == federationDirect) {
+			link.mu.Lock()
+			link.received++
+			link.mu.Unlock()
+			f.handle(link, *frame.Message)
+		}
+	}
+
+	select {
+	case <-f.done:
+		err = nil
+	default:
+		slog.Warn("Federation link down", "server", link.config.ServerId, "error", err)
+	}
+	link.detach(conn, err)
+}
+
+// Write the frames queued for a connection and a ping every interval, signed when the link has a key,
+// until the queue is closed
+func writeFederationFrames(conn net.Conn, out chan federationFrame, sent *frameMac) {
+	encoder := json.NewEncoder(conn)
+	ping := time.NewTicker(FederationPingInterval)
+	defer ping.Stop()
+	for {
+		frame := federationFrame{Type: federationPing}
+		select {
+		case queued, ok := <-out:
+			if !ok {
+				return
+			}
+			frame = queued
+		case <-ping.C:
+		}
+		sent.seal(&frame)
+		conn.SetWriteDeadline(time.Now().Add(FederationHandshakeTimeout))
+		if err := encoder.Encode(frame); err != nil {
+			conn.Close()
+			return
+		}
+	}
+}
+
+// Make a connection the link's own, closing the one it replaces, and return its queue
+func (l *federationLink) attach(conn net.Conn) chan federationFrame {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn != nil {
+		l.conn.Close()
+		close(l.out)
+	}
+	l.conn, l.out = conn, make(chan federationFrame, FederationQueueSize)
+	l.state, l.since, l.lastError = FederationLinkUp, time.Now().UTC(), ""
+	return l.out
+}
+
+// Drop a connection that failed, unless it was already replaced
+func (l *federationLink) detach(conn net.Conn, err error) {
+	conn.Close()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.conn != conn {
+		return
+	}
+	close(l.out)
+	l.conn, l.out = nil, nil
+	l.state, l.since = FederationLinkDown, time.Now().UTC()
+	if err != nil {
+		l.lastError = err.Error()
+	}
+}
+
+// Set the state of a link that has no connection
+func (l *federationLink) setState(state string, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.state != state {
+		l.state, l.since = state, time.Now().UTC()
+	}
+	if err != nil {
+		l.lastError = err.Error()
+	}
+}
+
+// Queue a frame for the linked server, returning false when the link is down or its queue is full
+func (l *federationLink) send(frame federationFrame) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.out == nil {
+		l.dropped++
+		return false
+	}
+	select {
+	case l.out <- frame:
+		l.sent++
+		return true
+	default:
+		l.dropped++
+		return false
+	}
+}
+
+// Random nonce for a handshake
+func newNonce() string {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	return hex.EncodeToString(nonce)
+}
+
+// Proof that a server knows the secret, bound to the nonce the other side picked - empty without a secret
+func proof(secret string, server string, nonce string) string {
+	if secret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(server + "|" + nonce))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check a proof in constant time
+func validProof(secret string, server string, nonce string, got string) bool {
+	return hmac.Equal([]byte(proof(secret, server, nonce)), []byte(got))
+}
+
+// Federate with the servers of the config, creating the bridged rooms that don't exist yet
+func (s *Server) StartFederation(config FederationConfig) error {
+	federation, err := NewFederationService(config, s.receiveFederated)
+	if err != nil {
+		return err
+	}
+	for _, room := range federation.BridgedRooms() {
+		if !s.roomService.RoomExists(room) {
+			if err := s.roomService.CreateRoom(room, ""); err != nil {
+				federation.Close()
+				return fmt.Errorf("bridged room [%s]: %w", room, err)
+			}
+		}
+	}
+	s.federation = federation
+	return nil
+}
+
+// Address of a local user as other servers see it
+func (s *Server) federatedAddress(identity string) string {
+	return identity + "@" + s.federation.ServerId()
+}
+
+// Post a chat message from another server to its bridged room, or deliver a direct message to a local user.
+// Authors are user@server addresses of other servers, so a federated message never passes for a local user's,
+// and chat from authors banned or muted in the room is dropped.
+func (s *Server) receiveFederated(message FederatedMessage) {
+	if message.Origin == "" || !strings.HasSuffix(message.Author, "@"+message.Origin) {
+		slog.Warn("Dropping federated message with a local author", "origin", message.Origin, "author", message.Author)
+		return
+	}
+	if message.Room != "" {
+		if !s.roomService.RoomExists(message.Room) {
+			return
+		}
+		if _, banned := s.moderationService.IsBanned(message.Room, message.Author, ""); banned {
+			slog.Info("Dropping federated message from a banned author", "room", message.Room, "author", message.Author)
+			return
+		}
+		if _, muted := s.moderationService.IsMuted(message.Room, message.Author); muted {
+			slog.Info("Dropping federated message from a muted author", "room", message.Room, "author", message.Author)
+			return
+		}
+		local, err := s.messageService.AddMessage(message.Room, message.Author, message.Msg, "")
+		if err == nil {
+			s.announceMessage(local, nil)
+		}
+		return
+	}
+	if _, ok := s.userService.GetUser(message.To); ok && s.Online(message.To) {
+		direct := DirectMessage{Id: message.Id, From: message.Author, To: message.To, Msg: message.Msg, Timestamp: message.Timestamp}
+		s.NotifyIdentity(message.To, DirectMessageNotificationRpcMethod, direct)
+	}
+}
+
+// Send a local chat message to the servers bridging its room - thread replies stay on this server
+func (s *Server) federateMessage(message *Message) {
+	if s.federation == nil || message.ParentId != "" {
+		return
+	}
+	s.federation.Forward(FederatedMessage{Id: message.Id, Origin: s.federation.ServerId(), Room: message.Room, Author: s.federatedAddress(message.Author), Msg: message.Msg, Timestamp: message.Timestamp})
+}
+
+// Send a direct message to a user@server address on a linked server
+func (s *Server) sendFederatedDirect(from string, to string, server string, msg []byte) (ChatResult, error) {
+	if s.federation == nil {
+		return ChatResult{}, ErrServerUnreachable
+	}
+	message := FederatedMessage{Id: uuid.New().String(), Origin: s.federation.ServerId(), To: to, Author: s.federatedAddress(from), Msg: msg, Timestamp: time.Now().UTC()}
+	if err := s.federation.SendDirect(message, server); err != nil {
+		return ChatResult{}, err
+	}
+	return ChatResult{Success: true, MessageId: message.Id}, nil
+}
+
+// Show the state of the links to other servers
+func (s *Server) AdminFederationLinksHandler(ctx context.Context, params NoParams) (FederationLinksResult, error) {
+	if s.federation == nil {
+		return FederationLinksResult{Links: make([]FederationLinkState, 0)}, nil
+	}
+	return FederationLinksResult{Server: s.federation.ServerId(), Links: s.federation.Links()}, nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Server federating with the config, stopped when the test ends
+func FederatedServerFixture(t testing.TB, config FederationConfig) *Server {
+	t.Helper()
+	server := ServerFixture()
+	if err := server.StartFederation(config); err != nil {
+		t.Fatal("failed to start federation", err)
+	}
+	t.Cleanup(func() { server.federation.Close() })
+	return server
+}
+
+// Wait for a federated server's link to another server to be up
+func AssertLinkUp(t testing.TB, server *Server, peer string) {
+	t.Helper()
+	AssertEventually(t, "the link to "+peer, func() bool {
+		for _, link := range server.federation.Links() {
+			if link.Server == peer && link.State == FederationLinkUp {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// Messages of a room on a server
+func RoomMessages(t testing.TB, server *Server, room string) []*Message {
+	t.Helper()
+	result, err := server.messageService.GetHistory(room, "", 0)
+	AssertErrorNotNil(t, err)
+	return result.Messages
+}
+
+// Write a certificate authority and a certificate for each name, signed by it, to a directory
+func FederationCertsFixture(t testing.TB, names ...string) string {
+	t.Helper()
+	dir := t.TempDir()
+	writePEM := func(name string, kind string, der []byte) {
+		AssertErrorNotNil(t, os.WriteFile(filepath.Join(dir, name), pem.EncodeToMemory(&pem.Block{Type: kind, Bytes: der}), 0o600))
+	}
+
+	caKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ca := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "chat federation"}, NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+		IsCA: true, BasicConstraintsValid: true, KeyUsage: x509.KeyUsageCertSign}
+	caDer, err := x509.CreateCertificate(rand.Reader, ca, ca, &caKey.PublicKey, caKey)
+	AssertErrorNotNil(t, err)
+	writePEM("ca.pem", "CERTIFICATE", caDer)
+
+	for i, name := range names {
+		key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		template := &x509.Certificate{SerialNumber: big.NewInt(int64(i + 2)), Subject: pkix.Name{CommonName: name}, DNSNames: []string{name}, NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Now().Add(time.Hour),
+			KeyUsage: x509.KeyUsageDigitalSignature, ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth}}
+		der, err := x509.CreateCertificate(rand.Reader, template, ca, &key.PublicKey, caKey)
+		AssertErrorNotNil(t, err)
+		keyDer, _ := x509.MarshalECPrivateKey(key)
+		writePEM(name+".pem", "CERTIFICATE", der)
+		writePEM(name+"-key.pem", "EC PRIVATE KEY", keyDer)
+	}
+	return dir
+}
+
+// Dial a federated server as a linked server and do the handshake, returning the connection and the MACs
+// for the frames sent on it
+func FederationPeerFixture(t testing.TB, address string, server string, secret string) (net.Conn, *frameMac) {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal("failed to dial", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	encoder, decoder := json.NewEncoder(conn), json.NewDecoder(conn)
+	nonce := newNonce()
+	var hello, welcome federationFrame
+	encoder.Encode(federationFrame{Type: federationHello, Server: server, Nonce: nonce})
+	decoder.Decode(&hello)
+	encoder.Encode(federationFrame{Type: federationAuth, Proof: proof(secret, server, hello.Nonce)})
+	if err := decoder.Decode(&welcome); err != nil || welcome.Type != federationWelcome {
+		t.Fatalf("got no welcome: %v", err)
+	}
+	return conn, &frameMac{key: sessionKey(secret, nonce, hello.Nonce), server: server}
+}
+
+// Sign and send a chat frame
+func SendFederatedChat(conn net.Conn, sent *frameMac, message FederatedMessage) {
+	frame := federationFrame{Type: federationChat, Message: &message}
+	sent.seal(&frame)
+	json.NewEncoder(conn).Encode(frame)
+}
+
+func TestFederation(t *testing.T) {
+	t.Run("bridged rooms carry chat both ways", func(t *testing.T) {
+		a := FederatedServerFixture(t, FederationConfig{ServerId: "a", Listen: "127.0.0.1:0", Links: []FederationLinkConfig{{ServerId: "b", Secret: "s3cret", Rooms: []string{"lobby"}}}})
+		b := FederatedServerFixture(t, FederationConfig{ServerId: "b", Links: []FederationLinkConfig{{ServerId: "a", Address: a.federation.Addr(), Secret: "s3cret", Rooms: []string{"lobby"}}}})
+		AssertLinkUp(t, b, "a")
+		alice, _ := AddFakeConnection(t, a, "alice")
+		bob, bobConn := AddFakeConnection(t, b, "bob")
+		AssertSuccess(t, CallMethod(t, a, alice, JoinChatRoomRpcMethod, RoomParams{Room: "lobby"}))
+		AssertSuccess(t, CallMethod(t, b, bob, JoinChatRoomRpcMethod, RoomParams{Room: "lobby"}))
+
+		AssertSuccess(t, CallMethod(t, a, alice, ChatRpcMethod, ChatRequestParams{Room: "lobby", Msg: []byte("hi from a")}))
+		AssertSuccess(t, CallMethod(t, a, alice, ChatRpcMethod, ChatRequestParams{Room: DefaultRoom, Msg: []byte("not bridged")}))
+		AssertEventually(t, "the chat to reach b", func() bool { return CountNotifications(bobConn, ChatNotificationRpcMethod) == 1 })
+		if messages := RoomMessages(t, b, "lobby"); len(messages) != 1 || messages[0].Author != "alice@a" {
+			t.Errorf("got messages %+v on b", messages)
+		}
+
+		AssertSuccess(t, CallMethod(t, b, bob, ChatRpcMethod, ChatRequestParams{Room: "lobby", Msg: []byte("hi from b")}))
+		AssertEventually(t, "the reply to reach a", func() bool { return len(RoomMessages(t, a, "lobby")) == 2 })
+		if len(RoomMessages(t, b, DefaultRoom)) != 0 {
+			t.Error("a room that isn't bridged was federated")
+		}
+	})
+
+	t.Run("messages don't loop between three servers", func(t *testing.T) {
+		link := func(server string, address string) FederationLinkConfig {
+			return FederationLinkConfig{ServerId: server, Address: address, Secret: "s3cret", Rooms: []string{"lobby"}}
+		}
+		a := FederatedServerFixture(t, FederationConfig{ServerId: "a", Listen: "127.0.0.1:0", Links: []FederationLinkConfig{link("b", ""), link("c", "")}})
+		b := FederatedServerFixture(t, FederationConfig{ServerId: "b", Listen: "127.0.0.1:0", Links: []FederationLinkConfig{link("a", a.federation.Addr()), link("c", "")}})
+		c := FederatedServerFixture(t, FederationConfig{ServerId: "c", Links: []FederationLinkConfig{link("a", a.federation.Addr()), link("b", b.federation.Addr())}})
+		AssertLinkUp(t, a, "b")
+		AssertLinkUp(t, a, "c")
+		AssertLinkUp(t, b, "c")
+
+		alice, _ := AddFakeConnection(t, a, "alice")
+		CallMethod(t, a, alice, JoinChatRoomRpcMethod, RoomParams{Room: "lobby"})
+		AssertSuccess(t, CallMethod(t, a, alice, ChatRpcMethod, ChatRequestParams{Room: "lobby", Msg: []byte("once")}))
+		AssertEventually(t, "the chat to reach b and c", func() bool {
+			return len(RoomMessages(t, b, "lobby")) == 1 && len(RoomMessages(t, c, "lobby")) == 1
+		})
+		time.Sleep(100 * time.Millisecond)
+		for i, server := range []*Server{a, b, c} {
+			if got := len(RoomMessages(t, server, "lobby")); got != 1 {
+				t.Errorf("server %d has %d messages", i, got)
+			}
+		}
+	})
+
+	t.Run("direct messages reach user@server", func(t *testing.T) {
+		a := FederatedServerFixture(t, FederationConfig{ServerId: "a", Listen: "127.0.0.1:0", Links: []FederationLinkConfig{{ServerId: "b", Secret: "s3cret"}}})
+		b := FederatedServerFixture(t, FederationConfig{ServerId: "b", Links: []FederationLinkConfig{{ServerId: "a", Address: a.federation.Addr(), Secret: "s3cret"}}})
+		AssertLinkUp(t, b, "a")
+		alice, _ := AddFakeConnection(t, a, "alice")
+		_, bobConn := AddFakeConnection(t, b, "bob")
+
+		AssertSuccess(t, CallMethod(t, a, alice, DirectMessageRpcMethod, DirectMessageParams{To: "bob@b", Msg: []byte("psst")}))
+		AssertEventually(t, "the direct message to reach b", func() bool { return CountNotifications(bobConn, DirectMessageNotificationRpcMethod) == 1 })
+		var notification JsonRpcNotification
+		var direct DirectMessage
+		json.Unmarshal([]byte(bobConn.messagesWrote[len(bobConn.messagesWrote)-1]), &notification)
+		json.Unmarshal(notification.Params, &direct)
+		if direct.From != "alice@a" || direct.To != "bob" {
+			t.Errorf("got direct message %+v", direct)
+		}
+		AssertErrorCode(t, CallMethod(t, a, alice, DirectMessageRpcMethod, DirectMessageParams{To: "bob@elsewhere", Msg: []byte("hi")}), ServerUnreachableErrorCode)
+	})
+
+	t.Run("a wrong secret keeps the link down", func(t *testing.T) {
+		a := FederatedServerFixture(t, FederationConfig{ServerId: "a", Listen: "127.0.0.1:0", Links: []FederationLinkConfig{{ServerId: "b", Secret: "s3cret"}}})
+		b := FederatedServerFixture(t, FederationConfig{ServerId: "b", Links: []FederationLinkConfig{{ServerId: "a", Address: a.federation.Addr(), Secret: "guess"}}})
+
+		AssertEventually(t, "the handshake to fail", func() bool {
+			result, _ := b.AdminFederationLinksHandler(context.Background(), NoParams{})
+			return result.Links[0].LastError != ""
+		})
+		result, _ := a.AdminFederationLinksHandler(context.Background(), NoParams{})
+		if result.Server != "a" || len(result.Links) != 1 || result.Links[0].State != FederationLinkDown {
+			t.Errorf("got links %+v", result)
+		}
+	})
+
+	t.Run("certificates authenticate servers", func(t *testing.T) {
+		dir := FederationCertsFixture(t, "a", "b", "mallory")
+		config := func(server string, cert string, links ...FederationLinkConfig) FederationConfig {
+			return FederationConfig{ServerId: server, CertFile: filepath.Join(dir, cert+".pem"), KeyFile: filepath.Join(dir, cert+"-key.pem"), CAFile: filepath.Join(dir, "ca.pem"), Links: links}
+		}
+		aConfig := config("a", "a", FederationLinkConfig{ServerId: "b"})
+		aConfig.Listen = "127.0.0.1:0"
+		a := FederatedServerFixture(t, aConfig)
+
+		b := FederatedServerFixture(t, config("b", "b", FederationLinkConfig{ServerId: "a", Address: a.federation.Addr()}))
+		AssertLinkUp(t, b, "a")
+
+		impostor := FederatedServerFixture(t, config("b", "mallory", FederationLinkConfig{ServerId: "a", Address: a.federation.Addr()}))
+		AssertEventually(t, "the impostor to be refused", func() bool { return impostor.federation.Links()[0].LastError != "" })
+		if impostor.federation.Links()[0].State == FederationLinkUp {
+			t.Error("a server with another server's id got a link")
+		}
+	})
+
+	t.Run("messages the linked server couldn't have sent are dropped", func(t *testing.T) {
+		a := FederatedServerFixture(t, FederationConfig{ServerId: "a", Listen: "127.0.0.1:0", Links: []FederationLinkConfig{{ServerId: "b", Secret: "s3cret", Rooms: []string{"lobby"}}}})
+		conn, sent := FederationPeerFixture(t, a.federation.Addr(), "b", "s3cret")
+
+		now := time.Now().UTC()
+		forged := []FederatedMessage{
+			{Id: "1", Origin: "b", Via: []string{"b"}, Room: "lobby", Author: "alice", Msg: []byte("a local author"), Timestamp: now},
+			{Id: "2", Origin: "b", Via: []string{"b"}, Room: "lobby", Author: "bob@c", Msg: []byte("another server's author"), Timestamp: now},
+			{Id: "3", Origin: "c", Via: []string{"b"}, Room: "lobby", Author: "carol@c", Msg: []byte("not by way of its origin"), Timestamp: now},
+			{Id: "4", Origin: "c", Via: []string{"c"}, Room: "lobby", Author: "carol@c", Msg: []byte("not by way of the link"), Timestamp: now},
+		}
+		for _, message := range forged {
+			SendFederatedChat(conn, sent, message)
+		}
+		SendFederatedChat(conn, sent, FederatedMessage{Id: "5", Origin: "c", Via: []string{"c", "b"}, Room: "lobby", Author: "carol@c", Msg: []byte("relayed"), Timestamp: now})
+
+		AssertEventually(t, "the relayed message", func() bool { return len(RoomMessages(t, a, "lobby")) > 0 })
+		if messages := RoomMessages(t, a, "lobby"); len(messages) != 1 || messages[0].Author != "carol@c" {
+			t.Errorf("got messages %+v", messages)
+		}
+	})
+
+	t.Run("chat from banned and muted authors is dropped", func(t *testing.T) {
+		a := FederatedServerFixture(t, FederationConfig{ServerId: "a", Listen: "127.0.0.1:0", Links: []FederationLinkConfig{{ServerId: "b", Secret: "s3cret", Rooms: []string{"lobby"}}}})
+		a.moderationService.Ban("lobby", "mallory@b", "", 0)
+		a.moderationService.Mute("lobby", "eve@b", time.Hour)
+
+		now := time.Now().UTC()
+		for _, author := range []string{"mallory@b", "eve@b", "carol@b"} {
+			a.receiveFederated(FederatedMessage{Id: author, Origin: "b", Via: []string{"b"}, Room: "lobby", Author: author, Msg: []byte("hi"), Timestamp: now})
+		}
+		if messages := RoomMessages(t, a, "lobby"); len(messages) != 1 || messages[0].Author != "carol@b" {
+			t.Errorf("got messages %+v", messages)
+		}
+	})
+
+	t.Run("a frame with a bad MAC brings the link down", func(t *testing.T) {
+		a := FederatedServerFixture(t, FederationConfig{ServerId: "a", Listen: "127.0.0.1:0", Links: []FederationLinkConfig{{ServerId: "b", Secret: "s3cret", Rooms: []string{"lobby"}}}})
+		conn, sent := FederationPeerFixture(t, a.federation.Addr(), "b", "s3cret")
+		AssertLinkUp(t, a, "b")
+
+		frame := federationFrame{Type: federationChat, Message: &FederatedMessage{Id: "1", Origin: "b", Via: []string{"b"}, Room: "lobby", Author: "bob@b", Msg: []byte("hi"), Timestamp: time.Now().UTC()}}
+		sent.seal(&frame)
+		frame.Message.Msg = []byte("tampered")
+		json.NewEncoder(conn).Encode(frame)
+
+		AssertEventually(t, "the link to go down", func() bool { return a.federation.Links()[0].State == FederationLinkDown })
+		if messages := RoomMessages(t, a, "lobby"); len(messages) != 0 {
+			t.Errorf("got messages %+v", messages)
+		}
+	})
+
+	t.Run("links need a secret or a certificate", func(t *testing.T) {
+		_, err := NewFederationService(FederationConfig{ServerId: "a", Links: []FederationLinkConfig{{ServerId: "b"}}}, nil)
+		if err == nil {
+			t.Error("got no error for a link without authentication")
+		}
+	})
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+)
+
+const (
+	StorageSnapshotFile = "snapshot.json"
+	StorageLogFile      = "transactions.log"
+	// Transactions logged before the log is folded into a new snapshot
+	StorageCompactEvery = 1000
+)
+
+// A committed transaction as it's written to the log
+type storageLogRecord struct {
+	Ops []StorageOp `json:"ops"`
+}
+
+var ErrStorageFailed = errors.New("storage failed")
+
+// Keep storage in memory, made durable with a snapshot file and a log of the transactions committed since.
+// Each transaction is appended to the log and synced before it's applied, and the log is folded into a new
+// snapshot when it grows long and when the storage is closed. A transaction that fails to append is cut
+// off the log again - when that fails too, every commit fails until a compaction empties the log.
+type FileStorage struct {
+	*MemoryStorage
+	dir    string
+	log    *os.File
+	logged int
+	// Length of the log up to the end of the last transaction appended in full
+	size   int64
+	failed error
+}
+
+// Open the storage kept in a directory, creating the directory if needed
+func OpenFileStorage(dir string) (*FileStorage, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+
+	s := &FileStorage{MemoryStorage: NewMemoryStorage(), dir: dir}
+	if err := s.loadSnapshot(); err != nil {
+		return nil, err
+	}
+	replayed, size, err := s.replayLog()
+	if err != nil {
+		return nil, err
+	}
+
+	s.log, err = os.OpenFile(filepath.Join(dir, StorageLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	// Cut off a partly written last transaction, so the next one isn't appended to it
+	if err := s.log.Truncate(size); err != nil {
+		s.log.Close()
+		return nil, err
+	}
+	s.size = size
+	s.commit = s.appendLog
+	if replayed > 0 {
+		if err := s.Compact(); err != nil {
+			s.log.Close()
+			return nil, err
+		}
+	}
+	slog.Info("Opened storage", "dir", dir, "replayed_transactions", replayed)
+	return s, nil
+}
+
+// Load the buckets from the snapshot, if there is one
+func (s *FileStorage) loadSnapshot() error {
+	data, err := os.ReadFile(filepath.Join(s.dir, StorageSnapshotFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &s.buckets); err != nil {
+		return fmt.Errorf("corrupt snapshot: %w", err)
+	}
+	return nil
+}
+
+// Apply the transactions logged since the snapshot, returning how many there were and the length of the log
+// they take up. A partly written last line is what a crash in the middle of a commit leaves behind - that
+// transaction never committed, so it's dropped.
+func (s *FileStorage) replayLog() (int, int64, error) {
+	file, err := os.Open(filepath.Join(s.dir, StorageLogFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	replayed := 0
+	var size int64
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				slog.Warn("Dropping a partly written transaction at the end of the log", "dir", s.dir)
+			}
+			return replayed, size, nil
+		}
+		if err != nil {
+			return replayed, size, err
+		}
+
+		var record storageLogRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			return replayed, size, fmt.Errorf("corrupt transaction log after %d transactions: %w", replayed, err)
+		}
+		s.apply(record.Ops)
+		replayed++
+		size += int64(len(line))
+	}
+}
+
+// Append a transaction to the log, syncing it to disk before it's applied. When the append fails the log
+// is truncated back to the transactions before it, since a replay would otherwise apply what was written
+// of a transaction that was rolled back.
+func (s *FileStorage) appendLog(ops []StorageOp) error {
+	if s.failed != nil {
+		return fmt.Errorf("%w: %w", ErrStorageFailed, s.failed)
+	}
+	line, err := json.Marshal(storageLogRecord{Ops: ops})
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	_, err = s.log.Write(line)
+	if err == nil {
+		err = s.log.Sync()
+	}
+	if err != nil {
+		if truncateErr := os.Truncate(filepath.Join(s.dir, StorageLogFile), s.size); truncateErr != nil {
+			slog.Error("Failed to cut a failed transaction off the log, refusing further writes", "dir", s.dir, "error", truncateErr)
+			s.failed = truncateErr
+		}
+		return err
+	}
+	s.size += int64(len(line))
+	s.logged++
+	return nil
+}
+
+// Run a read-write transaction, compacting the log when it has grown long
+func (s *FileStorage) Update(fn func(tx StorageTx) error) error {
+	if err := s.MemoryStorage.Update(fn); err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	long := s.logged >= StorageCompactEvery
+	s.mu.RUnlock()
+	if long {
+		return s.Compact()
+	}
+	return nil
+}
+
+// Write every bucket to a new snapshot and empty the log. The snapshot replaces the old one in a single
+// rename, and replaying a log over a snapshot that already has its writes changes nothing, so a crash at
+// any point leaves the storage intact.
+func (s *FileStorage) Compact() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data, err := json.Marshal(s.buckets)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, StorageSnapshotFile)
+	temp, err := os.CreateTemp(s.dir, StorageSnapshotFile+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	if _, err := temp.Write(data); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Sync(); err != nil {
+		temp.Close()
+		return err
+	}
+	if err := temp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(temp.Name(), path); err != nil {
+		return err
+	}
+
+	if err := s.log.Truncate(0); err != nil {
+		return err
+	}
+	s.logged = 0
+	s.size = 0
+	s.failed = nil
+	return nil
+}
+
+// Compact the log into the snapshot and close the files
+func (s *FileStorage) Close() error {
+	err := s.Compact()
+	if closeErr := s.log.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
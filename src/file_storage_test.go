@@ -0,0 +1,173 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// File storage in a directory, closed when the test ends unless it's closed before
+func FileStorageFixture(t testing.TB, dir string) *FileStorage {
+	t.Helper()
+	storage, err := OpenFileStorage(dir)
+	if err != nil {
+		t.Fatal("failed to open storage", err)
+	}
+	return storage
+}
+
+// Put a user in a transaction of its own
+func PutUser(t testing.TB, storage Storage, name string) {
+	t.Helper()
+	AssertErrorNotNil(t, storage.Update(func(tx StorageTx) error {
+		return tx.Put(UsersBucket, name, User{Name: name})
+	}))
+}
+
+func TestFileStorage(t *testing.T) {
+	t.Run("committed transactions survive a crash", func(t *testing.T) {
+		dir := t.TempDir()
+		storage := FileStorageFixture(t, dir)
+		PutUser(t, storage, "alice")
+		PutUser(t, storage, "bob")
+		storage.log.Close()
+
+		reopened := FileStorageFixture(t, dir)
+		defer reopened.Close()
+		if keys := BucketKeys(t, reopened, UsersBucket, ""); strings.Join(keys, ",") != "alice,bob" {
+			t.Errorf("got users %v", keys)
+		}
+	})
+
+	t.Run("a partly written last transaction is dropped", func(t *testing.T) {
+		dir := t.TempDir()
+		storage := FileStorageFixture(t, dir)
+		PutUser(t, storage, "alice")
+		storage.log.WriteString(`{"ops":[{"bucket":"users","key":"bob","val`)
+		storage.log.Close()
+
+		reopened := FileStorageFixture(t, dir)
+		defer reopened.Close()
+		if keys := BucketKeys(t, reopened, UsersBucket, ""); strings.Join(keys, ",") != "alice" {
+			t.Errorf("got users %v", keys)
+		}
+		PutUser(t, reopened, "carol")
+	})
+
+	t.Run("a partly written transaction is cut off before the next is appended", func(t *testing.T) {
+		dir := t.TempDir()
+		storage := FileStorageFixture(t, dir)
+		PutUser(t, storage, "alice")
+		AssertErrorNotNil(t, storage.Close())
+		os.WriteFile(filepath.Join(dir, StorageLogFile), []byte(`{"ops":[{"bucket":"users","key":"bob","val`), 0o600)
+
+		reopened := FileStorageFixture(t, dir)
+		PutUser(t, reopened, "carol")
+		reopened.log.Close()
+
+		again := FileStorageFixture(t, dir)
+		defer again.Close()
+		if keys := BucketKeys(t, again, UsersBucket, ""); strings.Join(keys, ",") != "alice,carol" {
+			t.Errorf("got users %v", keys)
+		}
+	})
+
+	t.Run("a failed append is cut off the log", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, StorageLogFile)
+		storage := FileStorageFixture(t, dir)
+		PutUser(t, storage, "alice")
+		info, _ := os.Stat(path)
+
+		// What a write that failed part way leaves behind, then a log that can't be written to
+		partial, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+		partial.WriteString(`{"ops":[{"bucket":"users","key":"bob","val`)
+		partial.Close()
+		storage.log.Close()
+		storage.log, _ = os.Open(path)
+		if err := storage.Update(func(tx StorageTx) error { return tx.Put(UsersBucket, "bob", User{Name: "bob"}) }); err == nil {
+			t.Fatal("got a transaction committed to a log that can't be written to")
+		}
+		if after, _ := os.Stat(path); after.Size() != info.Size() {
+			t.Errorf("got log of %d bytes but want %d", after.Size(), info.Size())
+		}
+
+		storage.log.Close()
+		storage.log, _ = os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0o600)
+		PutUser(t, storage, "carol")
+		storage.log.Close()
+
+		reopened := FileStorageFixture(t, dir)
+		defer reopened.Close()
+		if keys := BucketKeys(t, reopened, UsersBucket, ""); strings.Join(keys, ",") != "alice,carol" {
+			t.Errorf("got users %v", keys)
+		}
+	})
+
+	t.Run("storage fails when a failed append can't be cut off", func(t *testing.T) {
+		dir := t.TempDir()
+		path := filepath.Join(dir, StorageLogFile)
+		storage := FileStorageFixture(t, dir)
+		storage.log.Close()
+		storage.log, _ = os.Open(path)
+		os.Remove(path)
+		put := func(name string) error {
+			return storage.Update(func(tx StorageTx) error { return tx.Put(UsersBucket, name, User{Name: name}) })
+		}
+		if err := put("alice"); err == nil {
+			t.Fatal("got a transaction committed to a log that can't be written to")
+		}
+
+		storage.log.Close()
+		storage.log, _ = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+		if err := put("bob"); !errors.Is(err, ErrStorageFailed) {
+			t.Errorf("got error %v but want the storage failed", err)
+		}
+		if keys := BucketKeys(t, storage, UsersBucket, ""); len(keys) != 0 {
+			t.Errorf("got users %v applied after the storage failed", keys)
+		}
+		AssertErrorNotNil(t, storage.Close())
+	})
+
+	t.Run("a corrupt log is refused", func(t *testing.T) {
+		dir := t.TempDir()
+		os.WriteFile(filepath.Join(dir, StorageLogFile), []byte("garbage\n{\"ops\":[]}\n"), 0o600)
+
+		if _, err := OpenFileStorage(dir); err == nil {
+			t.Error("got a corrupt log opened")
+		}
+	})
+
+	t.Run("closing folds the log into the snapshot", func(t *testing.T) {
+		dir := t.TempDir()
+		storage := FileStorageFixture(t, dir)
+		PutUser(t, storage, "alice")
+		AssertErrorNotNil(t, storage.Close())
+
+		if info, err := os.Stat(filepath.Join(dir, StorageLogFile)); err != nil || info.Size() != 0 {
+			t.Errorf("got log %+v", info)
+		}
+		reopened := FileStorageFixture(t, dir)
+		defer reopened.Close()
+		if keys := BucketKeys(t, reopened, UsersBucket, ""); len(keys) != 1 {
+			t.Errorf("got users %v", keys)
+		}
+	})
+
+	t.Run("server state is reloaded after a restart", func(t *testing.T) {
+		dir := t.TempDir()
+		storage := FileStorageFixture(t, dir)
+		stores := PersistentStoresFixture(t, storage)
+		NewRoomService(stores.Rooms).CreateRoom("ops", "alice")
+		AssertErrorNotNil(t, storage.Close())
+
+		reopened := FileStorageFixture(t, dir)
+		defer reopened.Close()
+		rooms := NewRoomService(PersistentStoresFixture(t, reopened).Rooms)
+		if !rooms.IsMember("ops", "alice") || rooms.Role("ops", "alice") != RoleOwner {
+			t.Errorf("got rooms %+v", rooms.DumpRooms())
+		}
+	})
+}
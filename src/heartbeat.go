@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// Heartbeat settings - a ping is sent every Interval and connections that haven't been heard from
+// for MaxMissed intervals are evicted
+type HeartbeatConfig struct {
+	Interval  time.Duration
+	MaxMissed int
+}
+
+// Default heartbeat settings
+func DefaultHeartbeatConfig() HeartbeatConfig {
+	return HeartbeatConfig{Interval: 30 * time.Second, MaxMissed: 2}
+}
+
+// How long a connection can go without being heard from before it's evicted
+func (c HeartbeatConfig) Timeout() time.Duration {
+	return c.Interval * time.Duration(c.MaxMissed)
+}
+
+// Read deadline of a connection - one interval longer than the timeout, so a connection is normally
+// evicted by the heartbeat before its read times out
+func (c HeartbeatConfig) ReadDeadline(now time.Time) time.Time {
+	return now.Add(c.Timeout() + c.Interval)
+}
+
+// Check the heartbeats every interval until the server stops
+func (s *Server) RunHeartbeat() {
+	ticker := time.NewTicker(s.heartbeatConfig.Interval)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		s.CheckHeartbeats(now)
+	}
+}
+
+// Evict the connections that missed too many heartbeats and ping the rest - evicted connections are closed
+// in their own goroutines, since closing one can wait on a write stuck until its timeout
+func (s *Server) CheckHeartbeats(now time.Time) {
+	alive := make([]*Connection, 0)
+	for _, c := range s.connectionService.ListConnections() {
+		if now.Sub(c.LastSeen()) > s.heartbeatConfig.Timeout() {
+			slog.Info("Evicting connection that missed heartbeats", "connection_id", c.id, "last_seen", c.LastSeen())
+			go s.CloseConnection(c)
+			continue
+		}
+		alive = append(alive, c)
+	}
+
+	s.Notify(alive, PingRpcMethod, Heartbeat{Time: now}, nil)
+}
+
+// Acknowledge a pong - the read loop has already recorded that the client was heard from
+func (s *Server) PongHandler(ctx context.Context, params Heartbeat) (Heartbeat, error) {
+	return params, nil
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckHeartbeats(t *testing.T) {
+	t.Run("live connections are pinged and dead ones are evicted", func(t *testing.T) {
+		server := ServerFixture()
+		server.heartbeatConfig = HeartbeatConfig{Interval: time.Second, MaxMissed: 2}
+		alive, aliveConn := AddFakeConnection(t, server, "alice")
+		dead, deadConn := AddFakeConnection(t, server, "bob")
+		dead.lastSeen.Store(time.Now().Add(-3 * time.Second).UnixNano())
+
+		server.CheckHeartbeats(time.Now())
+
+		AssertNumberOfConnections(t, CountNotifications(aliveConn, PingRpcMethod), 1)
+		AssertNumberOfConnections(t, CountNotifications(deadConn, PingRpcMethod), 0)
+		AssertEventually(t, "the dead connection to be evicted", func() bool {
+			_, connected := server.connectionService.GetConnection(dead.id)
+			_, signedIn := server.userService.UserForConnection(dead.id)
+			return !connected && !signedIn
+		})
+		if _, ok := server.connectionService.GetConnection(alive.id); !ok {
+			t.Errorf("connection [%s] was evicted but is alive", alive.id)
+		}
+	})
+
+	t.Run("dead connections that are slow to close don't hold up the sweep", func(t *testing.T) {
+		server := ServerFixture()
+		server.heartbeatConfig = HeartbeatConfig{Interval: time.Second, MaxMissed: 2}
+		release := make(chan struct{})
+		defer close(release)
+		for range 3 {
+			dead := server.AcceptConnection(&SlowClosingConn{FakeNetConn: NewFakeNetConn(), release: release})
+			dead.lastSeen.Store(time.Now().Add(-3 * time.Second).UnixNano())
+		}
+		_, aliveConn := AddFakeConnection(t, server, "alice")
+
+		swept := make(chan struct{})
+		go func() {
+			server.CheckHeartbeats(time.Now())
+			close(swept)
+		}()
+		select {
+		case <-swept:
+		case <-time.After(time.Second):
+			t.Fatal("sweep waited on the dead connections closing")
+		}
+		AssertNumberOfConnections(t, CountNotifications(aliveConn, PingRpcMethod), 1)
+	})
+
+	t.Run("pong is acknowledged", func(t *testing.T) {
+		server := ServerFixture()
+		alice, _ := AddFakeConnection(t, server, "alice")
+
+		response := CallMethod(t, server, alice, PongRpcMethod, Heartbeat{Time: time.Now()})
+		AssertSuccess(t, response)
+	})
+}
+
+// Connection whose close blocks until released, like one with a write stuck until its timeout
+type SlowClosingConn struct {
+	*FakeNetConn
+	release chan struct{}
+}
+
+func (c *SlowClosingConn) Close() error {
+	<-c.release
+	return c.FakeNetConn.Close()
+}
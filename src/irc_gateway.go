@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// Name the gateway gives itself in the prefix of its replies
+	IrcServerName = "chat"
+	// Longest line read from an IRC client, leaving room for message tags
+	IrcMaxLine = 8192
+	// Marks CTCP messages such as ACTION
+	ircCtcp = "\x01"
+)
+
+// IRC numeric replies the gateway sends
+const (
+	RplWelcome           = "001"
+	RplNoTopic           = "331"
+	RplTopic             = "332"
+	RplNamReply          = "353"
+	RplEndOfNames        = "366"
+	ErrNoSuchNick        = "401"
+	ErrNoSuchChannel     = "403"
+	ErrCannotSendToChan  = "404"
+	ErrUnknownCommand    = "421"
+	ErrNoMotd            = "422"
+	ErrNoNicknameGiven   = "431"
+	ErrErroneusNickname  = "432"
+	ErrNicknameInUse     = "433"
+	ErrNotOnChannel      = "442"
+	ErrNotRegistered     = "451"
+	ErrNeedMoreParams    = "461"
+	ErrAlreadyRegistered = "462"
+	ErrPasswdMismatch    = "464"
+	ErrBannedFromChan    = "474"
+	ErrChanOPrivsNeeded  = "482"
+	ErrIrcInternalServer = "500"
+)
+
+// A line of the IRC protocol - the last of several params is sent as the trailing one
+type IrcMessage struct {
+	Prefix  string
+	Command string
+	Params  []string
+}
+
+// Parse a line from an IRC client, ignoring message tags - false for an empty line
+func ParseIrcMessage(line string) (IrcMessage, bool) {
+	var message IrcMessage
+	line = strings.TrimRight(line, "\r\n")
+	if strings.HasPrefix(line, "@") {
+		_, line, _ = strings.Cut(line, " ")
+	}
+	if strings.HasPrefix(line, ":") {
+		message.Prefix, line, _ = strings.Cut(line[1:], " ")
+	}
+	for line = strings.TrimLeft(line, " "); line != ""; line = strings.TrimLeft(line, " ") {
+		if trailing, ok := strings.CutPrefix(line, ":"); ok {
+			message.Params = append(message.Params, trailing)
+			break
+		}
+		var param string
+		param, line, _ = strings.Cut(line, " ")
+		message.Params = append(message.Params, param)
+	}
+	if len(message.Params) == 0 {
+		return message, false
+	}
+	message.Command, message.Params = strings.ToUpper(message.Params[0]), message.Params[1:]
+	return message, true
+}
+
+// Characters that would end an IRC line early - params hold topics, reasons and federated authors, which
+// mustn't be able to smuggle in lines of their own
+var ircLineBreaks = strings.NewReplacer("\r", "", "\n", "", "\x00", "")
+
+// Format the message as a line, without the line ending - line breaks and NULs in the prefix and params are stripped
+func (m IrcMessage) String() string {
+	var line strings.Builder
+	if m.Prefix != "" {
+		line.WriteString(":" + ircLineBreaks.Replace(m.Prefix) + " ")
+	}
+	line.WriteString(m.Command)
+	for i, param := range m.Params {
+		param = ircLineBreaks.Replace(param)
+		if i == len(m.Params)-1 && (i > 0 || param == "" || strings.HasPrefix(param, ":") || strings.Contains(param, " ")) {
+			line.WriteString(" :" + param)
+		} else {
+			line.WriteString(" " + param)
+		}
+	}
+	return line.String()
+}
+
+// Nick an identity goes by on IRC - nicks can't hold @, so federated users appear as user|server
+func IrcNick(identity string) string {
+	return strings.ReplaceAll(identity, "@", "|")
+}
+
+// Identity of an IRC nick
+func IrcIdentity(nick string) string {
+	return strings.ReplaceAll(nick, "|", "@")
+}
+
+// Channel of a room and room of a channel
+func IrcChannel(room string) string {
+	return "#" + room
+}
+
+func IrcRoom(channel string) string {
+	return strings.TrimPrefix(channel, "#")
+}
+
+// Prefix of lines from an identity
+func ircPrefix(identity string) string {
+	nick := IrcNick(identity)
+	return nick + "!" + nick + "@" + IrcServerName
+}
+
+// Lines of a chat message, turning /me into a CTCP ACTION
+func ircTextLines(msg []byte) []string {
+	lines := make([]string, 0)
+	for _, line := range strings.Split(strings.ReplaceAll(string(msg), "\r", ""), "\n") {
+		if line == "" {
+			continue
+		}
+		if action, ok := strings.CutPrefix(line, ActionPrefix); ok {
+			line = ircCtcp + "ACTION " + action + ircCtcp
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+// Connection of an IRC client - the JSON-RPC notifications the server writes to it are sent as IRC lines,
+// so IRC clients get the same broadcasts as everyone else
+type ircConn struct {
+	net.Conn
+	nick string
+	mu   sync.Mutex
+}
+
+// Send lines to the client
+func (c *ircConn) send(messages ...IrcMessage) error {
+	var lines bytes.Buffer
+	for _, message := range messages {
+		lines.WriteString(message.String() + "\r\n")
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.Conn.Write(lines.Bytes())
+	return err
+}
+
+// Send a numeric reply to the client
+func (c *ircConn) reply(numeric string, params ...string) error {
+	c.mu.Lock()
+	nick := c.nick
+	c.mu.Unlock()
+	if nick == "" {
+		nick = "*"
+	}
+	return c.send(IrcMessage{Prefix: IrcServerName, Command: numeric, Params: append([]string{nick}, params...)})
+}
+
+// Translate a JSON-RPC notification to IRC lines - nothing is sent before the client has registered
+func (c *ircConn) Write(b []byte) (int, error) {
+	var notification JsonRpcNotification
+	if json.Unmarshal(b, &notification) != nil || notification.Method == "" {
+		return len(b), nil
+	}
+	c.mu.Lock()
+	nick := c.nick
+	c.mu.Unlock()
+	if nick == "" {
+		return len(b), nil
+	}
+	if err := c.send(IrcNotificationLines(nick, notification)...); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// IRC lines of a notification to the client with the nick
+func IrcNotificationLines(nick string, notification JsonRpcNotification) []IrcMessage {
+	messages := make([]IrcMessage, 0)
+	switch notification.Method {
+	case ChatNotificationRpcMethod:
+		var chat ChatMessageNotification
+		if json.Unmarshal(notification.Params, &chat) == nil {
+			for _, line := range ircTextLines(chat.Msg) {
+				messages = append(messages, IrcMessage{Prefix: ircPrefix(chat.Author), Command: "PRIVMSG", Params: []string{IrcChannel(chat.Room), line}})
+			}
+		}
+	case DirectMessageNotificationRpcMethod:
+		var direct DirectMessage
+		if json.Unmarshal(notification.Params, &direct) == nil {
+			for _, line := range ircTextLines(direct.Msg) {
+				messages = append(messages, IrcMessage{Prefix: ircPrefix(direct.From), Command: "PRIVMSG", Params: []string{nick, line}})
+			}
+		}
+	case TopicChangedRpcMethod:
+		var change TopicChange
+		if json.Unmarshal(notification.Params, &change) == nil {
+			messages = append(messages, IrcMessage{Prefix: ircPrefix(change.By), Command: "TOPIC", Params: []string{IrcChannel(change.Room), change.Topic}})
+		}
+	case AnnouncementRpcMethod:
+		var announcement Announcement
+		if json.Unmarshal(notification.Params, &announcement) == nil {
+			messages = append(messages, IrcMessage{Prefix: ircPrefix(announcement.From), Command: "NOTICE", Params: []string{nick, announcement.Msg}})
+		}
+	case ModeratedRpcMethod:
+		var action ModerationAction
+		if json.Unmarshal(notification.Params, &action) == nil {
+			if action.Action == ModerationActionKick {
+				messages = append(messages, IrcMessage{Prefix: ircPrefix(action.Actor), Command: "KICK", Params: []string{IrcChannel(action.Room), nick, action.Reason}})
+			} else {
+				text := action.Actor + " " + action.Action + "s you in " + IrcChannel(action.Room)
+				if action.Reason != "" {
+					text += ": " + action.Reason
+				}
+				messages = append(messages, IrcMessage{Prefix: IrcServerName, Command: "NOTICE", Params: []string{nick, text}})
+			}
+		}
+	case PingRpcMethod:
+		messages = append(messages, IrcMessage{Command: "PING", Params: []string{IrcServerName}})
+	}
+	return messages
+}
+
+// An IRC client's session - its commands are run as JSON-RPC requests on its connection
+type ircSession struct {
+	server     *Server
+	conn       *ircConn
+	connection *Connection
+	nick       string
+	user       string
+	password   string
+}
+
+// Accept IRC clients until the listener is closed
+func (s *Server) ServeIrc(listener net.Listener) {
+	slog.Info("IRC gateway listening", "address", listener.Addr().String())
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.Warn("Error accepting IRC connection", "error", err)
+			continue
+		}
+		go s.HandleIrcConnection(conn)
+	}
+}
+
+// Run an IRC client's connection until it quits or drops
+func (s *Server) HandleIrcConnection(conn net.Conn) {
+	irc := &ircConn{Conn: conn}
+	session := &ircSession{server: s, conn: irc, connection: s.AcceptConnection(irc)}
+	logger := slog.Default().With("connection_id", session.connection.id, "protocol", "irc")
+	logger.Info("IRC client connected", "remote_addr", conn.RemoteAddr().String())
+
+	scanner := bufio.NewScanner(session.connection)
+	scanner.Buffer(make([]byte, IrcMaxLine), IrcMaxLine)
+	for {
+		if s.heartbeatConfig.Interval > 0 {
+			conn.SetReadDeadline(s.heartbeatConfig.ReadDeadline(time.Now()))
+		}
+		if !scanner.Scan() {
+			break
+		}
+		session.connection.Touch()
+		message, ok := ParseIrcMessage(scanner.Text())
+		if !ok {
+			continue
+		}
+		logger.Debug("Read IRC line", "command", message.Command)
+		if !session.handle(message) {
+			break
+		}
+		if s.rateLimiter.ShouldDisconnect(session.connection.id) {
+			logger.Warn("Disconnecting IRC client for exceeding rate limits")
+			irc.send(IrcMessage{Command: "ERROR", Params: []string{"Rate limit exceeded"}})
+			break
+		}
+	}
+	if err := scanner.Err(); err != nil && !errors.Is(err, io.EOF) {
+		logger.Info("Error reading IRC connection", "error", err)
+	}
+	logger.Info("IRC client disconnected")
+	s.CloseConnection(session.connection)
+}
+
+// Run a JSON-RPC method on the session's connection
+func (i *ircSession) call(method string, params any) (json.RawMessage, *JsonRpcError) {
+	paramsJson, _ := json.Marshal(params)
+	request := JsonRpcRequest{Id: "irc", JsonRpc: JsonRpcVersion, Method: method, Params: paramsJson}
+	ctx := ContextWithLogger(ContextWithConnection(context.Background(), i.connection), i.server.requestLogger(i.connection, request))
+
+	var written bytes.Buffer
+	i.server.dispatcher.Dispatch(ctx, request, &written)
+	var response JsonRpcResponse
+	if err := json.Unmarshal(written.Bytes(), &response); err != nil {
+		return nil, &JsonRpcError{Code: -32603, Message: "Internal error"}
+	}
+	return response.Result, response.Error
+}
+
+// Send the numeric reply for a failed request about a target
+func (i *ircSession) replyError(target string, err *JsonRpcError) {
+	switch err.Code {
+	case RoomNotFoundErrorCode:
+		i.conn.reply(ErrNoSuchChannel, target, "No such channel")
+	case NotRoomMemberErrorCode:
+		i.conn.reply(ErrNotOnChannel, target, "You're not on that channel")
+	case UserNotFoundErrorCode, ServerUnreachableErrorCode:
+		i.conn.reply(ErrNoSuchNick, target, "No such nick/channel")
+	case BannedErrorCode:
+		i.conn.reply(ErrBannedFromChan, target, "Cannot join channel (+b)")
+	case MutedErrorCode:
+		i.conn.reply(ErrCannotSendToChan, target, "Cannot send to channel")
+	case PermissionDeniedErrorCode:
+		i.conn.reply(ErrChanOPrivsNeeded, target, "You're not channel operator")
+	default:
+		i.conn.reply(ErrIrcInternalServer, target, err.Message)
+	}
+}
+
+// Check a command has enough params, telling the client when it hasn't
+func (i *ircSession) hasParams(message IrcMessage, count int) bool {
+	if len(message.Params) < count {
+		i.conn.reply(ErrNeedMoreParams, message.Command, "Not enough parameters")
+		return false
+	}
+	return true
+}
+
+// Handle a command from the client, returning false when the connection should close
+func (i *ircSession) handle(message IrcMessage) bool {
+	switch message.Command {
+	case "CAP":
+		if len(message.Params) > 0 && strings.ToUpper(message.Params[0]) == "LS" {
+			i.conn.send(IrcMessage{Prefix: IrcServerName, Command: "CAP", Params: []string{"*", "LS", ""}})
+		}
+		return true
+	case "PASS":
+		if !i.hasParams(message, 1) {
+			return true
+		}
+		if i.conn.nick != "" {
+			i.conn.reply(ErrAlreadyRegistered, "You may not reregister")
+			return true
+		}
+		i.password = message.Params[0]
+		return true
+	case "NICK":
+		i.handleNick(message.Params)
+		return true
+	case "USER":
+		if !i.hasParams(message, 4) {
+			return true
+		}
+		i.user = message.Params[0]
+		i.register()
+		return true
+	case "PING":
+		i.conn.send(IrcMessage{Prefix: IrcServerName, Command: "PONG", Params: append([]string{IrcServerName}, message.Params...)})
+		return true
+	case "PONG":
+		return true
+	case "QUIT":
+		i.conn.send(IrcMessage{Command: "ERROR", Params: []string{"Closing link"}})
+		return false
+	}
+
+	if i.conn.nick == "" {
+		i.conn.reply(ErrNotRegistered, "You have not registered")
+		return true
+	}
+	switch message.Command {
+	case "JOIN":
+		if !i.hasParams(message, 1) {
+			return true
+		}
+		for _, channel := range strings.Split(message.Params[0], ",") {
+			i.join(channel)
+		}
+	case "PART":
+		if !i.hasParams(message, 1) {
+			return true
+		}
+		for _, channel := range strings.Split(message.Params[0], ",") {
+			i.part(channel)
+		}
+	case "PRIVMSG":
+		if !i.hasParams(message, 2) {
+			return true
+		}
+		i.privmsg(message.Params[0], message.Params[1])
+	case "NAMES":
+		channels := make([]string, 0)
+		if len(message.Params) > 0 {
+			channels = strings.Split(message.Params[0], ",")
+		} else {
+			for _, room := range i.server.roomService.RoomsForMember(i.nick) {
+				channels = append(channels, IrcChannel(room))
+			}
+		}
+		for _, channel := range channels {
+			i.names(channel)
+		}
+	case "TOPIC":
+		if !i.hasParams(message, 1) {
+			return true
+		}
+		i.topic(message.Params)
+	default:
+		i.conn.reply(ErrUnknownCommand, message.Command, "Unknown command")
+	}
+	return true
+}
+
+// Pick a nick - it's the user name the connection signs in as once the client has registered
+func (i *ircSession) handleNick(params []string) {
+	if len(params) == 0 || params[0] == "" {
+		i.conn.reply(ErrNoNicknameGiven, "No nickname given")
+		return
+	}
+	if i.conn.nick != "" {
+		i.conn.send(IrcMessage{Prefix: IrcServerName, Command: "NOTICE", Params: []string{i.nick, "Nick changes are not supported"}})
+		return
+	}
+	if !userNamePattern.MatchString(params[0]) {
+		i.conn.reply(ErrErroneusNickname, params[0], "Erroneous nickname")
+		return
+	}
+	i.nick = params[0]
+	i.register()
+}
+
+// Sign in with the PASS password once both NICK and USER were sent, and show the client the rooms it's in
+func (i *ircSession) register() {
+	if i.nick == "" || i.user == "" || i.conn.nick != "" {
+		return
+	}
+	if i.password == "" {
+		i.conn.reply(ErrPasswdMismatch, "Password required - send PASS before NICK")
+		i.nick = ""
+		return
+	}
+	if _, err := i.call(CreateUserRpcMethod, CreateUserParams{Name: i.nick, Password: i.password}); err != nil {
+		switch err.Code {
+		case UserNameTakenErrorCode:
+			i.conn.reply(ErrNicknameInUse, i.nick, "Nickname is already in use")
+		case BadCredentialsErrorCode, -32602:
+			i.conn.reply(ErrPasswdMismatch, "Password incorrect")
+		default:
+			i.conn.reply(ErrErroneusNickname, i.nick, err.Message)
+		}
+		i.nick = ""
+		return
+	}
+
+	i.conn.mu.Lock()
+	i.conn.nick = i.nick
+	i.conn.mu.Unlock()
+	i.conn.reply(RplWelcome, "Welcome to the chat, "+i.nick)
+	i.conn.reply(ErrNoMotd, "MOTD File is missing")
+	for _, room := range i.server.roomService.RoomsForMember(i.nick) {
+		i.joined(room)
+	}
+}
+
+// Join a channel, creating its room when it doesn't exist
+func (i *ircSession) join(channel string) {
+	room := IrcRoom(channel)
+	_, err := i.call(JoinChatRoomRpcMethod, RoomParams{Room: room})
+	if err != nil && err.Code == RoomNotFoundErrorCode {
+		_, err = i.call(CreateChatRoomRpcMethod, RoomParams{Room: room})
+	}
+	if err != nil {
+		i.replyError(channel, err)
+		return
+	}
+	i.joined(room)
+}
+
+// Tell the client it's in a room, with the room's topic and members
+func (i *ircSession) joined(room string) {
+	i.conn.send(IrcMessage{Prefix: ircPrefix(i.nick), Command: "JOIN", Params: []string{IrcChannel(room)}})
+	if topic := i.server.roomService.Topic(room); topic != "" {
+		i.conn.reply(RplTopic, IrcChannel(room), topic)
+	}
+	i.names(IrcChannel(room))
+}
+
+// Leave a channel
+func (i *ircSession) part(channel string) {
+	if _, err := i.call(LeaveChatRoomRpcMethod, RoomParams{Room: IrcRoom(channel)}); err != nil {
+		i.replyError(channel, err)
+		return
+	}
+	i.conn.send(IrcMessage{Prefix: ircPrefix(i.nick), Command: "PART", Params: []string{channel}})
+}
+
+// Send a chat message to a channel, or a direct message to a nick
+func (i *ircSession) privmsg(target string, text string) {
+	if action, ok := strings.CutPrefix(text, ircCtcp+"ACTION "); ok {
+		text = ActionPrefix + strings.TrimSuffix(action, ircCtcp)
+	} else if strings.HasPrefix(text, ircCtcp) {
+		return
+	}
+
+	var err *JsonRpcError
+	if strings.HasPrefix(target, "#") {
+		_, err = i.call(ChatRpcMethod, ChatRequestParams{Room: IrcRoom(target), Msg: []byte(text)})
+	} else {
+		_, err = i.call(DirectMessageRpcMethod, DirectMessageParams{To: IrcIdentity(target), Msg: []byte(text)})
+	}
+	if err != nil {
+		i.replyError(target, err)
+	}
+}
+
+// List the members of a channel - owners and moderators are shown as operators
+func (i *ircSession) names(channel string) {
+	result, err := i.call(ListMembersRpcMethod, RoomParams{Room: IrcRoom(channel)})
+	if err == nil {
+		var members ListMembersResult
+		json.Unmarshal(result, &members)
+		nicks := make([]string, 0, len(members.Members))
+		for _, member := range members.Members {
+			nick := IrcNick(member)
+			if role := i.server.roomService.Role(members.Room, member); role == RoleOwner || role == RoleModerator {
+				nick = "@" + nick
+			}
+			nicks = append(nicks, nick)
+		}
+		i.conn.reply(RplNamReply, "=", channel, strings.Join(nicks, " "))
+	}
+	i.conn.reply(RplEndOfNames, channel, "End of /NAMES list")
+}
+
+// Show the topic of a channel, or set it when a topic is given
+func (i *ircSession) topic(params []string) {
+	channel := params[0]
+	if len(params) > 1 {
+		if _, err := i.call(SetTopicRpcMethod, SetTopicParams{Room: IrcRoom(channel), Topic: params[1]}); err != nil {
+			i.replyError(channel, err)
+		}
+		return
+	}
+	if !i.server.roomService.RoomExists(IrcRoom(channel)) {
+		i.conn.reply(ErrNoSuchChannel, channel, "No such channel")
+	} else if topic := i.server.roomService.Topic(IrcRoom(channel)); topic != "" {
+		i.conn.reply(RplTopic, channel, topic)
+	} else {
+		i.conn.reply(RplNoTopic, channel, "No topic is set")
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// IRC client connected to a server's gateway, closed when the test ends
+func IrcClientFixture(t testing.TB, server *Server) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("failed to listen", err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go server.ServeIrc(listener)
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal("failed to connect", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	return conn, bufio.NewReader(conn)
+}
+
+// IRC client signed in with a nick, past the welcome
+func IrcUserFixture(t testing.TB, server *Server, nick string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, reader := IrcClientFixture(t, server)
+	fmt.Fprintf(conn, "PASS %s\r\nNICK %s\r\nUSER %s 0 * :%s\r\n", PasswordFor(nick), nick, nick, nick)
+	ExpectIrcLine(t, reader, " 001 "+nick+" ")
+	ExpectIrcLine(t, reader, " 366 "+nick+" #"+DefaultRoom+" ")
+	return conn, reader
+}
+
+// Read lines from the client until one contains the text
+func ExpectIrcLine(t testing.TB, reader *bufio.Reader, text string) string {
+	t.Helper()
+	read := make([]string, 0)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatalf("got %s waiting for %q after %q", err, text, read)
+		}
+		if strings.Contains(line, text) {
+			return line
+		}
+		read = append(read, line)
+	}
+}
+
+func TestParseIrcMessage(t *testing.T) {
+	tests := []struct {
+		line string
+		want IrcMessage
+	}{
+		{"NICK alice\r\n", IrcMessage{Command: "NICK", Params: []string{"alice"}}},
+		{"privmsg #general :hello there", IrcMessage{Command: "PRIVMSG", Params: []string{"#general", "hello there"}}},
+		{":alice!a@host JOIN #dev", IrcMessage{Prefix: "alice!a@host", Command: "JOIN", Params: []string{"#dev"}}},
+		{"@time=now TOPIC #dev :", IrcMessage{Command: "TOPIC", Params: []string{"#dev", ""}}},
+		{"USER alice 0 * :Alice A", IrcMessage{Command: "USER", Params: []string{"alice", "0", "*", "Alice A"}}},
+	}
+	for _, test := range tests {
+		got, ok := ParseIrcMessage(test.line)
+		if !ok || got.String() != test.want.String() || len(got.Params) != len(test.want.Params) {
+			t.Errorf("ParseIrcMessage(%q) = %+v, want %+v", test.line, got, test.want)
+		}
+	}
+	if _, ok := ParseIrcMessage("  \r\n"); ok {
+		t.Error("parsed an empty line")
+	}
+	if got := (IrcMessage{Prefix: "chat", Command: "PRIVMSG", Params: []string{"#dev", ":)"}}).String(); got != ":chat PRIVMSG #dev ::)" {
+		t.Errorf("got line %q", got)
+	}
+	injected := IrcMessage{Prefix: "bob|b\r\nQUIT", Command: "TOPIC", Params: []string{"#dev", "new\r\nPRIVMSG #dev :owned\x00"}}
+	if got := injected.String(); got != ":bob|bQUIT TOPIC #dev :newPRIVMSG #dev :owned" {
+		t.Errorf("got line %q", got)
+	}
+}
+
+func TestIrcGateway(t *testing.T) {
+	t.Run("registering signs in and joins the default room", func(t *testing.T) {
+		server := ServerFixture()
+		conn, reader := IrcClientFixture(t, server)
+		fmt.Fprint(conn, "CAP LS 302\r\nPASS secret-password\r\nNICK alice\r\nUSER alice 0 * :Alice\r\n")
+		ExpectIrcLine(t, reader, "CAP * LS")
+		ExpectIrcLine(t, reader, " 001 alice ")
+		ExpectIrcLine(t, reader, ":alice!alice@chat JOIN #"+DefaultRoom)
+		ExpectIrcLine(t, reader, " 353 alice = #"+DefaultRoom+" :alice")
+		if !server.Online("alice") || !server.roomService.IsMember(DefaultRoom, "alice") {
+			t.Error("the IRC user isn't signed in")
+		}
+	})
+
+	t.Run("IRC and JSON-RPC users see each other's messages", func(t *testing.T) {
+		server := ServerFixture()
+		conn, reader := IrcUserFixture(t, server, "alice")
+		bob, bobConn := AddFakeConnection(t, server, "bob")
+
+		fmt.Fprintf(conn, "PRIVMSG #%s :hi bob\r\nPRIVMSG #%s :\x01ACTION waves\x01\r\nPING :x\r\n", DefaultRoom, DefaultRoom)
+		ExpectIrcLine(t, reader, "PONG chat :x")
+		AssertNumberOfConnections(t, CountNotifications(bobConn, ChatNotificationRpcMethod), 2)
+		if messages := RoomMessages(t, server, DefaultRoom); string(messages[1].Msg) != ActionPrefix+"waves" {
+			t.Errorf("got messages %+v", messages)
+		}
+
+		AssertSuccess(t, CallMethod(t, server, bob, ChatRpcMethod, ChatRequestParams{Msg: []byte("hi alice\n/me waves back")}))
+		ExpectIrcLine(t, reader, ":bob!bob@chat PRIVMSG #"+DefaultRoom+" :hi alice")
+		ExpectIrcLine(t, reader, ":bob!bob@chat PRIVMSG #"+DefaultRoom+" :\x01ACTION waves back\x01")
+
+		AssertSuccess(t, CallMethod(t, server, bob, DirectMessageRpcMethod, DirectMessageParams{To: "alice", Msg: []byte("psst")}))
+		ExpectIrcLine(t, reader, ":bob!bob@chat PRIVMSG alice :psst")
+		fmt.Fprint(conn, "PRIVMSG bob :yes?\r\nPRIVMSG nobody :hello\r\n")
+		ExpectIrcLine(t, reader, " 401 alice nobody ")
+		AssertNumberOfConnections(t, CountNotifications(bobConn, DirectMessageNotificationRpcMethod), 1)
+	})
+
+	t.Run("a nick needs its password", func(t *testing.T) {
+		server := ServerFixture()
+		AddFakeConnection(t, server, "alice")
+		conn, reader := IrcClientFixture(t, server)
+		fmt.Fprint(conn, "JOIN #dev\r\nNICK alice\r\nUSER alice 0 * :Alice\r\n")
+		ExpectIrcLine(t, reader, " 451 * ")
+		ExpectIrcLine(t, reader, " 464 * ")
+		fmt.Fprint(conn, "PASS wrong-password\r\nNICK alice\r\nNICK not@valid\r\n")
+		ExpectIrcLine(t, reader, " 464 * ")
+		ExpectIrcLine(t, reader, " 432 * not@valid ")
+		fmt.Fprint(conn, "NICK alice2\r\n")
+		ExpectIrcLine(t, reader, " 001 alice2 ")
+		fmt.Fprint(conn, "PASS other-password\r\n")
+		ExpectIrcLine(t, reader, " 462 alice2 ")
+	})
+
+	t.Run("channels map to rooms", func(t *testing.T) {
+		server := ServerFixture()
+		conn, reader := IrcUserFixture(t, server, "alice")
+		bob, bobConn := AddFakeConnection(t, server, "bob")
+
+		fmt.Fprint(conn, "JOIN #dev\r\n")
+		ExpectIrcLine(t, reader, ":alice!alice@chat JOIN #dev")
+		ExpectIrcLine(t, reader, " 353 alice = #dev :@alice")
+		AssertSuccess(t, CallMethod(t, server, bob, JoinChatRoomRpcMethod, RoomParams{Room: "dev"}))
+
+		fmt.Fprint(conn, "TOPIC #dev :builds\r\n")
+		ExpectIrcLine(t, reader, ":alice!alice@chat TOPIC #dev :builds")
+		AssertEventually(t, "bob to see the topic", func() bool { return CountNotifications(bobConn, TopicChangedRpcMethod) == 1 })
+		fmt.Fprint(conn, "TOPIC #dev\r\nNAMES #dev\r\n")
+		ExpectIrcLine(t, reader, " 332 alice #dev :builds")
+		ExpectIrcLine(t, reader, " 353 alice = #dev :@alice bob")
+
+		fmt.Fprint(conn, "PART #dev\r\nPRIVMSG #dev :still here?\r\nFROB\r\n")
+		ExpectIrcLine(t, reader, ":alice!alice@chat PART #dev")
+		ExpectIrcLine(t, reader, " 442 alice #dev ")
+		ExpectIrcLine(t, reader, " 421 alice FROB ")
+		if server.roomService.IsMember("dev", "alice") {
+			t.Error("alice is still in the room after leaving the channel")
+		}
+	})
+
+	t.Run("quitting closes the connection", func(t *testing.T) {
+		server := ServerFixture()
+		conn, reader := IrcUserFixture(t, server, "alice")
+		fmt.Fprint(conn, "QUIT :bye\r\n")
+		ExpectIrcLine(t, reader, "ERROR")
+		AssertEventually(t, "the user to go offline", func() bool { return !server.Online("alice") })
+	})
+}
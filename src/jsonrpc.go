@@ -1,12 +1,20 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"log/slog"
+	"sort"
+	"sync"
+	"time"
 )
 
+const DefaultRoom = "general"
+
 const (
 	JsonRpcVersion            = "2.0"
 	ChatRpcMethod             = "chat"
@@ -16,6 +24,117 @@ const (
 	JoinChatRoomRpcMethod     = "joinChatRoom"
 	LeaveChatRoomRpcMethod    = "leaveChatRoom"
 	ChatNotificationRpcMethod = "chatNotification"
+	GetThreadRpcMethod        = "getThread"
+	ThreadUpdatedRpcMethod    = "threadUpdated"
+	SearchMessagesRpcMethod   = "searchMessages"
+	GetMentionsRpcMethod      = "getMentions"
+	ClearMentionsRpcMethod    = "clearMentions"
+	MentionedRpcMethod        = "mentioned"
+	MarkReadRpcMethod         = "markRead"
+	ListRoomsRpcMethod        = "listRooms"
+	ListMembersRpcMethod      = "listMembers"
+	ReadReceiptRpcMethod      = "readReceipt"
+	KickUserRpcMethod         = "kickUser"
+	BanUserRpcMethod          = "banUser"
+	UnbanUserRpcMethod        = "unbanUser"
+	MuteUserRpcMethod         = "muteUser"
+	UnmuteUserRpcMethod       = "unmuteUser"
+	SetRoleRpcMethod          = "setRole"
+	GetModerationLogRpcMethod = "getModerationLog"
+	ModeratedRpcMethod        = "moderated"
+	DiscoverRpcMethod         = "rpc.discover"
+	PingRpcMethod             = "ping"
+	PongRpcMethod             = "pong"
+	AnnouncementRpcMethod     = "announcement"
+	ClientInfoRpcMethod       = "client.info"
+	InitializeRpcMethod       = "initialize"
+	GetHistoryRpcMethod       = "getHistory"
+	SetTopicRpcMethod         = "setTopic"
+	TopicChangedRpcMethod     = "topicChanged"
+)
+
+// Direct messages go straight to the recipient's connections instead of through a room
+const (
+	DirectMessageRpcMethod             = "directMessage"
+	DirectMessageNotificationRpcMethod = "directMessageNotification"
+)
+
+// Webhooks POST a room's events to URLs outside the chat
+const (
+	AddWebhookRpcMethod            = "addWebhook"
+	RemoveWebhookRpcMethod         = "removeWebhook"
+	ListWebhooksRpcMethod          = "listWebhooks"
+	GetWebhookDeadLettersRpcMethod = "getWebhookDeadLetters"
+)
+
+// Room events a webhook can subscribe to
+const (
+	WebhookEventMessage    = "message"
+	WebhookEventJoin       = "join"
+	WebhookEventLeave      = "leave"
+	WebhookEventModeration = "moderation"
+)
+
+// Prefix of a chat message sent with /me, which clients show as an action by its author
+const ActionPrefix = "/me "
+
+// Protocol version spoken by this build - peers agree on a version with the same major version
+const ProtocolVersion = "1.0"
+
+// Optional protocol features a client and server can negotiate when the connection starts
+const (
+	FeatureBatching    = "batching"
+	FeatureCompression = "compression"
+	FeatureBinary      = "binary"
+	FeatureThreads     = "threads"
+)
+
+const (
+	MessageNotFoundErrorCode      = -32001
+	RoomNotFoundErrorCode         = -32002
+	NotRoomMemberErrorCode        = -32003
+	RoomExistsErrorCode           = -32004
+	UserNameTakenErrorCode        = -32005
+	PermissionDeniedErrorCode     = -32006
+	NotSignedInErrorCode          = -32007
+	BannedErrorCode               = -32008
+	MutedErrorCode                = -32009
+	RateLimitedErrorCode          = -32010
+	ConnectionNotFoundErrorCode   = -32011
+	ClientTimeoutErrorCode        = -32012
+	UnsupportedVersionErrorCode   = -32013
+	FeatureNotNegotiatedErrorCode = -32014
+	UserNotFoundErrorCode         = -32015
+	ServerUnreachableErrorCode    = -32016
+	WebhookNotFoundErrorCode      = -32017
+	BadCredentialsErrorCode       = -32018
+	BadAdminTokenErrorCode        = -32019
+)
+
+// Admin methods share a namespace that only server admins can call
+const (
+	AdminNamespace                = "admin."
+	AdminAuthenticateRpcMethod    = "admin.authenticate"
+	AdminListConnectionsRpcMethod = "admin.listConnections"
+	AdminDisconnectRpcMethod      = "admin.disconnect"
+	AdminAnnounceRpcMethod        = "admin.announce"
+	AdminReloadConfigRpcMethod    = "admin.reloadConfig"
+	AdminDumpRoomsRpcMethod       = "admin.dumpRooms"
+	AdminClientInfoRpcMethod      = "admin.clientInfo"
+	AdminFederationLinksRpcMethod = "admin.federationLinks"
+)
+
+const (
+	RoleOwner     = "owner"
+	RoleModerator = "moderator"
+	RoleMember    = "member"
+	RoleReadOnly  = "read-only"
+)
+
+const (
+	MentionKindUser = "user"
+	MentionKindRoom = "room"
+	MentionKindHere = "here"
 )
 
 type JsonRpcRequest struct {
@@ -71,50 +190,611 @@ func (e *JsonRpcError) String() string {
 	return fmt.Sprintf("JsonRpcError(Code=%d, Message=%s", e.Code, e.Message)
 }
 
+// A JSON-RPC error can be returned by typed handlers as it is
+func (e *JsonRpcError) Error() string {
+	return e.String()
+}
+
+// A param that failed to decode or validate
+type FieldError struct {
+	Field   string `json:"field,omitempty"`
+	Message string `json:"message"`
+}
+
+// Data of an Invalid params error
+type InvalidParamsErrorData struct {
+	Fields []FieldError `json:"fields"`
+}
+
 type ChatRequestParams struct {
-	Msg []byte `json:"msg"`
+	Msg      []byte `json:"msg" validate:"required"`
+	Room     string `json:"room,omitempty"`
+	ParentId string `json:"parentId,omitempty"`
 }
 
 type SuccessResult struct {
 	Success bool `json:"success"`
 }
 
+// Result of sending a message - Room is the room it was posted in, which for a reply is the room of its thread
+type ChatResult struct {
+	Success   bool   `json:"success"`
+	MessageId string `json:"messageId"`
+	Room      string `json:"room,omitempty"`
+}
+
 type ChatMessageNotification struct {
-	Msg []byte `json:"msg"`
+	Id        string    `json:"id"`
+	Room      string    `json:"room"`
+	Author    string    `json:"author"`
+	ParentId  string    `json:"parentId,omitempty"`
+	Msg       []byte    `json:"msg"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// A chat message - replies carry the id of the thread root in ParentId
+type Message struct {
+	Id        string    `json:"id"`
+	Room      string    `json:"room"`
+	Author    string    `json:"author"`
+	ParentId  string    `json:"parentId,omitempty"`
+	Msg       []byte    `json:"msg"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Summary of the replies to a root message
+type Thread struct {
+	RootId      string    `json:"rootId"`
+	ReplyCount  int       `json:"replyCount"`
+	LastReplyAt time.Time `json:"lastReplyAt"`
+}
+
+type GetThreadParams struct {
+	RootId string `json:"rootId" validate:"required"`
+	Cursor string `json:"cursor,omitempty"`
+	Limit  int    `json:"limit,omitempty" validate:"min=0"`
+}
+
+type GetThreadResult struct {
+	Thread     Thread     `json:"thread"`
+	Root       *Message   `json:"root"`
+	Replies    []*Message `json:"replies"`
+	NextCursor string     `json:"nextCursor,omitempty"`
+}
+
+type SearchMessagesParams struct {
+	Query  string     `json:"query" validate:"required"`
+	Room   string     `json:"room,omitempty"`
+	Author string     `json:"author,omitempty"`
+	From   *time.Time `json:"from,omitempty"`
+	To     *time.Time `json:"to,omitempty"`
+	Cursor string     `json:"cursor,omitempty"`
+	Limit  int        `json:"limit,omitempty" validate:"min=0"`
+}
+
+// A search match - matched terms are wrapped in ** in the snippet
+type SearchHit struct {
+	Message *Message `json:"message"`
+	Score   float64  `json:"score"`
+	Snippet string   `json:"snippet"`
+}
+
+type SearchMessagesResult struct {
+	Hits       []SearchHit `json:"hits"`
+	Total      int         `json:"total"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+}
+
+type CreateUserParams struct {
+	Name     string `json:"name" validate:"required"`
+	Password string `json:"password" validate:"required,min=8,max=256"`
+}
+
+type RoomParams struct {
+	Room string `json:"room" validate:"required"`
+}
+
+// Get a page of a room's messages, going back from the message id given as the Before cursor
+type GetHistoryParams struct {
+	Room   string `json:"room" validate:"required"`
+	Before string `json:"before,omitempty"`
+	Limit  int    `json:"limit,omitempty" validate:"min=0"`
+}
+
+// A page of a room's messages, oldest first - NextCursor is the Before cursor of the page before it
+type GetHistoryResult struct {
+	Room       string     `json:"room"`
+	Messages   []*Message `json:"messages"`
+	NextCursor string     `json:"nextCursor,omitempty"`
+}
+
+type SetTopicParams struct {
+	Room  string `json:"room" validate:"required"`
+	Topic string `json:"topic" validate:"max=256"`
+}
+
+type TopicChange struct {
+	Room  string    `json:"room"`
+	Topic string    `json:"topic"`
+	By    string    `json:"by"`
+	Time  time.Time `json:"time"`
+}
+
+type DirectMessageParams struct {
+	To  string `json:"to" validate:"required"`
+	Msg []byte `json:"msg" validate:"required"`
+}
+
+// A private message between two users - direct messages aren't kept by the server
+type DirectMessage struct {
+	Id        string    `json:"id"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	Msg       []byte    `json:"msg"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// A mention of a user in a chat message - Kind is how the user was mentioned (user, room or here)
+type Mention struct {
+	MessageId string    `json:"messageId"`
+	Room      string    `json:"room"`
+	Author    string    `json:"author"`
+	Kind      string    `json:"kind"`
+	Msg       []byte    `json:"msg"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+type GetMentionsResult struct {
+	Mentions []Mention `json:"mentions"`
+}
+
+// Clear the listed unread mentions, or all of them when no message ids are given
+type ClearMentionsParams struct {
+	MessageIds []string `json:"messageIds,omitempty"`
+}
+
+type ClearMentionsResult struct {
+	Cleared int `json:"cleared"`
+}
+
+type MarkReadParams struct {
+	Room      string `json:"room" validate:"required"`
+	MessageId string `json:"messageId" validate:"required"`
+}
+
+// The last message a user has read in a room
+type ReadReceipt struct {
+	Room      string    `json:"room"`
+	User      string    `json:"user"`
+	MessageId string    `json:"messageId"`
+	ReadAt    time.Time `json:"readAt"`
+}
+
+type RoomSummary struct {
+	Name       string `json:"name"`
+	Members    int    `json:"members"`
+	Joined     bool   `json:"joined"`
+	Unread     int    `json:"unread"`
+	LastReadId string `json:"lastReadId,omitempty"`
+	Topic      string `json:"topic,omitempty"`
+}
+
+type ListRoomsResult struct {
+	Rooms []RoomSummary `json:"rooms"`
+}
+
+type ListMembersResult struct {
+	Room    string   `json:"room"`
+	Members []string `json:"members"`
+}
+
+// Params for the moderation methods - Duration is in seconds and is optional for bans
+type ModerationParams struct {
+	Room     string `json:"room" validate:"required"`
+	User     string `json:"user,omitempty"`
+	IP       string `json:"ip,omitempty"`
+	Role     string `json:"role,omitempty" validate:"oneof=read-only member moderator"`
+	Duration int    `json:"duration,omitempty" validate:"min=0"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// A moderation action, sent to its target and recorded in the audit log
+type ModerationAction struct {
+	Time      time.Time  `json:"time"`
+	Room      string     `json:"room"`
+	Actor     string     `json:"actor"`
+	Action    string     `json:"action"`
+	Target    string     `json:"target"`
+	Role      string     `json:"role,omitempty"`
+	Reason    string     `json:"reason,omitempty"`
+	ExpiresAt *time.Time `json:"expiresAt,omitempty"`
+}
+
+type GetModerationLogResult struct {
+	Actions []ModerationAction `json:"actions"`
+}
+
+// Subscribe a URL to a room's events - all of them when no events are given. A secret is made up when none is given
+type AddWebhookParams struct {
+	Room   string   `json:"room" validate:"required"`
+	URL    string   `json:"url" validate:"required"`
+	Events []string `json:"events,omitempty"`
+	Secret string   `json:"secret,omitempty"`
+}
+
+type WebhookParams struct {
+	Room string `json:"room" validate:"required"`
+	Id   string `json:"id" validate:"required"`
+}
+
+// A URL subscribed to a room's events - payloads are signed with the secret, which is only shown when the webhook is added
+type Webhook struct {
+	Id        string    `json:"id"`
+	Room      string    `json:"room"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedBy string    `json:"createdBy"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type ListWebhooksResult struct {
+	Webhooks []Webhook `json:"webhooks"`
+}
+
+// A chat message as webhooks send it, with its text instead of its bytes
+type WebhookMessage struct {
+	Id        string    `json:"id"`
+	Author    string    `json:"author"`
+	ParentId  string    `json:"parentId,omitempty"`
+	Text      string    `json:"text"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Body a webhook POSTs - the field of the event's kind is set
+type WebhookPayload struct {
+	Id         string            `json:"id"`
+	Event      string            `json:"event"`
+	Room       string            `json:"room"`
+	Time       time.Time         `json:"time"`
+	Message    *WebhookMessage   `json:"message,omitempty"`
+	Member     string            `json:"member,omitempty"`
+	Moderation *ModerationAction `json:"moderation,omitempty"`
+}
+
+// A payload a webhook gave up delivering
+type WebhookDeadLetter struct {
+	Webhook  string         `json:"webhook"`
+	URL      string         `json:"url"`
+	Payload  WebhookPayload `json:"payload"`
+	Attempts int            `json:"attempts"`
+	Error    string         `json:"error"`
+	Time     time.Time      `json:"time"`
+}
+
+type GetWebhookDeadLettersResult struct {
+	DeadLetters []WebhookDeadLetter `json:"deadLetters"`
+}
+
+// Error data of rate limited requests - the request can be retried after RetryAfterMs milliseconds
+type RateLimitedErrorData struct {
+	Method       string `json:"method"`
+	RetryAfterMs int64  `json:"retryAfterMs"`
+}
+
+// Heartbeat sent by the server in a ping notification and echoed back by the client in a pong request
+type Heartbeat struct {
+	Time time.Time `json:"time"`
+}
+
+// A connection as seen by server admins
+type ConnectionInfo struct {
+	Id          string    `json:"id"`
+	RemoteAddr  string    `json:"remoteAddr"`
+	User        string    `json:"user,omitempty"`
+	ConnectedAt time.Time `json:"connectedAt"`
+	BytesIn     int64     `json:"bytesIn"`
+	BytesOut    int64     `json:"bytesOut"`
+}
+
+type ListConnectionsResult struct {
+	Connections []ConnectionInfo `json:"connections"`
+}
+
+type AdminAuthenticateParams struct {
+	Token string `json:"token" validate:"required"`
+}
+
+type DisconnectParams struct {
+	ConnectionId string `json:"connectionId" validate:"required"`
+}
+
+type AnnounceParams struct {
+	Msg string `json:"msg" validate:"required"`
+}
+
+// Server-wide announcement sent to every connection
+type Announcement struct {
+	From string    `json:"from"`
+	Msg  string    `json:"msg"`
+	Time time.Time `json:"time"`
+}
+
+// Settings read from the server config file - the data dir, ports, cluster and federation only take effect when the server starts.
+// The IRC gateway is off unless it has a port
+type ServerConfig struct {
+	Admins      []AdminConfig     `json:"admins"`
+	LogLevel    string            `json:"logLevel,omitempty"`
+	DataDir     string            `json:"dataDir,omitempty"`
+	Port        int               `json:"port,omitempty"`
+	MetricsPort int               `json:"metricsPort,omitempty"`
+	IrcPort     int               `json:"ircPort,omitempty"`
+	Cluster     *ClusterConfig    `json:"cluster,omitempty"`
+	Federation  *FederationConfig `json:"federation,omitempty"`
+}
+
+// A server admin and the token they authenticate admin methods with
+type AdminConfig struct {
+	User  string `json:"user"`
+	Token string `json:"token"`
+}
+
+// The applied server config, without the admin tokens, link secrets or key paths
+type ReloadConfigResult struct {
+	Admins     []string                 `json:"admins"`
+	LogLevel   string                   `json:"logLevel,omitempty"`
+	Federation *FederationConfigSummary `json:"federation,omitempty"`
+}
+
+type FederationConfigSummary struct {
+	ServerId string                  `json:"serverId"`
+	Listen   string                  `json:"listen,omitempty"`
+	Links    []FederationLinkSummary `json:"links"`
+}
+
+type FederationLinkSummary struct {
+	ServerId string   `json:"serverId"`
+	Address  string   `json:"address,omitempty"`
+	Rooms    []string `json:"rooms"`
+}
+
+// Settings of federation with other servers - the server id is the part after @ in the addresses of this
+// server's users, and the certificate files turn on TLS for every link
+type FederationConfig struct {
+	ServerId string                 `json:"serverId"`
+	Listen   string                 `json:"listen,omitempty"`
+	CertFile string                 `json:"certFile,omitempty"`
+	KeyFile  string                 `json:"keyFile,omitempty"`
+	CAFile   string                 `json:"caFile,omitempty"`
+	Links    []FederationLinkConfig `json:"links"`
+}
+
+// A link to another server and the rooms bridged with it - the server is dialed when an address is given
+type FederationLinkConfig struct {
+	ServerId string   `json:"serverId"`
+	Address  string   `json:"address,omitempty"`
+	Secret   string   `json:"secret,omitempty"`
+	Rooms    []string `json:"rooms"`
+}
+
+// State of a link to another server
+type FederationLinkState struct {
+	Server    string    `json:"server"`
+	Address   string    `json:"address,omitempty"`
+	Rooms     []string  `json:"rooms"`
+	State     string    `json:"state"`
+	Since     time.Time `json:"since"`
+	LastError string    `json:"lastError,omitempty"`
+	Sent      int       `json:"sent"`
+	Received  int       `json:"received"`
+	Dropped   int       `json:"dropped"`
+}
+
+type FederationLinksResult struct {
+	Server string                `json:"server,omitempty"`
+	Links  []FederationLinkState `json:"links"`
+}
+
+// Settings of a node of a cluster - every node lists the mesh addresses of all the others as its peers and
+// shares the secret the mesh is authenticated with
+type ClusterConfig struct {
+	NodeId string   `json:"nodeId,omitempty"`
+	Listen string   `json:"listen"`
+	Peers  []string `json:"peers"`
+	Secret string   `json:"secret"`
+}
+
+// Full state of a room as seen by server admins
+type RoomState struct {
+	Name      string            `json:"name"`
+	Owner     string            `json:"owner,omitempty"`
+	Topic     string            `json:"topic,omitempty"`
+	Members   []string          `json:"members"`
+	Roles     map[string]string `json:"roles"`
+	CreatedAt time.Time         `json:"createdAt"`
+	Node      string            `json:"node,omitempty"`
 }
 
-// JSON-RPC Handler function type
-type RequestHandler func(request JsonRpcRequest) JsonRpcResponse
+type DumpRoomsResult struct {
+	Rooms []RoomState `json:"rooms"`
+}
+
+type ClientInfoParams struct {
+	ConnectionId string `json:"connectionId" validate:"required"`
+}
+
+// A client's answer to a client.info request from the server - Methods are the methods the server can call on it
+type ClientInfo struct {
+	Name    string   `json:"name"`
+	Version string   `json:"version"`
+	Methods []string `json:"methods"`
+}
+
+// Limits a peer works within - zero means no limit. HeartbeatInterval is in seconds.
+type ProtocolLimits struct {
+	MaxMessageBytes   int `json:"maxMessageBytes,omitempty" validate:"min=0"`
+	MaxPageSize       int `json:"maxPageSize,omitempty" validate:"min=0"`
+	HeartbeatInterval int `json:"heartbeatInterval,omitempty" validate:"min=0"`
+}
+
+// Sent by the client when the connection starts - Features are the features it supports
+type InitializeParams struct {
+	ProtocolVersion string         `json:"protocolVersion" validate:"required"`
+	ClientInfo      ClientInfo     `json:"clientInfo"`
+	Features        []string       `json:"features,omitempty"`
+	Limits          ProtocolLimits `json:"limits"`
+}
+
+type ServerInfo struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+// The negotiated protocol - Features are the features both peers support
+type InitializeResult struct {
+	ProtocolVersion string         `json:"protocolVersion"`
+	ServerInfo      ServerInfo     `json:"serverInfo"`
+	Features        []string       `json:"features"`
+	Limits          ProtocolLimits `json:"limits"`
+}
+
+// Data of an Unsupported protocol version error
+type UnsupportedVersionErrorData struct {
+	Supported []string `json:"supported"`
+}
+
+// Data of a Feature not negotiated error
+type FeatureNotNegotiatedErrorData struct {
+	Feature string `json:"feature"`
+}
+
+// Build a successful JSON-RPC response for the request
+func NewResultResponse(request JsonRpcRequest, result any) JsonRpcResponse {
+	resultJson, err := json.Marshal(result)
+	if err != nil {
+		slog.Error("Failed to serialize json-rpc result", "method", request.Method, "request_id", request.Id, "error", err)
+		return NewErrorResponse(request, -32603, "Internal error")
+	}
+	return JsonRpcResponse{Id: request.Id, JsonRpc: request.JsonRpc, Result: resultJson}
+}
+
+// Build an error JSON-RPC response for the request
+func NewErrorResponse(request JsonRpcRequest, code int, message string) JsonRpcResponse {
+	return JsonRpcResponse{Id: request.Id, JsonRpc: request.JsonRpc, Error: &JsonRpcError{Code: code, Message: message}}
+}
+
+// JSON-RPC Handler function type - the context carries the connection the request arrived on
+type RequestHandler func(ctx context.Context, request JsonRpcRequest) JsonRpcResponse
+
+// Middleware wraps a handler - it can reject a request before it reaches the handler
+type Middleware func(next RequestHandler) RequestHandler
 
 // JSON-RPC Request dispatcher for handling requests
 type JsonRpcDispatcher struct {
-	handlers map[string]RequestHandler
+	handlers      map[string]RequestHandler
+	middlewares   []Middleware
+	methods       map[string]MethodInfo
+	notifications map[string]MethodInfo
+	clientMethods map[string]MethodInfo
+	errorMapper   func(request JsonRpcRequest, err error) JsonRpcResponse
 }
 
-// Register a JSON-RPC Method with an associated handler func
-func (d *JsonRpcDispatcher) AddMethod(method string, handler RequestHandler) {
-	log.Printf("Adding rpc method: [%s]", method)
+// Metadata describing a method or notification - Params and Result are zero values of the
+// types they're serialized from, and nil when there are none. Feature is the protocol feature
+// a client must have negotiated to call the method. Awaits marks methods whose handler waits on
+// another client, which are dispatched off the caller's read loop.
+type MethodInfo struct {
+	Description string
+	Params      any
+	Result      any
+	Errors      []JsonRpcError
+	Feature     string
+	Awaits      bool
+}
+
+type loggerContextKey struct{}
+
+// Attach a request scoped logger to the context
+func ContextWithLogger(ctx context.Context, logger *slog.Logger) context.Context {
+	return context.WithValue(ctx, loggerContextKey{}, logger)
+}
+
+// Get the request scoped logger from the context, or the default logger
+func LoggerFromContext(ctx context.Context) *slog.Logger {
+	if logger, ok := ctx.Value(loggerContextKey{}).(*slog.Logger); ok {
+		return logger
+	}
+	return slog.Default()
+}
+
+// Register a JSON-RPC Method with an associated handler func, optionally described by its metadata
+func (d *JsonRpcDispatcher) AddMethod(method string, handler RequestHandler, info ...MethodInfo) {
+	slog.Debug("Adding rpc method", "method", method)
 	d.handlers[method] = handler
+	if len(info) > 0 {
+		d.methods[method] = info[0]
+	}
+}
+
+// Report whether a handler is registered for the method
+func (d *JsonRpcDispatcher) HasMethod(method string) bool {
+	_, ok := d.handlers[method]
+	return ok
+}
+
+// Report whether the method's handler waits on another client
+func (d *JsonRpcDispatcher) Awaits(method string) bool {
+	return d.methods[method].Awaits
+}
+
+// Describe a notification sent by the server
+func (d *JsonRpcDispatcher) AddNotification(method string, info MethodInfo) {
+	d.notifications[method] = info
+}
+
+// Describe a method the server calls on clients
+func (d *JsonRpcDispatcher) AddClientMethod(method string, info MethodInfo) {
+	d.clientMethods[method] = info
+}
+
+// Add a middleware around every handler - the first middleware added is the outermost
+func (d *JsonRpcDispatcher) Use(middleware Middleware) {
+	d.middlewares = append(d.middlewares, middleware)
 }
 
-// Invoke the handler if it exists
-func (d *JsonRpcDispatcher) invokeHandler(request JsonRpcRequest) JsonRpcResponse {
+// Respond to a request for a method that isn't registered
+func methodNotFound(ctx context.Context, request JsonRpcRequest) JsonRpcResponse {
+	LoggerFromContext(ctx).Warn("RPC Method not supported")
+	rpcError := &JsonRpcError{Code: -32601, Message: "Method not found"}
+	return JsonRpcResponse{JsonRpc: request.JsonRpc, Id: request.Id, Error: rpcError}
+}
+
+// Invoke the handler wrapped in the middlewares - unknown methods still pass through the middlewares
+func (d *JsonRpcDispatcher) invokeHandler(ctx context.Context, request JsonRpcRequest) JsonRpcResponse {
 	handler, ok := d.handlers[request.Method]
 	if !ok {
-		log.Printf("RPC Method not supported [%s]\n", request.Method)
-		rpcError := &JsonRpcError{Code: -32601, Message: "Method not found"}
-		return JsonRpcResponse{JsonRpc: request.JsonRpc, Id: request.Id, Error: rpcError}
+		handler = methodNotFound
+	}
+
+	for i := len(d.middlewares) - 1; i >= 0; i-- {
+		handler = d.middlewares[i](handler)
 	}
-	return handler(request)
+	return handler(ctx, request)
 }
 
-// Main interface for handling a JSON-RPC request and sending the response back to the client
-func (d *JsonRpcDispatcher) Dispatch(request JsonRpcRequest, receiver io.Writer) error {
-	response := d.invokeHandler(request)
+// Receiver that writes responses apart from notifications, e.g. so they skip a queue that drops notifications
+type ResponseWriter interface {
+	WriteResponse(b []byte) (int, error)
+}
+
+// Main interface for handling a JSON-RPC request and sending the response back to the client -
+// receivers with WriteResponse get the response through it
+func (d *JsonRpcDispatcher) Dispatch(ctx context.Context, request JsonRpcRequest, receiver io.Writer) error {
+	response := d.invokeHandler(ctx, request)
 	responseJson, err := json.Marshal(response)
 
 	if err != nil {
-		log.Println("Failed to serialize json-rpc response to JSON")
+		LoggerFromContext(ctx).Error("Failed to serialize json-rpc response to JSON", "error", err)
 		errorResponse := JsonRpcResponse{Id: request.Id, JsonRpc: request.JsonRpc, Error: &JsonRpcError{Code: -32700, Message: "Parse error"}}
 		responseJson, err = json.Marshal(errorResponse)
 		if err != nil {
@@ -122,39 +802,146 @@ func (d *JsonRpcDispatcher) Dispatch(request JsonRpcRequest, receiver io.Writer)
 		}
 	}
 
-	log.Println("Sending json-rpc response")
-	_, err = receiver.Write(responseJson)
+	if responseWriter, ok := receiver.(ResponseWriter); ok {
+		_, err = responseWriter.WriteResponse(responseJson)
+	} else {
+		_, err = receiver.Write(responseJson)
+	}
 	if err != nil {
-		log.Println("Failed to send json-rpc response to client")
+		LoggerFromContext(ctx).Warn("Failed to send json-rpc response to client", "error", err)
 		return err
 	}
 
-	log.Println("Response sent")
+	LoggerFromContext(ctx).Debug("Response sent", "bytes", len(responseJson))
 	return nil
 }
 
-// Send the JSON-RPC Notification to all the receivers
-func (d *JsonRpcDispatcher) SendNotification(notification JsonRpcNotification, receivers []io.Writer) error {
+// Send the JSON-RPC Notification to all the receivers, returning how many receivers it couldn't be written to
+func (d *JsonRpcDispatcher) SendNotification(notification JsonRpcNotification, receivers []io.Writer) (int, error) {
 	notificationJson, err := json.Marshal(notification)
 	if err != nil {
-		log.Println("Failed to seriailize json-rpc notification")
-		return err
+		slog.Error("Failed to serialize json-rpc notification", "method", notification.Method, "error", err)
+		return 0, err
 	}
 
-	log.Printf("Broadcasting notification  to [%d] receivers\n", len(receivers))
+	slog.Debug("Broadcasting notification", "method", notification.Method, "receivers", len(receivers))
+	failed := 0
 	for _, r := range receivers {
 		_, err := r.Write(notificationJson)
 		if err != nil {
-			fmt.Println("Failed to send notification to receiver, moving on")
+			slog.Warn("Failed to send notification to receiver, moving on", "method", notification.Method, "error", err)
+			failed++
 		}
 	}
 
-	return nil
+	return failed, nil
+}
+
+// List the registered methods, sorted by name
+func (d *JsonRpcDispatcher) Methods() []string {
+	methods := make([]string, 0, len(d.handlers))
+	for method := range d.handlers {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	return methods
+}
+
+// Tell a response from a request or notification - responses have no method, and a result or an error
+func IsJsonRpcResponse(message []byte) bool {
+	var envelope struct {
+		Method *string          `json:"method"`
+		Result json.RawMessage  `json:"result"`
+		Error  *json.RawMessage `json:"error"`
+	}
+	if err := json.Unmarshal(message, &envelope); err != nil {
+		return false
+	}
+	return envelope.Method == nil && (envelope.Result != nil || envelope.Error != nil)
+}
+
+var (
+	ErrResponseTimeout = errors.New("timeout waiting for response")
+	ErrPeerClosed      = errors.New("connection closed before the response arrived")
+)
+
+// Requests sent to the other side of a connection that are waiting for their responses - both the
+// client and the server send requests, so both track them. The zero value is ready to use.
+type PendingRequests struct {
+	responses map[string]chan JsonRpcResponse
+	mu        sync.Mutex
+}
+
+// Start waiting for the response to a request - call it before the request is sent so a fast response isn't missed
+func (p *PendingRequests) Add(id string) {
+	p.mu.Lock()
+	if p.responses == nil {
+		p.responses = make(map[string]chan JsonRpcResponse)
+	}
+	p.responses[id] = make(chan JsonRpcResponse, 1)
+	p.mu.Unlock()
+}
+
+// Wait for the response to a request that was added - a response delivered before waiting starts isn't lost
+func (p *PendingRequests) Await(id string, timeout time.Duration) (JsonRpcResponse, error) {
+	p.mu.Lock()
+	ch, ok := p.responses[id]
+	p.mu.Unlock()
+	if !ok {
+		return JsonRpcResponse{}, ErrPeerClosed
+	}
+	defer p.Forget(id)
+
+	select {
+	case response, ok := <-ch:
+		if !ok {
+			return JsonRpcResponse{}, ErrPeerClosed
+		}
+		return response, nil
+	case <-time.After(timeout):
+		return JsonRpcResponse{}, ErrResponseTimeout
+	}
+}
+
+// Deliver a response to the request waiting for it, returning false when no request is waiting for it
+// or it already has its response
+func (p *PendingRequests) Resolve(response JsonRpcResponse) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	ch, ok := p.responses[response.Id]
+	if !ok {
+		return false
+	}
+	select {
+	case ch <- response:
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop waiting for the response to a request
+func (p *PendingRequests) Forget(id string) {
+	p.mu.Lock()
+	delete(p.responses, id)
+	p.mu.Unlock()
+}
+
+// Fail every waiting request with ErrPeerClosed
+func (p *PendingRequests) CloseAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for id, ch := range p.responses {
+		close(ch)
+		delete(p.responses, id)
+	}
 }
 
 // Initialise a new dispatcher
 func NewDispatcher() *JsonRpcDispatcher {
 	handlers := make(map[string]RequestHandler)
-	dispatcher := &JsonRpcDispatcher{handlers: handlers}
+	dispatcher := &JsonRpcDispatcher{handlers: handlers, methods: make(map[string]MethodInfo), notifications: make(map[string]MethodInfo), clientMethods: make(map[string]MethodInfo)}
 	return dispatcher
 }
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	ShortIdLength       = 8
+	ResponseTimeout     = 5 * time.Second
+	HeartbeatTimeout    = 90 * time.Second
+	DialTimeout         = 5 * time.Second
+	ReconnectMinBackoff = time.Second
+	ReconnectMaxBackoff = 30 * time.Second
+	ClientName          = "chat-client"
+	ClientVersion       = "1.0.0"
+)
+
+// Errors the client answers requests with when the server never does - the codes are from the range
+// JSON-RPC leaves to implementations, away from the codes the server uses
+const (
+	MessageTooLargeErrorCode = -32097
+	NotConnectedErrorCode    = -32098
+	ResponseTimeoutErrorCode = -32099
+)
+
+var ErrMessageTooLarge = errors.New("message is larger than the server accepts")
+
+// Protocol features the client supports
+var ClientFeatures = []string{FeatureBinary, FeatureThreads}
+
+// JSON-RPC Client for sending and receiving messages - JSON-RPC is transport agnostic.
+// When an address is set the client reconnects to it if the server goes away. The server can also
+// send requests to the client, which are answered by the handlers registered on its dispatcher.
+type JsonRpcClient struct {
+	transport        io.ReadWriter
+	address          string
+	heartbeatTimeout time.Duration
+	responseTimeout  time.Duration
+	pending          PendingRequests
+	dispatcher       *JsonRpcDispatcher
+	messageIds       map[string]string
+	lastSeen         map[string]string
+	room             string
+	user             string
+	password         string
+	onNotification   func(JsonRpcNotification)
+	onChatMessage    func(*Message)
+	protocol         *InitializeResult
+	closed           chan struct{}
+	mu               sync.Mutex
+}
+
+// Create a client over the transport - it reconnects to the address when the server goes away,
+// unless the address is empty
+func NewJsonRpcClient(transport io.ReadWriter, address string) *JsonRpcClient {
+	client := &JsonRpcClient{
+		transport:        transport,
+		address:          address,
+		heartbeatTimeout: HeartbeatTimeout,
+		responseTimeout:  ResponseTimeout,
+		closed:           make(chan struct{}),
+		dispatcher:       NewDispatcher(),
+		messageIds:       make(map[string]string),
+		lastSeen:         make(map[string]string),
+		room:             DefaultRoom,
+	}
+	AddTypedMethod(client.dispatcher, ClientInfoRpcMethod, client.ClientInfoHandler)
+	return client
+}
+
+// Get the dispatcher for requests sent by the server - handlers are added with AddMethod or AddTypedMethod
+func (c *JsonRpcClient) Dispatcher() *JsonRpcDispatcher {
+	return c.dispatcher
+}
+
+// Describe the client to the server
+func (c *JsonRpcClient) ClientInfoHandler(ctx context.Context, params NoParams) (ClientInfo, error) {
+	return c.clientInfo(), nil
+}
+
+func (c *JsonRpcClient) clientInfo() ClientInfo {
+	return ClientInfo{Name: ClientName, Version: ClientVersion, Methods: c.dispatcher.Methods()}
+}
+
+// Negotiate the protocol version and features with the server. Servers from before the handshake don't
+// know the method, and are assumed to speak the first protocol version with every client feature.
+func (c *JsonRpcClient) Initialize() JsonRpcResponse {
+	params := InitializeParams{ProtocolVersion: ProtocolVersion, ClientInfo: c.clientInfo(), Features: ClientFeatures}
+	response := c.Call(InitializeRpcMethod, params)
+
+	var result InitializeResult
+	switch {
+	case response.Error == nil && json.Unmarshal(response.Result, &result) == nil:
+	case response.Error != nil && response.Error.Code == -32601:
+		result = InitializeResult{ProtocolVersion: ProtocolVersion, Features: ClientFeatures}
+	default:
+		return response
+	}
+
+	c.mu.Lock()
+	c.protocol = &result
+	c.mu.Unlock()
+	log.Printf("Negotiated protocol version [%s] with features %v\n", result.ProtocolVersion, result.Features)
+	return response
+}
+
+// Check whether a feature was negotiated with the server - before initializing, every client feature is assumed
+func (c *JsonRpcClient) HasFeature(feature string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.protocol == nil {
+		return slices.Contains(ClientFeatures, feature)
+	}
+	return slices.Contains(c.protocol.Features, feature)
+}
+
+// Set the handler of the notifications from the server
+func (c *JsonRpcClient) SetNotificationHandler(handler func(JsonRpcNotification)) {
+	c.mu.Lock()
+	c.onNotification = handler
+	c.mu.Unlock()
+}
+
+// Set the function called with every chat message sent or received, for keeping a transcript
+func (c *JsonRpcClient) SetChatObserver(observer func(*Message)) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.onChatMessage = observer
+}
+
+// Pass a chat message to the observer, if there is one
+func (c *JsonRpcClient) observeChatMessage(message *Message) {
+	c.mu.Lock()
+	onChatMessage := c.onChatMessage
+	c.mu.Unlock()
+	if onChatMessage != nil {
+		onChatMessage(message)
+	}
+}
+
+// Get a channel closed when the connection to the server is gone for good - clients without an address
+// to reconnect to close it when the server goes away
+func (c *JsonRpcClient) Closed() <-chan struct{} {
+	return c.closed
+}
+
+// Set how long requests wait for the server's response
+func (c *JsonRpcClient) SetResponseTimeout(timeout time.Duration) {
+	c.responseTimeout = timeout
+}
+
+// Get the transport to the server
+func (c *JsonRpcClient) Transport() io.ReadWriter {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.transport
+}
+
+// Get the room chat messages are sent to
+func (c *JsonRpcClient) CurrentRoom() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.room
+}
+
+// Set the room chat messages are sent to
+func (c *JsonRpcClient) SetCurrentRoom(room string) {
+	c.mu.Lock()
+	c.room = room
+	c.mu.Unlock()
+}
+
+// Shorten a message id so it can be typed by users
+func ShortId(id string) string {
+	if len(id) <= ShortIdLength {
+		return id
+	}
+	return id[:ShortIdLength]
+}
+
+// Remember a message id so it can be referenced by its short id
+func (c *JsonRpcClient) rememberMessageId(id string) {
+	c.mu.Lock()
+	c.messageIds[ShortId(id)] = id
+	c.mu.Unlock()
+}
+
+// Remember the latest message seen in a room so the room can be marked as read
+func (c *JsonRpcClient) rememberLastSeen(room string, id string) {
+	c.mu.Lock()
+	c.lastSeen[room] = id
+	c.mu.Unlock()
+}
+
+// Resolve a short id to the full id of a message seen by this client
+func (c *JsonRpcClient) ResolveMessageId(shortId string) (string, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	id, ok := c.messageIds[shortId]
+	return id, ok
+}
+
+// Build a JSON-RPC request
+func (c *JsonRpcClient) BuildRequest(params []byte, method string) JsonRpcRequest {
+	requestId := uuid.New().String()
+	request := JsonRpcRequest{Id: requestId, JsonRpc: "2.0", Method: method, Params: params}
+	c.pending.Add(requestId)
+	return request
+}
+
+// Largest message the server accepts, as it said when initializing - zero when it didn't say
+func (c *JsonRpcClient) maxMessageBytes() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.protocol == nil {
+		return 0
+	}
+	return c.protocol.Limits.MaxMessageBytes
+}
+
+// Send a JSON-RPC Request - requests larger than the server accepts aren't sent
+func (c *JsonRpcClient) Send(request JsonRpcRequest) error {
+	requestJson, err := json.Marshal(request)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	if limit := c.maxMessageBytes(); limit > 0 && len(requestJson) > limit {
+		log.Printf("Not sending json-rpc request [%s] %s of %d bytes, over the server's limit of %d\n", request.Method, request.Id, len(requestJson), limit)
+		return ErrMessageTooLarge
+	}
+
+	// Only the method and id are logged - params can hold a password
+	log.Printf("Sending json-rpc request [%s] %s\n", request.Method, request.Id)
+	_, err = c.Transport().Write(requestJson)
+
+	if err != nil {
+		log.Printf("Failed to send json rpc request [%s] %s\n", request.Method, request.Id)
+		log.Println(err)
+		return err
+	}
+
+	log.Println("Request successfully sent")
+	return nil
+}
+
+// Send a JSON-RPC Request and read the JSON-RPC Response from the server
+func (c *JsonRpcClient) SendAndRecv(request JsonRpcRequest) JsonRpcResponse {
+	if err := c.Send(request); err != nil {
+		c.pending.Forget(request.Id)
+		if errors.Is(err, ErrMessageTooLarge) {
+			return JsonRpcResponse{JsonRpc: JsonRpcVersion, Id: request.Id, Error: &JsonRpcError{Code: MessageTooLargeErrorCode, Message: "Message too large"}}
+		}
+		return JsonRpcResponse{JsonRpc: JsonRpcVersion, Id: request.Id, Error: &JsonRpcError{Code: NotConnectedErrorCode, Message: "Not connected to server"}}
+	}
+
+	response, err := c.pending.Await(request.Id, c.responseTimeout)
+	if err != nil {
+		log.Printf("Timeout waiting for response to [%s]\n", request.Method)
+		return JsonRpcResponse{JsonRpc: JsonRpcVersion, Id: request.Id, Error: &JsonRpcError{Code: ResponseTimeoutErrorCode, Message: "Timeout waiting for response"}}
+	}
+	return response
+}
+
+// Handle Messages from the server, reconnecting and restoring the session when the server goes away
+func (c *JsonRpcClient) HandleServerMessages() {
+	for {
+		c.readServerMessages(c.Transport())
+		if c.address == "" {
+			close(c.closed)
+			return
+		}
+		c.Reconnect()
+		go c.RestoreSession()
+	}
+}
+
+// Read messages from the transport until the server closes it or stops sending heartbeats
+func (c *JsonRpcClient) readServerMessages(transport io.ReadWriter) {
+	conn, isConn := transport.(net.Conn)
+	decoder := json.NewDecoder(transport)
+	for {
+		if isConn && c.heartbeatTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(c.heartbeatTimeout))
+		}
+
+		var message json.RawMessage
+		if err := decoder.Decode(&message); err != nil {
+			var netErr net.Error
+			switch {
+			case errors.As(err, &netErr) && netErr.Timeout():
+				log.Printf("No heartbeat from server in %s, assuming it's dead\n", c.heartbeatTimeout)
+				return
+			case err == io.EOF || errors.Is(err, io.ErrUnexpectedEOF) || errors.As(err, &netErr):
+				log.Println("Connection closed by server")
+				return
+			}
+			// The decoder can't get past invalid JSON, so drop what it buffered and start again
+			log.Println("Error decoding message:", err)
+			decoder = json.NewDecoder(transport)
+			continue
+		}
+
+		if !IsJsonRpcResponse(message) {
+			var request JsonRpcRequest
+			if err := json.Unmarshal(message, &request); err != nil {
+				log.Println("Error deserializing message", err)
+				continue
+			}
+			if request.Id != "" {
+				// Handle a request from the server - handlers may send requests of their own, so they can't block reading
+				go c.dispatcher.Dispatch(context.Background(), request, transport)
+				continue
+			}
+
+			var notification JsonRpcNotification
+			if err := json.Unmarshal(message, &notification); err != nil {
+				log.Println("Error deserializing notification", err)
+				continue
+			}
+			if notification.Method == PingRpcMethod {
+				var heartbeat Heartbeat
+				json.Unmarshal(notification.Params, &heartbeat)
+				go c.SendPongRequest(heartbeat)
+				continue
+			}
+			if notification.Method == ChatNotificationRpcMethod {
+				var chat ChatMessageNotification
+				if json.Unmarshal(notification.Params, &chat) == nil {
+					c.observeChatMessage(&Message{Id: chat.Id, Room: chat.Room, Author: chat.Author, ParentId: chat.ParentId, Msg: chat.Msg, Timestamp: chat.Timestamp})
+				}
+			}
+			c.mu.Lock()
+			onNotification := c.onNotification
+			c.mu.Unlock()
+			if onNotification != nil {
+				onNotification(notification)
+			}
+		} else {
+			// Handle response
+			var response JsonRpcResponse
+			if err := json.Unmarshal(message, &response); err != nil {
+				log.Println("Error deserializing response", err)
+				continue
+			}
+			if response.Error != nil {
+				log.Printf("Error from server: %s %s\n", response.Error, formatJSON(response.Error.Data))
+			} else {
+				log.Printf("Response from server: %s \n", formatJSON(response.Result))
+			}
+
+			c.pending.Resolve(response)
+		}
+	}
+}
+
+// Reconnect to the server, backing off exponentially while it's unreachable
+func (c *JsonRpcClient) Reconnect() {
+	if closer, ok := c.Transport().(io.Closer); ok {
+		closer.Close()
+	}
+
+	backoff := ReconnectMinBackoff
+	for {
+		log.Printf("Reconnecting to server [%s] in %s\n", c.address, backoff)
+		time.Sleep(backoff)
+
+		conn, err := net.DialTimeout("tcp", c.address, DialTimeout)
+		if err == nil {
+			c.mu.Lock()
+			c.transport = conn
+			c.mu.Unlock()
+			log.Println("Reconnected")
+			return
+		}
+
+		log.Println("Failed to reconnect", err)
+		backoff = min(backoff*2, ReconnectMaxBackoff)
+	}
+}
+
+// Negotiate the protocol again, sign back in and rejoin the current room after reconnecting
+func (c *JsonRpcClient) RestoreSession() {
+	c.mu.Lock()
+	user, password := c.user, c.password
+	c.mu.Unlock()
+
+	c.Initialize()
+	if user != "" {
+		c.SendCreateUserRequest(user, password)
+	}
+	if room := c.CurrentRoom(); room != DefaultRoom {
+		c.JoinRoom(room)
+	}
+}
+
+// Answer a ping from the server so it knows the client is alive - the response isn't waited for
+func (c *JsonRpcClient) SendPongRequest(heartbeat Heartbeat) error {
+	params, _ := json.Marshal(heartbeat)
+	request := c.BuildRequest(params, PongRpcMethod)
+	err := c.Send(request)
+	c.pending.Forget(request.Id)
+	return err
+}
+
+// Send a request to chat
+func (c *JsonRpcClient) SendChatRequest(msg []byte) JsonRpcResponse {
+	return c.SendReplyRequest("", msg)
+}
+
+// Send a chat request replying to the parent message - an empty parentId starts a new thread
+func (c *JsonRpcClient) SendReplyRequest(parentId string, msg []byte) JsonRpcResponse {
+	room := c.CurrentRoom()
+	params, _ := json.Marshal(ChatRequestParams{Msg: msg, Room: room, ParentId: parentId})
+	request := c.BuildRequest(params, ChatRpcMethod)
+	response := c.SendAndRecv(request)
+
+	var result ChatResult
+	if err := json.Unmarshal(response.Result, &result); err == nil && result.MessageId != "" {
+		if result.Room != "" {
+			room = result.Room
+		}
+		c.rememberMessageId(result.MessageId)
+		c.rememberLastSeen(room, result.MessageId)
+		c.observeChatMessage(&Message{Id: result.MessageId, Room: room, Author: c.User(), ParentId: parentId, Msg: msg, Timestamp: time.Now()})
+		log.Printf("Sent message [%s]\n", ShortId(result.MessageId))
+	}
+	return response
+}
+
+// Send a request for a page of a thread's replies
+func (c *JsonRpcClient) SendGetThreadRequest(rootId string, cursor string) JsonRpcResponse {
+	params, _ := json.Marshal(GetThreadParams{RootId: rootId, Cursor: cursor})
+	request := c.BuildRequest(params, GetThreadRpcMethod)
+	return c.SendAndRecv(request)
+}
+
+// Send a request to search the message history
+func (c *JsonRpcClient) SendSearchRequest(params SearchMessagesParams) JsonRpcResponse {
+	paramsJson, _ := json.Marshal(params)
+	request := c.BuildRequest(paramsJson, SearchMessagesRpcMethod)
+	return c.SendAndRecv(request)
+}
+
+// Send a request to sign in as a user - the password is kept to sign back in after reconnecting
+func (c *JsonRpcClient) SendCreateUserRequest(name string, password string) JsonRpcResponse {
+	params, _ := json.Marshal(CreateUserParams{Name: name, Password: password})
+	request := c.BuildRequest(params, CreateUserRpcMethod)
+	response := c.SendAndRecv(request)
+	if response.Error == nil {
+		c.mu.Lock()
+		c.user, c.password = name, password
+		c.mu.Unlock()
+	}
+	return response
+}
+
+// Send a room request (create, delete, join or leave)
+func (c *JsonRpcClient) SendRoomRequest(method string, room string) JsonRpcResponse {
+	params, _ := json.Marshal(RoomParams{Room: room})
+	request := c.BuildRequest(params, method)
+	return c.SendAndRecv(request)
+}
+
+// Join a room and make it the current room
+func (c *JsonRpcClient) JoinRoom(room string) JsonRpcResponse {
+	response := c.SendRoomRequest(JoinChatRoomRpcMethod, room)
+	if response.Error == nil {
+		c.SetCurrentRoom(room)
+	}
+	return response
+}
+
+// Send a request for the signed in user's unread mentions
+func (c *JsonRpcClient) SendGetMentionsRequest() JsonRpcResponse {
+	request := c.BuildRequest(nil, GetMentionsRpcMethod)
+	return c.SendAndRecv(request)
+}
+
+// Mark the current room as read up to the latest message seen in it
+func (c *JsonRpcClient) SendMarkReadRequest() JsonRpcResponse {
+	room := c.CurrentRoom()
+	c.mu.Lock()
+	messageId, ok := c.lastSeen[room]
+	c.mu.Unlock()
+	if !ok {
+		log.Printf("No messages seen in #%s\n", room)
+		return JsonRpcResponse{}
+	}
+
+	params, _ := json.Marshal(MarkReadParams{Room: room, MessageId: messageId})
+	request := c.BuildRequest(params, MarkReadRpcMethod)
+	return c.SendAndRecv(request)
+}
+
+// Send a request to list the rooms with their unread counts
+func (c *JsonRpcClient) SendListRoomsRequest() JsonRpcResponse {
+	request := c.BuildRequest(nil, ListRoomsRpcMethod)
+	return c.SendAndRecv(request)
+}
+
+// Send a request to list the members of a room
+func (c *JsonRpcClient) SendListMembersRequest(room string) JsonRpcResponse {
+	params, _ := json.Marshal(RoomParams{Room: room})
+	request := c.BuildRequest(params, ListMembersRpcMethod)
+	return c.SendAndRecv(request)
+}
+
+// Send a request for a page of a room's messages, remembering their ids
+func (c *JsonRpcClient) SendGetHistoryRequest(room string, before string, limit int) JsonRpcResponse {
+	params, _ := json.Marshal(GetHistoryParams{Room: room, Before: before, Limit: limit})
+	request := c.BuildRequest(params, GetHistoryRpcMethod)
+	response := c.SendAndRecv(request)
+
+	var result GetHistoryResult
+	if err := json.Unmarshal(response.Result, &result); err == nil && len(result.Messages) > 0 {
+		for _, message := range result.Messages {
+			c.rememberMessageId(message.Id)
+		}
+		c.rememberLastSeen(room, result.Messages[len(result.Messages)-1].Id)
+	}
+	return response
+}
+
+// Send a request to set the topic of a room
+func (c *JsonRpcClient) SendSetTopicRequest(room string, topic string) JsonRpcResponse {
+	params, _ := json.Marshal(SetTopicParams{Room: room, Topic: topic})
+	request := c.BuildRequest(params, SetTopicRpcMethod)
+	return c.SendAndRecv(request)
+}
+
+// Send a private message to a user
+func (c *JsonRpcClient) SendDirectMessageRequest(to string, msg []byte) JsonRpcResponse {
+	params, _ := json.Marshal(DirectMessageParams{To: to, Msg: msg})
+	request := c.BuildRequest(params, DirectMessageRpcMethod)
+	return c.SendAndRecv(request)
+}
+
+// Get the user the client is signed in as, or "" when it's anonymous
+func (c *JsonRpcClient) User() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.user
+}
+
+// Send a request for any method, serializing the params
+func (c *JsonRpcClient) Call(method string, params any) JsonRpcResponse {
+	var paramsJson []byte
+	if params != nil {
+		paramsJson, _ = json.Marshal(params)
+	}
+	request := c.BuildRequest(paramsJson, method)
+	return c.SendAndRecv(request)
+}
+
+// Connect to the chat server using a TCP socket
+func TCPConnect(host string, port int) net.Conn {
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	log.Printf("Connecting to server [%s]\n", address)
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		log.Fatalln("Failed to connect to TCP server!", err)
+	}
+	log.Println("Connected")
+	return conn
+}
+
+func formatJSON(v interface{}) string {
+	formatted, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Sprintf("Error formatting JSON: %v", err)
+	}
+	return string(formatted)
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Params of a method that takes none
+type NoParams struct{}
+
+var (
+	noParamsType = reflect.TypeOf(NoParams{})
+	timeType     = reflect.TypeOf(time.Time{})
+)
+
+// A validation rule from a validate struct tag, e.g. `validate:"required,max=64"`
+type validationRule struct {
+	name string
+	arg  string
+}
+
+// Parse the validation rules of a struct field
+func validationRules(field reflect.StructField) []validationRule {
+	tag := field.Tag.Get("validate")
+	if tag == "" {
+		return nil
+	}
+
+	rules := make([]validationRule, 0)
+	for _, rule := range strings.Split(tag, ",") {
+		name, arg, _ := strings.Cut(rule, "=")
+		rules = append(rules, validationRule{name: name, arg: arg})
+	}
+	return rules
+}
+
+// Get the name a struct field is serialized as, or "" when it isn't serialized
+func jsonFieldName(field reflect.StructField) string {
+	name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+	if name == "-" || !field.IsExported() {
+		return ""
+	}
+	if name == "" {
+		return field.Name
+	}
+	return name
+}
+
+// Size of a value compared by min and max rules - the length of strings, slices and maps, otherwise the number itself
+func validationSize(v reflect.Value) (float64, bool) {
+	switch v.Kind() {
+	case reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+		return float64(v.Len()), true
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(v.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(v.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return v.Float(), true
+	}
+	return 0, false
+}
+
+// Check a value against a rule, returning the failure message
+func checkRule(v reflect.Value, rule validationRule) string {
+	switch rule.name {
+	case "required":
+		if v.IsZero() || ((v.Kind() == reflect.Slice || v.Kind() == reflect.Map) && v.Len() == 0) {
+			return "is required"
+		}
+	case "min", "max":
+		limit, err := strconv.ParseFloat(rule.arg, 64)
+		size, ok := validationSize(v)
+		if err != nil || !ok {
+			return ""
+		}
+		if rule.name == "min" && size < limit {
+			return "must be at least " + rule.arg
+		}
+		if rule.name == "max" && size > limit {
+			return "must be at most " + rule.arg
+		}
+	case "oneof":
+		if v.Kind() == reflect.String && v.String() != "" && !slices.Contains(strings.Fields(rule.arg), v.String()) {
+			return "must be one of " + strings.Join(strings.Fields(rule.arg), ", ")
+		}
+	}
+	return ""
+}
+
+// Validate a struct against the validate tags of its fields, and of its nested structs - rules other than
+// required are skipped for fields left empty
+func ValidateParams(params any) []FieldError {
+	return validateValue(reflect.ValueOf(params), "")
+}
+
+func validateValue(v reflect.Value, prefix string) []FieldError {
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	fieldErrors := make([]FieldError, 0)
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := jsonFieldName(field)
+		if name == "" {
+			continue
+		}
+		value := v.Field(i)
+
+		failed := false
+		for _, rule := range validationRules(field) {
+			if rule.name != "required" && value.Kind() == reflect.Pointer {
+				if value.IsNil() {
+					continue
+				}
+				value = value.Elem()
+			}
+			if rule.name != "required" && value.IsZero() {
+				continue
+			}
+			if message := checkRule(value, rule); message != "" {
+				fieldErrors = append(fieldErrors, FieldError{Field: prefix + name, Message: message})
+				failed = true
+				break
+			}
+		}
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Pointer {
+			fieldType = fieldType.Elem()
+		}
+		if !failed && fieldType.Kind() == reflect.Struct && fieldType != timeType {
+			fieldErrors = append(fieldErrors, validateValue(value, prefix+name+".")...)
+		}
+	}
+	return fieldErrors
+}
+
+// Decode params strictly into P - unknown fields are rejected and missing params decode to the zero value
+func DecodeParams[P any](raw []byte) (P, []FieldError) {
+	var params P
+	if len(bytes.TrimSpace(raw)) == 0 || bytes.Equal(bytes.TrimSpace(raw), []byte("null")) {
+		return params, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&params); err != nil {
+		var typeError *json.UnmarshalTypeError
+		switch {
+		case errors.As(err, &typeError):
+			return params, []FieldError{{Field: typeError.Field, Message: "must be " + jsonTypeName(typeError.Type)}}
+		case strings.HasPrefix(err.Error(), "json: unknown field "):
+			field, _ := strconv.Unquote(strings.TrimPrefix(err.Error(), "json: unknown field "))
+			return params, []FieldError{{Field: field, Message: "is not a known field"}}
+		}
+		return params, []FieldError{{Message: err.Error()}}
+	}
+	if decoder.More() {
+		return params, []FieldError{{Message: "unexpected data after params"}}
+	}
+	return params, nil
+}
+
+// Name of the JSON type a Go type is decoded from
+func jsonTypeName(t reflect.Type) string {
+	if t == timeType {
+		return "a date-time string"
+	}
+	switch t.Kind() {
+	case reflect.String:
+		return "a string"
+	case reflect.Bool:
+		return "a boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "an integer"
+	case reflect.Float32, reflect.Float64:
+		return "a number"
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return "a base64 string"
+		}
+		return "an array"
+	case reflect.Map, reflect.Struct:
+		return "an object"
+	}
+	return fmt.Sprintf("a %s", t)
+}
+
+// Invalid params error with the fields that failed to decode or validate - handlers return it for checks tags can't express
+func NewInvalidParamsError(fieldErrors ...FieldError) *JsonRpcError {
+	return &JsonRpcError{Code: -32602, Message: "Invalid params", Data: InvalidParamsErrorData{Fields: fieldErrors}}
+}
+
+// Build an Invalid params response with the fields that failed to decode or validate
+func NewInvalidParamsResponse(request JsonRpcRequest, fieldErrors []FieldError) JsonRpcResponse {
+	return JsonRpcResponse{JsonRpc: request.JsonRpc, Id: request.Id, Error: NewInvalidParamsError(fieldErrors...)}
+}
+
+// Register a typed handler for a method - params are decoded strictly into P and validated, the result
+// is serialized from R, and returned errors are mapped to JSON-RPC errors. The params and result
+// are described by P and R unless the metadata says otherwise.
+func AddTypedMethod[P any, R any](d *JsonRpcDispatcher, method string, handler func(ctx context.Context, params P) (R, error), info ...MethodInfo) {
+	var description MethodInfo
+	if len(info) > 0 {
+		description = info[0]
+	}
+	var params P
+	var result R
+	if description.Params == nil && reflect.TypeOf(params) != noParamsType {
+		description.Params = params
+	}
+	if description.Result == nil {
+		description.Result = result
+	}
+
+	d.AddMethod(method, func(ctx context.Context, request JsonRpcRequest) JsonRpcResponse {
+		params, fieldErrors := DecodeParams[P](request.Params)
+		if len(fieldErrors) == 0 {
+			fieldErrors = ValidateParams(params)
+		}
+		if len(fieldErrors) > 0 {
+			return NewInvalidParamsResponse(request, fieldErrors)
+		}
+
+		result, err := handler(ctx, params)
+		if err != nil {
+			return d.errorResponse(request, err)
+		}
+		return NewResultResponse(request, result)
+	}, description)
+}
+
+// Map an error returned by a typed handler to a JSON-RPC error response - a *JsonRpcError is returned as it is,
+// other errors go through the error mapper
+func (d *JsonRpcDispatcher) errorResponse(request JsonRpcRequest, err error) JsonRpcResponse {
+	var rpcError *JsonRpcError
+	if errors.As(err, &rpcError) {
+		response := *rpcError
+		return JsonRpcResponse{JsonRpc: request.JsonRpc, Id: request.Id, Error: &response}
+	}
+	if d.errorMapper != nil {
+		return d.errorMapper(request, err)
+	}
+	return NewErrorResponse(request, -32603, "Internal error")
+}
+
+// Set how errors returned by typed handlers are mapped to JSON-RPC error responses
+func (d *JsonRpcDispatcher) MapErrors(mapper func(request JsonRpcRequest, err error) JsonRpcResponse) {
+	d.errorMapper = mapper
+}
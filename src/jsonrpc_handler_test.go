@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+type ValidatedParams struct {
+	Name  string       `json:"name" validate:"required,max=8"`
+	Count int          `json:"count,omitempty" validate:"min=1,max=10"`
+	Kind  string       `json:"kind,omitempty" validate:"oneof=a b"`
+	Inner *InnerParams `json:"inner,omitempty"`
+}
+
+type InnerParams struct {
+	Value string `json:"value" validate:"required"`
+}
+
+type ValidatedResult struct {
+	Greeting string `json:"greeting"`
+}
+
+var errFixture = errors.New("fixture error")
+
+// Dispatcher with a typed method that greets by name, or fails for the names error and rpc-error
+func TypedDispatcherFixture() *JsonRpcDispatcher {
+	dispatcher := NewDispatcher()
+	dispatcher.MapErrors(func(request JsonRpcRequest, err error) JsonRpcResponse {
+		if errors.Is(err, errFixture) {
+			return NewErrorResponse(request, -32050, "Fixture error")
+		}
+		return NewErrorResponse(request, -32603, "Internal error")
+	})
+	AddTypedMethod(dispatcher, "greet", func(ctx context.Context, params ValidatedParams) (ValidatedResult, error) {
+		switch params.Name {
+		case "error":
+			return ValidatedResult{}, errFixture
+		case "rpcerror":
+			return ValidatedResult{}, &JsonRpcError{Code: -32051, Message: "Custom", Data: "details"}
+		}
+		return ValidatedResult{Greeting: "hello " + params.Name}, nil
+	}, MethodInfo{Description: "Greet"})
+	AddTypedMethod(dispatcher, "none", func(ctx context.Context, params NoParams) (bool, error) {
+		return true, nil
+	})
+	return dispatcher
+}
+
+// Dispatch raw params to a method and return the response
+func CallRaw(t testing.TB, dispatcher *JsonRpcDispatcher, method string, params string) JsonRpcResponse {
+	t.Helper()
+	request := JsonRpcRequest{Id: "1", JsonRpc: JsonRpcVersion, Method: method, Params: []byte(params)}
+	fakeWriter := &FakeWriter{data: make([]string, 0)}
+	dispatcher.Dispatch(context.Background(), request, fakeWriter)
+
+	var response JsonRpcResponse
+	if err := json.Unmarshal([]byte(fakeWriter.data[0]), &response); err != nil {
+		t.Fatalf("got invalid response [%s]", fakeWriter.data[0])
+	}
+	return response
+}
+
+// Assert that a response is an Invalid params error for exactly the given fields
+func AssertInvalidParams(t testing.TB, response JsonRpcResponse, fields ...string) {
+	t.Helper()
+	AssertErrorCode(t, response, -32602)
+
+	data, _ := json.Marshal(response.Error.Data)
+	var errorData InvalidParamsErrorData
+	json.Unmarshal(data, &errorData)
+	got := make([]string, 0)
+	for _, fieldError := range errorData.Fields {
+		got = append(got, fieldError.Field)
+	}
+	if !reflect.DeepEqual(got, fields) {
+		t.Errorf("got invalid fields %v but want %v", got, fields)
+	}
+}
+
+func TestAddTypedMethod(t *testing.T) {
+	t.Run("valid params are decoded and the result is serialized", func(t *testing.T) {
+		response := CallRaw(t, TypedDispatcherFixture(), "greet", `{"name":"bob","count":2,"inner":{"value":"x"}}`)
+
+		AssertSuccess(t, response)
+		if string(response.Result) != `{"greeting":"hello bob"}` {
+			t.Errorf("got result %s", response.Result)
+		}
+	})
+
+	t.Run("unknown fields are rejected", func(t *testing.T) {
+		response := CallRaw(t, TypedDispatcherFixture(), "greet", `{"name":"bob","extra":1}`)
+		AssertInvalidParams(t, response, "extra")
+	})
+
+	t.Run("fields of the wrong type are rejected", func(t *testing.T) {
+		response := CallRaw(t, TypedDispatcherFixture(), "greet", `{"name":"bob","count":"two"}`)
+		AssertInvalidParams(t, response, "count")
+	})
+
+	t.Run("every failed validation is reported", func(t *testing.T) {
+		response := CallRaw(t, TypedDispatcherFixture(), "greet", `{"count":11,"kind":"c","inner":{}}`)
+		AssertInvalidParams(t, response, "name", "count", "kind", "inner.value")
+	})
+
+	t.Run("missing params fail required fields", func(t *testing.T) {
+		response := CallRaw(t, TypedDispatcherFixture(), "greet", "")
+		AssertInvalidParams(t, response, "name")
+	})
+
+	t.Run("returned errors are mapped", func(t *testing.T) {
+		response := CallRaw(t, TypedDispatcherFixture(), "greet", `{"name":"error"}`)
+		AssertErrorCode(t, response, -32050)
+	})
+
+	t.Run("returned JSON-RPC errors are kept", func(t *testing.T) {
+		response := CallRaw(t, TypedDispatcherFixture(), "greet", `{"name":"rpcerror"}`)
+
+		AssertErrorCode(t, response, -32051)
+		if response.Error.Data != "details" {
+			t.Errorf("got error data %v", response.Error.Data)
+		}
+	})
+
+	t.Run("methods without params accept none", func(t *testing.T) {
+		AssertSuccess(t, CallRaw(t, TypedDispatcherFixture(), "none", ""))
+		AssertInvalidParams(t, CallRaw(t, TypedDispatcherFixture(), "none", `{"x":1}`), "x")
+	})
+
+	t.Run("params and result are described from their types", func(t *testing.T) {
+		dispatcher := TypedDispatcherFixture()
+
+		info := dispatcher.methods["greet"]
+		if _, ok := info.Params.(ValidatedParams); !ok || info.Description != "Greet" {
+			t.Errorf("got greet info %+v", info)
+		}
+		if _, ok := info.Result.(ValidatedResult); !ok {
+			t.Errorf("got greet result %T", info.Result)
+		}
+		if dispatcher.methods["none"].Params != nil {
+			t.Errorf("got params %T for a method without params", dispatcher.methods["none"].Params)
+		}
+	})
+}
+
+func TestValidatedSchema(t *testing.T) {
+	properties := JsonSchema(ValidatedParams{})["properties"].(map[string]any)
+
+	if name := properties["name"].(map[string]any); name["maxLength"] != 8 {
+		t.Errorf("got name schema %v", name)
+	}
+	if count := properties["count"].(map[string]any); count["minimum"] != 1 || count["maximum"] != 10 {
+		t.Errorf("got count schema %v", count)
+	}
+	if kind := properties["kind"].(map[string]any); !reflect.DeepEqual(kind["enum"], []string{"a", "b"}) {
+		t.Errorf("got kind schema %v", kind)
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"io"
 	"testing"
+	"time"
 )
 
 type AddRequestParams struct {
@@ -15,7 +17,7 @@ type AddRequestResult struct {
 	Sum int `json:"sum"`
 }
 
-func AddRequestHandler(request JsonRpcRequest) JsonRpcResponse {
+func AddRequestHandler(ctx context.Context, request JsonRpcRequest) JsonRpcResponse {
 	var params AddRequestParams
 	json.Unmarshal(request.Params, &params)
 	result := AddRequestResult{Sum: params.X + params.Y}
@@ -58,7 +60,7 @@ func TestRpcDispatch(t *testing.T) {
 		params, _ := json.Marshal(AddRequestParams{X: 5, Y: 10})
 		request := JsonRpcRequest{Id: "123", JsonRpc: JsonRpcVersion, Method: "add", Params: params}
 
-		dispatcher.Dispatch(request, &fakeWriter)
+		dispatcher.Dispatch(context.Background(), request, &fakeWriter)
 
 		expectedResponse := `{"jsonrpc":"2.0","result":{"sum":15},"id":"123"}`
 		fakeWriter.AssertMessageReceived(t, expectedResponse)
@@ -69,12 +71,29 @@ func TestRpcDispatch(t *testing.T) {
 		fakeWriter := FakeWriter{data: make([]string, 0)}
 
 		request := JsonRpcRequest{Id: "123", JsonRpc: JsonRpcVersion, Method: "fooBar"}
-		dispatcher.Dispatch(request, &fakeWriter)
+		dispatcher.Dispatch(context.Background(), request, &fakeWriter)
 
 		expectedResponse := `{"jsonrpc":"2.0","error":{"code":-32601,"message":"Method not found"},"id":"123"}`
 		fakeWriter.AssertMessageReceived(t, expectedResponse)
 	})
 
+	t.Run("middleware can reject a request before the handler", func(t *testing.T) {
+		dispatcher := DispatcherFixture()
+		dispatcher.Use(func(next RequestHandler) RequestHandler {
+			return func(ctx context.Context, request JsonRpcRequest) JsonRpcResponse {
+				return NewErrorResponse(request, -32006, "Permission denied")
+			}
+		})
+		fakeWriter := FakeWriter{data: make([]string, 0)}
+		params, _ := json.Marshal(AddRequestParams{X: 5, Y: 10})
+		request := JsonRpcRequest{Id: "123", JsonRpc: JsonRpcVersion, Method: "add", Params: params}
+
+		dispatcher.Dispatch(context.Background(), request, &fakeWriter)
+
+		expectedResponse := `{"jsonrpc":"2.0","error":{"code":-32006,"message":"Permission denied"},"id":"123"}`
+		fakeWriter.AssertMessageReceived(t, expectedResponse)
+	})
+
 	t.Run("notification is broadcasted to all receivers", func(t *testing.T) {
 		dispatcher := DispatcherFixture()
 		fakeWriters := make([]io.Writer, 0)
@@ -94,3 +113,47 @@ func TestRpcDispatch(t *testing.T) {
 
 	})
 }
+
+func TestIsJsonRpcResponse(t *testing.T) {
+	messages := map[string]bool{
+		`{"jsonrpc":"2.0","result":{"sum":15},"id":"1"}`:                      true,
+		`{"jsonrpc":"2.0","error":{"code":-32601,"message":"nope"},"id":"1"}`: true,
+		`{"jsonrpc":"2.0","method":"add","params":null,"id":"1"}`:             false,
+		`{"jsonrpc":"2.0","method":"hello","params":null}`:                    false,
+		`not json`: false,
+	}
+
+	for message, want := range messages {
+		if got := IsJsonRpcResponse([]byte(message)); got != want {
+			t.Errorf("got [%t] for %s but want [%t]", got, message, want)
+		}
+	}
+}
+
+func TestPendingRequests(t *testing.T) {
+	t.Run("a response is delivered to the request waiting for it", func(t *testing.T) {
+		var pending PendingRequests
+		pending.Add("1")
+
+		if !pending.Resolve(JsonRpcResponse{Id: "1", Result: json.RawMessage(`true`)}) {
+			t.Fatal("got response not delivered")
+		}
+		response, err := pending.Await("1", time.Second)
+		if err != nil || string(response.Result) != "true" {
+			t.Errorf("got response %+v and error [%v]", response, err)
+		}
+		if pending.Resolve(JsonRpcResponse{Id: "1"}) {
+			t.Error("got a response delivered after the request stopped waiting")
+		}
+	})
+
+	t.Run("responses nobody is waiting for are dropped", func(t *testing.T) {
+		var pending PendingRequests
+		pending.Add("1")
+		pending.Forget("1")
+
+		if pending.Resolve(JsonRpcResponse{Id: "1"}) || pending.Resolve(JsonRpcResponse{Id: "2"}) {
+			t.Error("got a response delivered to no request")
+		}
+	})
+}
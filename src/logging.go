@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+	RedactedValue = "[REDACTED]"
+)
+
+// Log attribute keys holding message bodies, request params or credentials
+var RedactedLogKeys = map[string]bool{
+	"body":          true,
+	"params":        true,
+	"password":      true,
+	"token":         true,
+	"secret":        true,
+	"authorization": true,
+}
+
+// Logging settings - message bodies and credentials are redacted unless Redact is turned off.
+// Level can be a *slog.LevelVar so the level can be changed while the server runs.
+type LogConfig struct {
+	Level  slog.Leveler
+	Format string
+	Redact bool
+}
+
+// Default logging settings
+func DefaultLogConfig() LogConfig {
+	return LogConfig{Level: slog.LevelInfo, Format: LogFormatText, Redact: true}
+}
+
+// Read the logging settings from CHAT_LOG_LEVEL (debug, info, warn, error), CHAT_LOG_FORMAT (text, json)
+// and CHAT_LOG_REDACT (false to log message bodies and credentials)
+func LogConfigFromEnv() (LogConfig, error) {
+	config := DefaultLogConfig()
+
+	if name := os.Getenv("CHAT_LOG_LEVEL"); name != "" {
+		var level slog.Level
+		if err := level.UnmarshalText([]byte(name)); err != nil {
+			return config, err
+		}
+		config.Level = level
+	}
+	if format := strings.ToLower(os.Getenv("CHAT_LOG_FORMAT")); format != "" {
+		if format != LogFormatText && format != LogFormatJSON {
+			return config, fmt.Errorf("unknown log format [%s]", format)
+		}
+		config.Format = format
+	}
+	if redact := os.Getenv("CHAT_LOG_REDACT"); redact != "" {
+		config.Redact = redact != "false" && redact != "0"
+	}
+
+	return config, nil
+}
+
+// Replace the values of redacted attributes
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if RedactedLogKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, RedactedValue)
+	}
+	return a
+}
+
+// Create a logger writing at the configured level and format
+func NewLogger(w io.Writer, config LogConfig) *slog.Logger {
+	options := &slog.HandlerOptions{Level: config.Level}
+	if config.Redact {
+		options.ReplaceAttr = redactAttr
+	}
+
+	if config.Format == LogFormatJSON {
+		return slog.New(slog.NewJSONHandler(w, options))
+	}
+	return slog.New(slog.NewTextHandler(w, options))
+}
+
+// Logger for a request from a connection, carrying the connection, user, method and request id
+func (s *Server) requestLogger(connection *Connection, request JsonRpcRequest) *slog.Logger {
+	logger := slog.Default().With("connection_id", connection.id, "method", request.Method, "request_id", request.Id)
+	if user, ok := s.userService.UserForConnection(connection.id); ok {
+		logger = logger.With("user", user)
+	}
+	return logger
+}
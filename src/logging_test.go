@@ -0,0 +1,91 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLogger(t *testing.T) {
+	t.Run("message bodies and credentials are redacted by default", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger := NewLogger(&buf, DefaultLogConfig())
+		logger.Info("Received request", "body", "secret plans", "params", `{"msg":"hi"}`, "password", "hunter2", "method", ChatRpcMethod)
+
+		output := buf.String()
+		for _, leaked := range []string{"secret plans", `{"msg":"hi"}`, "hunter2"} {
+			if strings.Contains(output, leaked) {
+				t.Errorf("got [%s] in log output %s", leaked, output)
+			}
+		}
+		if !strings.Contains(output, "method=chat") {
+			t.Errorf("got log output %s without the method", output)
+		}
+	})
+
+	t.Run("redaction can be turned off", func(t *testing.T) {
+		var buf bytes.Buffer
+		config := DefaultLogConfig()
+		config.Redact = false
+		NewLogger(&buf, config).Info("Received request", "body", "hello")
+
+		if !strings.Contains(buf.String(), "body=hello") {
+			t.Errorf("got log output %s without the body", buf.String())
+		}
+	})
+
+	t.Run("json output below the level is dropped", func(t *testing.T) {
+		var buf bytes.Buffer
+		logger := NewLogger(&buf, LogConfig{Level: slog.LevelWarn, Format: LogFormatJSON, Redact: true})
+		logger.Info("dropped")
+		logger.Warn("kept", "connection_id", "1")
+
+		var entry map[string]any
+		if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+			t.Fatalf("got invalid json log output %s", buf.String())
+		}
+		if entry["msg"] != "kept" || entry["connection_id"] != "1" {
+			t.Errorf("got log entry %v", entry)
+		}
+	})
+
+	t.Run("settings are read from the environment", func(t *testing.T) {
+		t.Setenv("CHAT_LOG_LEVEL", "debug")
+		t.Setenv("CHAT_LOG_FORMAT", "JSON")
+		t.Setenv("CHAT_LOG_REDACT", "false")
+
+		config, err := LogConfigFromEnv()
+		AssertErrorNotNil(t, err)
+		want := LogConfig{Level: slog.LevelDebug, Format: LogFormatJSON, Redact: false}
+		if config != want {
+			t.Errorf("got config %+v but want %+v", config, want)
+		}
+
+		t.Setenv("CHAT_LOG_FORMAT", "xml")
+		if _, err := LogConfigFromEnv(); err == nil {
+			t.Error("got no error for an unknown log format")
+		}
+	})
+
+	t.Run("request logger carries the connection, user, method and request id", func(t *testing.T) {
+		var buf bytes.Buffer
+		defaultLogger := slog.Default()
+		slog.SetDefault(NewLogger(&buf, DefaultLogConfig()))
+		defer slog.SetDefault(defaultLogger)
+
+		server := ServerFixture()
+		alice, _ := AddFakeConnection(t, server, "alice")
+		logger := server.requestLogger(alice, JsonRpcRequest{Id: "42", Method: ChatRpcMethod})
+		LoggerFromContext(ContextWithLogger(context.Background(), logger)).Info("handled")
+
+		line := buf.String()[strings.LastIndex(strings.TrimSpace(buf.String()), "\n")+1:]
+		for _, field := range []string{"connection_id=" + alice.id, "user=alice", "method=chat", "request_id=42"} {
+			if !strings.Contains(line, field) {
+				t.Errorf("got log line %s without [%s]", line, field)
+			}
+		}
+	})
+}
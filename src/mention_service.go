@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+)
+
+var mentionPattern = regexp.MustCompile(`(^|[^A-Za-z0-9_.@-])@([A-Za-z0-9_.-]+)`)
+
+// Mentions found in a chat message
+type ParsedMentions struct {
+	Users []string
+	Room  bool
+	Here  bool
+}
+
+// Find the @user, @room and @here mentions in a chat message
+func ParseMentions(text string) ParsedMentions {
+	var parsed ParsedMentions
+	seen := make(map[string]bool)
+
+	for _, match := range mentionPattern.FindAllStringSubmatch(text, -1) {
+		name := strings.TrimRight(match[2], ".-")
+		switch name {
+		case "":
+		case MentionKindRoom:
+			parsed.Room = true
+		case MentionKindHere:
+			parsed.Here = true
+		default:
+			if !seen[name] {
+				seen[name] = true
+				parsed.Users = append(parsed.Users, name)
+			}
+		}
+	}
+
+	return parsed
+}
+
+// Mention Data store Interface - unread mentions are kept per user
+type MentionStore interface {
+	Add(user string, mention Mention)
+	List(user string) []Mention
+	Clear(user string, messageIds []string) int
+}
+
+// Store unread mentions in memory with a map of users to their mentions
+type InMemoryMentionStore struct {
+	mentions map[string][]Mention
+	mu       sync.Mutex
+}
+
+// Create a new in-memory mention store
+func NewMentionStore() *InMemoryMentionStore {
+	mentions := make(map[string][]Mention)
+	return &InMemoryMentionStore{mentions: mentions}
+}
+
+// Add an unread mention for a user
+func (s *InMemoryMentionStore) Add(user string, mention Mention) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.mentions[user] = append(s.mentions[user], mention)
+}
+
+// List a user's unread mentions, oldest first
+func (s *InMemoryMentionStore) List(user string) []Mention {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mentionList := make([]Mention, len(s.mentions[user]))
+	copy(mentionList, s.mentions[user])
+	return mentionList
+}
+
+// Clear the given unread mentions of a user, or all of them when no ids are given
+func (s *InMemoryMentionStore) Clear(user string, messageIds []string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	mentions := s.mentions[user]
+	if len(messageIds) == 0 {
+		delete(s.mentions, user)
+		return len(mentions)
+	}
+
+	clear := make(map[string]bool)
+	for _, id := range messageIds {
+		clear[id] = true
+	}
+
+	remaining := make([]Mention, 0, len(mentions))
+	for _, m := range mentions {
+		if !clear[m.MessageId] {
+			remaining = append(remaining, m)
+		}
+	}
+	s.mentions[user] = remaining
+	return len(mentions) - len(remaining)
+}
+
+// Mention Service for tracking each user's unread mentions
+type MentionService struct {
+	store MentionStore
+}
+
+// Record an unread mention for a user
+func (s *MentionService) AddMention(user string, mention Mention) {
+	s.store.Add(user, mention)
+}
+
+// Get a user's unread mentions
+func (s *MentionService) UnreadMentions(user string) []Mention {
+	return s.store.List(user)
+}
+
+// Clear a user's unread mentions, returning how many were cleared
+func (s *MentionService) ClearMentions(user string, messageIds []string) int {
+	return s.store.Clear(user, messageIds)
+}
+
+// Deliver a mentioned notification to everyone mentioned in a message, wherever they are, and record it as
+// unread for registered users. A direct @user mention takes precedence over @room, which takes precedence over @here.
+func (s *Server) NotifyMentions(message *Message) {
+	parsed := ParseMentions(string(message.Msg))
+	kinds := make(map[string]string)
+
+	if parsed.Here {
+		for _, member := range s.roomService.Members(message.Room) {
+			if s.Online(member) {
+				kinds[member] = MentionKindHere
+			}
+		}
+	}
+	if parsed.Room {
+		for _, member := range s.roomService.Members(message.Room) {
+			kinds[member] = MentionKindRoom
+		}
+	}
+	for _, name := range parsed.Users {
+		if _, ok := s.userService.GetUser(name); ok {
+			kinds[name] = MentionKindUser
+		}
+	}
+	delete(kinds, message.Author)
+
+	for identity, kind := range kinds {
+		mention := Mention{MessageId: message.Id, Room: message.Room, Author: message.Author, Kind: kind, Msg: message.Msg, Timestamp: message.Timestamp}
+		if _, ok := s.userService.GetUser(identity); ok {
+			s.mentionService.AddMention(identity, mention)
+		}
+		s.NotifyIdentity(identity, MentionedRpcMethod, mention)
+	}
+}
+
+// Get the signed in user's unread mentions
+func (s *Server) GetMentionsHandler(ctx context.Context, params NoParams) (GetMentionsResult, error) {
+	connection, ok := ConnectionFromContext(ctx)
+	if !ok {
+		return GetMentionsResult{}, ErrNoConnection
+	}
+	user, ok := s.userService.UserForConnection(connection.id)
+	if !ok {
+		return GetMentionsResult{}, ErrNotSignedIn
+	}
+
+	return GetMentionsResult{Mentions: s.mentionService.UnreadMentions(user)}, nil
+}
+
+// Clear some or all of the signed in user's unread mentions
+func (s *Server) ClearMentionsHandler(ctx context.Context, params ClearMentionsParams) (ClearMentionsResult, error) {
+	connection, ok := ConnectionFromContext(ctx)
+	if !ok {
+		return ClearMentionsResult{}, ErrNoConnection
+	}
+	user, ok := s.userService.UserForConnection(connection.id)
+	if !ok {
+		return ClearMentionsResult{}, ErrNotSignedIn
+	}
+
+	return ClearMentionsResult{Cleared: s.mentionService.ClearMentions(user, params.MessageIds)}, nil
+}
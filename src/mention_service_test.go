@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestParseMentions(t *testing.T) {
+	parsed := ParseMentions("@bob and @carol. cc @bob, @here but not me@example.com or @room!")
+
+	if len(parsed.Users) != 2 || parsed.Users[0] != "bob" || parsed.Users[1] != "carol" {
+		t.Errorf("got users %v but wanted [bob carol]", parsed.Users)
+	}
+	if !parsed.Room || !parsed.Here {
+		t.Errorf("got room [%t] and here [%t] but wanted both", parsed.Room, parsed.Here)
+	}
+}
+
+func TestClearMentions(t *testing.T) {
+	service := &MentionService{store: NewMentionStore()}
+	service.AddMention("bob", Mention{MessageId: "1"})
+	service.AddMention("bob", Mention{MessageId: "2"})
+	service.AddMention("bob", Mention{MessageId: "3"})
+
+	if cleared := service.ClearMentions("bob", []string{"2"}); cleared != 1 {
+		t.Errorf("got [%d] cleared but wanted [1]", cleared)
+	}
+	if cleared := service.ClearMentions("bob", nil); cleared != 2 {
+		t.Errorf("got [%d] cleared but wanted [2]", cleared)
+	}
+	AssertNumberOfConnections(t, len(service.UnreadMentions("bob")), 0)
+}
+
+func TestNotifyMentions(t *testing.T) {
+	t.Run("mentioned user is notified in another room", func(t *testing.T) {
+		server := ServerFixture()
+		alice, _ := AddFakeConnection(t, server, "alice")
+		_, bobConn := AddFakeConnection(t, server, "bob")
+		server.roomService.CreateRoom("ops", "alice")
+
+		message, _ := server.messageService.AddMessage("ops", server.userService.Identity(alice), []byte("ping @bob"), "")
+		server.NotifyMentions(message)
+
+		AssertNumberOfConnections(t, CountNotifications(bobConn, MentionedRpcMethod), 1)
+		mentions := server.mentionService.UnreadMentions("bob")
+		if len(mentions) != 1 || mentions[0].Kind != MentionKindUser {
+			t.Errorf("got unread mentions %v but wanted one user mention", mentions)
+		}
+	})
+
+	t.Run("room mention reaches offline members but not the author", func(t *testing.T) {
+		server := ServerFixture()
+		alice, aliceConn := AddFakeConnection(t, server, "alice")
+		carol, _ := AddFakeConnection(t, server, "carol")
+		server.CloseConnection(carol)
+
+		message, _ := server.messageService.AddMessage(DefaultRoom, server.userService.Identity(alice), []byte("@room standup"), "")
+		server.NotifyMentions(message)
+
+		AssertNumberOfConnections(t, CountNotifications(aliceConn, MentionedRpcMethod), 0)
+		AssertNumberOfConnections(t, len(server.mentionService.UnreadMentions("alice")), 0)
+		AssertNumberOfConnections(t, len(server.mentionService.UnreadMentions("carol")), 1)
+	})
+
+	t.Run("here mention only reaches connected members", func(t *testing.T) {
+		server := ServerFixture()
+		alice, _ := AddFakeConnection(t, server, "alice")
+		_, anonymousConn := AddFakeConnection(t, server, "")
+		carol, _ := AddFakeConnection(t, server, "carol")
+		server.CloseConnection(carol)
+		server.roomService.JoinRoom(DefaultRoom, "carol")
+
+		message, _ := server.messageService.AddMessage(DefaultRoom, server.userService.Identity(alice), []byte("@here lunch"), "")
+		server.NotifyMentions(message)
+
+		AssertNumberOfConnections(t, CountNotifications(anonymousConn, MentionedRpcMethod), 1)
+		AssertNumberOfConnections(t, len(server.mentionService.UnreadMentions("carol")), 0)
+	})
+}
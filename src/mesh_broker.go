@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// Links send a ping this often, and a link that hears nothing for three times as long is dead
+	MeshPingInterval = time.Second
+	MeshDialTimeout  = 2 * time.Second
+	MeshMaxBackoff   = 5 * time.Second
+	// Events queued for a peer before new ones are dropped and the link resyncs
+	MeshQueueCapacity = 1024
+)
+
+// Types of frames sent over mesh connections
+const (
+	meshHello = "hello"
+	meshAuth  = "auth"
+	meshEvent = "event"
+)
+
+var (
+	errMeshBehind   = errors.New("peer fell behind")
+	ErrMeshAuth     = errors.New("cluster authentication failed")
+	ErrNoMeshSecret = errors.New("cluster secret is required")
+)
+
+// A frame of the mesh protocol - newline-delimited JSON, starting with the hello and auth handshake in which
+// both nodes prove they know the cluster secret. Each frame after it carries an event, numbered and signed
+// with a key derived from the secret and both handshake nonces, so events can't be forged, replayed or reordered.
+type meshFrame struct {
+	Type  string          `json:"type"`
+	Node  string          `json:"node,omitempty"`
+	Nonce string          `json:"nonce,omitempty"`
+	Proof string          `json:"proof,omitempty"`
+	Event json.RawMessage `json:"event,omitempty"`
+	Seq   uint64          `json:"seq,omitempty"`
+	Mac   string          `json:"mac,omitempty"`
+}
+
+// MAC of the event a node sent as a numbered frame of a connection
+func meshMac(key []byte, node string, seq uint64, event []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(node + "|"))
+	mac.Write(binary.BigEndian.AppendUint64(nil, seq))
+	mac.Write(event)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Broker connecting the nodes of a cluster over TCP, each node linked to every other. A node sends its
+// events down one outbound connection per peer and receives the peers' events on inbound connections.
+// Connections are authenticated with the cluster secret and their events signed, but not encrypted - keep
+// the mesh on a private network.
+type MeshBroker struct {
+	node     string
+	secret   string
+	local    *LocalBroker
+	listener net.Listener
+	links    []*meshLink
+	// Inbound connections per peer node, so a node is only down once its last connection is gone
+	inbound map[string]int
+	closed  bool
+	mu      sync.Mutex
+}
+
+// Start a mesh node listening for its peers on an address, e.g. ":7946" - every node of the cluster shares the secret
+func ListenMesh(node string, address string, secret string) (*MeshBroker, error) {
+	if secret == "" {
+		return nil, ErrNoMeshSecret
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	b := &MeshBroker{node: node, secret: secret, local: NewLocalBroker(), listener: listener, inbound: make(map[string]int)}
+	go b.accept()
+	slog.Info("Cluster mesh listening", "node", node, "address", listener.Addr().String())
+	return b, nil
+}
+
+// Address the node listens on
+func (b *MeshBroker) Addr() string {
+	return b.listener.Addr().String()
+}
+
+// Link to the peers, keeping each link up until the broker is closed. The snapshot is sent first every
+// time a link connects, so a peer that missed events catches up.
+func (b *MeshBroker) Connect(peers []string, snapshot func() ClusterEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, address := range peers {
+		link := &meshLink{node: b.node, secret: b.secret, address: address, snapshot: snapshot, wake: make(chan struct{}, 1), done: make(chan struct{})}
+		b.links = append(b.links, link)
+		go link.run()
+	}
+}
+
+// Hand an event to the local subscribers and send it to every peer
+func (b *MeshBroker) Publish(event ClusterEvent) {
+	b.local.Publish(event)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, link := range b.links {
+		link.send(event)
+	}
+}
+
+// Add a local subscriber
+func (b *MeshBroker) Subscribe(handler func(event ClusterEvent)) {
+	b.local.Subscribe(handler)
+}
+
+// Stop listening and close every link
+func (b *MeshBroker) Close() error {
+	b.mu.Lock()
+	b.closed = true
+	links := b.links
+	b.mu.Unlock()
+
+	err := b.listener.Close()
+	for _, link := range links {
+		link.close()
+	}
+	b.local.Close()
+	return err
+}
+
+// Accept inbound connections from peers
+func (b *MeshBroker) accept() {
+	for {
+		conn, err := b.listener.Accept()
+		if err != nil {
+			b.mu.Lock()
+			closed := b.closed
+			b.mu.Unlock()
+			if closed {
+				return
+			}
+			slog.Warn("Error accepting cluster connection", "error", err)
+			continue
+		}
+		go b.receive(conn)
+	}
+}
+
+// Authenticate a node that dialed in, returning its name and the key of its event MACs
+func (b *MeshBroker) acceptHandshake(conn net.Conn, decoder *json.Decoder) (string, []byte, error) {
+	conn.SetDeadline(time.Now().Add(MeshDialTimeout))
+	defer conn.SetDeadline(time.Time{})
+	encoder := json.NewEncoder(conn)
+	var hello, auth meshFrame
+	if err := decoder.Decode(&hello); err != nil {
+		return "", nil, err
+	}
+	if hello.Type != meshHello || hello.Node == "" || hello.Node == b.node {
+		return "", nil, fmt.Errorf("%w: bad hello from [%s]", ErrMeshAuth, hello.Node)
+	}
+	nonce := newNonce()
+	if err := encoder.Encode(meshFrame{Type: meshHello, Node: b.node, Nonce: nonce, Proof: proof(b.secret, b.node, hello.Nonce)}); err != nil {
+		return "", nil, err
+	}
+	if err := decoder.Decode(&auth); err != nil {
+		return "", nil, err
+	}
+	if auth.Type != meshAuth || !validProof(b.secret, hello.Node, nonce, auth.Proof) {
+		return "", nil, fmt.Errorf("%w: wrong secret from [%s]", ErrMeshAuth, hello.Node)
+	}
+	return hello.Node, sessionKey(b.secret, hello.Nonce, nonce), nil
+}
+
+// Pass the events of an inbound connection to the local subscribers. A connection speaks for the node it
+// authenticated as - events claiming another node are dropped, and an event with a bad MAC fails the
+// connection. When the last connection from a node drops, the subscribers are told the node is down.
+func (b *MeshBroker) receive(conn net.Conn) {
+	defer conn.Close()
+	decoder := json.NewDecoder(conn)
+	node, key, err := b.acceptHandshake(conn, decoder)
+	if err != nil {
+		slog.Warn("Refused cluster connection", "remote_addr", conn.RemoteAddr().String(), "error", err)
+		return
+	}
+	b.mu.Lock()
+	b.inbound[node]++
+	b.mu.Unlock()
+	slog.Info("Cluster node connected", "node", node, "remote_addr", conn.RemoteAddr().String())
+
+	for seq := uint64(1); ; seq++ {
+		conn.SetReadDeadline(time.Now().Add(3 * MeshPingInterval))
+		var frame meshFrame
+		if err := decoder.Decode(&frame); err != nil {
+			break
+		}
+		if frame.Type != meshEvent || frame.Seq != seq || !hmac.Equal([]byte(frame.Mac), []byte(meshMac(key, node, seq, frame.Event))) {
+			slog.Warn("Dropping cluster connection on a frame with a bad MAC", "node", node, "seq", seq)
+			break
+		}
+		var event ClusterEvent
+		if err := json.Unmarshal(frame.Event, &event); err != nil {
+			break
+		}
+		if event.Node != node {
+			slog.Warn("Dropping cluster event from another node than the connection's", "node", node, "claimed", event.Node, "kind", event.Kind)
+			continue
+		}
+		if event.Kind != EventPing {
+			b.local.Publish(event)
+		}
+	}
+
+	b.mu.Lock()
+	b.inbound[node]--
+	down := b.inbound[node] == 0 && !b.closed
+	if b.inbound[node] == 0 {
+		delete(b.inbound, node)
+	}
+	b.mu.Unlock()
+	if down {
+		slog.Warn("Cluster node down", "node", node)
+		b.local.Publish(ClusterEvent{Kind: EventNodeDown, Node: node})
+	}
+}
+
+// Outbound connection to a peer - events are queued while it's connecting. A full queue drops events
+// and marks the peer behind, which reconnects the link so the snapshot brings the peer up to date.
+type meshLink struct {
+	node     string
+	secret   string
+	address  string
+	snapshot func() ClusterEvent
+	queue    []ClusterEvent
+	behind   bool
+	closed   bool
+	wake     chan struct{}
+	done     chan struct{}
+	mu       sync.Mutex
+}
+
+// Queue an event for the peer
+func (l *meshLink) send(event ClusterEvent) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return
+	}
+	if len(l.queue) >= MeshQueueCapacity {
+		if !l.behind {
+			slog.Warn("Cluster link queue full, dropping events until the peer resyncs", "peer", l.address)
+		}
+		l.behind = true
+	} else {
+		l.queue = append(l.queue, event)
+	}
+	select {
+	case l.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Stop the link
+func (l *meshLink) close() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.closed {
+		l.closed = true
+		close(l.done)
+	}
+}
+
+// Connect to the peer, redialing with backoff, and stream the queued events
+func (l *meshLink) run() {
+	backoff := 100 * time.Millisecond
+	for {
+		conn, err := net.DialTimeout("tcp", l.address, MeshDialTimeout)
+		if err != nil {
+			select {
+			case <-l.done:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, MeshMaxBackoff)
+			continue
+		}
+		backoff = 100 * time.Millisecond
+
+		l.reconnected()
+		err = l.stream(conn)
+		conn.Close()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		slog.Warn("Cluster link lost", "peer", l.address, "error", err)
+	}
+}
+
+// Drop the queued events the snapshot sent on connecting makes stale. The snapshot carries the rooms, users,
+// webhooks and presence, and notifications are stale by now, but it leaves out chat history - queued messages are
+// still sent after it.
+func (l *meshLink) reconnected() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	messages := make([]ClusterEvent, 0)
+	for _, event := range l.queue {
+		if event.Kind == EventMessage {
+			messages = append(messages, event)
+		}
+	}
+	l.queue = messages
+	l.behind = false
+}
+
+// Authenticate to the peer, returning the key of the event MACs
+func (l *meshLink) handshake(conn net.Conn, encoder *json.Encoder) ([]byte, error) {
+	conn.SetDeadline(time.Now().Add(MeshDialTimeout))
+	defer conn.SetDeadline(time.Time{})
+	nonce := newNonce()
+	var hello meshFrame
+	err := encoder.Encode(meshFrame{Type: meshHello, Node: l.node, Nonce: nonce})
+	if err == nil {
+		err = json.NewDecoder(conn).Decode(&hello)
+	}
+	if err == nil && (hello.Type != meshHello || hello.Node == l.node || !validProof(l.secret, hello.Node, nonce, hello.Proof)) {
+		err = fmt.Errorf("%w: wrong secret from [%s]", ErrMeshAuth, hello.Node)
+	}
+	if err == nil {
+		err = encoder.Encode(meshFrame{Type: meshAuth, Proof: proof(l.secret, l.node, hello.Nonce)})
+	}
+	if err != nil {
+		return nil, err
+	}
+	return sessionKey(l.secret, nonce, hello.Nonce), nil
+}
+
+// Authenticate, then send the snapshot and the queued events until the connection fails or the link is closed
+func (l *meshLink) stream(conn net.Conn) error {
+	encoder := json.NewEncoder(conn)
+	key, err := l.handshake(conn, encoder)
+	if err != nil {
+		return err
+	}
+	seq := uint64(0)
+	write := func(event ClusterEvent) error {
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		seq++
+		conn.SetWriteDeadline(time.Now().Add(3 * MeshPingInterval))
+		return encoder.Encode(meshFrame{Type: meshEvent, Event: data, Seq: seq, Mac: meshMac(key, l.node, seq, data)})
+	}
+	if err := write(l.snapshot()); err != nil {
+		return err
+	}
+
+	ping := time.NewTicker(MeshPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-l.done:
+			return net.ErrClosed
+		case <-ping.C:
+			if err := write(ClusterEvent{Kind: EventPing, Node: l.node}); err != nil {
+				return err
+			}
+		case <-l.wake:
+			l.mu.Lock()
+			if l.behind {
+				l.mu.Unlock()
+				return errMeshBehind
+			}
+			events := l.queue
+			l.queue = nil
+			l.mu.Unlock()
+			for _, event := range events {
+				if err := write(event); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
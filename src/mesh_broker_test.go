@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// Secret the mesh nodes of the tests share
+const MeshSecret = "cluster-secret"
+
+// Mesh node on a free loopback port, closed when the test ends
+func MeshFixture(t testing.TB, node string) *MeshBroker {
+	t.Helper()
+	mesh, err := ListenMesh(node, "127.0.0.1:0", MeshSecret)
+	if err != nil {
+		t.Fatal("failed to listen", err)
+	}
+	t.Cleanup(func() { mesh.Close() })
+	return mesh
+}
+
+// Connect to a mesh node as a node and authenticate with a secret, returning the connection and a function
+// sending signed events down it
+func MeshDial(t testing.TB, address string, node string, secret string) (net.Conn, func(event ClusterEvent), error) {
+	t.Helper()
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	encoder := json.NewEncoder(conn)
+	link := &meshLink{node: node, secret: secret}
+	key, err := link.handshake(conn, encoder)
+	seq := uint64(0)
+	send := func(event ClusterEvent) {
+		data, _ := json.Marshal(event)
+		seq++
+		encoder.Encode(meshFrame{Type: meshEvent, Event: data, Seq: seq, Mac: meshMac(key, node, seq, data)})
+	}
+	return conn, send, err
+}
+
+// Wait for a condition to hold, failing the test after a few seconds
+func AssertEventually(t testing.TB, what string, condition func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMeshBroker(t *testing.T) {
+	t.Run("peers get the snapshot, then the events, then the node going down", func(t *testing.T) {
+		a, b := MeshFixture(t, "a"), MeshFixture(t, "b")
+		events := make(chan ClusterEvent, 16)
+		b.Subscribe(func(event ClusterEvent) {
+			if event.Node == "a" {
+				events <- event
+			}
+		})
+
+		a.Connect([]string{b.Addr()}, func() ClusterEvent { return ClusterEvent{Kind: EventSync, Node: "a", Snapshot: &ClusterSnapshot{}} })
+		want := []string{EventSync, EventNotification}
+		for _, kind := range want {
+			if kind == EventNotification {
+				a.Publish(ClusterEvent{Kind: EventNotification, Node: "a", Notification: &ClusterNotification{Audience: AudienceAll, Method: "announce"}})
+			}
+			select {
+			case event := <-events:
+				if event.Kind != kind {
+					t.Fatalf("got a %s event, want %s", event.Kind, kind)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("timed out waiting for a %s event", kind)
+			}
+		}
+
+		a.Close()
+		select {
+		case event := <-events:
+			if event.Kind != EventNodeDown {
+				t.Errorf("got a %s event, want %s", event.Kind, EventNodeDown)
+			}
+		case <-time.After(5 * time.Second):
+			t.Error("timed out waiting for the node to go down")
+		}
+	})
+
+	t.Run("events claiming another node than the connection's are dropped", func(t *testing.T) {
+		b := MeshFixture(t, "b")
+		events := make(chan ClusterEvent, 16)
+		b.Subscribe(func(event ClusterEvent) { events <- event })
+		_, send, err := MeshDial(t, b.Addr(), "a", MeshSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, node := range []string{"a", "c", "a"} {
+			send(ClusterEvent{Kind: EventNotification, Node: node, Notification: &ClusterNotification{Audience: AudienceAll, Method: "from " + node}})
+		}
+		for range 2 {
+			select {
+			case event := <-events:
+				if event.Node != "a" {
+					t.Errorf("got an event from node [%s] on node a's connection", event.Node)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("timed out waiting for node a's events")
+			}
+		}
+	})
+
+	t.Run("nodes without the secret are refused", func(t *testing.T) {
+		b := MeshFixture(t, "b")
+		if _, _, err := MeshDial(t, b.Addr(), "a", "guessed"); !errors.Is(err, ErrMeshAuth) {
+			t.Errorf("got error %v dialing with the wrong secret", err)
+		}
+		if _, err := ListenMesh("c", "127.0.0.1:0", ""); !errors.Is(err, ErrNoMeshSecret) {
+			t.Errorf("got error %v listening without a secret", err)
+		}
+	})
+
+	t.Run("an event with a bad MAC fails the connection", func(t *testing.T) {
+		b := MeshFixture(t, "b")
+		events := make(chan ClusterEvent, 16)
+		b.Subscribe(func(event ClusterEvent) { events <- event })
+		conn, _, err := MeshDial(t, b.Addr(), "a", MeshSecret)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, _ := json.Marshal(ClusterEvent{Kind: EventNotification, Node: "a", Notification: &ClusterNotification{Audience: AudienceAll, Method: "forged"}})
+		json.NewEncoder(conn).Encode(meshFrame{Type: meshEvent, Event: data, Seq: 1, Mac: "forged"})
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); !errors.Is(err, io.EOF) {
+			t.Errorf("got error %v reading after a forged event", err)
+		}
+		select {
+		case event := <-events:
+			if event.Kind == EventNotification {
+				t.Error("got the forged event")
+			}
+		case <-time.After(100 * time.Millisecond):
+		}
+	})
+
+	t.Run("a full link queue drops events and resyncs, keeping the messages", func(t *testing.T) {
+		link := &meshLink{node: "a", address: "b", wake: make(chan struct{}, 1), done: make(chan struct{})}
+		for i := range MeshQueueCapacity + 10 {
+			kind := EventPresence
+			if i%2 == 0 {
+				kind = EventMessage
+			}
+			link.send(ClusterEvent{Kind: kind, Node: "a"})
+		}
+		if len(link.queue) != MeshQueueCapacity || !link.behind {
+			t.Fatalf("got %d events queued and behind %t", len(link.queue), link.behind)
+		}
+
+		link.reconnected()
+		if len(link.queue) != MeshQueueCapacity/2 || link.behind {
+			t.Errorf("got %d events queued and behind %t after reconnecting", len(link.queue), link.behind)
+		}
+		for _, event := range link.queue {
+			if event.Kind != EventMessage {
+				t.Errorf("got a %s event queued after reconnecting", event.Kind)
+			}
+		}
+	})
+
+	t.Run("servers chat across the mesh", func(t *testing.T) {
+		servers := []*Server{ServerFixture(), ServerFixture()}
+		meshes := []*MeshBroker{MeshFixture(t, "a"), MeshFixture(t, "b")}
+		for i, server := range servers {
+			server.JoinCluster(meshes[i].node, meshes[i])
+			meshes[i].Connect([]string{meshes[1-i].Addr()}, server.ClusterSnapshot)
+		}
+		alice, _ := AddFakeConnection(t, servers[0], "alice")
+		AddFakeConnection(t, servers[1], "bob")
+		AssertEventually(t, "users to be online on both nodes", func() bool {
+			return servers[0].Online("bob") && servers[1].Online("alice")
+		})
+
+		AssertSuccess(t, CallMethod(t, servers[0], alice, CreateChatRoomRpcMethod, RoomParams{Room: "dev"}))
+		AssertEventually(t, "the room to reach the other node", func() bool {
+			return servers[1].roomService.RoomExists("dev")
+		})
+	})
+}
@@ -0,0 +1,478 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	DefaultThreadPageSize  = 50
+	MaxThreadPageSize      = 100
+	DefaultSearchPageSize  = 20
+	MaxSearchPageSize      = 100
+	DefaultHistoryPageSize = 50
+	MaxHistoryPageSize     = 100
+)
+
+var (
+	ErrMessageNotFound = errors.New("message not found")
+	ErrInvalidCursor   = errors.New("invalid cursor")
+)
+
+// Message Data store Interface - read receipts are kept alongside the messages they refer to
+type MessageStore interface {
+	Add(message *Message) error
+	Get(messageId string) (*Message, bool)
+	List() []*Message
+	Replies(rootId string) []*Message
+	ReplyPosition(replyId string) (int, bool)
+	RoomMessages(room string) []*Message
+	Count() int
+	SetReadReceipt(receipt ReadReceipt) error
+	GetReadReceipt(room string, user string) (ReadReceipt, bool)
+}
+
+// Store messages in memory, keeping insertion order and indexes of replies per thread and messages per room
+type InMemoryMessageStore struct {
+	messages map[string]*Message
+	order    []*Message
+	replies  map[string][]*Message
+	replyPos map[string]int
+	rooms    map[string][]*Message
+	receipts map[string]map[string]ReadReceipt
+	mu       sync.RWMutex
+}
+
+// Create a new in-memory message store
+func NewMessageStore() *InMemoryMessageStore {
+	messages := make(map[string]*Message)
+	replies := make(map[string][]*Message)
+	rooms := make(map[string][]*Message)
+	receipts := make(map[string]map[string]ReadReceipt)
+	return &InMemoryMessageStore{messages: messages, order: make([]*Message, 0), replies: replies, replyPos: make(map[string]int), rooms: rooms, receipts: receipts}
+}
+
+// Get the number of messages
+func (s *InMemoryMessageStore) Count() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.order)
+}
+
+// Get a message by ID
+func (s *InMemoryMessageStore) Get(messageId string) (*Message, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	message, ok := s.messages[messageId]
+	return message, ok
+}
+
+// List all messages in the order they were added
+func (s *InMemoryMessageStore) List() []*Message {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	messageList := make([]*Message, len(s.order))
+	copy(messageList, s.order)
+	return messageList
+}
+
+// List the replies to a root message in the order they were added
+func (s *InMemoryMessageStore) Replies(rootId string) []*Message {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	replyList := make([]*Message, len(s.replies[rootId]))
+	copy(replyList, s.replies[rootId])
+	return replyList
+}
+
+// Get the position of a reply within its thread
+func (s *InMemoryMessageStore) ReplyPosition(replyId string) (int, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	position, ok := s.replyPos[replyId]
+	return position, ok
+}
+
+// List the messages of a room in the order they were added
+func (s *InMemoryMessageStore) RoomMessages(room string) []*Message {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	messageList := make([]*Message, len(s.rooms[room]))
+	copy(messageList, s.rooms[room])
+	return messageList
+}
+
+// Insert a message into the store
+func (s *InMemoryMessageStore) Add(message *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.messages[message.Id] = message
+	s.order = append(s.order, message)
+	s.rooms[message.Room] = append(s.rooms[message.Room], message)
+	if message.ParentId != "" {
+		s.replyPos[message.Id] = len(s.replies[message.ParentId])
+		s.replies[message.ParentId] = append(s.replies[message.ParentId], message)
+	}
+	return nil
+}
+
+// Record the last message a user has read in a room
+func (s *InMemoryMessageStore) SetReadReceipt(receipt ReadReceipt) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.receipts[receipt.Room]; !ok {
+		s.receipts[receipt.Room] = make(map[string]ReadReceipt)
+	}
+	s.receipts[receipt.Room][receipt.User] = receipt
+	return nil
+}
+
+// Get the last message a user has read in a room
+func (s *InMemoryMessageStore) GetReadReceipt(room string, user string) (ReadReceipt, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	receipt, ok := s.receipts[room][user]
+	return receipt, ok
+}
+
+// Store messages in memory, writing them and read receipts through to storage so they outlive the server.
+// Messages are keyed by their position so storage lists them in the order they were added.
+type PersistentMessageStore struct {
+	*InMemoryMessageStore
+	storage Storage
+	next    int
+	mu      sync.Mutex
+}
+
+// Create a message store over storage, loading the messages and read receipts it holds
+func NewPersistentMessageStore(storage Storage) (*PersistentMessageStore, error) {
+	s := &PersistentMessageStore{InMemoryMessageStore: NewMessageStore(), storage: storage}
+	err := storage.View(func(tx StorageTx) error {
+		if err := LoadBucket(tx, MessagesBucket, func(message *Message) { s.InMemoryMessageStore.Add(message) }); err != nil {
+			return err
+		}
+		return LoadBucket(tx, ReceiptsBucket, func(receipt *ReadReceipt) { s.InMemoryMessageStore.SetReadReceipt(*receipt) })
+	})
+	s.next = s.Count()
+	return s, err
+}
+
+// Insert a message and store it
+func (s *PersistentMessageStore) Add(message *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := writeThrough(s.storage, "message", func(tx StorageTx) error {
+		return tx.Put(MessagesBucket, fmt.Sprintf("%016d", s.next), message)
+	})
+	if err != nil {
+		return err
+	}
+	s.next++
+	return s.InMemoryMessageStore.Add(message)
+}
+
+// Record the last message a user has read in a room and store it
+func (s *PersistentMessageStore) SetReadReceipt(receipt ReadReceipt) error {
+	err := writeThrough(s.storage, "read receipt", func(tx StorageTx) error {
+		return tx.Put(ReceiptsBucket, receipt.Room+"/"+receipt.User, receipt)
+	})
+	if err != nil {
+		return err
+	}
+	return s.InMemoryMessageStore.SetReadReceipt(receipt)
+}
+
+// Message Service for recording chat messages, their threads and the search index
+type MessageService struct {
+	store MessageStore
+	index *SearchIndex
+}
+
+// Record a new chat message. Replying to a reply attaches the message to the root of that thread,
+// and replies always belong to the room of their thread.
+func (s *MessageService) AddMessage(room string, author string, msg []byte, parentId string) (*Message, error) {
+	if room == "" {
+		room = DefaultRoom
+	}
+	if parentId != "" {
+		parent, ok := s.store.Get(parentId)
+		if !ok {
+			return nil, ErrMessageNotFound
+		}
+		if parent.ParentId != "" {
+			parentId = parent.ParentId
+		}
+		room = parent.Room
+	}
+
+	message := &Message{Id: uuid.New().String(), Room: room, Author: author, ParentId: parentId, Msg: msg, Timestamp: time.Now().UTC()}
+	slog.Debug("Adding message", "message_id", message.Id, "room", message.Room, "author", message.Author)
+	if err := s.store.Add(message); err != nil {
+		return nil, err
+	}
+	s.index.Index(message)
+	return message, nil
+}
+
+// Store and index a message sent on another node, unless it's already known
+func (s *MessageService) AddRemoteMessage(message *Message) {
+	if _, ok := s.store.Get(message.Id); ok {
+		return
+	}
+	if err := s.store.Add(message); err != nil {
+		return
+	}
+	s.index.Index(message)
+}
+
+// Index the messages already in the store, e.g. those loaded from storage
+func (s *MessageService) RebuildIndex() {
+	for _, message := range s.store.List() {
+		s.index.Index(message)
+	}
+}
+
+// Get a message
+func (s *MessageService) GetMessage(messageId string) (*Message, bool) {
+	return s.store.Get(messageId)
+}
+
+// Get the reply count and last reply time of a thread
+func (s *MessageService) GetThreadSummary(rootId string) Thread {
+	replies := s.store.Replies(rootId)
+	thread := Thread{RootId: rootId, ReplyCount: len(replies)}
+	if len(replies) > 0 {
+		thread.LastReplyAt = replies[len(replies)-1].Timestamp
+	}
+	return thread
+}
+
+// Get a page of a thread's replies, starting after the reply id given as the cursor
+func (s *MessageService) GetThread(rootId string, cursor string, limit int) (GetThreadResult, error) {
+	root, ok := s.store.Get(rootId)
+	if !ok || root.ParentId != "" {
+		return GetThreadResult{}, ErrMessageNotFound
+	}
+
+	if limit <= 0 {
+		limit = DefaultThreadPageSize
+	}
+	limit = min(limit, MaxThreadPageSize)
+
+	replies := s.store.Replies(rootId)
+	start := 0
+	if cursor != "" {
+		position, ok := s.store.ReplyPosition(cursor)
+		if !ok || position >= len(replies) || replies[position].Id != cursor {
+			return GetThreadResult{}, ErrMessageNotFound
+		}
+		start = position + 1
+	}
+
+	end := min(start+limit, len(replies))
+	result := GetThreadResult{Thread: s.GetThreadSummary(rootId), Root: root, Replies: replies[start:end]}
+	if end < len(replies) {
+		result.NextCursor = replies[end-1].Id
+	}
+	return result, nil
+}
+
+// Get a page of a room's messages, oldest first, ending before the message id given as the cursor
+func (s *MessageService) GetHistory(room string, before string, limit int) (GetHistoryResult, error) {
+	if limit <= 0 {
+		limit = DefaultHistoryPageSize
+	}
+	limit = min(limit, MaxHistoryPageSize)
+
+	messages := s.store.RoomMessages(room)
+	end := len(messages)
+	if before != "" {
+		end = messagePosition(messages, before)
+		if end == -1 {
+			return GetHistoryResult{}, ErrMessageNotFound
+		}
+	}
+
+	start := max(0, end-limit)
+	result := GetHistoryResult{Room: room, Messages: messages[start:end]}
+	if start > 0 {
+		result.NextCursor = messages[start].Id
+	}
+	return result, nil
+}
+
+// Position of a message within its room, or -1 if it isn't in the room
+func messagePosition(messages []*Message, messageId string) int {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Id == messageId {
+			return i
+		}
+	}
+	return -1
+}
+
+// Record that a user has read a room up to a message. Receipts only move forward - marking an older
+// message as read leaves the receipt unchanged and reports it as not updated.
+func (s *MessageService) MarkRead(room string, user string, messageId string) (ReadReceipt, bool, error) {
+	message, ok := s.store.Get(messageId)
+	if !ok || message.Room != room {
+		return ReadReceipt{}, false, ErrMessageNotFound
+	}
+
+	current, ok := s.store.GetReadReceipt(room, user)
+	if ok {
+		messages := s.store.RoomMessages(room)
+		if messagePosition(messages, current.MessageId) >= messagePosition(messages, messageId) {
+			return current, false, nil
+		}
+	}
+
+	receipt := ReadReceipt{Room: room, User: user, MessageId: messageId, ReadAt: time.Now().UTC()}
+	if err := s.store.SetReadReceipt(receipt); err != nil {
+		return ReadReceipt{}, false, err
+	}
+	return receipt, true, nil
+}
+
+// Get the last message a user has read in a room
+func (s *MessageService) GetReadReceipt(room string, user string) (ReadReceipt, bool) {
+	return s.store.GetReadReceipt(room, user)
+}
+
+// Count the messages by other users in a room since the user's read receipt
+func (s *MessageService) UnreadCount(room string, user string) int {
+	messages := s.store.RoomMessages(room)
+	start := 0
+	if receipt, ok := s.store.GetReadReceipt(room, user); ok {
+		start = messagePosition(messages, receipt.MessageId) + 1
+	}
+
+	unread := 0
+	for _, message := range messages[start:] {
+		if message.Author != user {
+			unread++
+		}
+	}
+	return unread
+}
+
+// Check a message against the room, author and time range filters of a search
+func matchesSearchFilters(message *Message, params SearchMessagesParams) bool {
+	if params.Room != "" && message.Room != params.Room {
+		return false
+	}
+	if params.Author != "" && message.Author != params.Author {
+		return false
+	}
+	if params.From != nil && message.Timestamp.Before(*params.From) {
+		return false
+	}
+	if params.To != nil && message.Timestamp.After(*params.To) {
+		return false
+	}
+	return true
+}
+
+// Search the indexed messages of the rooms visible allows, ranked by relevance and then by recency
+func (s *MessageService) SearchMessages(params SearchMessagesParams, visible func(room string) bool) (SearchMessagesResult, error) {
+	var after *SearchHit
+	size := s.index.Size()
+	if params.Cursor != "" {
+		hit, snapshot, err := decodeSearchCursor(params.Cursor)
+		if err != nil || snapshot > size {
+			return SearchMessagesResult{}, ErrInvalidCursor
+		}
+		after, size = &hit, snapshot
+	}
+
+	limit := params.Limit
+	if limit <= 0 {
+		limit = DefaultSearchPageSize
+	}
+	limit = min(limit, MaxSearchPageSize)
+
+	terms := queryTerms(params.Query)
+	hits := make([]SearchHit, 0)
+	for messageId, score := range s.index.ScoreAsOf(terms, size) {
+		message, ok := s.store.Get(messageId)
+		if !ok || !visible(message.Room) || !matchesSearchFilters(message, params) {
+			continue
+		}
+		hits = append(hits, SearchHit{Message: message, Score: score})
+	}
+
+	sort.Slice(hits, func(a, b int) bool {
+		return searchHitBefore(hits[a], hits[b])
+	})
+
+	result := SearchMessagesResult{Hits: make([]SearchHit, 0), Total: len(hits)}
+	start := 0
+	if after != nil {
+		start = sort.Search(len(hits), func(i int) bool { return searchHitBefore(*after, hits[i]) })
+	}
+
+	end := min(start+limit, len(hits))
+	for _, hit := range hits[start:end] {
+		hit.Snippet = Snippet(string(hit.Message.Msg), terms)
+		result.Hits = append(result.Hits, hit)
+	}
+	if end < len(hits) {
+		result.NextCursor = encodeSearchCursor(hits[end-1], size)
+	}
+
+	return result, nil
+}
+
+// Order search hits by score, then newest first, then by id so every hit has a fixed place
+func searchHitBefore(a SearchHit, b SearchHit) bool {
+	if a.Score != b.Score {
+		return a.Score > b.Score
+	}
+	if !a.Message.Timestamp.Equal(b.Message.Timestamp) {
+		return a.Message.Timestamp.After(b.Message.Timestamp)
+	}
+	return a.Message.Id < b.Message.Id
+}
+
+// Encode the index size a search was scored at and the sort key of the last hit of a page.
+// Later pages score the same snapshot of the index and start after that hit, so messages
+// added between pages neither appear in the results nor repeat or skip hits.
+func encodeSearchCursor(hit SearchHit, size int) string {
+	key := fmt.Sprintf("%d|%s|%d|%s", size, strconv.FormatFloat(hit.Score, 'g', -1, 64), hit.Message.Timestamp.UnixNano(), hit.Message.Id)
+	return base64.RawURLEncoding.EncodeToString([]byte(key))
+}
+
+// Decode a search cursor into the sort key of the hit it points after and the index size it was scored at
+func decodeSearchCursor(cursor string) (SearchHit, int, error) {
+	key, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return SearchHit{}, 0, ErrInvalidCursor
+	}
+	fields := strings.SplitN(string(key), "|", 4)
+	if len(fields) != 4 || fields[3] == "" {
+		return SearchHit{}, 0, ErrInvalidCursor
+	}
+	size, err := strconv.Atoi(fields[0])
+	if err != nil || size < 0 {
+		return SearchHit{}, 0, ErrInvalidCursor
+	}
+	score, err := strconv.ParseFloat(fields[1], 64)
+	if err != nil {
+		return SearchHit{}, 0, ErrInvalidCursor
+	}
+	nanos, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil {
+		return SearchHit{}, 0, ErrInvalidCursor
+	}
+	return SearchHit{Score: score, Message: &Message{Id: fields[3], Timestamp: time.Unix(0, nanos)}}, size, nil
+}
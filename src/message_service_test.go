@@ -0,0 +1,178 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"testing"
+)
+
+func MessageServiceFixture() *MessageService {
+	return &MessageService{store: NewMessageStore(), index: NewSearchIndex()}
+}
+
+func AssertNumberOfReplies(t testing.TB, got int, want int) {
+	t.Helper()
+	if got != want {
+		t.Errorf("got [%d] replies but want [%d]", got, want)
+	}
+}
+
+func AssertUnreadCount(t testing.TB, got int, want int) {
+	t.Helper()
+	if got != want {
+		t.Errorf("got [%d] unread but want [%d]", got, want)
+	}
+}
+
+func TestAddMessage(t *testing.T) {
+	t.Run("add root message", func(t *testing.T) {
+		service := MessageServiceFixture()
+		message, err := service.AddMessage("", "alice", []byte("hello"), "")
+
+		AssertErrorNotNil(t, err)
+		if message.ParentId != "" {
+			t.Errorf("got parent [%s] but wanted none", message.ParentId)
+		}
+		if service.store.Count() != 1 {
+			t.Errorf("got [%d] messages but want [1]", service.store.Count())
+		}
+	})
+
+	t.Run("reply to a reply is attached to the thread root", func(t *testing.T) {
+		service := MessageServiceFixture()
+		root, _ := service.AddMessage("", "alice", []byte("hello"), "")
+		reply, _ := service.AddMessage("", "bob", []byte("hi"), root.Id)
+		nested, err := service.AddMessage("", "carol", []byte("hey"), reply.Id)
+
+		AssertErrorNotNil(t, err)
+		if nested.ParentId != root.Id {
+			t.Errorf("got parent [%s] but wanted [%s]", nested.ParentId, root.Id)
+		}
+
+		thread := service.GetThreadSummary(root.Id)
+		AssertNumberOfReplies(t, thread.ReplyCount, 2)
+		if !thread.LastReplyAt.Equal(nested.Timestamp) {
+			t.Errorf("got last reply at [%s] but wanted [%s]", thread.LastReplyAt, nested.Timestamp)
+		}
+	})
+
+	t.Run("reply to unknown message", func(t *testing.T) {
+		service := MessageServiceFixture()
+		_, err := service.AddMessage("", "alice", []byte("hello"), "missing")
+
+		if !errors.Is(err, ErrMessageNotFound) {
+			t.Errorf("got error [%v] but wanted [%v]", err, ErrMessageNotFound)
+		}
+	})
+}
+
+func TestGetThread(t *testing.T) {
+	service := MessageServiceFixture()
+	root, _ := service.AddMessage("", "alice", []byte("hello"), "")
+	for i := 0; i < 5; i++ {
+		service.AddMessage("", "bob", []byte("reply"), root.Id)
+	}
+
+	t.Run("paginate replies with a cursor", func(t *testing.T) {
+		first, err := service.GetThread(root.Id, "", 3)
+		AssertErrorNotNil(t, err)
+		AssertNumberOfReplies(t, len(first.Replies), 3)
+		AssertNumberOfReplies(t, first.Thread.ReplyCount, 5)
+
+		if first.NextCursor == "" {
+			t.Fatal("got no cursor but wanted one")
+		}
+
+		second, err := service.GetThread(root.Id, first.NextCursor, 3)
+		AssertErrorNotNil(t, err)
+		AssertNumberOfReplies(t, len(second.Replies), 2)
+
+		if second.NextCursor != "" {
+			t.Errorf("got cursor [%s] on the last page", second.NextCursor)
+		}
+	})
+
+	t.Run("cursors from another thread are rejected", func(t *testing.T) {
+		other, _ := service.AddMessage("", "alice", []byte("other"), "")
+		reply, _ := service.AddMessage("", "bob", []byte("reply"), other.Id)
+		_, err := service.GetThread(root.Id, reply.Id, 3)
+
+		if !errors.Is(err, ErrMessageNotFound) {
+			t.Errorf("got error [%v] but wanted [%v]", err, ErrMessageNotFound)
+		}
+	})
+
+	t.Run("get thread of a reply", func(t *testing.T) {
+		replies := service.store.Replies(root.Id)
+		_, err := service.GetThread(replies[0].Id, "", 0)
+
+		if !errors.Is(err, ErrMessageNotFound) {
+			t.Errorf("got error [%v] but wanted [%v]", err, ErrMessageNotFound)
+		}
+	})
+}
+
+func TestGetHistory(t *testing.T) {
+	service := MessageServiceFixture()
+	for i := 0; i < 5; i++ {
+		service.AddMessage("", "alice", []byte(strconv.Itoa(i)), "")
+	}
+
+	t.Run("page back through a room from the newest message", func(t *testing.T) {
+		latest, err := service.GetHistory(DefaultRoom, "", 3)
+		AssertErrorNotNil(t, err)
+		AssertNumberOfReplies(t, len(latest.Messages), 3)
+		if string(latest.Messages[0].Msg) != "2" || string(latest.Messages[2].Msg) != "4" {
+			t.Errorf("got messages %s to %s but want 2 to 4", latest.Messages[0].Msg, latest.Messages[2].Msg)
+		}
+
+		earlier, err := service.GetHistory(DefaultRoom, latest.NextCursor, 3)
+		AssertErrorNotNil(t, err)
+		AssertNumberOfReplies(t, len(earlier.Messages), 2)
+		if earlier.NextCursor != "" {
+			t.Errorf("got cursor [%s] on the first page", earlier.NextCursor)
+		}
+	})
+
+	t.Run("unknown cursors are rejected", func(t *testing.T) {
+		_, err := service.GetHistory(DefaultRoom, "missing", 3)
+
+		if !errors.Is(err, ErrMessageNotFound) {
+			t.Errorf("got error [%v] but wanted [%v]", err, ErrMessageNotFound)
+		}
+	})
+}
+
+func TestReadReceipts(t *testing.T) {
+	service := MessageServiceFixture()
+	first, _ := service.AddMessage("", "alice", []byte("one"), "")
+	second, _ := service.AddMessage("", "alice", []byte("two"), "")
+	service.AddMessage("", "bob", []byte("three"), "")
+	service.AddMessage("", "alice", []byte("four"), "")
+	service.AddMessage("ops", "alice", []byte("elsewhere"), "")
+
+	t.Run("unread counts other users' messages in the room", func(t *testing.T) {
+		AssertUnreadCount(t, service.UnreadCount(DefaultRoom, "bob"), 3)
+	})
+
+	t.Run("mark read moves the receipt forward", func(t *testing.T) {
+		_, updated, err := service.MarkRead(DefaultRoom, "bob", second.Id)
+		AssertErrorNotNil(t, err)
+		if !updated {
+			t.Error("got receipt not updated")
+		}
+		AssertUnreadCount(t, service.UnreadCount(DefaultRoom, "bob"), 1)
+
+		receipt, updated, _ := service.MarkRead(DefaultRoom, "bob", first.Id)
+		if updated || receipt.MessageId != second.Id {
+			t.Errorf("got receipt [%s] moved back to an older message", receipt.MessageId)
+		}
+	})
+
+	t.Run("mark read with a message from another room", func(t *testing.T) {
+		_, _, err := service.MarkRead("ops", "bob", first.Id)
+		if !errors.Is(err, ErrMessageNotFound) {
+			t.Errorf("got error [%v] but wanted [%v]", err, ErrMessageNotFound)
+		}
+	})
+}
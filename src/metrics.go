@@ -0,0 +1,236 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const UnknownMethodLabel = "unknown"
+
+var (
+	DispatchLatencyBuckets = []float64{0.0001, 0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1}
+	FanOutBuckets          = []float64{0, 1, 5, 10, 50, 100, 500, 1000}
+)
+
+// Histogram of observations counted into cumulative buckets
+type Histogram struct {
+	buckets []float64
+	counts  []int64
+	sum     float64
+	count   int64
+}
+
+// Create a histogram with the given bucket upper bounds
+func NewHistogram(buckets []float64) *Histogram {
+	return &Histogram{buckets: buckets, counts: make([]int64, len(buckets))}
+}
+
+// Count an observation into every bucket it fits in
+func (h *Histogram) Observe(value float64) {
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// Write the histogram's buckets, sum and count in the text exposition format
+func (h *Histogram) writeTo(w io.Writer, name string, labels string) {
+	separator := ""
+	if labels != "" {
+		separator = ","
+	}
+	for i, bound := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%s%sle=\"%s\"} %d\n", name, labels, separator, formatFloat(bound), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%s%sle=\"+Inf\"} %d\n", name, labels, separator, h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, braces(labels), formatFloat(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, braces(labels), h.count)
+}
+
+type requestKey struct {
+	method string
+	code   int
+}
+
+// Server metrics - counters and histograms are updated as the server runs, while gauges are read when scraped
+type Metrics struct {
+	requests             map[requestKey]int64
+	latency              map[string]*Histogram
+	fanOut               *Histogram
+	bytesIn              atomic.Int64
+	bytesOut             atomic.Int64
+	notificationFailures atomic.Int64
+	outboundDropped      atomic.Int64
+	mu                   sync.Mutex
+}
+
+// Create empty metrics
+func NewMetrics() *Metrics {
+	return &Metrics{
+		requests: make(map[requestKey]int64),
+		latency:  make(map[string]*Histogram),
+		fanOut:   NewHistogram(FanOutBuckets),
+	}
+}
+
+// Count a dispatched request by method and error code (0 for success) and record how long it took
+func (m *Metrics) ObserveRequest(method string, code int, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.requests[requestKey{method: method, code: code}]++
+	histogram, ok := m.latency[method]
+	if !ok {
+		histogram = NewHistogram(DispatchLatencyBuckets)
+		m.latency[method] = histogram
+	}
+	histogram.Observe(elapsed.Seconds())
+}
+
+// Record how many receivers a notification was sent to and how many writes failed
+func (m *Metrics) ObserveNotification(receivers int, failed int) {
+	m.mu.Lock()
+	m.fanOut.Observe(float64(receivers))
+	m.mu.Unlock()
+	m.AddNotificationFailures(failed)
+}
+
+// Count notifications that couldn't be written to a receiver
+func (m *Metrics) AddNotificationFailures(n int) {
+	m.notificationFailures.Add(int64(n))
+}
+
+// Count messages dropped by an outbound queue
+func (m *Metrics) AddOutboundDropped(n int) {
+	m.outboundDropped.Add(int64(n))
+}
+
+// Count bytes read from clients
+func (m *Metrics) AddBytesIn(n int) {
+	m.bytesIn.Add(int64(n))
+}
+
+// Count bytes written to clients
+func (m *Metrics) AddBytesOut(n int) {
+	m.bytesOut.Add(int64(n))
+}
+
+// Write the metrics in the text exposition format, along with the current connection and outbound queue gauges
+func (m *Metrics) WriteTo(w io.Writer, connections []*Connection) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var queues OutboundQueueStats
+	for _, c := range connections {
+		stats := c.OutboundStats()
+		queues.Depth += stats.Depth
+		queues.HighWater = max(queues.HighWater, stats.HighWater)
+	}
+
+	writeHeader(w, "chat_connections", "gauge", "Active connections")
+	fmt.Fprintf(w, "chat_connections %d\n", len(connections))
+
+	writeHeader(w, "chat_requests_total", "counter", "JSON-RPC requests by method and error code, 0 for success")
+	keys := make([]requestKey, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	slices.SortFunc(keys, func(a, b requestKey) int {
+		if a.method != b.method {
+			return cmp.Compare(a.method, b.method)
+		}
+		return a.code - b.code
+	})
+	for _, key := range keys {
+		fmt.Fprintf(w, "chat_requests_total{method=\"%s\",code=\"%d\"} %d\n", key.method, key.code, m.requests[key])
+	}
+
+	writeHeader(w, "chat_dispatch_duration_seconds", "histogram", "Time taken to dispatch JSON-RPC requests by method")
+	methods := make([]string, 0, len(m.latency))
+	for method := range m.latency {
+		methods = append(methods, method)
+	}
+	slices.Sort(methods)
+	for _, method := range methods {
+		m.latency[method].writeTo(w, "chat_dispatch_duration_seconds", fmt.Sprintf("method=\"%s\"", method))
+	}
+
+	writeHeader(w, "chat_broadcast_fanout", "histogram", "Receivers per notification")
+	m.fanOut.writeTo(w, "chat_broadcast_fanout", "")
+
+	writeHeader(w, "chat_bytes_in_total", "counter", "Bytes read from clients")
+	fmt.Fprintf(w, "chat_bytes_in_total %d\n", m.bytesIn.Load())
+	writeHeader(w, "chat_bytes_out_total", "counter", "Bytes written to clients")
+	fmt.Fprintf(w, "chat_bytes_out_total %d\n", m.bytesOut.Load())
+	writeHeader(w, "chat_notification_write_failures_total", "counter", "Notifications and queued messages that couldn't be written to a receiver")
+	fmt.Fprintf(w, "chat_notification_write_failures_total %d\n", m.notificationFailures.Load())
+
+	writeHeader(w, "chat_outbound_queue_depth", "gauge", "Messages waiting in the outbound queues of active connections")
+	fmt.Fprintf(w, "chat_outbound_queue_depth %d\n", queues.Depth)
+	writeHeader(w, "chat_outbound_queue_high_water", "gauge", "Deepest outbound queue of an active connection")
+	fmt.Fprintf(w, "chat_outbound_queue_high_water %d\n", queues.HighWater)
+	writeHeader(w, "chat_outbound_queue_dropped_total", "counter", "Messages dropped by outbound queues")
+	fmt.Fprintf(w, "chat_outbound_queue_dropped_total %d\n", m.outboundDropped.Load())
+}
+
+func writeHeader(w io.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// Count requests by method and error code and time how long they take to dispatch
+func (s *Server) MetricsMiddleware(next RequestHandler) RequestHandler {
+	return func(ctx context.Context, request JsonRpcRequest) JsonRpcResponse {
+		start := time.Now()
+		response := next(ctx, request)
+
+		method, code := request.Method, 0
+		if !s.dispatcher.HasMethod(method) {
+			method = UnknownMethodLabel
+		}
+		if response.Error != nil {
+			code = response.Error.Code
+		}
+		s.metrics.ObserveRequest(method, code, time.Since(start))
+		return response
+	}
+}
+
+// Serve the metrics to scrapers
+func (s *Server) MetricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.metrics.WriteTo(w, s.connectionService.ListConnections())
+}
+
+// Serve the /metrics HTTP endpoint on the metrics port
+func (s *Server) ServeMetrics() {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.MetricsHandler)
+	address := fmt.Sprintf(":%d", s.metricsPort)
+	slog.Info("Serving metrics", "address", address, "path", "/metrics")
+	if err := http.ListenAndServe(address, mux); err != nil {
+		slog.Error("Metrics endpoint stopped", "error", err)
+	}
+}
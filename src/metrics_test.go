@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type FailingWriter struct{}
+
+func (f FailingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("broken pipe")
+}
+
+func AssertMetric(t testing.TB, body string, line string) {
+	t.Helper()
+	for _, got := range strings.Split(body, "\n") {
+		if got == line {
+			return
+		}
+	}
+	t.Errorf("got metrics without [%s]:\n%s", line, body)
+}
+
+func TestHistogram(t *testing.T) {
+	histogram := NewHistogram([]float64{1, 5})
+	for _, value := range []float64{0.5, 3, 10} {
+		histogram.Observe(value)
+	}
+
+	var body strings.Builder
+	histogram.writeTo(&body, "size", `room="general"`)
+	want := `size_bucket{room="general",le="1"} 1
+size_bucket{room="general",le="5"} 2
+size_bucket{room="general",le="+Inf"} 3
+size_sum{room="general"} 13.5
+size_count{room="general"} 3
+`
+	if body.String() != want {
+		t.Errorf("got histogram:\n%s\nbut want:\n%s", body.String(), want)
+	}
+}
+
+func TestMetricsEndpoint(t *testing.T) {
+	t.Run("requests, fan-out, bytes and write failures are exposed", func(t *testing.T) {
+		server := ServerFixture()
+		alice, _ := AddFakeConnection(t, server, "alice")
+		AddFakeConnection(t, server, "bob")
+
+		CallMethod(t, server, alice, ChatRpcMethod, ChatRequestParams{Msg: []byte("hello")})
+		CallMethod(t, server, alice, ChatRpcMethod, ChatRequestParams{Msg: []byte("hello"), Room: "missing"})
+		CallMethod(t, server, alice, "nope", nil)
+		notification := JsonRpcNotification{JsonRpc: JsonRpcVersion, Method: "hello"}
+		failed, _ := server.dispatcher.SendNotification(notification, []io.Writer{FailingWriter{}})
+		server.metrics.ObserveNotification(1, failed)
+
+		recorder := httptest.NewRecorder()
+		server.MetricsHandler(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		body := recorder.Body.String()
+
+		AssertMetric(t, body, "chat_connections 2")
+		AssertMetric(t, body, `chat_requests_total{method="chat",code="0"} 1`)
+		AssertMetric(t, body, `chat_requests_total{method="chat",code="-32002"} 1`)
+		AssertMetric(t, body, `chat_requests_total{method="unknown",code="-32601"} 1`)
+		AssertMetric(t, body, `chat_dispatch_duration_seconds_count{method="chat"} 2`)
+		AssertMetric(t, body, `chat_broadcast_fanout_bucket{le="1"} 2`)
+		AssertMetric(t, body, "chat_notification_write_failures_total 1")
+		if strings.Contains(body, "chat_bytes_out_total 0\n") {
+			t.Errorf("got no bytes out after broadcasting chat:\n%s", body)
+		}
+	})
+
+	t.Run("only registered methods are labelled", func(t *testing.T) {
+		server := ServerFixture()
+		alice, _ := AddFakeConnection(t, server, "alice")
+
+		AssertErrorCode(t, CallMethod(t, server, alice, "admin.nope", nil), PermissionDeniedErrorCode)
+
+		recorder := httptest.NewRecorder()
+		server.MetricsHandler(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		body := recorder.Body.String()
+		AssertMetric(t, body, fmt.Sprintf(`chat_requests_total{method="unknown",code="%d"} 1`, PermissionDeniedErrorCode))
+		if strings.Contains(body, "admin.nope") {
+			t.Errorf("got a label for an unregistered method:\n%s", body)
+		}
+	})
+
+	t.Run("drops and failed writes are counted after the queue is gone", func(t *testing.T) {
+		metrics := NewMetrics()
+		server, client := net.Pipe()
+		slow := make(chan struct{}, 1)
+		config := OutboundQueueConfig{Capacity: 1, WriteTimeout: time.Second, Policy: SlowConsumerDropNewest}
+		queue := NewOutboundQueue(server, config, metrics, func() { slow <- struct{}{} })
+
+		queue.Enqueue([]byte("hello\n"))
+		for queue.Stats().Depth != 0 {
+			time.Sleep(time.Millisecond)
+		}
+		queue.Enqueue([]byte("hello\n"))
+		queue.Enqueue([]byte("hello\n"))
+		client.Close()
+		<-slow
+		server.Close()
+		queue.Close()
+
+		var body strings.Builder
+		metrics.WriteTo(&body, nil)
+		AssertMetric(t, body.String(), "chat_outbound_queue_dropped_total 1")
+		AssertMetric(t, body.String(), "chat_notification_write_failures_total 1")
+	})
+
+	t.Run("latency is observed in seconds", func(t *testing.T) {
+		metrics := NewMetrics()
+		metrics.ObserveRequest(ChatRpcMethod, 0, 2*time.Millisecond)
+
+		var body strings.Builder
+		metrics.WriteTo(&body, nil)
+		AssertMetric(t, body.String(), `chat_dispatch_duration_seconds_bucket{method="chat",le="0.001"} 0`)
+		AssertMetric(t, body.String(), `chat_dispatch_duration_seconds_bucket{method="chat",le="0.005"} 1`)
+		AssertMetric(t, body.String(), "chat_connections 0")
+	})
+}
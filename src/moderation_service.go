@@ -0,0 +1,601 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	ModerationActionKick   = "kick"
+	ModerationActionBan    = "ban"
+	ModerationActionUnban  = "unban"
+	ModerationActionMute   = "mute"
+	ModerationActionUnmute = "unmute"
+	ModerationActionRole   = "role"
+)
+
+var (
+	ErrBanned = errors.New("banned from the room")
+	ErrMuted  = errors.New("muted in the room")
+)
+
+// Minimum room role needed to call each moderation method
+var moderationMethodRoles = map[string]string{
+	KickUserRpcMethod:              RoleModerator,
+	BanUserRpcMethod:               RoleModerator,
+	UnbanUserRpcMethod:             RoleModerator,
+	MuteUserRpcMethod:              RoleModerator,
+	UnmuteUserRpcMethod:            RoleModerator,
+	SetRoleRpcMethod:               RoleModerator,
+	GetModerationLogRpcMethod:      RoleModerator,
+	SetTopicRpcMethod:              RoleModerator,
+	AddWebhookRpcMethod:            RoleOwner,
+	RemoveWebhookRpcMethod:         RoleOwner,
+	ListWebhooksRpcMethod:          RoleModerator,
+	GetWebhookDeadLettersRpcMethod: RoleModerator,
+}
+
+// A ban of a user or a remote IP from a room - bans without an expiry are permanent
+type Ban struct {
+	Room      string
+	User      string
+	IP        string
+	ExpiresAt *time.Time
+}
+
+// A mute of a user in a room
+type Mute struct {
+	Room      string
+	User      string
+	ExpiresAt time.Time
+}
+
+// Check whether a ban or mute expiry has passed
+func expired(expiresAt *time.Time, now time.Time) bool {
+	return expiresAt != nil && !now.Before(*expiresAt)
+}
+
+// Moderation Data store Interface - bans, mutes and the append-only audit log
+type ModerationStore interface {
+	AddBan(ban Ban) error
+	RemoveBan(room string, user string, ip string) (bool, error)
+	Bans(room string) []Ban
+	AddMute(mute Mute) error
+	RemoveMute(room string, user string) (bool, error)
+	GetMute(room string, user string) (Mute, bool)
+	AppendAction(action ModerationAction) error
+	Actions(room string) []ModerationAction
+}
+
+// Store moderation state in memory
+type InMemoryModerationStore struct {
+	bans    map[string][]Ban
+	mutes   map[string]map[string]Mute
+	actions []ModerationAction
+	mu      sync.RWMutex
+}
+
+// Create a new in-memory moderation store
+func NewModerationStore() *InMemoryModerationStore {
+	bans := make(map[string][]Ban)
+	mutes := make(map[string]map[string]Mute)
+	return &InMemoryModerationStore{bans: bans, mutes: mutes, actions: make([]ModerationAction, 0)}
+}
+
+// Add a ban, replacing an existing ban of the same user or IP
+func (s *InMemoryModerationStore) AddBan(ban Ban) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bans := s.bans[ban.Room]
+	for i, b := range bans {
+		if b.User == ban.User && b.IP == ban.IP {
+			bans[i] = ban
+			return nil
+		}
+	}
+	s.bans[ban.Room] = append(bans, ban)
+	return nil
+}
+
+// Remove the ban of a user or IP
+func (s *InMemoryModerationStore) RemoveBan(room string, user string, ip string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bans := s.bans[room]
+	for i, b := range bans {
+		if b.User == user && b.IP == ip {
+			s.bans[room] = append(bans[:i], bans[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// List the bans of a room
+func (s *InMemoryModerationStore) Bans(room string) []Ban {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	banList := make([]Ban, len(s.bans[room]))
+	copy(banList, s.bans[room])
+	return banList
+}
+
+// Add a mute, replacing an existing mute of the user
+func (s *InMemoryModerationStore) AddMute(mute Mute) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.mutes[mute.Room]; !ok {
+		s.mutes[mute.Room] = make(map[string]Mute)
+	}
+	s.mutes[mute.Room][mute.User] = mute
+	return nil
+}
+
+// Remove the mute of a user
+func (s *InMemoryModerationStore) RemoveMute(room string, user string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.mutes[room][user]
+	delete(s.mutes[room], user)
+	return ok, nil
+}
+
+// Get the mute of a user
+func (s *InMemoryModerationStore) GetMute(room string, user string) (Mute, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	mute, ok := s.mutes[room][user]
+	return mute, ok
+}
+
+// Append an action to the audit log
+func (s *InMemoryModerationStore) AppendAction(action ModerationAction) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.actions = append(s.actions, action)
+	return nil
+}
+
+// List the audit log of a room, oldest first
+func (s *InMemoryModerationStore) Actions(room string) []ModerationAction {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	actionList := make([]ModerationAction, 0)
+	for _, a := range s.actions {
+		if a.Room == room {
+			actionList = append(actionList, a)
+		}
+	}
+	return actionList
+}
+
+// Store moderation state in memory, writing bans, mutes and the audit log through to storage so they outlive the server
+type PersistentModerationStore struct {
+	*InMemoryModerationStore
+	storage Storage
+}
+
+// Create a moderation store over storage, loading the bans, mutes and audit log it holds
+func NewPersistentModerationStore(storage Storage) (*PersistentModerationStore, error) {
+	s := &PersistentModerationStore{InMemoryModerationStore: NewModerationStore(), storage: storage}
+	err := storage.View(func(tx StorageTx) error {
+		if err := LoadBucket(tx, BansBucket, func(ban *Ban) { s.InMemoryModerationStore.AddBan(*ban) }); err != nil {
+			return err
+		}
+		if err := LoadBucket(tx, MutesBucket, func(mute *Mute) { s.InMemoryModerationStore.AddMute(*mute) }); err != nil {
+			return err
+		}
+		return LoadBucket(tx, ModerationLogBucket, func(action *ModerationAction) { s.InMemoryModerationStore.AppendAction(*action) })
+	})
+	return s, err
+}
+
+// Key of the ban of a user or IP from a room
+func banKey(room string, user string, ip string) string {
+	return room + "/" + user + "/" + ip
+}
+
+// Key of the mute of a user in a room
+func muteKey(room string, user string) string {
+	return room + "/" + user
+}
+
+// Key of an audit log action - keys sort in the order the actions were taken
+func actionKey(action ModerationAction) string {
+	return fmt.Sprintf("%019d/%s/%s/%s", action.Time.UnixNano(), action.Room, action.Action, action.Target)
+}
+
+// Add a ban and store it
+func (s *PersistentModerationStore) AddBan(ban Ban) error {
+	err := writeThrough(s.storage, "ban", func(tx StorageTx) error {
+		return tx.Put(BansBucket, banKey(ban.Room, ban.User, ban.IP), ban)
+	})
+	if err != nil {
+		return err
+	}
+	return s.InMemoryModerationStore.AddBan(ban)
+}
+
+// Remove the ban of a user or IP from memory and storage
+func (s *PersistentModerationStore) RemoveBan(room string, user string, ip string) (bool, error) {
+	err := writeThrough(s.storage, "ban", func(tx StorageTx) error {
+		return tx.Delete(BansBucket, banKey(room, user, ip))
+	})
+	if err != nil {
+		return false, err
+	}
+	return s.InMemoryModerationStore.RemoveBan(room, user, ip)
+}
+
+// Add a mute and store it
+func (s *PersistentModerationStore) AddMute(mute Mute) error {
+	err := writeThrough(s.storage, "mute", func(tx StorageTx) error {
+		return tx.Put(MutesBucket, muteKey(mute.Room, mute.User), mute)
+	})
+	if err != nil {
+		return err
+	}
+	return s.InMemoryModerationStore.AddMute(mute)
+}
+
+// Remove the mute of a user from memory and storage
+func (s *PersistentModerationStore) RemoveMute(room string, user string) (bool, error) {
+	err := writeThrough(s.storage, "mute", func(tx StorageTx) error {
+		return tx.Delete(MutesBucket, muteKey(room, user))
+	})
+	if err != nil {
+		return false, err
+	}
+	return s.InMemoryModerationStore.RemoveMute(room, user)
+}
+
+// Append an action to the audit log and store it
+func (s *PersistentModerationStore) AppendAction(action ModerationAction) error {
+	err := writeThrough(s.storage, "moderation action", func(tx StorageTx) error {
+		return tx.Put(ModerationLogBucket, actionKey(action), action)
+	})
+	if err != nil {
+		return err
+	}
+	return s.InMemoryModerationStore.AppendAction(action)
+}
+
+// Moderation Service for bans, mutes and the moderation audit log
+type ModerationService struct {
+	store ModerationStore
+}
+
+// Ban a user or an IP from a room, for the duration if it's not zero
+func (s *ModerationService) Ban(room string, user string, ip string, duration time.Duration) (Ban, error) {
+	ban := Ban{Room: room, User: user, IP: ip}
+	if duration > 0 {
+		expiresAt := time.Now().UTC().Add(duration)
+		ban.ExpiresAt = &expiresAt
+	}
+	return ban, s.store.AddBan(ban)
+}
+
+// Lift the ban of a user or an IP
+func (s *ModerationService) Unban(room string, user string, ip string) (bool, error) {
+	return s.store.RemoveBan(room, user, ip)
+}
+
+// Check whether a user, or the IP they are connecting from, is banned from a room
+func (s *ModerationService) IsBanned(room string, user string, ip string) (Ban, bool) {
+	now := time.Now()
+	for _, ban := range s.store.Bans(room) {
+		if expired(ban.ExpiresAt, now) {
+			continue
+		}
+		if (ban.User != "" && ban.User == user) || (ban.IP != "" && ban.IP == ip) {
+			return ban, true
+		}
+	}
+	return Ban{}, false
+}
+
+// Mute a user in a room for the duration
+func (s *ModerationService) Mute(room string, user string, duration time.Duration) (Mute, error) {
+	mute := Mute{Room: room, User: user, ExpiresAt: time.Now().UTC().Add(duration)}
+	return mute, s.store.AddMute(mute)
+}
+
+// Lift the mute of a user
+func (s *ModerationService) Unmute(room string, user string) (bool, error) {
+	return s.store.RemoveMute(room, user)
+}
+
+// Check whether a user is muted in a room
+func (s *ModerationService) IsMuted(room string, user string) (Mute, bool) {
+	mute, ok := s.store.GetMute(room, user)
+	if !ok || expired(&mute.ExpiresAt, time.Now()) {
+		return Mute{}, false
+	}
+	return mute, true
+}
+
+// Record an action in the audit log
+func (s *ModerationService) Record(action ModerationAction) error {
+	slog.Info("Moderation", "room", action.Room, "actor", action.Actor, "action", action.Action, "target", action.Target, "reason", action.Reason)
+	return s.store.AppendAction(action)
+}
+
+// Get the audit log of a room
+func (s *ModerationService) AuditLog(room string) []ModerationAction {
+	return s.store.Actions(room)
+}
+
+// Get the IP a connection is connecting from
+func RemoteIP(connection *Connection) string {
+	addr := connection.RemoteAddr()
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Get the room a chat request is sent to - replies go to the room of their thread
+func (s *Server) chatRequestRoom(request JsonRpcRequest) string {
+	var params ChatRequestParams
+	json.Unmarshal(request.Params, &params)
+	if params.ParentId != "" {
+		if parent, ok := s.messageService.GetMessage(params.ParentId); ok {
+			return parent.Room
+		}
+	}
+	if params.Room == "" {
+		return DefaultRoom
+	}
+	return params.Room
+}
+
+// Enforce bans, mutes, read-only members and the roles needed for moderation methods before requests are handled.
+// Moderation methods need a user signed in with its password - anonymous connections can't hold room roles.
+func (s *Server) ModerationMiddleware(next RequestHandler) RequestHandler {
+	return func(ctx context.Context, request JsonRpcRequest) JsonRpcResponse {
+		connection, ok := ConnectionFromContext(ctx)
+		if !ok {
+			if _, moderated := moderationMethodRoles[request.Method]; moderated {
+				return NewServiceErrorResponse(request, ErrPermissionDenied)
+			}
+			return next(ctx, request)
+		}
+		identity := s.userService.Identity(connection)
+
+		switch request.Method {
+		case ChatRpcMethod:
+			room := s.chatRequestRoom(request)
+			if _, banned := s.moderationService.IsBanned(room, identity, RemoteIP(connection)); banned {
+				return NewServiceErrorResponse(request, ErrBanned)
+			}
+			if mute, muted := s.moderationService.IsMuted(room, identity); muted {
+				response := NewServiceErrorResponse(request, ErrMuted)
+				response.Error.Data = map[string]time.Time{"expiresAt": mute.ExpiresAt}
+				return response
+			}
+			if s.roomService.Role(room, identity) == RoleReadOnly {
+				return NewErrorResponse(request, PermissionDeniedErrorCode, "Read-only members can't chat")
+			}
+		case JoinChatRoomRpcMethod:
+			var params RoomParams
+			json.Unmarshal(request.Params, &params)
+			if _, banned := s.moderationService.IsBanned(params.Room, identity, RemoteIP(connection)); banned {
+				return NewServiceErrorResponse(request, ErrBanned)
+			}
+		default:
+			required, ok := moderationMethodRoles[request.Method]
+			if !ok {
+				break
+			}
+			if _, signedIn := s.userService.UserForConnection(connection.id); !signedIn {
+				return NewServiceErrorResponse(request, ErrNotSignedIn)
+			}
+			var params ModerationParams
+			json.Unmarshal(request.Params, &params)
+			if RoleRank(s.roomService.Role(params.Room, identity)) < RoleRank(required) {
+				return NewServiceErrorResponse(request, ErrPermissionDenied)
+			}
+		}
+
+		return next(ctx, request)
+	}
+}
+
+// Moderation params naming exactly one of a user or a remote IP
+func targetFieldErrors(params ModerationParams) []FieldError {
+	if (params.User == "") == (params.IP == "") {
+		return []FieldError{{Field: "user", Message: "exactly one of user and ip is required"}}
+	}
+	return nil
+}
+
+// Check that the actor outranks the target user in the room
+func (s *Server) canModerate(room string, actor string, target string) bool {
+	targetRole := s.roomService.Role(room, target)
+	return actor != target && RoleRank(s.roomService.Role(room, actor)) > RoleRank(targetRole)
+}
+
+// Record a moderation action in the audit log and send it to the room's webhooks
+func (s *Server) record(action ModerationAction) error {
+	if err := s.moderationService.Record(action); err != nil {
+		return err
+	}
+	s.webhookService.Emit(WebhookPayload{Event: WebhookEventModeration, Room: action.Room, Moderation: &action})
+	return nil
+}
+
+// Record a moderation action and notify its target
+func (s *Server) moderate(action ModerationAction) error {
+	action.Time = time.Now().UTC()
+	if err := s.record(action); err != nil {
+		return err
+	}
+	s.NotifyIdentity(action.Target, ModeratedRpcMethod, action)
+	return nil
+}
+
+// Remove a user from a room and notify them
+func (s *Server) KickUserHandler(ctx context.Context, params ModerationParams) (SuccessResult, error) {
+	if params.User == "" {
+		return SuccessResult{}, NewInvalidParamsError(FieldError{Field: "user", Message: "is required"})
+	}
+	actor := s.callerIdentity(ctx)
+	if !s.canModerate(params.Room, actor, params.User) {
+		return SuccessResult{}, ErrPermissionDenied
+	}
+
+	if err := s.roomService.LeaveRoom(params.Room, params.User); err != nil {
+		return SuccessResult{}, err
+	}
+	if err := s.moderate(ModerationAction{Room: params.Room, Actor: actor, Action: ModerationActionKick, Target: params.User, Reason: params.Reason}); err != nil {
+		return SuccessResult{}, err
+	}
+	return SuccessResult{Success: true}, nil
+}
+
+// Ban a user or a remote IP from a room, removing the banned members from the room
+func (s *Server) BanUserHandler(ctx context.Context, params ModerationParams) (SuccessResult, error) {
+	if fieldErrors := targetFieldErrors(params); fieldErrors != nil {
+		return SuccessResult{}, NewInvalidParamsError(fieldErrors...)
+	}
+	actor := s.callerIdentity(ctx)
+	if params.User != "" && !s.canModerate(params.Room, actor, params.User) {
+		return SuccessResult{}, ErrPermissionDenied
+	}
+
+	ban, err := s.moderationService.Ban(params.Room, params.User, params.IP, time.Duration(params.Duration)*time.Second)
+	if err != nil {
+		return SuccessResult{}, err
+	}
+	action := ModerationAction{Room: params.Room, Actor: actor, Action: ModerationActionBan, Reason: params.Reason, ExpiresAt: ban.ExpiresAt}
+
+	targets := make(map[string]bool)
+	if params.User != "" {
+		targets[params.User] = true
+	}
+	for _, c := range s.connectionService.ListConnections() {
+		identity := s.userService.Identity(c)
+		if params.IP != "" && RemoteIP(c) == params.IP && s.canModerate(params.Room, actor, identity) {
+			targets[identity] = true
+		}
+	}
+	for target := range targets {
+		s.roomService.LeaveRoom(params.Room, target)
+		action.Target = target
+		if err := s.moderate(action); err != nil {
+			return SuccessResult{}, err
+		}
+	}
+
+	if params.IP != "" {
+		action.Time = time.Now().UTC()
+		action.Target = params.IP
+		if err := s.record(action); err != nil {
+			return SuccessResult{}, err
+		}
+	}
+	return SuccessResult{Success: true}, nil
+}
+
+// Lift the ban of a user or a remote IP
+func (s *Server) UnbanUserHandler(ctx context.Context, params ModerationParams) (SuccessResult, error) {
+	if fieldErrors := targetFieldErrors(params); fieldErrors != nil {
+		return SuccessResult{}, NewInvalidParamsError(fieldErrors...)
+	}
+
+	unbanned, err := s.moderationService.Unban(params.Room, params.User, params.IP)
+	if err != nil || !unbanned {
+		return SuccessResult{Success: false}, err
+	}
+	target := params.User + params.IP
+	if err := s.record(ModerationAction{Time: time.Now().UTC(), Room: params.Room, Actor: s.callerIdentity(ctx), Action: ModerationActionUnban, Target: target, Reason: params.Reason}); err != nil {
+		return SuccessResult{}, err
+	}
+	return SuccessResult{Success: true}, nil
+}
+
+// Mute a user in a room for a duration
+func (s *Server) MuteUserHandler(ctx context.Context, params ModerationParams) (SuccessResult, error) {
+	if params.User == "" {
+		return SuccessResult{}, NewInvalidParamsError(FieldError{Field: "user", Message: "is required"})
+	}
+	if params.Duration <= 0 {
+		return SuccessResult{}, NewInvalidParamsError(FieldError{Field: "duration", Message: "must be at least 1"})
+	}
+	actor := s.callerIdentity(ctx)
+	if !s.canModerate(params.Room, actor, params.User) {
+		return SuccessResult{}, ErrPermissionDenied
+	}
+
+	mute, err := s.moderationService.Mute(params.Room, params.User, time.Duration(params.Duration)*time.Second)
+	if err != nil {
+		return SuccessResult{}, err
+	}
+	if err := s.moderate(ModerationAction{Room: params.Room, Actor: actor, Action: ModerationActionMute, Target: params.User, Reason: params.Reason, ExpiresAt: &mute.ExpiresAt}); err != nil {
+		return SuccessResult{}, err
+	}
+	return SuccessResult{Success: true}, nil
+}
+
+// Lift the mute of a user
+func (s *Server) UnmuteUserHandler(ctx context.Context, params ModerationParams) (SuccessResult, error) {
+	if params.User == "" {
+		return SuccessResult{}, NewInvalidParamsError(FieldError{Field: "user", Message: "is required"})
+	}
+
+	unmuted, err := s.moderationService.Unmute(params.Room, params.User)
+	if err != nil || !unmuted {
+		return SuccessResult{Success: false}, err
+	}
+	if err := s.moderate(ModerationAction{Room: params.Room, Actor: s.callerIdentity(ctx), Action: ModerationActionUnmute, Target: params.User, Reason: params.Reason}); err != nil {
+		return SuccessResult{}, err
+	}
+	return SuccessResult{Success: true}, nil
+}
+
+// Change the role of a room member - only the owner can make moderators
+func (s *Server) SetRoleHandler(ctx context.Context, params ModerationParams) (SuccessResult, error) {
+	if params.User == "" {
+		return SuccessResult{}, NewInvalidParamsError(FieldError{Field: "user", Message: "is required"})
+	}
+	if params.Role == "" {
+		return SuccessResult{}, NewInvalidParamsError(FieldError{Field: "role", Message: "is required"})
+	}
+	if _, ok := s.userService.GetUser(params.User); !ok {
+		return SuccessResult{}, ErrUserNotFound
+	}
+	actor := s.callerIdentity(ctx)
+	if !s.canModerate(params.Room, actor, params.User) || RoleRank(params.Role) >= RoleRank(s.roomService.Role(params.Room, actor)) {
+		return SuccessResult{}, ErrPermissionDenied
+	}
+
+	if err := s.roomService.SetRole(params.Room, params.User, params.Role); err != nil {
+		return SuccessResult{}, err
+	}
+	if err := s.moderate(ModerationAction{Room: params.Room, Actor: actor, Action: ModerationActionRole, Target: params.User, Role: params.Role, Reason: params.Reason}); err != nil {
+		return SuccessResult{}, err
+	}
+	return SuccessResult{Success: true}, nil
+}
+
+// Get the moderation audit log of a room
+func (s *Server) GetModerationLogHandler(ctx context.Context, params ModerationParams) (GetModerationLogResult, error) {
+	return GetModerationLogResult{Actions: s.moderationService.AuditLog(params.Room)}, nil
+}
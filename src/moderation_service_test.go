@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+// Server fixture with a room owned by alice, where bob is a moderator and carol a member
+func ModerationFixture(t testing.TB) (*Server, map[string]*Connection, map[string]*FakeNetConn) {
+	t.Helper()
+	server := ServerFixture()
+	connections := make(map[string]*Connection)
+	conns := make(map[string]*FakeNetConn)
+	for _, name := range []string{"alice", "bob", "carol"} {
+		connections[name], conns[name] = AddFakeConnection(t, server, name)
+	}
+
+	server.roomService.CreateRoom("ops", "alice")
+	server.roomService.JoinRoom("ops", "bob")
+	server.roomService.JoinRoom("ops", "carol")
+	server.roomService.SetRole("ops", "bob", RoleModerator)
+	return server, connections, conns
+}
+
+func TestModerationRoles(t *testing.T) {
+	t.Run("members can't moderate", func(t *testing.T) {
+		server, connections, _ := ModerationFixture(t)
+		response := CallMethod(t, server, connections["carol"], KickUserRpcMethod, ModerationParams{Room: "ops", User: "bob"})
+		AssertErrorCode(t, response, PermissionDeniedErrorCode)
+	})
+
+	t.Run("anonymous connections can't moderate", func(t *testing.T) {
+		server, _, _ := ModerationFixture(t)
+		anonymous, _ := AddFakeConnection(t, server, "")
+		server.roomService.CreateRoom("lobby", anonymous.id)
+
+		response := CallMethod(t, server, anonymous, KickUserRpcMethod, ModerationParams{Room: "lobby", User: "carol"})
+		AssertErrorCode(t, response, NotSignedInErrorCode)
+		AssertErrorCode(t, CallMethod(t, server, anonymous, CreateChatRoomRpcMethod, RoomParams{Room: "mine"}), NotSignedInErrorCode)
+	})
+
+	t.Run("roles only go to registered users", func(t *testing.T) {
+		server, connections, _ := ModerationFixture(t)
+		anonymous, _ := AddFakeConnection(t, server, "")
+		server.roomService.JoinRoom("ops", anonymous.id)
+
+		response := CallMethod(t, server, connections["alice"], SetRoleRpcMethod, ModerationParams{Room: "ops", User: anonymous.id, Role: RoleModerator})
+		AssertErrorCode(t, response, UserNotFoundErrorCode)
+	})
+
+	t.Run("moderators can't act on the owner", func(t *testing.T) {
+		server, connections, _ := ModerationFixture(t)
+		response := CallMethod(t, server, connections["bob"], MuteUserRpcMethod, ModerationParams{Room: "ops", User: "alice", Duration: 60})
+		AssertErrorCode(t, response, PermissionDeniedErrorCode)
+	})
+
+	t.Run("only the owner can make moderators", func(t *testing.T) {
+		server, connections, _ := ModerationFixture(t)
+		response := CallMethod(t, server, connections["bob"], SetRoleRpcMethod, ModerationParams{Room: "ops", User: "carol", Role: RoleModerator})
+		AssertErrorCode(t, response, PermissionDeniedErrorCode)
+
+		response = CallMethod(t, server, connections["alice"], SetRoleRpcMethod, ModerationParams{Room: "ops", User: "carol", Role: RoleModerator})
+		AssertSuccess(t, response)
+	})
+
+	t.Run("read-only members can't chat", func(t *testing.T) {
+		server, connections, _ := ModerationFixture(t)
+		AssertSuccess(t, CallMethod(t, server, connections["bob"], SetRoleRpcMethod, ModerationParams{Room: "ops", User: "carol", Role: RoleReadOnly}))
+
+		response := CallMethod(t, server, connections["carol"], ChatRpcMethod, ChatRequestParams{Room: "ops", Msg: []byte("hi")})
+		AssertErrorCode(t, response, PermissionDeniedErrorCode)
+	})
+}
+
+func TestKickUser(t *testing.T) {
+	server, connections, conns := ModerationFixture(t)
+	response := CallMethod(t, server, connections["bob"], KickUserRpcMethod, ModerationParams{Room: "ops", User: "carol", Reason: "spam"})
+
+	AssertSuccess(t, response)
+	if server.roomService.IsMember("ops", "carol") {
+		t.Error("got kicked user still a member")
+	}
+	AssertNumberOfConnections(t, CountNotifications(conns["carol"], ModeratedRpcMethod), 1)
+
+	actions := server.moderationService.AuditLog("ops")
+	if len(actions) != 1 || actions[0].Action != ModerationActionKick || actions[0].Actor != "bob" {
+		t.Errorf("got audit log %v but wanted bob's kick", actions)
+	}
+}
+
+func TestBanUser(t *testing.T) {
+	t.Run("banned user is removed and can't rejoin", func(t *testing.T) {
+		server, connections, _ := ModerationFixture(t)
+		AssertSuccess(t, CallMethod(t, server, connections["bob"], BanUserRpcMethod, ModerationParams{Room: "ops", User: "carol"}))
+
+		response := CallMethod(t, server, connections["carol"], JoinChatRoomRpcMethod, RoomParams{Room: "ops"})
+		AssertErrorCode(t, response, BannedErrorCode)
+	})
+
+	t.Run("ban by remote IP", func(t *testing.T) {
+		server, _, _ := ModerationFixture(t)
+		owner, _ := AddFakeConnection(t, server, "dave")
+		server.roomService.CreateRoom("lobby", "dave")
+		troll, trollConn := AddFakeConnection(t, server, "")
+		trollConn.remoteAddr = &net.TCPAddr{IP: net.ParseIP("10.0.0.9"), Port: 4000}
+		server.roomService.JoinRoom("lobby", troll.id)
+
+		AssertSuccess(t, CallMethod(t, server, owner, BanUserRpcMethod, ModerationParams{Room: "lobby", IP: "10.0.0.9", Duration: 60}))
+
+		response := CallMethod(t, server, troll, JoinChatRoomRpcMethod, RoomParams{Room: "lobby"})
+		AssertErrorCode(t, response, BannedErrorCode)
+	})
+
+	t.Run("banned users and IPs aren't put back in the default room", func(t *testing.T) {
+		server := ServerFixture()
+		server.moderationService.Ban(DefaultRoom, "carol", "", 0)
+		server.moderationService.Ban(DefaultRoom, "", "10.0.0.9", 0)
+
+		AddFakeConnection(t, server, "carol")
+		AddFakeConnection(t, server, "alice")
+		conn := NewFakeNetConn()
+		conn.remoteAddr = &net.TCPAddr{IP: net.ParseIP("10.0.0.9"), Port: 4000}
+		troll := server.AcceptConnection(conn)
+
+		if server.roomService.IsMember(DefaultRoom, "carol") || server.roomService.IsMember(DefaultRoom, troll.id) {
+			t.Errorf("got banned members %v", server.roomService.Members(DefaultRoom))
+		}
+		if !server.roomService.IsMember(DefaultRoom, "alice") {
+			t.Error("got alice left out of the default room")
+		}
+	})
+
+	t.Run("expired ban", func(t *testing.T) {
+		service := &ModerationService{store: NewModerationStore()}
+		expiresAt := time.Now().Add(-time.Minute)
+		service.store.AddBan(Ban{Room: "ops", User: "carol", ExpiresAt: &expiresAt})
+
+		if _, banned := service.IsBanned("ops", "carol", ""); banned {
+			t.Error("got banned but wanted the ban expired")
+		}
+	})
+}
+
+func TestMuteUser(t *testing.T) {
+	server, connections, _ := ModerationFixture(t)
+	AssertSuccess(t, CallMethod(t, server, connections["bob"], MuteUserRpcMethod, ModerationParams{Room: "ops", User: "carol", Duration: 60}))
+
+	response := CallMethod(t, server, connections["carol"], ChatRpcMethod, ChatRequestParams{Room: "ops", Msg: []byte("hi")})
+	AssertErrorCode(t, response, MutedErrorCode)
+
+	AssertSuccess(t, CallMethod(t, server, connections["bob"], UnmuteUserRpcMethod, ModerationParams{Room: "ops", User: "carol"}))
+	AssertSuccess(t, CallMethod(t, server, connections["carol"], ChatRpcMethod, ChatRequestParams{Room: "ops", Msg: []byte("hi")}))
+}
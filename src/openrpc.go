@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const OpenRpcVersion = "1.2.6"
+
+// Params of every request and notification are sent as a base64 encoded JSON string rather than a JSON object
+const ParamsEncodingDescription = "Request and notification params are sent as a base64 encoded JSON string of the params object described by each method."
+
+var (
+	invalidParamsError        = JsonRpcError{Code: -32602, Message: "Invalid params"}
+	internalError             = JsonRpcError{Code: -32603, Message: "Internal error"}
+	messageNotFoundError      = JsonRpcError{Code: MessageNotFoundErrorCode, Message: "Message not found"}
+	roomNotFoundError         = JsonRpcError{Code: RoomNotFoundErrorCode, Message: "Room not found"}
+	notRoomMemberError        = JsonRpcError{Code: NotRoomMemberErrorCode, Message: "Not a member of the room"}
+	roomExistsError           = JsonRpcError{Code: RoomExistsErrorCode, Message: "Room already exists"}
+	userNameTakenError        = JsonRpcError{Code: UserNameTakenErrorCode, Message: "User name taken"}
+	permissionDeniedError     = JsonRpcError{Code: PermissionDeniedErrorCode, Message: "Permission denied"}
+	notSignedInError          = JsonRpcError{Code: NotSignedInErrorCode, Message: "Not signed in"}
+	bannedError               = JsonRpcError{Code: BannedErrorCode, Message: "Banned from the room"}
+	mutedError                = JsonRpcError{Code: MutedErrorCode, Message: "Muted in the room"}
+	rateLimitedError          = JsonRpcError{Code: RateLimitedErrorCode, Message: "Rate limit exceeded"}
+	connectionNotFoundError   = JsonRpcError{Code: ConnectionNotFoundErrorCode, Message: "Connection not found"}
+	clientTimeoutError        = JsonRpcError{Code: ClientTimeoutErrorCode, Message: "Client did not respond"}
+	unsupportedVersionError   = JsonRpcError{Code: UnsupportedVersionErrorCode, Message: "Unsupported protocol version"}
+	featureNotNegotiatedError = JsonRpcError{Code: FeatureNotNegotiatedErrorCode, Message: "Feature not negotiated"}
+	userNotFoundError         = JsonRpcError{Code: UserNotFoundErrorCode, Message: "User not found"}
+	serverUnreachableError    = JsonRpcError{Code: ServerUnreachableErrorCode, Message: "Server unreachable"}
+	webhookNotFoundError      = JsonRpcError{Code: WebhookNotFoundErrorCode, Message: "Webhook not found"}
+	badCredentialsError       = JsonRpcError{Code: BadCredentialsErrorCode, Message: "Wrong password"}
+	badAdminTokenError        = JsonRpcError{Code: BadAdminTokenErrorCode, Message: "Wrong admin token"}
+)
+
+type OpenRpcInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// Named schema of a method's params or result
+type OpenRpcContentDescriptor struct {
+	Name     string         `json:"name"`
+	Required bool           `json:"required,omitempty"`
+	Schema   map[string]any `json:"schema"`
+}
+
+// Method or notification in the OpenRPC format - the protocol feature a client must negotiate to use it is the x-feature extension
+type OpenRpcMethod struct {
+	Name           string                     `json:"name"`
+	Description    string                     `json:"description,omitempty"`
+	ParamStructure string                     `json:"paramStructure"`
+	Params         []OpenRpcContentDescriptor `json:"params"`
+	Result         OpenRpcContentDescriptor   `json:"result"`
+	Errors         []JsonRpcError             `json:"errors,omitempty"`
+	Feature        string                     `json:"x-feature,omitempty"`
+}
+
+// OpenRPC document - notifications sent by the server are listed under the x-notifications extension,
+// and requests the server sends to clients under x-client-methods
+type OpenRpcDocument struct {
+	OpenRpc       string          `json:"openrpc"`
+	Info          OpenRpcInfo     `json:"info"`
+	Methods       []OpenRpcMethod `json:"methods"`
+	Notifications []OpenRpcMethod `json:"x-notifications"`
+	ClientMethods []OpenRpcMethod `json:"x-client-methods"`
+}
+
+// Build the JSON schema of the type a value is serialized from
+func JsonSchema(value any) map[string]any {
+	if value == nil {
+		return map[string]any{}
+	}
+	return typeSchema(reflect.TypeOf(value))
+}
+
+func typeSchema(t reflect.Type) map[string]any {
+	if t == timeType {
+		return map[string]any{"type": "string", "format": "date-time"}
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return typeSchema(t.Elem())
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return map[string]any{"type": "string", "contentEncoding": "base64"}
+		}
+		return map[string]any{"type": "array", "items": typeSchema(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": typeSchema(t.Elem())}
+	case reflect.Struct:
+		return structSchema(t)
+	}
+	return map[string]any{}
+}
+
+// JSON schema keyword of a min or max validation rule for a schema's type
+func schemaLimitKeyword(schema map[string]any, rule string) string {
+	prefix := map[string]string{"string": "Length", "array": "Items", "object": "Properties"}[fmt.Sprint(schema["type"])]
+	if prefix == "" {
+		return map[string]string{"min": "minimum", "max": "maximum"}[rule]
+	}
+	return rule + prefix
+}
+
+// Build the object schema of a struct from its exported fields and their json and validate tags - fields
+// that are omitted when empty or are pointers aren't required unless they're validated as required
+func structSchema(t reflect.Type) map[string]any {
+	properties := make(map[string]any)
+	required := make([]string, 0)
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name, options, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+
+		schema := typeSchema(field.Type)
+		isRequired := !strings.Contains(options, "omitempty") && field.Type.Kind() != reflect.Pointer
+		for _, rule := range validationRules(field) {
+			switch rule.name {
+			case "required":
+				isRequired = true
+			case "oneof":
+				schema["enum"] = strings.Fields(rule.arg)
+			case "min", "max":
+				if limit, err := strconv.Atoi(rule.arg); err == nil {
+					schema[schemaLimitKeyword(schema, rule.name)] = limit
+				}
+			}
+		}
+
+		properties[name] = schema
+		if isRequired {
+			required = append(required, name)
+		}
+	}
+
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// Describe a method or notification in the OpenRPC format - params are described by name
+func openRpcMethod(name string, info MethodInfo, commonErrors []JsonRpcError) OpenRpcMethod {
+	method := OpenRpcMethod{
+		Name:           name,
+		Description:    info.Description,
+		ParamStructure: "by-name",
+		Params:         make([]OpenRpcContentDescriptor, 0),
+		Result:         OpenRpcContentDescriptor{Name: "result", Schema: JsonSchema(info.Result)},
+		Errors:         append(append([]JsonRpcError{}, info.Errors...), commonErrors...),
+		Feature:        info.Feature,
+	}
+
+	if info.Params == nil {
+		return method
+	}
+	schema := JsonSchema(info.Params)
+	properties, _ := schema["properties"].(map[string]any)
+	required, _ := schema["required"].([]string)
+	for _, param := range sortedKeys(properties) {
+		method.Params = append(method.Params, OpenRpcContentDescriptor{
+			Name:     param,
+			Required: slices.Contains(required, param),
+			Schema:   properties[param].(map[string]any),
+		})
+	}
+	return method
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Build the OpenRPC document of the registered methods and notifications - the common errors can be
+// returned by every method
+func (d *JsonRpcDispatcher) OpenRpcDocument(info OpenRpcInfo, commonErrors ...JsonRpcError) OpenRpcDocument {
+	document := OpenRpcDocument{OpenRpc: OpenRpcVersion, Info: info, Methods: make([]OpenRpcMethod, 0), Notifications: make([]OpenRpcMethod, 0), ClientMethods: make([]OpenRpcMethod, 0)}
+
+	for _, name := range sortedKeys(d.handlers) {
+		document.Methods = append(document.Methods, openRpcMethod(name, d.methods[name], commonErrors))
+	}
+	for _, name := range sortedKeys(d.notifications) {
+		notification := openRpcMethod(name, d.notifications[name], nil)
+		document.Notifications = append(document.Notifications, notification)
+	}
+	for _, name := range sortedKeys(d.clientMethods) {
+		document.ClientMethods = append(document.ClientMethods, openRpcMethod(name, d.clientMethods[name], nil))
+	}
+	return document
+}
+
+// Describe the server's methods and notifications as an OpenRPC document
+func (s *Server) DiscoverHandler(ctx context.Context, params NoParams) (OpenRpcDocument, error) {
+	info := OpenRpcInfo{Title: ServerName, Version: ServerVersion, Description: ParamsEncodingDescription}
+	return s.dispatcher.OpenRpcDocument(info, rateLimitedError), nil
+}
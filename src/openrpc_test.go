@@ -0,0 +1,93 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type SchemaFixture struct {
+	Name     string         `json:"name"`
+	Note     string         `json:"note,omitempty"`
+	Data     []byte         `json:"data"`
+	At       *time.Time     `json:"at"`
+	Tags     []string       `json:"tags"`
+	Counts   map[string]int `json:"counts"`
+	Ignored  string         `json:"-"`
+	internal string
+}
+
+func TestJsonSchema(t *testing.T) {
+	got := JsonSchema(SchemaFixture{})
+	want := map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"name":   map[string]any{"type": "string"},
+			"note":   map[string]any{"type": "string"},
+			"data":   map[string]any{"type": "string", "contentEncoding": "base64"},
+			"at":     map[string]any{"type": "string", "format": "date-time"},
+			"tags":   map[string]any{"type": "array", "items": map[string]any{"type": "string"}},
+			"counts": map[string]any{"type": "object", "additionalProperties": map[string]any{"type": "integer"}},
+		},
+		"required": []string{"name", "data", "tags", "counts"},
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got schema %v but want %v", got, want)
+	}
+}
+
+func TestDiscoverHandler(t *testing.T) {
+	server := ServerFixture()
+	alice, _ := AddFakeConnection(t, server, "alice")
+
+	response := CallMethod(t, server, alice, DiscoverRpcMethod, nil)
+	AssertSuccess(t, response)
+
+	var document OpenRpcDocument
+	if err := json.Unmarshal(response.Result, &document); err != nil {
+		t.Fatalf("got invalid OpenRPC document %s", response.Result)
+	}
+	if document.OpenRpc != OpenRpcVersion {
+		t.Errorf("got openrpc version [%s] but want [%s]", document.OpenRpc, OpenRpcVersion)
+	}
+
+	methods := make(map[string]OpenRpcMethod)
+	for _, method := range document.Methods {
+		methods[method.Name] = method
+	}
+	if len(methods) != len(server.dispatcher.handlers) {
+		t.Errorf("got [%d] methods but [%d] are registered", len(methods), len(server.dispatcher.handlers))
+	}
+
+	chat, ok := methods[ChatRpcMethod]
+	if !ok {
+		t.Fatal("got no chat method")
+	}
+	params := make(map[string]bool)
+	for _, param := range chat.Params {
+		params[param.Name] = param.Required
+	}
+	if !reflect.DeepEqual(params, map[string]bool{"msg": true, "room": false, "parentId": false}) {
+		t.Errorf("got chat params %v", params)
+	}
+	if chat.Result.Schema["type"] != "object" {
+		t.Errorf("got chat result schema %v", chat.Result.Schema)
+	}
+	codes := make(map[int]bool)
+	for _, e := range chat.Errors {
+		codes[e.Code] = true
+	}
+	if !codes[NotRoomMemberErrorCode] || !codes[RateLimitedErrorCode] {
+		t.Errorf("got chat errors %v", chat.Errors)
+	}
+
+	notifications := make(map[string]bool)
+	for _, notification := range document.Notifications {
+		notifications[notification.Name] = true
+	}
+	if !notifications[ChatNotificationRpcMethod] {
+		t.Errorf("got notifications %v without [%s]", notifications, ChatNotificationRpcMethod)
+	}
+}
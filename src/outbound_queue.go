@@ -0,0 +1,206 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	SlowConsumerDropOldest = "drop-oldest"
+	SlowConsumerDropNewest = "drop-newest"
+	SlowConsumerDisconnect = "disconnect"
+)
+
+var (
+	ErrQueueClosed  = errors.New("outbound queue closed")
+	ErrSlowConsumer = errors.New("slow consumer")
+)
+
+// Outbound queue settings - Policy decides what happens when a full queue gets another message
+type OutboundQueueConfig struct {
+	Capacity     int
+	WriteTimeout time.Duration
+	Policy       string
+}
+
+// Default outbound queue settings
+func DefaultOutboundQueueConfig() OutboundQueueConfig {
+	return OutboundQueueConfig{Capacity: 256, WriteTimeout: 5 * time.Second, Policy: SlowConsumerDropOldest}
+}
+
+// Queue depth metrics of an outbound queue
+type OutboundQueueStats struct {
+	Depth     int `json:"depth"`
+	HighWater int `json:"highWater"`
+	Dropped   int `json:"dropped"`
+}
+
+// Bounded queue of messages to a connection, drained by its own writer goroutine so that a slow
+// consumer never blocks the goroutine sending to it. Responses and requests are queued apart from
+// notifications and written first - the slow consumer policy never drops them.
+type OutboundQueue struct {
+	config         OutboundQueueConfig
+	messages       chan []byte
+	responses      chan []byte
+	done           chan struct{}
+	stopped        chan struct{}
+	onSlowConsumer func()
+	metrics        *Metrics
+	highWater      int
+	dropped        int
+	closed         bool
+	closeOnce      sync.Once
+	mu             sync.Mutex
+}
+
+// Create an outbound queue and start draining it to the connection. onSlowConsumer is called
+// when the consumer can't keep up - a write times out or fails, or the disconnect policy applies.
+// Drops and failed writes are counted in the metrics when they're given.
+func NewOutboundQueue(conn net.Conn, config OutboundQueueConfig, metrics *Metrics, onSlowConsumer func()) *OutboundQueue {
+	q := &OutboundQueue{
+		config:         config,
+		messages:       make(chan []byte, config.Capacity),
+		responses:      make(chan []byte, config.Capacity),
+		done:           make(chan struct{}),
+		stopped:        make(chan struct{}),
+		onSlowConsumer: onSlowConsumer,
+		metrics:        metrics,
+	}
+	go q.drain(conn)
+	return q
+}
+
+// Add a message to the queue, applying the slow consumer policy when the queue is full
+func (q *OutboundQueue) Enqueue(message []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	select {
+	case q.messages <- message:
+		q.highWater = max(q.highWater, len(q.messages))
+		return nil
+	default:
+	}
+
+	switch q.config.Policy {
+	case SlowConsumerDropNewest:
+		q.drop()
+		return nil
+	case SlowConsumerDisconnect:
+		q.drop()
+		go q.onSlowConsumer()
+		return ErrSlowConsumer
+	default:
+		select {
+		case <-q.messages:
+			q.drop()
+		default:
+		}
+		select {
+		case q.messages <- message:
+		default:
+			q.drop()
+		}
+		return nil
+	}
+}
+
+// Count a dropped message
+func (q *OutboundQueue) drop() {
+	q.dropped++
+	if q.metrics != nil {
+		q.metrics.AddOutboundDropped(1)
+	}
+}
+
+// Add a response or request to the queue - they're never dropped, so a consumer that lets a full
+// queue of them pile up is reported as slow
+func (q *OutboundQueue) EnqueueResponse(message []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrQueueClosed
+	}
+
+	select {
+	case q.responses <- message:
+		return nil
+	default:
+		go q.onSlowConsumer()
+		return ErrSlowConsumer
+	}
+}
+
+// Get the queue depth metrics
+func (q *OutboundQueue) Stats() OutboundQueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return OutboundQueueStats{Depth: len(q.messages) + len(q.responses), HighWater: q.highWater, Dropped: q.dropped}
+}
+
+// Write queued messages to the connection, responses first, until the queue is closed, then flush what's left
+func (q *OutboundQueue) drain(conn net.Conn) {
+	defer close(q.stopped)
+
+	for {
+		var message []byte
+		select {
+		case message = <-q.responses:
+		default:
+			select {
+			case message = <-q.responses:
+			case message = <-q.messages:
+			case <-q.done:
+				q.flush(conn, time.Now().Add(q.config.WriteTimeout))
+				return
+			}
+		}
+		if !q.write(conn, message, time.Now().Add(q.config.WriteTimeout)) {
+			return
+		}
+	}
+}
+
+// Write what's left in the queue, responses first, before the deadline
+func (q *OutboundQueue) flush(conn net.Conn, deadline time.Time) {
+	for _, messages := range []chan []byte{q.responses, q.messages} {
+		for len(messages) > 0 {
+			if !q.write(conn, <-messages, deadline) {
+				return
+			}
+		}
+	}
+}
+
+// Write a message before the deadline, reporting the consumer as slow when the write fails
+func (q *OutboundQueue) write(conn net.Conn, message []byte, deadline time.Time) bool {
+	conn.SetWriteDeadline(deadline)
+	if _, err := conn.Write(message); err != nil {
+		if q.metrics != nil {
+			q.metrics.AddNotificationFailures(1)
+		}
+		slog.Warn("Failed to write to connection, disconnecting slow consumer", "remote_addr", conn.RemoteAddr(), "error", err)
+		go q.onSlowConsumer()
+		return false
+	}
+	return true
+}
+
+// Stop accepting messages and wait for the queued messages to be flushed
+func (q *OutboundQueue) Close() {
+	q.closeOnce.Do(func() {
+		q.mu.Lock()
+		q.closed = true
+		q.mu.Unlock()
+		close(q.done)
+	})
+	<-q.stopped
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+// Outbound queue writing to one end of a pipe that nobody reads yet, with the first message already
+// taken by the writer goroutine and blocked on the pipe
+func BlockedQueueFixture(t testing.TB, policy string) (*OutboundQueue, net.Conn, chan struct{}) {
+	t.Helper()
+	server, client := net.Pipe()
+	slow := make(chan struct{}, 1)
+	config := OutboundQueueConfig{Capacity: 2, WriteTimeout: time.Second, Policy: policy}
+	queue := NewOutboundQueue(server, config, nil, func() { slow <- struct{}{} })
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+		queue.Close()
+	})
+
+	queue.Enqueue([]byte("1\n"))
+	deadline := time.Now().Add(time.Second)
+	for queue.Stats().Depth != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("writer goroutine never took the first message")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return queue, client, slow
+}
+
+// Read the messages written to the pipe until it's closed
+func ReadMessages(conn net.Conn) []string {
+	messages := make([]string, 0)
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		messages = append(messages, scanner.Text())
+	}
+	return messages
+}
+
+func AssertMessages(t testing.TB, got []string, want []string) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("got messages %v but want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("got messages %v but want %v", got, want)
+		}
+	}
+}
+
+func AssertStats(t testing.TB, got OutboundQueueStats, want OutboundQueueStats) {
+	t.Helper()
+	if got != want {
+		t.Errorf("got stats %+v but want %+v", got, want)
+	}
+}
+
+func TestOutboundQueue(t *testing.T) {
+	t.Run("messages are written in order and flushed on close", func(t *testing.T) {
+		server, client := net.Pipe()
+		queue := NewOutboundQueue(server, DefaultOutboundQueueConfig(), nil, func() {})
+
+		for _, m := range []string{"a\n", "b\n", "c\n"} {
+			AssertErrorNotNil(t, queue.Enqueue([]byte(m)))
+		}
+
+		read := make(chan []string)
+		go func() { read <- ReadMessages(client) }()
+		queue.Close()
+		server.Close()
+
+		AssertMessages(t, <-read, []string{"a", "b", "c"})
+		if err := queue.Enqueue([]byte("d\n")); err != ErrQueueClosed {
+			t.Errorf("got error [%v] but want [%v]", err, ErrQueueClosed)
+		}
+	})
+
+	t.Run("drop oldest keeps the newest messages", func(t *testing.T) {
+		queue, client, _ := BlockedQueueFixture(t, SlowConsumerDropOldest)
+		for _, m := range []string{"2\n", "3\n", "4\n"} {
+			AssertErrorNotNil(t, queue.Enqueue([]byte(m)))
+		}
+		AssertStats(t, queue.Stats(), OutboundQueueStats{Depth: 2, HighWater: 2, Dropped: 1})
+
+		read := make(chan []string)
+		go func() { read <- ReadMessages(client) }()
+		queue.Close()
+		client.SetReadDeadline(time.Now())
+
+		AssertMessages(t, <-read, []string{"1", "3", "4"})
+	})
+
+	t.Run("drop newest keeps the oldest messages", func(t *testing.T) {
+		queue, client, _ := BlockedQueueFixture(t, SlowConsumerDropNewest)
+		for _, m := range []string{"2\n", "3\n", "4\n"} {
+			AssertErrorNotNil(t, queue.Enqueue([]byte(m)))
+		}
+		AssertStats(t, queue.Stats(), OutboundQueueStats{Depth: 2, HighWater: 2, Dropped: 1})
+
+		read := make(chan []string)
+		go func() { read <- ReadMessages(client) }()
+		queue.Close()
+		client.SetReadDeadline(time.Now())
+
+		AssertMessages(t, <-read, []string{"1", "2", "3"})
+	})
+
+	t.Run("responses are never dropped and go first", func(t *testing.T) {
+		queue, client, _ := BlockedQueueFixture(t, SlowConsumerDropNewest)
+		for _, m := range []string{"2\n", "3\n", "4\n"} {
+			AssertErrorNotNil(t, queue.Enqueue([]byte(m)))
+		}
+		AssertErrorNotNil(t, queue.EnqueueResponse([]byte("response\n")))
+		AssertStats(t, queue.Stats(), OutboundQueueStats{Depth: 3, HighWater: 2, Dropped: 1})
+
+		read := make(chan []string)
+		go func() { read <- ReadMessages(client) }()
+		queue.Close()
+		client.SetReadDeadline(time.Now())
+
+		AssertMessages(t, <-read, []string{"1", "response", "2", "3"})
+	})
+
+	t.Run("a full queue of responses reports the slow consumer", func(t *testing.T) {
+		queue, _, slow := BlockedQueueFixture(t, SlowConsumerDropOldest)
+		queue.EnqueueResponse([]byte("a\n"))
+		queue.EnqueueResponse([]byte("b\n"))
+
+		if err := queue.EnqueueResponse([]byte("c\n")); err != ErrSlowConsumer {
+			t.Errorf("got error [%v] but want [%v]", err, ErrSlowConsumer)
+		}
+		select {
+		case <-slow:
+		case <-time.After(time.Second):
+			t.Fatal("slow consumer was not reported")
+		}
+	})
+
+	t.Run("disconnect reports the slow consumer when the queue is full", func(t *testing.T) {
+		queue, _, slow := BlockedQueueFixture(t, SlowConsumerDisconnect)
+		queue.Enqueue([]byte("2\n"))
+		queue.Enqueue([]byte("3\n"))
+
+		if err := queue.Enqueue([]byte("4\n")); err != ErrSlowConsumer {
+			t.Errorf("got error [%v] but want [%v]", err, ErrSlowConsumer)
+		}
+		select {
+		case <-slow:
+		case <-time.After(time.Second):
+			t.Fatal("slow consumer was not reported")
+		}
+	})
+
+	t.Run("a write that times out reports the slow consumer", func(t *testing.T) {
+		server, client := net.Pipe()
+		defer client.Close()
+		slow := make(chan struct{}, 1)
+		config := OutboundQueueConfig{Capacity: 2, WriteTimeout: 10 * time.Millisecond, Policy: SlowConsumerDropOldest}
+		queue := NewOutboundQueue(server, config, nil, func() { slow <- struct{}{} })
+		defer queue.Close()
+
+		queue.Enqueue([]byte("1\n"))
+		select {
+		case <-slow:
+		case <-time.After(time.Second):
+			t.Fatal("slow consumer was not reported")
+		}
+	})
+}
+
+func TestConnectionOutboundQueue(t *testing.T) {
+	t.Run("writes go through the queue once it's started", func(t *testing.T) {
+		server, client := net.Pipe()
+		connection := &Connection{id: "1", Conn: server}
+		connection.StartOutboundQueue(DefaultOutboundQueueConfig(), func() {})
+
+		message := []byte("hello\n")
+		n, err := connection.Write(message)
+		AssertErrorNotNil(t, err)
+		if n != len(message) {
+			t.Errorf("got [%d] bytes written but want [%d]", n, len(message))
+		}
+		copy(message, "world\n")
+
+		read := make(chan []string)
+		go func() { read <- ReadMessages(client) }()
+		connection.Close()
+
+		AssertMessages(t, <-read, []string{"hello"})
+		AssertStats(t, connection.OutboundStats(), OutboundQueueStats{Depth: 0, HighWater: 1, Dropped: 0})
+	})
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"context"
+	"math"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RateLimitScopeConnection = "connection"
+	RateLimitScopeUser       = "user"
+	RateLimitScopeIP         = "ip"
+	AnyMethod                = "*"
+	DefaultMaxViolations     = 10
+	DefaultViolationWindow   = time.Minute
+	DefaultBucketIdleTTL     = 10 * time.Minute
+	MaxRetryAfter            = time.Hour
+)
+
+// Token bucket limit - Rate tokens are added per second up to Burst tokens, and each request takes one.
+// A Rate of 0 never refills, so only Burst requests are allowed until the bucket is forgotten.
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Refill the bucket for the time passed since it was last used
+func (b *tokenBucket) refill(limit RateLimit, now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	b.tokens = math.Min(limit.Burst, b.tokens+elapsed*math.Max(0, limit.Rate))
+	b.last = now
+}
+
+// Time until the bucket has a token, at most MaxRetryAfter
+func (b *tokenBucket) retryAfter(limit RateLimit) time.Duration {
+	if b.tokens >= 1 {
+		return 0
+	}
+	if limit.Rate <= 0 {
+		return MaxRetryAfter
+	}
+	return min(MaxRetryAfter, time.Duration((1-b.tokens)/limit.Rate*float64(time.Second)))
+}
+
+// Rate limiter with token buckets per connection, user and remote IP, limited per RPC method.
+// Clients that are limited too often within the violation window should be disconnected.
+// Buckets unused for the idle TTL are forgotten, so users and IPs that went away don't keep theirs.
+type RateLimiter struct {
+	limits          map[string]map[string]RateLimit
+	buckets         map[string]*tokenBucket
+	violations      map[string][]time.Time
+	maxViolations   int
+	violationWindow time.Duration
+	idleTTL         time.Duration
+	lastSweep       time.Time
+	now             func() time.Time
+	mu              sync.Mutex
+}
+
+// Create a rate limiter with no limits
+func NewRateLimiter() *RateLimiter {
+	return &RateLimiter{
+		limits:          make(map[string]map[string]RateLimit),
+		buckets:         make(map[string]*tokenBucket),
+		violations:      make(map[string][]time.Time),
+		maxViolations:   DefaultMaxViolations,
+		violationWindow: DefaultViolationWindow,
+		idleTTL:         DefaultBucketIdleTTL,
+		now:             time.Now,
+	}
+}
+
+// Create a rate limiter with the default limits - chat is limited more tightly than other methods
+func NewDefaultRateLimiter() *RateLimiter {
+	limiter := NewRateLimiter()
+	limiter.SetLimit(RateLimitScopeConnection, AnyMethod, RateLimit{Rate: 20, Burst: 40})
+	limiter.SetLimit(RateLimitScopeConnection, ChatRpcMethod, RateLimit{Rate: 5, Burst: 10})
+	limiter.SetLimit(RateLimitScopeUser, ChatRpcMethod, RateLimit{Rate: 5, Burst: 10})
+	limiter.SetLimit(RateLimitScopeIP, AnyMethod, RateLimit{Rate: 50, Burst: 100})
+	limiter.SetLimit(RateLimitScopeIP, ChatRpcMethod, RateLimit{Rate: 20, Burst: 40})
+	return limiter
+}
+
+// Set the limit of a method within a scope - AnyMethod sets the limit for methods without their own
+func (r *RateLimiter) SetLimit(scope string, method string, limit RateLimit) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.limits[scope]; !ok {
+		r.limits[scope] = make(map[string]RateLimit)
+	}
+	r.limits[scope][method] = limit
+}
+
+// Get the limit of a method within a scope, and the method key its bucket is shared under
+func (r *RateLimiter) limitFor(scope string, method string) (RateLimit, string, bool) {
+	if limit, ok := r.limits[scope][method]; ok {
+		return limit, method, true
+	}
+	limit, ok := r.limits[scope][AnyMethod]
+	return limit, AnyMethod, ok
+}
+
+// Take a token for the method from the bucket of every subject, keyed by scope. Tokens are only taken
+// when every bucket has one - otherwise the longest wait until they all do is returned.
+func (r *RateLimiter) Allow(method string, subjects map[string]string) (bool, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	if now.Sub(r.lastSweep) >= r.idleTTL {
+		r.sweep(now)
+	}
+	buckets := make([]*tokenBucket, 0, len(subjects))
+	var retryAfter time.Duration
+
+	for scope, subject := range subjects {
+		limit, key, ok := r.limitFor(scope, method)
+		if subject == "" || !ok {
+			continue
+		}
+
+		bucketKey := scope + "/" + subject + "/" + key
+		bucket, ok := r.buckets[bucketKey]
+		if !ok {
+			bucket = &tokenBucket{tokens: limit.Burst, last: now}
+			r.buckets[bucketKey] = bucket
+		}
+		bucket.refill(limit, now)
+		retryAfter = max(retryAfter, bucket.retryAfter(limit))
+		buckets = append(buckets, bucket)
+	}
+
+	if retryAfter > 0 {
+		return false, retryAfter
+	}
+	for _, bucket := range buckets {
+		bucket.tokens--
+	}
+	return true, 0
+}
+
+// Forget the buckets that weren't used for the idle TTL and the violations that left the window.
+// An idle bucket has refilled under any limit that refills within the TTL, so forgetting it changes nothing.
+func (r *RateLimiter) sweep(now time.Time) {
+	for key, bucket := range r.buckets {
+		if now.Sub(bucket.last) >= r.idleTTL {
+			delete(r.buckets, key)
+		}
+	}
+	for connectionId, times := range r.violations {
+		if len(times) == 0 || now.Sub(times[len(times)-1]) >= r.violationWindow {
+			delete(r.violations, connectionId)
+		}
+	}
+	r.lastSweep = now
+}
+
+// Record a violation by a connection, reporting whether it has been limited too often and should be disconnected
+func (r *RateLimiter) RecordViolation(connectionId string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	recent := make([]time.Time, 0, len(r.violations[connectionId])+1)
+	for _, t := range r.violations[connectionId] {
+		if now.Sub(t) < r.violationWindow {
+			recent = append(recent, t)
+		}
+	}
+	recent = append(recent, now)
+	r.violations[connectionId] = recent
+	return len(recent) >= r.maxViolations
+}
+
+// Check whether a connection has been limited too often within the violation window
+func (r *RateLimiter) ShouldDisconnect(connectionId string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	count := 0
+	for _, t := range r.violations[connectionId] {
+		if now.Sub(t) < r.violationWindow {
+			count++
+		}
+	}
+	return count >= r.maxViolations
+}
+
+// Forget the buckets and violations of a closed connection
+func (r *RateLimiter) Forget(connectionId string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	prefix := RateLimitScopeConnection + "/" + connectionId + "/"
+	for key := range r.buckets {
+		if strings.HasPrefix(key, prefix) {
+			delete(r.buckets, key)
+		}
+	}
+	delete(r.violations, connectionId)
+}
+
+// Reject requests over the connection, user or remote IP limits with a rate limited error carrying the retry delay
+func (s *Server) RateLimitMiddleware(next RequestHandler) RequestHandler {
+	return func(ctx context.Context, request JsonRpcRequest) JsonRpcResponse {
+		connection, ok := ConnectionFromContext(ctx)
+		if !ok {
+			return next(ctx, request)
+		}
+
+		subjects := map[string]string{RateLimitScopeConnection: connection.id, RateLimitScopeIP: RemoteIP(connection)}
+		if user, ok := s.userService.UserForConnection(connection.id); ok {
+			subjects[RateLimitScopeUser] = user
+		}
+
+		allowed, retryAfter := s.rateLimiter.Allow(request.Method, subjects)
+		if allowed {
+			return next(ctx, request)
+		}
+
+		logger := LoggerFromContext(ctx)
+		logger.Info("Rate limited", "retry_after", retryAfter)
+		if s.rateLimiter.RecordViolation(connection.id) {
+			logger.Warn("Connection repeatedly exceeded rate limits")
+		}
+		response := NewErrorResponse(request, RateLimitedErrorCode, "Rate limit exceeded")
+		response.Error.Data = RateLimitedErrorData{Method: request.Method, RetryAfterMs: (retryAfter + time.Millisecond - 1).Milliseconds()}
+		return response
+	}
+}
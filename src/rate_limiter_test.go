@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// Rate limiter with a clock that only moves when the test advances it
+func RateLimiterFixture() (*RateLimiter, *time.Time) {
+	limiter := NewRateLimiter()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	limiter.now = func() time.Time { return now }
+	limiter.SetLimit(RateLimitScopeConnection, AnyMethod, RateLimit{Rate: 1, Burst: 2})
+	limiter.SetLimit(RateLimitScopeUser, ChatRpcMethod, RateLimit{Rate: 1, Burst: 3})
+	return limiter, &now
+}
+
+func AssertAllowed(t testing.TB, limiter *RateLimiter, method string, subjects map[string]string, want bool) time.Duration {
+	t.Helper()
+	allowed, retryAfter := limiter.Allow(method, subjects)
+	if allowed != want {
+		t.Fatalf("got allowed [%t] but want [%t]", allowed, want)
+	}
+	return retryAfter
+}
+
+func TestRateLimiter(t *testing.T) {
+	t.Run("burst is allowed and then limited until refilled", func(t *testing.T) {
+		limiter, now := RateLimiterFixture()
+		subjects := map[string]string{RateLimitScopeConnection: "1"}
+
+		AssertAllowed(t, limiter, ChatRpcMethod, subjects, true)
+		AssertAllowed(t, limiter, ChatRpcMethod, subjects, true)
+		retryAfter := AssertAllowed(t, limiter, ChatRpcMethod, subjects, false)
+		if retryAfter != time.Second {
+			t.Errorf("got retry after [%s] but want [1s]", retryAfter)
+		}
+
+		*now = now.Add(time.Second)
+		AssertAllowed(t, limiter, ChatRpcMethod, subjects, true)
+	})
+
+	t.Run("user limit is shared across connections", func(t *testing.T) {
+		limiter, _ := RateLimiterFixture()
+		first := map[string]string{RateLimitScopeConnection: "1", RateLimitScopeUser: "alice"}
+		second := map[string]string{RateLimitScopeConnection: "2", RateLimitScopeUser: "alice"}
+
+		AssertAllowed(t, limiter, ChatRpcMethod, first, true)
+		AssertAllowed(t, limiter, ChatRpcMethod, first, true)
+		AssertAllowed(t, limiter, ChatRpcMethod, second, true)
+		AssertAllowed(t, limiter, ChatRpcMethod, second, false)
+	})
+
+	t.Run("rejected requests don't take tokens", func(t *testing.T) {
+		limiter, _ := RateLimiterFixture()
+		limited := map[string]string{RateLimitScopeConnection: "1", RateLimitScopeUser: "alice"}
+		AssertAllowed(t, limiter, ChatRpcMethod, limited, true)
+		AssertAllowed(t, limiter, ChatRpcMethod, limited, true)
+		AssertAllowed(t, limiter, ChatRpcMethod, limited, false)
+
+		AssertAllowed(t, limiter, ChatRpcMethod, map[string]string{RateLimitScopeUser: "alice"}, true)
+	})
+
+	t.Run("limits without a refill rate", func(t *testing.T) {
+		limiter, _ := RateLimiterFixture()
+		limiter.SetLimit(RateLimitScopeIP, AnyMethod, RateLimit{Rate: 0, Burst: 1})
+		subjects := map[string]string{RateLimitScopeIP: "10.0.0.1"}
+
+		AssertAllowed(t, limiter, ChatRpcMethod, subjects, true)
+		if retryAfter := AssertAllowed(t, limiter, ChatRpcMethod, subjects, false); retryAfter != MaxRetryAfter {
+			t.Errorf("got retry after [%s] but want [%s]", retryAfter, MaxRetryAfter)
+		}
+	})
+
+	t.Run("idle buckets and old violations are forgotten", func(t *testing.T) {
+		limiter, now := RateLimiterFixture()
+		limiter.SetLimit(RateLimitScopeIP, AnyMethod, RateLimit{Rate: 1, Burst: 2})
+		AssertAllowed(t, limiter, ChatRpcMethod, map[string]string{RateLimitScopeUser: "alice", RateLimitScopeIP: "10.0.0.1"}, true)
+		limiter.RecordViolation("1")
+
+		*now = now.Add(DefaultBucketIdleTTL)
+		AssertAllowed(t, limiter, ChatRpcMethod, map[string]string{RateLimitScopeUser: "bob"}, true)
+		limiter.mu.Lock()
+		defer limiter.mu.Unlock()
+		if len(limiter.buckets) != 1 || limiter.buckets["user/bob/"+ChatRpcMethod] == nil {
+			t.Errorf("got buckets %v but wanted only bob's", limiter.buckets)
+		}
+		if len(limiter.violations) != 0 {
+			t.Errorf("got violations %v after the window", limiter.violations)
+		}
+	})
+
+	t.Run("repeated violations disconnect", func(t *testing.T) {
+		limiter, now := RateLimiterFixture()
+		for i := 0; i < DefaultMaxViolations-1; i++ {
+			limiter.RecordViolation("1")
+		}
+		if limiter.ShouldDisconnect("1") {
+			t.Fatal("got disconnect before the violation limit")
+		}
+
+		*now = now.Add(DefaultViolationWindow)
+		limiter.RecordViolation("1")
+		if limiter.ShouldDisconnect("1") {
+			t.Error("got disconnect for violations outside the window")
+		}
+	})
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	server := ServerFixture()
+	server.rateLimiter.SetLimit(RateLimitScopeConnection, ChatRpcMethod, RateLimit{Rate: 0.5, Burst: 1})
+	alice, _ := AddFakeConnection(t, server, "alice")
+
+	AssertSuccess(t, CallMethod(t, server, alice, ChatRpcMethod, ChatRequestParams{Msg: []byte("hi")}))
+	response := CallMethod(t, server, alice, ChatRpcMethod, ChatRequestParams{Msg: []byte("hi")})
+	AssertErrorCode(t, response, RateLimitedErrorCode)
+
+	data, _ := json.Marshal(response.Error.Data)
+	var errorData RateLimitedErrorData
+	json.Unmarshal(data, &errorData)
+	if errorData.Method != ChatRpcMethod || errorData.RetryAfterMs <= 0 || errorData.RetryAfterMs > 2000 {
+		t.Errorf("got error data %+v", errorData)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Prefix of the REPL's own commands, which are never sent to the server
+const ReplCommandPrefix = ":"
+
+const replHelp = `Type a JSON-RPC request, or a method followed by its params:
+
+  {"method": "joinChatRoom", "params": {"room": "dev"}}
+  listRooms
+  chat {"room": "general", "msg": "aGk="}
+
+jsonrpc and id are filled in when they're missing. Notifications are printed as they arrive.
+
+  :save <file>    save the requests of the session and their responses as JSON lines, credentials redacted
+  :replay <file>  send the requests of a saved session again, one after another
+  :help           show this help
+  :quit           leave
+`
+
+// Params holding credentials - their values are never printed or saved
+var credentialParams = map[string]bool{"password": true, "token": true, "secret": true}
+
+// Value credentials are replaced with
+const redactedCredential = "[REDACTED]"
+
+// Replace the credentials of JSON object params - other params are kept as they are
+func redactCredentials(params json.RawMessage) json.RawMessage {
+	var fields map[string]json.RawMessage
+	if json.Unmarshal(params, &fields) != nil {
+		return params
+	}
+	redacted := false
+	for key := range fields {
+		if credentialParams[strings.ToLower(key)] {
+			fields[key], _ = json.Marshal(redactedCredential)
+			redacted = true
+		}
+	}
+	if !redacted {
+		return params
+	}
+	return mustMarshal(fields)
+}
+
+// A request as it's typed and saved - unlike JsonRpcRequest the params are kept as JSON
+type ReplRequest struct {
+	JsonRpc string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Id      string          `json:"id"`
+}
+
+// A request of a session with the response it got - Elapsed is since the start of the session
+type SessionEntry struct {
+	Elapsed  time.Duration   `json:"elapsed"`
+	Took     time.Duration   `json:"took"`
+	Request  ReplRequest     `json:"request"`
+	Response JsonRpcResponse `json:"response"`
+}
+
+// Debug mode where raw JSON-RPC requests are typed and responses are printed with the request they answer.
+// Notifications go to their own writer so they can be watched apart from the responses.
+type RawRepl struct {
+	client        *JsonRpcClient
+	out           io.Writer
+	notifications io.Writer
+	start         time.Time
+	session       []SessionEntry
+	mu            sync.Mutex
+}
+
+// Create a REPL printing responses to out and notifications to notifications
+func NewRawRepl(client *JsonRpcClient, out io.Writer, notifications io.Writer) *RawRepl {
+	repl := &RawRepl{client: client, out: out, notifications: notifications, start: time.Now()}
+	client.SetNotificationHandler(repl.handleNotification)
+	return repl
+}
+
+// Print a notification with the time since the start of the session
+func (r *RawRepl) handleNotification(notification JsonRpcNotification) {
+	params := json.RawMessage(notification.Params)
+	if !json.Valid(params) {
+		params = nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	fmt.Fprintf(r.notifications, "[+%s] %s %s\n", r.elapsed(), notification.Method, prettyJSON(params))
+}
+
+// Time since the start of the session, rounded to the millisecond
+func (r *RawRepl) elapsed() time.Duration {
+	return time.Since(r.start).Round(time.Millisecond)
+}
+
+// Indent JSON for printing, leaving anything that isn't JSON as it is
+func prettyJSON(raw json.RawMessage) string {
+	if len(raw) == 0 {
+		return ""
+	}
+	var v any
+	if json.Unmarshal(raw, &v) != nil {
+		return string(raw)
+	}
+	return formatJSON(v)
+}
+
+// Parse a typed line into a request - either a JSON object or a method name followed by JSON params
+func ParseReplRequest(line string) (ReplRequest, error) {
+	var request ReplRequest
+	line = strings.TrimSpace(line)
+	if strings.HasPrefix(line, "{") {
+		if err := json.Unmarshal([]byte(line), &request); err != nil {
+			return request, fmt.Errorf("invalid request: %w", err)
+		}
+	} else {
+		method, params, _ := strings.Cut(line, " ")
+		request.Method = method
+		if params = strings.TrimSpace(params); params != "" {
+			request.Params = json.RawMessage(params)
+		}
+	}
+
+	if request.Method == "" {
+		return request, errors.New("missing method")
+	}
+	if len(request.Params) > 0 && !json.Valid(request.Params) {
+		return request, errors.New("params must be JSON")
+	}
+	if request.JsonRpc == "" {
+		request.JsonRpc = JsonRpcVersion
+	}
+	return request, nil
+}
+
+// Send a request and wait for its response - a typed id is kept, otherwise the client picks one
+func (r *RawRepl) Send(request ReplRequest) SessionEntry {
+	built := r.client.BuildRequest(request.Params, request.Method)
+	built.JsonRpc = request.JsonRpc
+	if request.Id != "" && request.Id != built.Id {
+		r.client.pending.Forget(built.Id)
+		r.client.pending.Add(request.Id)
+		built.Id = request.Id
+	}
+	request.Id = built.Id
+
+	entry := SessionEntry{Elapsed: r.elapsed(), Request: request}
+	entry.Request.Params = redactCredentials(request.Params)
+	sent := time.Now()
+	entry.Response = r.client.SendAndRecv(built)
+	entry.Took = time.Since(sent).Round(time.Microsecond)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.session = append(r.session, entry)
+	fmt.Fprintf(r.out, "--> [+%s] %s\n", entry.Elapsed, prettyJSON(mustMarshal(entry.Request)))
+	fmt.Fprintf(r.out, "<-- [%s] %s\n", entry.Took, prettyJSON(mustMarshal(entry.Response)))
+	return entry
+}
+
+// Marshal a value that always serializes
+func mustMarshal(v any) json.RawMessage {
+	raw, _ := json.Marshal(v)
+	return raw
+}
+
+// Save the requests of the session and their responses, one JSON line each
+func (r *RawRepl) Save(path string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var lines strings.Builder
+	for _, entry := range r.session {
+		lines.Write(mustMarshal(entry))
+		lines.WriteString("\n")
+	}
+	return os.WriteFile(path, []byte(lines.String()), 0o600)
+}
+
+// Send the requests saved in a session file again - ids are picked afresh so they can't clash with
+// the requests already sent. Lines holding a bare request are replayed too.
+func (r *RawRepl) Replay(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		var entry SessionEntry
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			return fmt.Errorf("line %d: %w", number, err)
+		}
+		if entry.Request.Method == "" {
+			if entry.Request, err = ParseReplRequest(line); err != nil {
+				return fmt.Errorf("line %d: %w", number, err)
+			}
+		}
+		entry.Request.Id = ""
+		r.Send(entry.Request)
+	}
+	return scanner.Err()
+}
+
+// Read lines and run them until :quit or the end of the input
+func (r *RawRepl) Run(in io.Reader) {
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, ReplCommandPrefix) {
+			request, err := ParseReplRequest(line)
+			if err != nil {
+				fmt.Fprintln(r.out, "error:", err)
+				continue
+			}
+			r.Send(request)
+			continue
+		}
+
+		command, arg, _ := strings.Cut(strings.TrimPrefix(line, ReplCommandPrefix), " ")
+		arg = strings.TrimSpace(arg)
+		var err error
+		switch command {
+		case "quit", "q":
+			return
+		case "help":
+			fmt.Fprint(r.out, replHelp)
+		case "save":
+			if err = r.Save(arg); err == nil {
+				fmt.Fprintf(r.out, "saved %d requests to %s\n", len(r.session), arg)
+			}
+		case "replay":
+			err = r.Replay(arg)
+		default:
+			err = fmt.Errorf("unknown command [%s], try :help", command)
+		}
+		if err != nil {
+			fmt.Fprintln(r.out, "error:", err)
+		}
+	}
+}
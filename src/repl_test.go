@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseReplRequest(t *testing.T) {
+	request, err := ParseReplRequest(`{"method": "joinChatRoom", "params": {"room": "dev"}, "id": "42"}`)
+	if err != nil || request.Method != JoinChatRoomRpcMethod || string(request.Params) != `{"room": "dev"}` || request.Id != "42" || request.JsonRpc != JsonRpcVersion {
+		t.Errorf("got request %+v and error %v", request, err)
+	}
+
+	request, err = ParseReplRequest(`listRooms {"all": true}`)
+	if err != nil || request.Method != ListRoomsRpcMethod || string(request.Params) != `{"all": true}` || request.Id != "" {
+		t.Errorf("got request %+v and error %v for a method with params", request, err)
+	}
+
+	for _, line := range []string{`{"params": {}}`, `{"method": `, `listRooms {oops`} {
+		if _, err := ParseReplRequest(line); err == nil {
+			t.Errorf("got no error for [%s]", line)
+		}
+	}
+}
+
+func TestRawReplSession(t *testing.T) {
+	var methods []string
+	client := FakeServerClient(t, func(request JsonRpcRequest) any {
+		methods = append(methods, request.Method)
+		return map[string]any{"params": json.RawMessage(request.Params)}
+	})
+	var out bytes.Buffer
+	repl := NewRawRepl(client, &out, &bytes.Buffer{})
+	session := filepath.Join(t.TempDir(), "session.jsonl")
+
+	repl.Run(strings.NewReader(`{"method": "joinChatRoom", "params": {"room": "dev"}, "id": "first"}
+listRooms
+not json {
+:save ` + session + `
+:replay ` + session + `
+:quit
+listMembers
+`))
+
+	if strings.Join(methods, ",") != "joinChatRoom,listRooms,joinChatRoom,listRooms" {
+		t.Errorf("got methods %v", methods)
+	}
+	if !strings.Contains(out.String(), `"id": "first"`) || !strings.Contains(out.String(), `"room": "dev"`) || !strings.Contains(out.String(), "error: params must be JSON") {
+		t.Errorf("got output [%s]", out.String())
+	}
+
+	saved, _ := os.ReadFile(session)
+	lines := strings.Split(strings.TrimSpace(string(saved)), "\n")
+	var entry SessionEntry
+	if len(lines) != 2 || json.Unmarshal([]byte(lines[0]), &entry) != nil || entry.Response.Id != "first" || string(entry.Response.Result) != `{"params":{"room":"dev"}}` {
+		t.Errorf("got session %q", lines)
+	}
+	if replayed := repl.session[2]; replayed.Request.Id == "first" || replayed.Request.Method != JoinChatRoomRpcMethod {
+		t.Errorf("got replayed request %+v", replayed.Request)
+	}
+}
+
+func TestRawReplRedactsCredentials(t *testing.T) {
+	var sent string
+	client := FakeServerClient(t, func(request JsonRpcRequest) any {
+		sent = string(request.Params)
+		return map[string]any{"name": "alice"}
+	})
+	var out bytes.Buffer
+	repl := NewRawRepl(client, &out, &bytes.Buffer{})
+	session := filepath.Join(t.TempDir(), "session.jsonl")
+
+	repl.Run(strings.NewReader(`createUser {"name": "alice", "password": "correct horse"}
+:save ` + session + `
+`))
+
+	if !strings.Contains(sent, "correct horse") {
+		t.Errorf("got params [%s] sent to the server", sent)
+	}
+	saved, _ := os.ReadFile(session)
+	for _, text := range []string{out.String(), string(saved)} {
+		if strings.Contains(text, "correct horse") || !strings.Contains(text, redactedCredential) || !strings.Contains(text, "alice") {
+			t.Errorf("got the password in [%s]", text)
+		}
+	}
+}
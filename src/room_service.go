@@ -0,0 +1,875 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRoomNotFound     = errors.New("room not found")
+	ErrRoomExists       = errors.New("room already exists")
+	ErrInvalidRoomName  = errors.New("invalid room name")
+	ErrNotRoomMember    = errors.New("not a member of the room")
+	ErrPermissionDenied = errors.New("permission denied")
+)
+
+var roomNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+var ErrInvalidRole = errors.New("invalid role")
+
+// Rank of each room role - a moderator can only act on members ranked below them
+var roleRanks = map[string]int{RoleReadOnly: 0, RoleMember: 1, RoleModerator: 2, RoleOwner: 3}
+
+// Get the rank of a room role, -1 for non-members
+func RoleRank(role string) int {
+	rank, ok := roleRanks[role]
+	if !ok {
+		return -1
+	}
+	return rank
+}
+
+// A chat room, the identities of its members and the roles of members who aren't plain members
+type Room struct {
+	Name      string
+	Owner     string
+	Topic     string
+	Members   map[string]bool
+	Roles     map[string]string
+	CreatedAt time.Time
+	// Cluster node the room was created on
+	Node string
+}
+
+// Room Data store Interface - rooms are changed through the store, which leaves a room as it was when
+// the change can't be stored
+type RoomStore interface {
+	Add(room *Room) error
+	Get(name string) (*Room, bool)
+	List() []*Room
+	Delete(name string) error
+	AddMember(name string, member string) error
+	RemoveMember(name string, member string) error
+	SetRole(name string, member string, role string) error
+	SetTopic(name string, topic string) error
+	RenameMember(name string, from string, to string) error
+}
+
+// Store rooms in memory with a map
+type InMemoryRoomStore struct {
+	rooms map[string]*Room
+}
+
+// Create a new in-memory room store
+func NewRoomStore() *InMemoryRoomStore {
+	rooms := make(map[string]*Room)
+	return &InMemoryRoomStore{rooms: rooms}
+}
+
+// Insert a room into the map
+func (s *InMemoryRoomStore) Add(room *Room) error {
+	s.rooms[room.Name] = room
+	return nil
+}
+
+// Get a room by name
+func (s *InMemoryRoomStore) Get(name string) (*Room, bool) {
+	room, ok := s.rooms[name]
+	return room, ok
+}
+
+// List all rooms
+func (s *InMemoryRoomStore) List() []*Room {
+	roomList := make([]*Room, 0, len(s.rooms))
+	for _, r := range s.rooms {
+		roomList = append(roomList, r)
+	}
+	return roomList
+}
+
+// Remove a room from the map
+func (s *InMemoryRoomStore) Delete(name string) error {
+	delete(s.rooms, name)
+	return nil
+}
+
+// Add a member to a room
+func (s *InMemoryRoomStore) AddMember(name string, member string) error {
+	if room, ok := s.rooms[name]; ok {
+		room.Members[member] = true
+	}
+	return nil
+}
+
+// Remove a member and their role from a room
+func (s *InMemoryRoomStore) RemoveMember(name string, member string) error {
+	if room, ok := s.rooms[name]; ok {
+		delete(room.Members, member)
+		delete(room.Roles, member)
+	}
+	return nil
+}
+
+// Set the role of a room member - plain members have no role stored
+func (s *InMemoryRoomStore) SetRole(name string, member string, role string) error {
+	if room, ok := s.rooms[name]; ok {
+		if role == RoleMember {
+			delete(room.Roles, member)
+		} else {
+			room.Roles[member] = role
+		}
+	}
+	return nil
+}
+
+// Set the topic of a room
+func (s *InMemoryRoomStore) SetTopic(name string, topic string) error {
+	if room, ok := s.rooms[name]; ok {
+		room.Topic = topic
+	}
+	return nil
+}
+
+// Move a member of a room to a new identity, or remove them when the new identity is empty
+func (s *InMemoryRoomStore) RenameMember(name string, from string, to string) error {
+	if room, ok := s.rooms[name]; ok {
+		renameRoomMember(room, from, to)
+	}
+	return nil
+}
+
+// A room as it's stored - its members are stored as memberships
+type roomRecord struct {
+	Name      string    `json:"name"`
+	Owner     string    `json:"owner,omitempty"`
+	Topic     string    `json:"topic,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+	Node      string    `json:"node,omitempty"`
+}
+
+// A member of a room as it's stored, with their role unless they're a plain member
+type membershipRecord struct {
+	Room   string `json:"room"`
+	Member string `json:"member"`
+	Role   string `json:"role,omitempty"`
+}
+
+// Store rooms in memory, writing them and the memberships of users through to storage so they outlive the
+// server. Each change writes only the keys it touches, and anonymous members, whose connection ids don't
+// outlive the run, aren't stored.
+type PersistentRoomStore struct {
+	*InMemoryRoomStore
+	storage Storage
+}
+
+// Create a room store over storage, loading the rooms and memberships it holds
+func NewPersistentRoomStore(storage Storage) (*PersistentRoomStore, error) {
+	s := &PersistentRoomStore{InMemoryRoomStore: NewRoomStore(), storage: storage}
+	err := storage.View(func(tx StorageTx) error {
+		err := LoadBucket(tx, RoomsBucket, func(record *roomRecord) {
+			s.InMemoryRoomStore.Add(&Room{Name: record.Name, Owner: record.Owner, Topic: record.Topic, Members: make(map[string]bool), Roles: make(map[string]string), CreatedAt: record.CreatedAt, Node: record.Node})
+		})
+		if err != nil {
+			return err
+		}
+		return LoadBucket(tx, MembershipsBucket, func(membership *membershipRecord) {
+			if room, ok := s.InMemoryRoomStore.Get(membership.Room); ok {
+				room.Members[membership.Member] = true
+				if membership.Role != "" {
+					room.Roles[membership.Member] = membership.Role
+				}
+			}
+		})
+	})
+	return s, err
+}
+
+// Key of a room's membership - room names can't contain a slash
+func membershipKey(room string, member string) string {
+	return room + "/" + member
+}
+
+// Check whether a member's memberships are stored - connection ids are longer than user names can be
+func storedMember(member string) bool {
+	return userNamePattern.MatchString(member)
+}
+
+// Write a room's record
+func putRoomRecord(tx StorageTx, room *Room) error {
+	return tx.Put(RoomsBucket, room.Name, roomRecord{Name: room.Name, Owner: room.Owner, Topic: room.Topic, CreatedAt: room.CreatedAt, Node: room.Node})
+}
+
+// Write the membership of a member of a room with their role, unless the member isn't stored
+func putMembership(tx StorageTx, room *Room, member string) error {
+	if !storedMember(member) {
+		return nil
+	}
+	return tx.Put(MembershipsBucket, membershipKey(room.Name, member), membershipRecord{Room: room.Name, Member: member, Role: room.Roles[member]})
+}
+
+// Delete the stored memberships of a room, except those of the members kept
+func (s *PersistentRoomStore) deleteMemberships(tx StorageTx, room string, keep map[string]bool) error {
+	var stale []string
+	err := tx.ForEach(MembershipsBucket, membershipKey(room, ""), func(key string, value json.RawMessage) error {
+		if !keep[strings.TrimPrefix(key, membershipKey(room, ""))] {
+			stale = append(stale, key)
+		}
+		return nil
+	})
+	for _, key := range stale {
+		if err == nil {
+			err = tx.Delete(MembershipsBucket, key)
+		}
+	}
+	return err
+}
+
+// Insert a room and store it with its memberships, replacing those of a room it replaces
+func (s *PersistentRoomStore) Add(room *Room) error {
+	err := writeThrough(s.storage, "room", func(tx StorageTx) error {
+		if err := putRoomRecord(tx, room); err != nil {
+			return err
+		}
+		if err := s.deleteMemberships(tx, room.Name, room.Members); err != nil {
+			return err
+		}
+		for member := range room.Members {
+			if err := putMembership(tx, room, member); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.InMemoryRoomStore.Add(room)
+}
+
+// Remove a room and its memberships from memory and storage
+func (s *PersistentRoomStore) Delete(name string) error {
+	err := writeThrough(s.storage, "room", func(tx StorageTx) error {
+		if err := tx.Delete(RoomsBucket, name); err != nil {
+			return err
+		}
+		return s.deleteMemberships(tx, name, nil)
+	})
+	if err != nil {
+		return err
+	}
+	return s.InMemoryRoomStore.Delete(name)
+}
+
+// Add a member to a room and store the membership
+func (s *PersistentRoomStore) AddMember(name string, member string) error {
+	room, ok := s.Get(name)
+	if !ok || room.Members[member] {
+		return nil
+	}
+	err := writeThrough(s.storage, "membership", func(tx StorageTx) error {
+		return putMembership(tx, room, member)
+	})
+	if err != nil {
+		return err
+	}
+	return s.InMemoryRoomStore.AddMember(name, member)
+}
+
+// Remove a member from a room and delete the membership
+func (s *PersistentRoomStore) RemoveMember(name string, member string) error {
+	room, ok := s.Get(name)
+	if !ok || (!room.Members[member] && room.Roles[member] == "") {
+		return nil
+	}
+	err := writeThrough(s.storage, "membership", func(tx StorageTx) error {
+		return tx.Delete(MembershipsBucket, membershipKey(name, member))
+	})
+	if err != nil {
+		return err
+	}
+	return s.InMemoryRoomStore.RemoveMember(name, member)
+}
+
+// Set the role of a room member and store it with their membership - roles of non-members aren't stored
+func (s *PersistentRoomStore) SetRole(name string, member string, role string) error {
+	room, ok := s.Get(name)
+	if !ok {
+		return nil
+	}
+	if room.Members[member] {
+		changed := &Room{Name: name, Roles: map[string]string{}}
+		if role != RoleMember {
+			changed.Roles[member] = role
+		}
+		err := writeThrough(s.storage, "membership", func(tx StorageTx) error {
+			return putMembership(tx, changed, member)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return s.InMemoryRoomStore.SetRole(name, member, role)
+}
+
+// Set the topic of a room and store its record
+func (s *PersistentRoomStore) SetTopic(name string, topic string) error {
+	room, ok := s.Get(name)
+	if !ok {
+		return nil
+	}
+	changed := *room
+	changed.Topic = topic
+	err := writeThrough(s.storage, "room", func(tx StorageTx) error {
+		return putRoomRecord(tx, &changed)
+	})
+	if err != nil {
+		return err
+	}
+	return s.InMemoryRoomStore.SetTopic(name, topic)
+}
+
+// Move a member of a room to a new identity, or remove them when the new identity is empty, storing the
+// memberships and the owner that changed
+func (s *PersistentRoomStore) RenameMember(name string, from string, to string) error {
+	room, ok := s.Get(name)
+	if !ok {
+		return nil
+	}
+	// Rename a copy of what changes, so the room is left as it was when storing fails
+	changed := &Room{Name: name, Owner: room.Owner, Topic: room.Topic, CreatedAt: room.CreatedAt, Node: room.Node, Members: map[string]bool{}, Roles: map[string]string{}}
+	for _, member := range []string{from, to} {
+		if room.Members[member] {
+			changed.Members[member] = true
+		}
+		if role, ok := room.Roles[member]; ok {
+			changed.Roles[member] = role
+		}
+	}
+	if !renameRoomMember(changed, from, to) {
+		return nil
+	}
+	err := writeThrough(s.storage, "membership", func(tx StorageTx) error {
+		if err := tx.Delete(MembershipsBucket, membershipKey(name, from)); err != nil {
+			return err
+		}
+		if changed.Members[to] {
+			if err := putMembership(tx, changed, to); err != nil {
+				return err
+			}
+		}
+		if changed.Owner != room.Owner {
+			return putRoomRecord(tx, changed)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.InMemoryRoomStore.RenameMember(name, from, to)
+}
+
+// Operations of room changes
+const (
+	RoomOpCreate = "create"
+	RoomOpDelete = "delete"
+	RoomOpJoin   = "join"
+	RoomOpLeave  = "leave"
+	RoomOpRole   = "role"
+	RoomOpTopic  = "topic"
+	RoomOpRename = "rename"
+	RoomOpRemove = "remove"
+)
+
+// A change to the rooms - the member is the owner of a created room and the old identity of a renamed
+// member, and the value is the role, the topic or the new identity. Changes are replayed on the other
+// nodes of a cluster.
+type RoomChange struct {
+	Op     string    `json:"op"`
+	Room   string    `json:"room,omitempty"`
+	Member string    `json:"member,omitempty"`
+	Value  string    `json:"value,omitempty"`
+	Time   time.Time `json:"time"`
+	Node   string    `json:"node,omitempty"`
+}
+
+// Room Service for creating rooms and managing their membership - the default room always exists
+type RoomService struct {
+	store    RoomStore
+	onChange func(change RoomChange)
+	node     string
+	mu       sync.RWMutex
+}
+
+// Create a new room service with the default room
+func NewRoomService(store RoomStore) *RoomService {
+	if _, ok := store.Get(DefaultRoom); !ok {
+		store.Add(&Room{Name: DefaultRoom, Members: make(map[string]bool), Roles: make(map[string]string), CreatedAt: time.Now().UTC()})
+	}
+	return &RoomService{store: store}
+}
+
+// Set the cluster node the rooms created here are attributed to
+func (s *RoomService) SetNode(node string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.node = node
+}
+
+// Create a room owned by its creator, who becomes its first member
+func (s *RoomService) CreateRoom(name string, owner string) error {
+	if !roomNamePattern.MatchString(name) {
+		return ErrInvalidRoomName
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.store.Get(name); ok {
+		return ErrRoomExists
+	}
+
+	slog.Info("Creating room", "room", name, "owner", owner)
+	return s.commit(RoomChange{Op: RoomOpCreate, Room: name, Member: owner, Time: time.Now().UTC(), Node: s.node})
+}
+
+// Delete a room - only its owner can delete it and the default room can't be deleted
+func (s *RoomService) DeleteRoom(name string, by string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room, ok := s.store.Get(name)
+	if !ok {
+		return ErrRoomNotFound
+	}
+	if room.Name == DefaultRoom || room.Owner != by {
+		return ErrPermissionDenied
+	}
+
+	slog.Info("Deleting room", "room", name, "by", by)
+	return s.commit(RoomChange{Op: RoomOpDelete, Room: name})
+}
+
+// Add a member to a room
+func (s *RoomService) JoinRoom(name string, member string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.store.Get(name); !ok {
+		return ErrRoomNotFound
+	}
+	return s.commit(RoomChange{Op: RoomOpJoin, Room: name, Member: member})
+}
+
+// Remove a member from a room
+func (s *RoomService) LeaveRoom(name string, member string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room, ok := s.store.Get(name)
+	if !ok {
+		return ErrRoomNotFound
+	}
+	if !room.Members[member] {
+		return ErrNotRoomMember
+	}
+	return s.commit(RoomChange{Op: RoomOpLeave, Room: name, Member: member})
+}
+
+// Get the role of a room member - the owner's role is always owner, and non-members have no role
+func (s *RoomService) Role(name string, member string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	room, ok := s.store.Get(name)
+	if !ok || !room.Members[member] {
+		return ""
+	}
+	if room.Owner == member {
+		return RoleOwner
+	}
+	if role, ok := room.Roles[member]; ok {
+		return role
+	}
+	return RoleMember
+}
+
+// Change the role of a room member - ownership can't be given away
+func (s *RoomService) SetRole(name string, member string, role string) error {
+	if role == RoleOwner || RoleRank(role) < 0 {
+		return ErrInvalidRole
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	room, ok := s.store.Get(name)
+	if !ok {
+		return ErrRoomNotFound
+	}
+	if !room.Members[member] {
+		return ErrNotRoomMember
+	}
+	if room.Owner == member {
+		return ErrPermissionDenied
+	}
+
+	return s.commit(RoomChange{Op: RoomOpRole, Room: name, Member: member, Value: role})
+}
+
+// List the names of all rooms, sorted by name
+func (s *RoomService) ListRooms() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rooms := make([]string, 0)
+	for _, room := range s.store.List() {
+		rooms = append(rooms, room.Name)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// Check whether a room exists
+func (s *RoomService) RoomExists(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.store.Get(name)
+	return ok
+}
+
+// Check whether an identity is a member of a room
+func (s *RoomService) IsMember(name string, member string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	room, ok := s.store.Get(name)
+	return ok && room.Members[member]
+}
+
+// List the members of a room, sorted by name
+func (s *RoomService) Members(name string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	members := make([]string, 0)
+	room, ok := s.store.Get(name)
+	if !ok {
+		return members
+	}
+	for member := range room.Members {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members
+}
+
+// List the rooms an identity is a member of, sorted by name
+func (s *RoomService) RoomsForMember(member string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rooms := make([]string, 0)
+	for _, room := range s.store.List() {
+		if room.Members[member] {
+			rooms = append(rooms, room.Name)
+		}
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// Move an identity's memberships to a new identity, e.g. when an anonymous connection signs in
+func (s *RoomService) RenameMember(from string, to string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commit(RoomChange{Op: RoomOpRename, Member: from, Value: to})
+}
+
+// Set the topic of a room
+func (s *RoomService) SetTopic(name string, topic string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.store.Get(name); !ok {
+		return ErrRoomNotFound
+	}
+	return s.commit(RoomChange{Op: RoomOpTopic, Room: name, Value: topic})
+}
+
+// Get the topic of a room
+func (s *RoomService) Topic(name string) string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if room, ok := s.store.Get(name); ok {
+		return room.Topic
+	}
+	return ""
+}
+
+// Get a copy of the full state of every room
+func (s *RoomService) DumpRooms() []RoomState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	rooms := make([]RoomState, 0)
+	for _, room := range s.store.List() {
+		state := RoomState{Name: room.Name, Owner: room.Owner, Topic: room.Topic, Members: make([]string, 0, len(room.Members)), Roles: make(map[string]string), CreatedAt: room.CreatedAt, Node: room.Node}
+		for member := range room.Members {
+			state.Members = append(state.Members, member)
+		}
+		sort.Strings(state.Members)
+		for member, role := range room.Roles {
+			state.Roles[member] = role
+		}
+		rooms = append(rooms, state)
+	}
+	sort.Slice(rooms, func(i, j int) bool { return rooms[i].Name < rooms[j].Name })
+	return rooms
+}
+
+// Remove an identity from every room
+func (s *RoomService) RemoveMember(member string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commit(RoomChange{Op: RoomOpRemove, Member: member})
+}
+
+// Set the function told about every change made through the service, e.g. to replay it on other nodes
+func (s *RoomService) OnChange(fn func(change RoomChange)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = fn
+}
+
+// Apply a change and pass it on - callers hold the lock, so changes are passed on in the order they're made.
+// A change that can't be stored isn't passed on.
+func (s *RoomService) commit(change RoomChange) error {
+	if err := s.apply(change); err != nil {
+		return err
+	}
+	if s.onChange != nil {
+		s.onChange(change)
+	}
+	return nil
+}
+
+// Apply a change made elsewhere, e.g. on another node - changes to rooms that don't exist are ignored
+func (s *RoomService) ApplyChange(change RoomChange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.apply(change)
+}
+
+// Merge the state of rooms from elsewhere, adding the rooms, members and roles missing here. A room created
+// here and elsewhere at once is settled by createdFirst, and the state of the room that lost is left out.
+func (s *RoomService) ApplyStates(states []RoomState) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, state := range states {
+		if room, ok := s.store.Get(state.Name); ok && state.Name != DefaultRoom && createdFirst(room.CreatedAt, room.Node, state.CreatedAt, state.Node) {
+			continue
+		}
+		s.apply(RoomChange{Op: RoomOpCreate, Room: state.Name, Member: state.Owner, Time: state.CreatedAt, Node: state.Node})
+		for _, member := range state.Members {
+			s.apply(RoomChange{Op: RoomOpJoin, Room: state.Name, Member: member})
+		}
+		for member, role := range state.Roles {
+			s.apply(RoomChange{Op: RoomOpRole, Room: state.Name, Member: member, Value: role})
+		}
+		if state.Topic != "" {
+			s.apply(RoomChange{Op: RoomOpTopic, Room: state.Name, Value: state.Topic})
+		}
+	}
+}
+
+// Settle a room created on two nodes at once - the earliest creation wins, then the lowest node id, so
+// every node keeps the same one
+func createdFirst(at time.Time, node string, otherAt time.Time, otherNode string) bool {
+	if !at.Equal(otherAt) {
+		return at.Before(otherAt)
+	}
+	return node < otherNode
+}
+
+// Apply a change to the store. A create for a room that exists replaces it only when it was created first.
+func (s *RoomService) apply(change RoomChange) error {
+	switch change.Op {
+	case RoomOpCreate:
+		if room, ok := s.store.Get(change.Room); ok && (change.Room == DefaultRoom || !createdFirst(change.Time, change.Node, room.CreatedAt, room.Node)) {
+			return nil
+		}
+		members := make(map[string]bool)
+		if change.Member != "" {
+			members[change.Member] = true
+		}
+		return s.store.Add(&Room{Name: change.Room, Owner: change.Member, Members: members, Roles: make(map[string]string), CreatedAt: change.Time, Node: change.Node})
+	case RoomOpDelete:
+		return s.store.Delete(change.Room)
+	case RoomOpRename, RoomOpRemove:
+		for _, room := range s.store.List() {
+			if err := s.store.RenameMember(room.Name, change.Member, change.Value); err != nil {
+				return err
+			}
+		}
+		return nil
+	case RoomOpJoin:
+		return s.store.AddMember(change.Room, change.Member)
+	case RoomOpLeave:
+		return s.store.RemoveMember(change.Room, change.Member)
+	case RoomOpRole:
+		return s.store.SetRole(change.Room, change.Member, change.Value)
+	case RoomOpTopic:
+		return s.store.SetTopic(change.Room, change.Value)
+	}
+	return nil
+}
+
+// Move a member of a room to a new identity, or remove them when the new identity is empty - returns
+// whether the room changed
+func renameRoomMember(room *Room, from string, to string) bool {
+	changed := false
+	if room.Members[from] {
+		delete(room.Members, from)
+		if to != "" {
+			room.Members[to] = true
+		}
+		changed = true
+	}
+	if role, ok := room.Roles[from]; ok {
+		delete(room.Roles, from)
+		if to != "" {
+			room.Roles[to] = role
+		}
+		changed = true
+	}
+	if room.Owner == from && to != "" {
+		room.Owner = to
+		changed = true
+	}
+	return changed
+}
+
+// Remove the members keep turns down from every room, e.g. the anonymous connections of an earlier run
+func (s *RoomService) PruneMembers(keep func(member string) bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, room := range s.store.List() {
+		for member := range room.Members {
+			if !keep(member) {
+				s.store.RemoveMember(room.Name, member)
+			}
+		}
+	}
+}
+
+// Get the identity of the connection a request arrived on - empty without a connection, which is no one's identity
+func (s *Server) callerIdentity(ctx context.Context) string {
+	connection, ok := ConnectionFromContext(ctx)
+	if !ok {
+		return ""
+	}
+	return s.userService.Identity(connection)
+}
+
+// Create a room owned by the caller - owners are signed in users so ownership can't be claimed by name alone
+func (s *Server) CreateChatRoomHandler(ctx context.Context, params RoomParams) (SuccessResult, error) {
+	connection, ok := ConnectionFromContext(ctx)
+	if !ok {
+		return SuccessResult{}, ErrNoConnection
+	}
+	owner, ok := s.userService.UserForConnection(connection.id)
+	if !ok {
+		return SuccessResult{}, ErrNotSignedIn
+	}
+	if err := s.roomService.CreateRoom(params.Room, owner); err != nil {
+		return SuccessResult{}, err
+	}
+	return SuccessResult{Success: true}, nil
+}
+
+// Delete a room owned by the caller
+func (s *Server) DeleteChatRoomHandler(ctx context.Context, params RoomParams) (SuccessResult, error) {
+	if err := s.roomService.DeleteRoom(params.Room, s.callerIdentity(ctx)); err != nil {
+		return SuccessResult{}, err
+	}
+	if err := s.webhookService.RemoveRoom(params.Room); err != nil {
+		return SuccessResult{}, err
+	}
+	return SuccessResult{Success: true}, nil
+}
+
+// Join a room, telling its webhooks
+func (s *Server) JoinChatRoomHandler(ctx context.Context, params RoomParams) (SuccessResult, error) {
+	identity := s.callerIdentity(ctx)
+	joined := s.roomService.IsMember(params.Room, identity)
+	if err := s.roomService.JoinRoom(params.Room, identity); err != nil {
+		return SuccessResult{}, err
+	}
+	if !joined {
+		s.webhookService.Emit(WebhookPayload{Event: WebhookEventJoin, Room: params.Room, Member: identity})
+	}
+	return SuccessResult{Success: true}, nil
+}
+
+// Leave a room, telling its webhooks
+func (s *Server) LeaveChatRoomHandler(ctx context.Context, params RoomParams) (SuccessResult, error) {
+	identity := s.callerIdentity(ctx)
+	if err := s.roomService.LeaveRoom(params.Room, identity); err != nil {
+		return SuccessResult{}, err
+	}
+	s.webhookService.Emit(WebhookPayload{Event: WebhookEventLeave, Room: params.Room, Member: identity})
+	return SuccessResult{Success: true}, nil
+}
+
+// List every room with its member count, and the caller's unread count for the rooms they have joined
+func (s *Server) ListRoomsHandler(ctx context.Context, params NoParams) (ListRoomsResult, error) {
+	identity := s.callerIdentity(ctx)
+
+	result := ListRoomsResult{Rooms: make([]RoomSummary, 0)}
+	for _, name := range s.roomService.ListRooms() {
+		members := s.roomService.Members(name)
+		summary := RoomSummary{Name: name, Members: len(members), Joined: s.roomService.IsMember(name, identity), Topic: s.roomService.Topic(name)}
+		if summary.Joined {
+			summary.Unread = s.messageService.UnreadCount(name, identity)
+			if receipt, ok := s.messageService.GetReadReceipt(name, identity); ok {
+				summary.LastReadId = receipt.MessageId
+			}
+		}
+		result.Rooms = append(result.Rooms, summary)
+	}
+
+	return result, nil
+}
+
+// List the members of a room
+func (s *Server) ListMembersHandler(ctx context.Context, params RoomParams) (ListMembersResult, error) {
+	if !s.roomService.RoomExists(params.Room) {
+		return ListMembersResult{}, ErrRoomNotFound
+	}
+	return ListMembersResult{Room: params.Room, Members: s.roomService.Members(params.Room)}, nil
+}
+
+// Set the topic of a room and tell its members - moderators and owners can set it. A topic is a
+// single line, since it's relayed as one to IRC and federated servers.
+func (s *Server) SetTopicHandler(ctx context.Context, params SetTopicParams) (TopicChange, error) {
+	if strings.ContainsAny(params.Topic, "\r\n\x00") {
+		return TopicChange{}, NewInvalidParamsError(FieldError{Field: "topic", Message: "must be a single line"})
+	}
+	if err := s.roomService.SetTopic(params.Room, params.Topic); err != nil {
+		return TopicChange{}, err
+	}
+
+	change := TopicChange{Room: params.Room, Topic: params.Topic, By: s.callerIdentity(ctx), Time: time.Now().UTC()}
+	s.BroadcastToRoom(params.Room, TopicChangedRpcMethod, change, nil)
+	return change, nil
+}
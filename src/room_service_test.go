@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func RoomServiceFixture() *RoomService {
+	service := NewRoomService(NewRoomStore())
+	service.CreateRoom("ops", "alice")
+	return service
+}
+
+func AssertServiceError(t testing.TB, got error, want error) {
+	t.Helper()
+	if !errors.Is(got, want) {
+		t.Errorf("got error [%v] but wanted [%v]", got, want)
+	}
+}
+
+func TestCreateRoom(t *testing.T) {
+	t.Run("creator is the owner and first member", func(t *testing.T) {
+		service := RoomServiceFixture()
+
+		if !service.IsMember("ops", "alice") {
+			t.Error("got creator not a member of the room")
+		}
+	})
+
+	t.Run("create existing room", func(t *testing.T) {
+		service := RoomServiceFixture()
+		AssertServiceError(t, service.CreateRoom("ops", "bob"), ErrRoomExists)
+	})
+
+	t.Run("create room with invalid name", func(t *testing.T) {
+		service := RoomServiceFixture()
+		AssertServiceError(t, service.CreateRoom("has spaces", "bob"), ErrInvalidRoomName)
+	})
+
+	t.Run("a room created on two nodes at once settles on the first creation", func(t *testing.T) {
+		at := time.Now().UTC()
+		fromA := RoomChange{Op: RoomOpCreate, Room: "ops", Member: "alice", Time: at, Node: "a"}
+		fromB := RoomChange{Op: RoomOpCreate, Room: "ops", Member: "bob", Time: at, Node: "b"}
+		nodes := []*RoomService{NewRoomService(NewRoomStore()), NewRoomService(NewRoomStore())}
+		nodes[0].ApplyChange(fromA)
+		nodes[0].ApplyChange(fromB)
+		nodes[1].ApplyChange(fromB)
+		nodes[1].ApplyChange(fromA)
+		for i, node := range nodes {
+			if node.Role("ops", "alice") != RoleOwner || node.IsMember("ops", "bob") {
+				t.Errorf("got rooms %+v on node %d", node.DumpRooms(), i)
+			}
+		}
+
+		earlier := RoomChange{Op: RoomOpCreate, Room: "ops", Member: "carol", Time: at.Add(-time.Second), Node: "c"}
+		nodes[1].ApplyStates([]RoomState{{Name: "ops", Owner: "carol", Members: []string{"carol"}, CreatedAt: earlier.Time, Node: "c"}})
+		nodes[0].ApplyChange(earlier)
+		nodes[0].ApplyStates(nodes[1].DumpRooms())
+		for i, node := range nodes {
+			if node.Role("ops", "carol") != RoleOwner || node.IsMember("ops", "alice") {
+				t.Errorf("got rooms %+v on node %d", node.DumpRooms(), i)
+			}
+		}
+
+		nodes[0].ApplyChange(RoomChange{Op: RoomOpCreate, Room: DefaultRoom, Member: "mallory", Time: at.Add(-time.Hour)})
+		if nodes[0].IsMember(DefaultRoom, "mallory") {
+			t.Error("got the default room replaced")
+		}
+	})
+}
+
+func TestDeleteRoom(t *testing.T) {
+	t.Run("only the owner can delete a room", func(t *testing.T) {
+		service := RoomServiceFixture()
+		AssertServiceError(t, service.DeleteRoom("ops", "bob"), ErrPermissionDenied)
+		AssertErrorNotNil(t, service.DeleteRoom("ops", "alice"))
+
+		if service.RoomExists("ops") {
+			t.Error("got room but wanted it deleted")
+		}
+	})
+
+	t.Run("default room can't be deleted", func(t *testing.T) {
+		service := RoomServiceFixture()
+		AssertServiceError(t, service.DeleteRoom(DefaultRoom, ""), ErrPermissionDenied)
+	})
+}
+
+func TestRoomMembership(t *testing.T) {
+	t.Run("join and leave a room", func(t *testing.T) {
+		service := RoomServiceFixture()
+		AssertErrorNotNil(t, service.JoinRoom("ops", "bob"))
+		AssertNumberOfConnections(t, len(service.Members("ops")), 2)
+
+		AssertErrorNotNil(t, service.LeaveRoom("ops", "bob"))
+		AssertServiceError(t, service.LeaveRoom("ops", "bob"), ErrNotRoomMember)
+	})
+
+	t.Run("join missing room", func(t *testing.T) {
+		service := RoomServiceFixture()
+		AssertServiceError(t, service.JoinRoom("missing", "bob"), ErrRoomNotFound)
+	})
+
+	t.Run("rename member keeps their rooms", func(t *testing.T) {
+		service := RoomServiceFixture()
+		service.JoinRoom(DefaultRoom, "connection-1")
+		service.JoinRoom("ops", "connection-1")
+		service.RenameMember("connection-1", "bob")
+
+		rooms := service.RoomsForMember("bob")
+		if len(rooms) != 2 || rooms[0] != DefaultRoom || rooms[1] != "ops" {
+			t.Errorf("got rooms %v but wanted [%s ops]", rooms, DefaultRoom)
+		}
+		if service.IsMember("ops", "connection-1") {
+			t.Error("got old identity still a member")
+		}
+	})
+}
+
+func TestListMembersHandler(t *testing.T) {
+	server := ServerFixture()
+	alice, _ := AddFakeConnection(t, server, "alice")
+	AddFakeConnection(t, server, "bob")
+
+	response := CallMethod(t, server, alice, ListMembersRpcMethod, RoomParams{Room: DefaultRoom})
+	AssertSuccess(t, response)
+
+	var result ListMembersResult
+	json.Unmarshal(response.Result, &result)
+	if len(result.Members) != 2 || result.Members[0] != "alice" || result.Members[1] != "bob" {
+		t.Errorf("got members %v but want [alice bob]", result.Members)
+	}
+	AssertErrorCode(t, CallMethod(t, server, alice, ListMembersRpcMethod, RoomParams{Room: "missing"}), RoomNotFoundErrorCode)
+}
+
+func TestSetTopicHandler(t *testing.T) {
+	server := ServerFixture()
+	alice, aliceConn := AddFakeConnection(t, server, "alice")
+	bob, bobConn := AddFakeConnection(t, server, "bob")
+	server.roomService.CreateRoom("dev", "alice")
+	server.roomService.JoinRoom("dev", "bob")
+
+	AssertSuccess(t, CallMethod(t, server, alice, SetTopicRpcMethod, SetTopicParams{Room: "dev", Topic: "release planning"}))
+	AssertNumberOfConnections(t, CountNotifications(aliceConn, TopicChangedRpcMethod), 1)
+	AssertNumberOfConnections(t, CountNotifications(bobConn, TopicChangedRpcMethod), 1)
+	if topic := server.roomService.Topic("dev"); topic != "release planning" {
+		t.Errorf("got topic [%s]", topic)
+	}
+
+	AssertErrorCode(t, CallMethod(t, server, bob, SetTopicRpcMethod, SetTopicParams{Room: "dev", Topic: "mine now"}), PermissionDeniedErrorCode)
+
+	for _, topic := range []string{"line\r\nPRIVMSG #dev :hi", "line\nbreak", "nul\x00"} {
+		AssertErrorCode(t, CallMethod(t, server, alice, SetTopicRpcMethod, SetTopicParams{Room: "dev", Topic: topic}), -32602)
+	}
+	if topic := server.roomService.Topic("dev"); topic != "release planning" {
+		t.Errorf("got topic [%q] after setting it to several lines", topic)
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const clientUsage = `Usage: chat-client [flags] [command [args]]
+
+Without a command the client runs interactively. Commands run once for scripts and exit:
+
+  send [-room room] <message>      send a message, read from stdin when it's - or missing
+  tail [-room room] [-n count]     print each chat message in a room as a JSON line
+  history [-room room] [-n count]  print the latest messages of a room as JSON lines
+  call <method> [params]           call a method with JSON params, read from stdin when they're -
+  export [-room room] [-format f]  print the whole history of a room as txt, jsonl or md
+
+Exit codes: 0 success, 1 error from the server, 2 bad usage, 3 timeout, 4 server unavailable
+
+Flags:
+`
+
+// Number of messages history prints unless told otherwise
+const DefaultHistoryCount = 20
+
+// Exit codes of the scripting commands
+const (
+	ExitOK          = 0
+	ExitError       = 1
+	ExitUsage       = 2
+	ExitTimeout     = 3
+	ExitUnavailable = 4
+)
+
+// A chat message as tail and history print it, with the message as text so it can be piped to jq
+type ScriptMessage struct {
+	Id        string    `json:"id"`
+	Room      string    `json:"room"`
+	Author    string    `json:"author"`
+	ParentId  string    `json:"parentId,omitempty"`
+	Msg       string    `json:"msg"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// A scripting command - it gets the arguments after the command name and returns the exit code
+type ScriptCommand func(c *JsonRpcClient, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int
+
+var scriptCommands = map[string]ScriptCommand{
+	"send":    runSend,
+	"tail":    runTail,
+	"history": runHistory,
+	"call":    runCall,
+	"export":  runExport,
+}
+
+// Exit code for a response - timeouts and lost connections are told apart from errors the server answered with
+func exitCode(response JsonRpcResponse) int {
+	switch {
+	case response.Error == nil:
+		return ExitOK
+	case response.Error.Code == ResponseTimeoutErrorCode:
+		return ExitTimeout
+	case response.Error.Code == NotConnectedErrorCode:
+		return ExitUnavailable
+	}
+	return ExitError
+}
+
+// Print the error of a response and return its exit code
+func reportError(stderr io.Writer, response JsonRpcResponse) int {
+	if response.Error.Data != nil {
+		data, _ := json.Marshal(response.Error.Data)
+		fmt.Fprintf(stderr, "error %d: %s %s\n", response.Error.Code, response.Error.Message, data)
+	} else {
+		fmt.Fprintf(stderr, "error %d: %s\n", response.Error.Code, response.Error.Message)
+	}
+	return exitCode(response)
+}
+
+// Write a value as one line of JSON
+func writeJSONLine(out io.Writer, v any) {
+	line, _ := json.Marshal(v)
+	fmt.Fprintln(out, string(line))
+}
+
+// Flags of a scripting command - errors go to stderr and fail the command with the usage exit code
+func scriptFlags(name string, stderr io.Writer) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	return flags
+}
+
+// Join the room given with -room, making it the current room
+func joinScriptRoom(c *JsonRpcClient, room string, stderr io.Writer) int {
+	if room == "" || room == c.CurrentRoom() {
+		return ExitOK
+	}
+	if response := c.JoinRoom(room); response.Error != nil {
+		return reportError(stderr, response)
+	}
+	return ExitOK
+}
+
+// Connect to the server and run a scripting command, returning the exit code
+func RunScript(address string, nick string, password string, timeout time.Duration, args []string) int {
+	if _, ok := scriptCommands[args[0]]; !ok {
+		fmt.Fprintf(os.Stderr, "unknown command [%s]\n", args[0])
+		flag.Usage()
+		return ExitUsage
+	}
+
+	conn, err := net.DialTimeout("tcp", address, DialTimeout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "failed to connect:", err)
+		return ExitUnavailable
+	}
+	defer conn.Close()
+
+	client := NewJsonRpcClient(conn, "")
+	client.SetResponseTimeout(timeout)
+	go client.HandleServerMessages()
+
+	if response := client.Initialize(); response.Error != nil && response.Error.Code != -32601 {
+		return reportError(os.Stderr, response)
+	}
+	if nick != "" {
+		if response := client.SendCreateUserRequest(nick, password); response.Error != nil {
+			return reportError(os.Stderr, response)
+		}
+	}
+	return RunScriptCommand(client, args, os.Stdin, os.Stdout, os.Stderr)
+}
+
+// Run a scripting command on a connected client, returning the exit code
+func RunScriptCommand(c *JsonRpcClient, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	command, ok := scriptCommands[args[0]]
+	if !ok {
+		fmt.Fprintf(stderr, "unknown command [%s]\n", args[0])
+		return ExitUsage
+	}
+	return command(c, args[1:], stdin, stdout, stderr)
+}
+
+// Send a message to a room and print the result
+func runSend(c *JsonRpcClient, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := scriptFlags("send", stderr)
+	room := flags.String("room", "", "room to send the message to")
+	if flags.Parse(args) != nil {
+		return ExitUsage
+	}
+
+	msg := strings.Join(flags.Args(), " ")
+	if msg == "" || msg == "-" {
+		input, err := io.ReadAll(stdin)
+		if err != nil {
+			fmt.Fprintln(stderr, "failed to read the message:", err)
+			return ExitError
+		}
+		msg = strings.TrimRight(string(input), "\n")
+	}
+	if msg == "" {
+		fmt.Fprintln(stderr, "missing message")
+		return ExitUsage
+	}
+
+	if code := joinScriptRoom(c, *room, stderr); code != ExitOK {
+		return code
+	}
+	response := c.SendChatRequest([]byte(msg))
+	if response.Error != nil {
+		return reportError(stderr, response)
+	}
+	fmt.Fprintln(stdout, string(response.Result))
+	return ExitOK
+}
+
+// Called once tail follows its room, so tests know when messages sent to it won't be missed
+var tailReady = func() {}
+
+// Print the chat messages of a room as JSON lines until the count is reached, the server goes away or the
+// process is interrupted
+func runTail(c *JsonRpcClient, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := scriptFlags("tail", stderr)
+	room := flags.String("room", "", "room to follow (default the default room)")
+	count := flags.Int("n", 0, "exit after this many messages (default no limit)")
+	if flags.Parse(args) != nil || flags.NArg() > 0 {
+		return ExitUsage
+	}
+	if code := joinScriptRoom(c, *room, stderr); code != ExitOK {
+		return code
+	}
+
+	following := c.CurrentRoom()
+	messages := make(chan ScriptMessage, 64)
+	c.SetNotificationHandler(func(notification JsonRpcNotification) {
+		var chat ChatMessageNotification
+		if notification.Method != ChatNotificationRpcMethod || json.Unmarshal(notification.Params, &chat) != nil || chat.Room != following {
+			return
+		}
+		messages <- ScriptMessage{Id: chat.Id, Room: chat.Room, Author: chat.Author, ParentId: chat.ParentId, Msg: string(chat.Msg), Timestamp: chat.Timestamp}
+	})
+	tailReady()
+
+	interrupted := make(chan os.Signal, 1)
+	signal.Notify(interrupted, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(interrupted)
+
+	for printed := 0; *count == 0 || printed < *count; printed++ {
+		select {
+		case message := <-messages:
+			writeJSONLine(stdout, message)
+		case <-c.Closed():
+			// Messages that arrived before the connection closed are still printed
+			for ; len(messages) > 0 && (*count == 0 || printed < *count); printed++ {
+				writeJSONLine(stdout, <-messages)
+			}
+			if *count > 0 && printed == *count {
+				return ExitOK
+			}
+			fmt.Fprintln(stderr, "connection closed by server")
+			return ExitUnavailable
+		case <-interrupted:
+			return ExitOK
+		}
+	}
+	return ExitOK
+}
+
+// Print the latest messages of a room as JSON lines, oldest first
+func runHistory(c *JsonRpcClient, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := scriptFlags("history", stderr)
+	room := flags.String("room", "", "room to print (default the default room)")
+	count := flags.Int("n", DefaultHistoryCount, "number of messages to print")
+	if flags.Parse(args) != nil || flags.NArg() > 0 || *count <= 0 {
+		return ExitUsage
+	}
+	if code := joinScriptRoom(c, *room, stderr); code != ExitOK {
+		return code
+	}
+
+	response := c.SendGetHistoryRequest(c.CurrentRoom(), "", *count)
+	if response.Error != nil {
+		return reportError(stderr, response)
+	}
+	var result GetHistoryResult
+	if err := json.Unmarshal(response.Result, &result); err != nil {
+		fmt.Fprintln(stderr, "invalid history:", err)
+		return ExitError
+	}
+	for _, message := range result.Messages {
+		writeJSONLine(stdout, ScriptMessage{Id: message.Id, Room: message.Room, Author: message.Author, ParentId: message.ParentId, Msg: string(message.Msg), Timestamp: message.Timestamp})
+	}
+	return ExitOK
+}
+
+// Print the whole history of a room as a transcript
+func runExport(c *JsonRpcClient, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	flags := scriptFlags("export", stderr)
+	room := flags.String("room", "", "room to export (default the default room)")
+	format := flags.String("format", TranscriptText, "transcript format: txt, jsonl or md")
+	if flags.Parse(args) != nil || flags.NArg() > 0 || !ValidTranscriptFormat(*format) {
+		return ExitUsage
+	}
+	if code := joinScriptRoom(c, *room, stderr); code != ExitOK {
+		return code
+	}
+
+	if _, err := ExportHistory(c, c.CurrentRoom(), *format, stdout); err != nil {
+		fmt.Fprintln(stderr, "failed to export:", err)
+		return ExitError
+	}
+	return ExitOK
+}
+
+// Call any method with JSON params and print its result
+func runCall(c *JsonRpcClient, args []string, stdin io.Reader, stdout io.Writer, stderr io.Writer) int {
+	if len(args) == 0 || len(args) > 2 {
+		fmt.Fprintln(stderr, "usage: call <method> [params]")
+		return ExitUsage
+	}
+
+	var params any
+	if len(args) == 2 {
+		raw := []byte(args[1])
+		if args[1] == "-" {
+			input, err := io.ReadAll(stdin)
+			if err != nil {
+				fmt.Fprintln(stderr, "failed to read the params:", err)
+				return ExitError
+			}
+			raw = input
+		}
+		if !json.Valid(raw) {
+			fmt.Fprintln(stderr, "params must be JSON")
+			return ExitUsage
+		}
+		params = json.RawMessage(raw)
+	}
+
+	response := c.Call(args[0], params)
+	if response.Error != nil {
+		return reportError(stderr, response)
+	}
+	fmt.Fprintln(stdout, string(response.Result))
+	return ExitOK
+}
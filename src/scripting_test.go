@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run a scripting command and return its exit code with what it printed
+func RunScriptFixture(client *JsonRpcClient, stdin string, args ...string) (int, string, string) {
+	var stdout, stderr bytes.Buffer
+	code := RunScriptCommand(client, args, strings.NewReader(stdin), &stdout, &stderr)
+	return code, stdout.String(), stderr.String()
+}
+
+func TestCallCommand(t *testing.T) {
+	t.Run("the result is printed", func(t *testing.T) {
+		client := FakeServerClient(t, func(request JsonRpcRequest) any {
+			return map[string]any{"method": request.Method, "params": json.RawMessage(request.Params)}
+		})
+
+		code, stdout, _ := RunScriptFixture(client, `{"room":"dev"}`, "call", "listRooms", "-")
+		if code != ExitOK || strings.TrimSpace(stdout) != `{"method":"listRooms","params":{"room":"dev"}}` {
+			t.Errorf("got exit code %d and output [%s]", code, stdout)
+		}
+	})
+
+	t.Run("exit codes tell failures apart", func(t *testing.T) {
+		client := FakeServerClient(t, func(request JsonRpcRequest) any {
+			return &JsonRpcError{Code: -32601, Message: "Method not found"}
+		})
+
+		if code, _, stderr := RunScriptFixture(client, "", "call", "frobnicate"); code != ExitError || !strings.Contains(stderr, "Method not found") {
+			t.Errorf("got exit code %d and error [%s] for a server error", code, stderr)
+		}
+		if code, _, _ := RunScriptFixture(client, "", "call", "listRooms", "{oops"); code != ExitUsage {
+			t.Errorf("got exit code %d for invalid params", code)
+		}
+		if code, _, _ := RunScriptFixture(client, "", "frobnicate"); code != ExitUsage {
+			t.Errorf("got exit code %d for an unknown command", code)
+		}
+	})
+
+	t.Run("a server that never answers times out", func(t *testing.T) {
+		done := make(chan struct{})
+		t.Cleanup(func() { close(done) })
+		client := FakeServerClient(t, func(request JsonRpcRequest) any {
+			<-done
+			return nil
+		})
+		client.SetResponseTimeout(50 * time.Millisecond)
+
+		if code, _, _ := RunScriptFixture(client, "", "call", "listRooms"); code != ExitTimeout {
+			t.Errorf("got exit code %d", code)
+		}
+	})
+}
+
+func TestSendAndHistoryCommands(t *testing.T) {
+	var sent []string
+	client := FakeServerClient(t, func(request JsonRpcRequest) any {
+		switch request.Method {
+		case ChatRpcMethod:
+			var params ChatRequestParams
+			json.Unmarshal(request.Params, &params)
+			sent = append(sent, string(params.Msg))
+			return SuccessResult{Success: true}
+		case GetHistoryRpcMethod:
+			return GetHistoryResult{Room: DefaultRoom, Messages: []*Message{{Id: "1", Room: DefaultRoom, Author: "bob", Msg: []byte("hi")}}}
+		}
+		return SuccessResult{Success: true}
+	})
+
+	if code, _, _ := RunScriptFixture(client, "from stdin\n", "send"); code != ExitOK {
+		t.Errorf("got exit code %d sending from stdin", code)
+	}
+	if code, _, _ := RunScriptFixture(client, "", "send", "-room", "dev", "hello", "there"); code != ExitOK || client.CurrentRoom() != "dev" {
+		t.Errorf("got exit code %d and room [%s] sending to a room", code, client.CurrentRoom())
+	}
+	if strings.Join(sent, "|") != "from stdin|hello there" {
+		t.Errorf("got messages %q", sent)
+	}
+
+	code, stdout, _ := RunScriptFixture(client, "", "history", "-n", "1")
+	var message ScriptMessage
+	if code != ExitOK || json.Unmarshal([]byte(stdout), &message) != nil || message.Author != "bob" || message.Msg != "hi" {
+		t.Errorf("got exit code %d and output [%s]", code, stdout)
+	}
+}
+
+func TestTailCommand(t *testing.T) {
+	clientConn, serverConn := net.Pipe()
+	t.Cleanup(func() { clientConn.Close() })
+	client := NewJsonRpcClient(clientConn, "")
+	ready := make(chan struct{})
+	tailReady = func() { close(ready) }
+	t.Cleanup(func() { tailReady = func() {} })
+	go func() {
+		// Only read once tail follows the room, so no notification arrives before it listens
+		<-ready
+		client.HandleServerMessages()
+	}()
+
+	go func() {
+		for _, room := range []string{"dev", DefaultRoom} {
+			params, _ := json.Marshal(ChatMessageNotification{Id: "1", Room: room, Author: "bob", Msg: []byte("in " + room)})
+			notification, _ := json.Marshal(JsonRpcNotification{JsonRpc: JsonRpcVersion, Method: ChatNotificationRpcMethod, Params: params})
+			serverConn.Write(notification)
+		}
+		serverConn.Close()
+	}()
+
+	code, stdout, _ := RunScriptFixture(client, "", "tail")
+	if code != ExitUnavailable || strings.Count(stdout, "\n") != 1 || !strings.Contains(stdout, `"msg":"in `+DefaultRoom+`"`) {
+		t.Errorf("got exit code %d and output [%s]", code, stdout)
+	}
+}
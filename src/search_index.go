@@ -0,0 +1,196 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	SnippetRadius   = 40
+	HighlightMarker = "**"
+	bm25K1          = 1.2
+	bm25B           = 0.75
+)
+
+// Position of a term within a message's text
+type tokenSpan struct {
+	term  string
+	start int
+	end   int
+}
+
+// Split text into lower-cased terms along with their byte offsets
+func tokenize(text string) []tokenSpan {
+	spans := make([]tokenSpan, 0)
+	start := -1
+
+	for i, r := range text {
+		isWordChar := unicode.IsLetter(r) || unicode.IsDigit(r)
+		if isWordChar && start == -1 {
+			start = i
+		}
+		if !isWordChar && start != -1 {
+			spans = append(spans, tokenSpan{term: strings.ToLower(text[start:i]), start: start, end: i})
+			start = -1
+		}
+	}
+	if start != -1 {
+		spans = append(spans, tokenSpan{term: strings.ToLower(text[start:]), start: start, end: len(text)})
+	}
+
+	return spans
+}
+
+// Get the distinct terms of a search query
+func queryTerms(query string) []string {
+	seen := make(map[string]bool)
+	terms := make([]string, 0)
+	for _, span := range tokenize(query) {
+		if !seen[span.term] {
+			seen[span.term] = true
+			terms = append(terms, span.term)
+		}
+	}
+	return terms
+}
+
+// Inverted index over message text, updated incrementally as messages are added.
+// Messages keep the position they were indexed at so searches can be scored as of an earlier size.
+type SearchIndex struct {
+	postings     map[string]map[string]int
+	lengths      map[string]int
+	positions    map[string]int
+	totalLengths []int
+	mu           sync.RWMutex
+}
+
+// Create a new empty search index
+func NewSearchIndex() *SearchIndex {
+	postings := make(map[string]map[string]int)
+	lengths := make(map[string]int)
+	positions := make(map[string]int)
+	return &SearchIndex{postings: postings, lengths: lengths, positions: positions, totalLengths: make([]int, 0)}
+}
+
+// Get the number of indexed messages
+func (i *SearchIndex) Size() int {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+	return len(i.totalLengths)
+}
+
+// Add a message's terms to the index
+func (i *SearchIndex) Index(message *Message) {
+	spans := tokenize(string(message.Msg))
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if _, ok := i.lengths[message.Id]; ok {
+		return
+	}
+
+	for _, span := range spans {
+		postings, ok := i.postings[span.term]
+		if !ok {
+			postings = make(map[string]int)
+			i.postings[span.term] = postings
+		}
+		postings[message.Id]++
+	}
+	totalLength := len(spans)
+	if size := len(i.totalLengths); size > 0 {
+		totalLength += i.totalLengths[size-1]
+	}
+	i.lengths[message.Id] = len(spans)
+	i.positions[message.Id] = len(i.totalLengths)
+	i.totalLengths = append(i.totalLengths, totalLength)
+}
+
+// Score every message containing at least one of the terms using BM25
+func (i *SearchIndex) Score(terms []string) map[string]float64 {
+	return i.ScoreAsOf(terms, i.Size())
+}
+
+// Score the first size indexed messages as if nothing had been indexed after them
+func (i *SearchIndex) ScoreAsOf(terms []string, size int) map[string]float64 {
+	i.mu.RLock()
+	defer i.mu.RUnlock()
+
+	scores := make(map[string]float64)
+	size = min(size, len(i.totalLengths))
+	if size <= 0 {
+		return scores
+	}
+	documentCount := float64(size)
+	averageLength := float64(i.totalLengths[size-1]) / documentCount
+
+	for _, term := range terms {
+		postings := make(map[string]int)
+		for messageId, frequency := range i.postings[term] {
+			if i.positions[messageId] < size {
+				postings[messageId] = frequency
+			}
+		}
+		matches := float64(len(postings))
+		idf := math.Log(1 + (documentCount-matches+0.5)/(matches+0.5))
+
+		for messageId, frequency := range postings {
+			tf := float64(frequency)
+			norm := 1 - bm25B + bm25B*float64(i.lengths[messageId])/averageLength
+			scores[messageId] += idf * tf * (bm25K1 + 1) / (tf + bm25K1*norm)
+		}
+	}
+
+	return scores
+}
+
+// Build a snippet around the first matched term, wrapping every matched term in the highlight marker
+func Snippet(text string, terms []string) string {
+	matched := make(map[string]bool)
+	for _, term := range terms {
+		matched[term] = true
+	}
+
+	highlights := make([]tokenSpan, 0)
+	for _, span := range tokenize(text) {
+		if matched[span.term] {
+			highlights = append(highlights, span)
+		}
+	}
+	if len(highlights) == 0 {
+		return text
+	}
+
+	start := max(highlights[0].start-SnippetRadius, 0)
+	end := min(highlights[0].end+SnippetRadius, len(text))
+	for start > 0 && !utf8.RuneStart(text[start]) {
+		start--
+	}
+	for end < len(text) && !utf8.RuneStart(text[end]) {
+		end++
+	}
+
+	var snippet strings.Builder
+	if start > 0 {
+		snippet.WriteString("...")
+	}
+	position := start
+	for _, span := range highlights {
+		if span.start < start || span.end > end {
+			continue
+		}
+		snippet.WriteString(text[position:span.start])
+		snippet.WriteString(HighlightMarker + text[span.start:span.end] + HighlightMarker)
+		position = span.end
+	}
+	snippet.WriteString(text[position:end])
+	if end < len(text) {
+		snippet.WriteString("...")
+	}
+
+	return snippet.String()
+}
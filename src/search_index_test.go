@@ -0,0 +1,128 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func SearchFixture() *MessageService {
+	service := MessageServiceFixture()
+	service.AddMessage("general", "alice", []byte("the deploy failed again"), "")
+	service.AddMessage("general", "bob", []byte("deploy deploy deploy, rolling back the deploy"), "")
+	service.AddMessage("random", "alice", []byte("lunch?"), "")
+	service.AddMessage("ops", "carol", []byte("Deploy finished"), "")
+	return service
+}
+
+// Search filter letting every room's messages through
+func EveryRoom(room string) bool {
+	return true
+}
+
+func AssertNumberOfHits(t testing.TB, got int, want int) {
+	t.Helper()
+	if got != want {
+		t.Errorf("got [%d] hits but want [%d]", got, want)
+	}
+}
+
+func TestTokenize(t *testing.T) {
+	spans := tokenize("Héllo, wörld! 42")
+	want := []string{"héllo", "wörld", "42"}
+
+	if len(spans) != len(want) {
+		t.Fatalf("got [%d] terms but want [%d]", len(spans), len(want))
+	}
+	for i, span := range spans {
+		if span.term != want[i] {
+			t.Errorf("got term [%s] but want [%s]", span.term, want[i])
+		}
+	}
+}
+
+func TestSnippet(t *testing.T) {
+	t.Run("matched terms are highlighted", func(t *testing.T) {
+		got := Snippet("the Deploy failed", []string{"deploy"})
+		want := "the **Deploy** failed"
+		if got != want {
+			t.Errorf("got [%s] but want [%s]", got, want)
+		}
+	})
+
+	t.Run("long text is trimmed around the first match", func(t *testing.T) {
+		text := "aaaaaaaaaa aaaaaaaaaa aaaaaaaaaa aaaaaaaaaa aaaaaaaaaa needle bbbbbbbbbb bbbbbbbbbb bbbbbbbbbb bbbbbbbbbb bbbbbbbbbb"
+		got := Snippet(text, []string{"needle"})
+		want := "...aaaaaa aaaaaaaaaa aaaaaaaaaa aaaaaaaaaa **needle** bbbbbbbbbb bbbbbbbbbb bbbbbbbbbb bbbbbb..."
+		if got != want {
+			t.Errorf("got [%s] but want [%s]", got, want)
+		}
+	})
+}
+
+func TestSearchMessages(t *testing.T) {
+	t.Run("results are ranked by relevance", func(t *testing.T) {
+		service := SearchFixture()
+		result, err := service.SearchMessages(SearchMessagesParams{Query: "deploy"}, EveryRoom)
+
+		AssertErrorNotNil(t, err)
+		AssertNumberOfHits(t, result.Total, 3)
+		if result.Hits[0].Message.Author != "bob" {
+			t.Errorf("got top hit from [%s] but wanted [bob]", result.Hits[0].Message.Author)
+		}
+	})
+
+	t.Run("filter by room and author", func(t *testing.T) {
+		service := SearchFixture()
+		result, _ := service.SearchMessages(SearchMessagesParams{Query: "deploy", Room: "general", Author: "alice"}, EveryRoom)
+
+		AssertNumberOfHits(t, result.Total, 1)
+		if result.Hits[0].Snippet != "the **deploy** failed again" {
+			t.Errorf("got snippet [%s]", result.Hits[0].Snippet)
+		}
+	})
+
+	t.Run("filter by time range", func(t *testing.T) {
+		service := SearchFixture()
+		future := time.Now().Add(time.Hour)
+		result, _ := service.SearchMessages(SearchMessagesParams{Query: "deploy", From: &future}, EveryRoom)
+
+		AssertNumberOfHits(t, result.Total, 0)
+	})
+
+	t.Run("paginate with a cursor", func(t *testing.T) {
+		service := SearchFixture()
+		first, _ := service.SearchMessages(SearchMessagesParams{Query: "deploy", Limit: 2}, EveryRoom)
+		AssertNumberOfHits(t, len(first.Hits), 2)
+
+		second, err := service.SearchMessages(SearchMessagesParams{Query: "deploy", Limit: 2, Cursor: first.NextCursor}, EveryRoom)
+		AssertErrorNotNil(t, err)
+		AssertNumberOfHits(t, len(second.Hits), 1)
+		if second.NextCursor != "" {
+			t.Errorf("got cursor [%s] on the last page", second.NextCursor)
+		}
+	})
+
+	t.Run("messages added between pages don't repeat hits", func(t *testing.T) {
+		service := SearchFixture()
+		first, _ := service.SearchMessages(SearchMessagesParams{Query: "deploy", Limit: 1}, EveryRoom)
+		service.AddMessage("", "carol", []byte("deploy deploy deploy"), "")
+
+		second, err := service.SearchMessages(SearchMessagesParams{Query: "deploy", Limit: 10, Cursor: first.NextCursor}, EveryRoom)
+		AssertErrorNotNil(t, err)
+		AssertNumberOfHits(t, len(second.Hits), 2)
+		for _, hit := range second.Hits {
+			if hit.Message.Id == first.Hits[0].Message.Id {
+				t.Errorf("got hit [%s] again on the second page", hit.Message.Id)
+			}
+		}
+	})
+
+	t.Run("invalid cursor", func(t *testing.T) {
+		service := SearchFixture()
+		_, err := service.SearchMessages(SearchMessagesParams{Query: "deploy", Cursor: "abc"}, EveryRoom)
+
+		if err != ErrInvalidCursor {
+			t.Errorf("got error [%v] but wanted [%v]", err, ErrInvalidCursor)
+		}
+	})
+}
@@ -1,11 +1,18 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -15,7 +22,26 @@ type Server struct {
 	port              int
 	listener          net.Listener
 	connectionService *ConnectionService
+	messageService    *MessageService
+	userService       *UserService
+	roomService       *RoomService
+	mentionService    *MentionService
+	moderationService *ModerationService
+	webhookService    *WebhookService
+	rateLimiter       *RateLimiter
+	outboundConfig    OutboundQueueConfig
+	heartbeatConfig   HeartbeatConfig
+	metrics           *Metrics
+	metricsPort       int
+	logLevel          *slog.LevelVar
+	configPath        string
+	admins            map[string]string
+	configMu          sync.RWMutex
 	dispatcher        *JsonRpcDispatcher
+	node              string
+	broker            Broker
+	presence          *ClusterPresence
+	federation        *FederationService
 }
 
 // Start the server and listen for connections (Main entry point)
@@ -23,11 +49,18 @@ func (s *Server) Start() {
 	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", s.port))
 
 	if err != nil {
-		log.Fatalf("Failed to start server! Exiting", err)
+		slog.Error("Failed to start server! Exiting", "port", s.port, "error", err)
+		os.Exit(1)
 	}
 
 	s.listener = listener
-	log.Printf("Server starting... Listening on port: [%d] \n", s.port)
+	slog.Info("Server starting", "port", s.port)
+	if s.heartbeatConfig.Interval > 0 {
+		go s.RunHeartbeat()
+	}
+	if s.metricsPort > 0 {
+		go s.ServeMetrics()
+	}
 	s.Listen()
 }
 
@@ -35,76 +68,149 @@ func (s *Server) Start() {
 func (s *Server) Listen() {
 	for {
 		conn, err := s.listener.Accept()
-		log.Println("New connection accepted")
 		if err != nil {
-			log.Println("Error accepting incoming connection:", err)
+			slog.Warn("Error accepting incoming connection", "error", err)
 			continue
 		}
-		connectionId := uuid.New().String()
-		log.Printf("Connection Accepted. ConnectionId = [%s]\n", connectionId)
-		connection := &Connection{id: connectionId, Conn: conn}
-		s.connectionService.AddConnection(connection)
+		connection := s.AcceptConnection(conn)
 		go s.HandleConnectionMessages(connection)
 	}
 }
 
-// Handle incoming messages from a connection
-func (s *Server) HandleConnectionMessages(connection *Connection) {
-	buf := make([]byte, 1024)
-	var request JsonRpcRequest
+// Add a new connection, joining it to the default room and telling the other nodes about it
+func (s *Server) AcceptConnection(conn net.Conn) *Connection {
+	connection := s.connectionService.AddConnection(conn)
+	if s.outboundConfig.Capacity > 0 {
+		connection.StartOutboundQueue(s.outboundConfig, func() { s.CloseConnection(connection) })
+	}
+	s.joinDefaultRoom(connection, connection.id)
+	s.publishPresence(connection, true)
+	return connection
+}
 
-	for {
-		connections := s.connectionService.ListConnections()
-		log.Printf("[%d] connections listening", len(connections))
+// Put an identity of a connection in the default room unless it or the connection's IP is banned from it -
+// a banned identity is taken out instead, since signing in keeps the rooms joined while anonymous
+func (s *Server) joinDefaultRoom(connection *Connection, identity string) {
+	if _, banned := s.moderationService.IsBanned(DefaultRoom, identity, RemoteIP(connection)); banned {
+		s.roomService.LeaveRoom(DefaultRoom, identity)
+		return
+	}
+	s.roomService.JoinRoom(DefaultRoom, identity)
+}
 
-		bytesRead, err := connection.Read(buf)
-		message := buf[:bytesRead]
+// Reader failing once the message being decoded from it runs past a limit, so a client can't make the
+// server buffer an endless message - start is moved to the end of each message decoded, and a decoder
+// only reads more while its current message is incomplete
+type messageLimitReader struct {
+	reader io.Reader
+	limit  int64
+	read   int64
+	start  int64
+}
 
-		if err != nil {
-			log.Fatalln("Error reading connection buffer", err.Error())
+func (r *messageLimitReader) Read(p []byte) (int, error) {
+	if r.read-r.start > r.limit {
+		return 0, ErrRequestTooLarge
+	}
+	n, err := r.reader.Read(p)
+	r.read += int64(n)
+	return n, err
+}
+
+// Handle incoming messages from a connection - messages are JSON values one after another, however the
+// reads split or join them
+func (s *Server) HandleConnectionMessages(connection *Connection) {
+	ctx := ContextWithConnection(context.Background(), connection)
+	logger := slog.Default().With("connection_id", connection.id)
+	reader := &messageLimitReader{reader: connection, limit: MaxRequestBytes}
+	decoder := json.NewDecoder(reader)
+	decoded := int64(0)
+
+	for {
+		if s.heartbeatConfig.Interval > 0 {
+			connection.SetReadDeadline(s.heartbeatConfig.ReadDeadline(time.Now()))
+		}
+		var message json.RawMessage
+		err := decoder.Decode(&message)
+		if err == nil && len(message) > MaxRequestBytes {
+			err = ErrRequestTooLarge
+		}
+		var syntaxErr *json.SyntaxError
+		switch {
+		case errors.As(err, &syntaxErr):
+			// The decoder can't get past invalid JSON, so drop what it buffered and start again
+			logger.Info("Failed decoding message", "error", err)
+			connection.Write([]byte("Invalid Request, must follow JSON-RPC Request schema"))
+			decoder, decoded, reader.start = json.NewDecoder(reader), reader.read, reader.read
+			continue
+		case errors.Is(err, ErrRequestTooLarge):
+			logger.Warn("Disconnecting connection for a message over the size limit", "limit", MaxRequestBytes)
+			response, _ := json.Marshal(JsonRpcResponse{JsonRpc: JsonRpcVersion, Error: &JsonRpcError{Code: -32600, Message: "Request too large"}})
+			connection.Write(response)
+			s.CloseConnection(connection)
+			return
+		case err != nil:
 			if err == io.EOF {
-				log.Printf("Connection closed: %s", connection.id)
-				s.connectionService.DeleteConnection(connection.id)
-				continue
+				logger.Info("Connection closed")
+			} else {
+				logger.Info("Error reading connection", "error", err)
 			}
-
+			s.CloseConnection(connection)
+			return
 		}
+		reader.start = decoded + decoder.InputOffset()
 
-		log.Printf("Read [%d] bytes from connection [%s} \n", bytesRead, connection.id)
-		log.Printf("Message: %s\n", buf)
+		connection.Touch()
+		logger.Debug("Read from connection", "bytes", len(message), "body", string(message))
 
+		if IsJsonRpcResponse(message) {
+			var response JsonRpcResponse
+			if err := json.Unmarshal(message, &response); err != nil || !connection.Resolve(response) {
+				logger.Info("Dropping response that no request is waiting for", "request_id", response.Id)
+			}
+			continue
+		}
+
+		var request JsonRpcRequest
 		err = json.Unmarshal(message, &request)
 		if err != nil {
-			log.Printf("Failed deserializing message [%s] into JSON-RPC Request\n", buf)
+			logger.Info("Failed deserializing message into JSON-RPC Request", "bytes", len(message), "body", string(message), "error", err)
 			connection.Write([]byte("Invalid Request, must follow JSON-RPC Request schema"))
 			continue
 		}
 
-		s.dispatcher.Dispatch(request, connection)
-
-		if request.Method == "chat" {
-			var chatParams ChatRequestParams
-			err = json.Unmarshal(request.Params, &chatParams)
-
-			if err != nil {
-				log.Printf("Failed deserializing request params: [%s] \n", request.Id)
-				continue
-			}
-
-			params, _ := json.Marshal(ChatMessageNotification{Msg: chatParams.Msg})
-			notification := JsonRpcNotification{JsonRpc: JsonRpcVersion, Method: ChatNotificationRpcMethod, Params: params}
-			s.dispatcher.SendNotification(notification, ConnectionsToWriters(connections, connection))
+		requestLogger := s.requestLogger(connection, request)
+		requestLogger.Debug("Received request", "params", string(request.Params))
+		if s.dispatcher.Awaits(request.Method) {
+			// Its response may take as long as another client does, so later requests aren't held up behind it
+			go s.dispatcher.Dispatch(ContextWithLogger(ctx, requestLogger), request, connection)
+		} else {
+			s.dispatcher.Dispatch(ContextWithLogger(ctx, requestLogger), request, connection)
 		}
 
-		clear(buf)
+		if s.rateLimiter.ShouldDisconnect(connection.id) {
+			logger.Warn("Disconnecting connection for exceeding rate limits")
+			s.CloseConnection(connection)
+			return
+		}
 	}
 }
 
+// Remove a connection and sign it out - anonymous connections also leave their rooms
+func (s *Server) CloseConnection(connection *Connection) {
+	s.connectionService.DeleteConnection(connection.id)
+	s.userService.SignOut(connection.id)
+	s.roomService.RemoveMember(connection.id)
+	s.rateLimiter.Forget(connection.id)
+	s.publishPresence(connection, false)
+	connection.Close()
+}
+
 func ConnectionsToWriters(connections []*Connection, exclude *Connection) []io.Writer {
 	writers := make([]io.Writer, 0)
 
 	for _, c := range connections {
-		if c.id != exclude.id {
+		if exclude == nil || c.id != exclude.id {
 			writers = append(writers, c)
 		}
 	}
@@ -112,24 +218,496 @@ func ConnectionsToWriters(connections []*Connection, exclude *Connection) []io.W
 	return writers
 }
 
-func ChatMessageHandler(request JsonRpcRequest) JsonRpcResponse {
-	var params ChatRequestParams
-	err := json.Unmarshal(request.Params, &params)
+// Send a notification to the connections except the excluded one
+func (s *Server) Notify(connections []*Connection, method string, params any, exclude *Connection) {
+	paramsJson, err := json.Marshal(params)
 	if err != nil {
-		errorResponse := JsonRpcResponse{Id: request.Id, JsonRpc: request.JsonRpc, Error: &JsonRpcError{Code: -32600, Message: "Invalid Request"}}
-		return errorResponse
+		slog.Error("Failed serializing notification params", "method", method, "error", err)
+		return
+	}
+
+	notification := JsonRpcNotification{JsonRpc: JsonRpcVersion, Method: method, Params: paramsJson}
+	receivers := ConnectionsToWriters(connections, exclude)
+	failed, err := s.dispatcher.SendNotification(notification, receivers)
+	if err == nil {
+		s.metrics.ObserveNotification(len(receivers), failed)
 	}
+}
+
+// Broadcast a notification to every connection in the cluster except the excluded one
+func (s *Server) Broadcast(method string, params any, exclude *Connection) {
+	s.publishNotification(AudienceAll, "", "", method, params, exclude)
+}
 
-	result := SuccessResult{Success: true}
-	resultJson, err := json.Marshal(result)
-	response := JsonRpcResponse{Id: request.Id, JsonRpc: request.JsonRpc, Result: resultJson}
-	return response
+// Broadcast a notification to the connections of a room's members in the cluster except the excluded one
+func (s *Server) BroadcastToRoom(room string, method string, params any, exclude *Connection) {
+	s.publishNotification(AudienceRoom, room, "", method, params, exclude)
+}
+
+// Send a notification to the connections of an identity in the cluster
+func (s *Server) NotifyIdentity(identity string, method string, params any) {
+	s.publishNotification(AudienceIdentity, identity, "", method, params, nil)
+}
+
+// List the connections whose identity is a member of the room
+func (s *Server) RoomConnections(room string) []*Connection {
+	connections := make([]*Connection, 0)
+	for _, c := range s.connectionService.ListConnections() {
+		if s.roomService.IsMember(room, s.userService.Identity(c)) {
+			connections = append(connections, c)
+		}
+	}
+	return connections
+}
+
+// List the connections of an identity - a signed in user name or an anonymous connection id
+func (s *Server) IdentityConnections(identity string) []*Connection {
+	connections := make([]*Connection, 0)
+	for _, connectionId := range s.userService.ConnectionsForUser(identity) {
+		if c, ok := s.connectionService.GetConnection(connectionId); ok {
+			connections = append(connections, c)
+		}
+	}
+	if c, ok := s.connectionService.GetConnection(identity); ok && s.userService.Identity(c) == identity {
+		connections = append(connections, c)
+	}
+	return connections
+}
+
+// Map service errors to JSON-RPC error responses
+func NewServiceErrorResponse(request JsonRpcRequest, err error) JsonRpcResponse {
+	switch {
+	case errors.Is(err, ErrMessageNotFound):
+		return NewErrorResponse(request, MessageNotFoundErrorCode, "Message not found")
+	case errors.Is(err, ErrRoomNotFound):
+		return NewErrorResponse(request, RoomNotFoundErrorCode, "Room not found")
+	case errors.Is(err, ErrNotRoomMember):
+		return NewErrorResponse(request, NotRoomMemberErrorCode, "Not a member of the room")
+	case errors.Is(err, ErrRoomExists):
+		return NewErrorResponse(request, RoomExistsErrorCode, "Room already exists")
+	case errors.Is(err, ErrUserNameTaken):
+		return NewErrorResponse(request, UserNameTakenErrorCode, "User name taken")
+	case errors.Is(err, ErrPermissionDenied):
+		return NewErrorResponse(request, PermissionDeniedErrorCode, "Permission denied")
+	case errors.Is(err, ErrNotSignedIn):
+		return NewErrorResponse(request, NotSignedInErrorCode, "Not signed in")
+	case errors.Is(err, ErrBanned):
+		return NewErrorResponse(request, BannedErrorCode, "Banned from the room")
+	case errors.Is(err, ErrUserNotFound):
+		return NewErrorResponse(request, UserNotFoundErrorCode, "User not found")
+	case errors.Is(err, ErrConnectionNotFound):
+		return NewErrorResponse(request, ConnectionNotFoundErrorCode, "Connection not found")
+	case errors.Is(err, ErrResponseTimeout), errors.Is(err, ErrPeerClosed):
+		return NewErrorResponse(request, ClientTimeoutErrorCode, "Client did not respond")
+	case errors.Is(err, ErrServerUnreachable):
+		return NewErrorResponse(request, ServerUnreachableErrorCode, "Server unreachable")
+	case errors.Is(err, ErrWebhookNotFound):
+		return NewErrorResponse(request, WebhookNotFoundErrorCode, "Webhook not found")
+	case errors.Is(err, ErrMuted):
+		return NewErrorResponse(request, MutedErrorCode, "Muted in the room")
+	case errors.Is(err, ErrBadCredentials):
+		return NewErrorResponse(request, BadCredentialsErrorCode, "Wrong password")
+	case errors.Is(err, ErrBadAdminToken):
+		return NewErrorResponse(request, BadAdminTokenErrorCode, "Wrong admin token")
+	case errors.Is(err, ErrInvalidUserName), errors.Is(err, ErrInvalidRoomName), errors.Is(err, ErrInvalidCursor), errors.Is(err, ErrInvalidRole):
+		return NewErrorResponse(request, -32602, "Invalid params")
+	}
+	slog.Error("Unexpected service error", "method", request.Method, "request_id", request.Id, "error", err)
+	return NewErrorResponse(request, -32603, "Internal error")
+}
+
+// Record a chat message and broadcast it to the room - replies also broadcast the updated thread summary
+func (s *Server) ChatMessageHandler(ctx context.Context, params ChatRequestParams) (ChatResult, error) {
+	connection, ok := ConnectionFromContext(ctx)
+	if !ok {
+		return ChatResult{}, ErrNoConnection
+	}
+	author := s.userService.Identity(connection)
+	if params.Room == "" {
+		params.Room = DefaultRoom
+	}
+	if params.ParentId != "" {
+		if !connection.HasFeature(FeatureThreads) {
+			return ChatResult{}, NewFeatureNotNegotiatedError(FeatureThreads)
+		}
+		parent, ok := s.messageService.GetMessage(params.ParentId)
+		if !ok {
+			return ChatResult{}, ErrMessageNotFound
+		}
+		params.Room = parent.Room
+	}
+	if !s.roomService.RoomExists(params.Room) {
+		return ChatResult{}, ErrRoomNotFound
+	}
+	if !s.roomService.IsMember(params.Room, author) {
+		return ChatResult{}, ErrNotRoomMember
+	}
+
+	message, err := s.messageService.AddMessage(params.Room, author, params.Msg, params.ParentId)
+	if err != nil {
+		return ChatResult{}, err
+	}
+	s.announceMessage(message, connection)
+	s.federateMessage(message)
+	return ChatResult{Success: true, MessageId: message.Id, Room: message.Room}, nil
+}
+
+// Pass a new message to the other nodes and broadcast it to the room except the sender's connection -
+// replies also broadcast the updated thread summary, and the room's webhooks get the message
+func (s *Server) announceMessage(message *Message, sender *Connection) {
+	s.publish(ClusterEvent{Kind: EventMessage, Message: message})
+
+	notification := ChatMessageNotification{Id: message.Id, Room: message.Room, Author: message.Author, ParentId: message.ParentId, Msg: message.Msg, Timestamp: message.Timestamp}
+	s.BroadcastToRoom(message.Room, ChatNotificationRpcMethod, notification, sender)
+	s.NotifyMentions(message)
+
+	if message.ParentId != "" {
+		s.publishNotification(AudienceRoom, message.Room, FeatureThreads, ThreadUpdatedRpcMethod, s.messageService.GetThreadSummary(message.ParentId), nil)
+	}
+	s.webhookService.Emit(WebhookPayload{Event: WebhookEventMessage, Room: message.Room, Message: &WebhookMessage{
+		Id: message.Id, Author: message.Author, ParentId: message.ParentId, Text: string(message.Msg), Timestamp: message.Timestamp,
+	}})
+}
+
+// Get a page of replies to a thread - only members of the root message's room can read it
+func (s *Server) GetThreadHandler(ctx context.Context, params GetThreadParams) (GetThreadResult, error) {
+	root, ok := s.messageService.GetMessage(params.RootId)
+	if !ok {
+		return GetThreadResult{}, ErrMessageNotFound
+	}
+	if !s.roomService.IsMember(root.Room, s.callerIdentity(ctx)) {
+		return GetThreadResult{}, ErrNotRoomMember
+	}
+	return s.messageService.GetThread(params.RootId, params.Cursor, params.Limit)
+}
+
+// Get a page of a room's messages - only members can read a room's history
+func (s *Server) GetHistoryHandler(ctx context.Context, params GetHistoryParams) (GetHistoryResult, error) {
+	if !s.roomService.RoomExists(params.Room) {
+		return GetHistoryResult{}, ErrRoomNotFound
+	}
+	if !s.roomService.IsMember(params.Room, s.callerIdentity(ctx)) {
+		return GetHistoryResult{}, ErrNotRoomMember
+	}
+	return s.messageService.GetHistory(params.Room, params.Before, params.Limit)
+}
+
+// Search persisted chat messages by text - only the rooms the caller is a member of are searched
+func (s *Server) SearchMessagesHandler(ctx context.Context, params SearchMessagesParams) (SearchMessagesResult, error) {
+	identity := s.callerIdentity(ctx)
+	return s.messageService.SearchMessages(params, func(room string) bool { return s.roomService.IsMember(room, identity) })
+}
+
+// Record the caller's read receipt for a room and broadcast it to the room when it moves forward
+func (s *Server) MarkReadHandler(ctx context.Context, params MarkReadParams) (ReadReceipt, error) {
+	connection, ok := ConnectionFromContext(ctx)
+	if !ok {
+		return ReadReceipt{}, ErrNoConnection
+	}
+	identity := s.userService.Identity(connection)
+	if !s.roomService.IsMember(params.Room, identity) {
+		return ReadReceipt{}, ErrNotRoomMember
+	}
+
+	receipt, updated, err := s.messageService.MarkRead(params.Room, identity, params.MessageId)
+	if err != nil {
+		return ReadReceipt{}, err
+	}
+	if updated {
+		s.BroadcastToRoom(params.Room, ReadReceiptRpcMethod, receipt, connection)
+	}
+
+	return receipt, nil
+}
+
+// Register the middlewares and RPC methods with the dispatcher
+func (s *Server) RegisterMethods() {
+	s.dispatcher.Use(s.MetricsMiddleware)
+	s.dispatcher.Use(s.RateLimitMiddleware)
+	s.dispatcher.Use(s.FeatureMiddleware)
+	s.dispatcher.Use(s.ModerationMiddleware)
+	s.dispatcher.Use(s.AdminMiddleware)
+	s.dispatcher.MapErrors(NewServiceErrorResponse)
+	AddTypedMethod(s.dispatcher, InitializeRpcMethod, s.InitializeHandler, MethodInfo{
+		Description: "Negotiate the protocol version, features and limits - sent by the client when the connection starts",
+		Errors:      []JsonRpcError{invalidParamsError, unsupportedVersionError},
+	})
+	AddTypedMethod(s.dispatcher, ChatRpcMethod, s.ChatMessageHandler, MethodInfo{
+		Description: "Send a chat message to a room, or a reply to a thread when a parent id is given (replies need the threads feature)",
+		Errors:      []JsonRpcError{invalidParamsError, roomNotFoundError, notRoomMemberError, messageNotFoundError, bannedError, mutedError, permissionDeniedError, featureNotNegotiatedError},
+	})
+	AddTypedMethod(s.dispatcher, GetThreadRpcMethod, s.GetThreadHandler, MethodInfo{
+		Description: "Get a page of a thread's replies",
+		Errors:      []JsonRpcError{invalidParamsError, messageNotFoundError, notRoomMemberError, featureNotNegotiatedError},
+		Feature:     FeatureThreads,
+	})
+	AddTypedMethod(s.dispatcher, GetHistoryRpcMethod, s.GetHistoryHandler, MethodInfo{
+		Description: "Get a page of a room's messages, going back from a cursor",
+		Errors:      []JsonRpcError{invalidParamsError, roomNotFoundError, notRoomMemberError, messageNotFoundError},
+	})
+	AddTypedMethod(s.dispatcher, DirectMessageRpcMethod, s.DirectMessageHandler, MethodInfo{
+		Description: "Send a private message to a signed in user, or to user@server on a federated server",
+		Errors:      []JsonRpcError{invalidParamsError, notSignedInError, userNotFoundError, serverUnreachableError},
+	})
+	AddTypedMethod(s.dispatcher, SearchMessagesRpcMethod, s.SearchMessagesHandler, MethodInfo{
+		Description: "Search the message history by text",
+		Errors:      []JsonRpcError{invalidParamsError},
+	})
+	AddTypedMethod(s.dispatcher, CreateUserRpcMethod, s.CreateUserHandler, MethodInfo{
+		Description: "Sign the connection in as a user with its password, creating the user if it doesn't exist",
+		Errors:      []JsonRpcError{invalidParamsError, userNameTakenError, badCredentialsError},
+	})
+	AddTypedMethod(s.dispatcher, CreateChatRoomRpcMethod, s.CreateChatRoomHandler, MethodInfo{
+		Description: "Create a room owned by the caller",
+		Errors:      []JsonRpcError{invalidParamsError, notSignedInError, roomExistsError},
+	})
+	AddTypedMethod(s.dispatcher, DeleteChatRoomRpcMethod, s.DeleteChatRoomHandler, MethodInfo{
+		Description: "Delete a room owned by the caller",
+		Errors:      []JsonRpcError{invalidParamsError, roomNotFoundError, permissionDeniedError},
+	})
+	AddTypedMethod(s.dispatcher, JoinChatRoomRpcMethod, s.JoinChatRoomHandler, MethodInfo{
+		Description: "Join a room",
+		Errors:      []JsonRpcError{invalidParamsError, roomNotFoundError, bannedError},
+	})
+	AddTypedMethod(s.dispatcher, LeaveChatRoomRpcMethod, s.LeaveChatRoomHandler, MethodInfo{
+		Description: "Leave a room",
+		Errors:      []JsonRpcError{invalidParamsError, roomNotFoundError, notRoomMemberError},
+	})
+	AddTypedMethod(s.dispatcher, GetMentionsRpcMethod, s.GetMentionsHandler, MethodInfo{
+		Description: "Get the signed in user's unread mentions",
+		Errors:      []JsonRpcError{notSignedInError},
+	})
+	AddTypedMethod(s.dispatcher, ClearMentionsRpcMethod, s.ClearMentionsHandler, MethodInfo{
+		Description: "Clear the given unread mentions of the signed in user, or all of them when no ids are given",
+		Errors:      []JsonRpcError{invalidParamsError, notSignedInError},
+	})
+	AddTypedMethod(s.dispatcher, MarkReadRpcMethod, s.MarkReadHandler, MethodInfo{
+		Description: "Mark a room as read up to a message",
+		Errors:      []JsonRpcError{invalidParamsError, notRoomMemberError, messageNotFoundError},
+	})
+	AddTypedMethod(s.dispatcher, ListRoomsRpcMethod, s.ListRoomsHandler, MethodInfo{
+		Description: "List every room with its member count and the caller's unread count",
+	})
+	AddTypedMethod(s.dispatcher, ListMembersRpcMethod, s.ListMembersHandler, MethodInfo{
+		Description: "List the members of a room, sorted by name",
+		Errors:      []JsonRpcError{invalidParamsError, roomNotFoundError},
+	})
+	AddTypedMethod(s.dispatcher, SetTopicRpcMethod, s.SetTopicHandler, MethodInfo{
+		Description: "Set the topic of a room (moderators and owners)",
+		Errors:      []JsonRpcError{invalidParamsError, notSignedInError, roomNotFoundError, permissionDeniedError},
+	})
+	AddTypedMethod(s.dispatcher, KickUserRpcMethod, s.KickUserHandler, MethodInfo{
+		Description: "Remove a user from a room",
+		Errors:      []JsonRpcError{invalidParamsError, notSignedInError, permissionDeniedError, notRoomMemberError},
+	})
+	AddTypedMethod(s.dispatcher, BanUserRpcMethod, s.BanUserHandler, MethodInfo{
+		Description: "Ban a user or remote IP from a room, permanently or for a duration in seconds",
+		Errors:      []JsonRpcError{invalidParamsError, notSignedInError, permissionDeniedError},
+	})
+	AddTypedMethod(s.dispatcher, UnbanUserRpcMethod, s.UnbanUserHandler, MethodInfo{
+		Description: "Lift the ban of a user or remote IP from a room",
+		Errors:      []JsonRpcError{invalidParamsError, notSignedInError, permissionDeniedError},
+	})
+	AddTypedMethod(s.dispatcher, MuteUserRpcMethod, s.MuteUserHandler, MethodInfo{
+		Description: "Stop a user chatting in a room, permanently or for a duration in seconds",
+		Errors:      []JsonRpcError{invalidParamsError, notSignedInError, permissionDeniedError},
+	})
+	AddTypedMethod(s.dispatcher, UnmuteUserRpcMethod, s.UnmuteUserHandler, MethodInfo{
+		Description: "Let a muted user chat in a room again",
+		Errors:      []JsonRpcError{invalidParamsError, notSignedInError, permissionDeniedError},
+	})
+	AddTypedMethod(s.dispatcher, SetRoleRpcMethod, s.SetRoleHandler, MethodInfo{
+		Description: "Set the role of a room member",
+		Errors:      []JsonRpcError{invalidParamsError, notSignedInError, permissionDeniedError, notRoomMemberError, userNotFoundError},
+	})
+	AddTypedMethod(s.dispatcher, GetModerationLogRpcMethod, s.GetModerationLogHandler, MethodInfo{
+		Description: "Get the moderation audit log of a room",
+		Errors:      []JsonRpcError{invalidParamsError, notSignedInError, permissionDeniedError},
+	})
+	AddTypedMethod(s.dispatcher, AddWebhookRpcMethod, s.AddWebhookHandler, MethodInfo{
+		Description: "Subscribe a URL to a room's message, join, leave and moderation events, POSTed as JSON signed with the webhook's secret (owners)",
+		Errors:      []JsonRpcError{invalidParamsError, notSignedInError, permissionDeniedError},
+	})
+	AddTypedMethod(s.dispatcher, RemoveWebhookRpcMethod, s.RemoveWebhookHandler, MethodInfo{
+		Description: "Remove a webhook of a room (owners)",
+		Errors:      []JsonRpcError{invalidParamsError, notSignedInError, permissionDeniedError, webhookNotFoundError},
+	})
+	AddTypedMethod(s.dispatcher, ListWebhooksRpcMethod, s.ListWebhooksHandler, MethodInfo{
+		Description: "List the webhooks of a room, without their secrets (moderators and owners)",
+		Errors:      []JsonRpcError{invalidParamsError, notSignedInError, permissionDeniedError},
+	})
+	AddTypedMethod(s.dispatcher, GetWebhookDeadLettersRpcMethod, s.GetWebhookDeadLettersHandler, MethodInfo{
+		Description: "Get the payloads the webhooks of a room gave up delivering after their retries (moderators and owners)",
+		Errors:      []JsonRpcError{invalidParamsError, notSignedInError, permissionDeniedError},
+	})
+	AddTypedMethod(s.dispatcher, PongRpcMethod, s.PongHandler, MethodInfo{
+		Description: "Answer a ping from the server, echoing its heartbeat",
+		Errors:      []JsonRpcError{invalidParamsError},
+	})
+	AddTypedMethod(s.dispatcher, AdminAuthenticateRpcMethod, s.AdminAuthenticateHandler, MethodInfo{
+		Description: "Present the admin token from the server config - admin methods are denied until the connection's admin has",
+		Errors:      []JsonRpcError{invalidParamsError, notSignedInError, badAdminTokenError},
+	})
+	AddTypedMethod(s.dispatcher, AdminListConnectionsRpcMethod, s.AdminListConnectionsHandler, MethodInfo{
+		Description: "List every connection with its user and traffic (admins only)",
+		Errors:      []JsonRpcError{notSignedInError, permissionDeniedError},
+	})
+	AddTypedMethod(s.dispatcher, AdminDisconnectRpcMethod, s.AdminDisconnectHandler, MethodInfo{
+		Description: "Forcibly disconnect a connection (admins only)",
+		Errors:      []JsonRpcError{invalidParamsError, notSignedInError, permissionDeniedError, connectionNotFoundError},
+	})
+	AddTypedMethod(s.dispatcher, AdminAnnounceRpcMethod, s.AdminAnnounceHandler, MethodInfo{
+		Description: "Send an announcement to every connection (admins only)",
+		Errors:      []JsonRpcError{invalidParamsError, notSignedInError, permissionDeniedError},
+	})
+	AddTypedMethod(s.dispatcher, AdminReloadConfigRpcMethod, s.AdminReloadConfigHandler, MethodInfo{
+		Description: "Reload the server config file (admins only)",
+		Errors:      []JsonRpcError{notSignedInError, permissionDeniedError, internalError},
+	})
+	AddTypedMethod(s.dispatcher, AdminDumpRoomsRpcMethod, s.AdminDumpRoomsHandler, MethodInfo{
+		Description: "Dump the full state of every room (admins only)",
+		Errors:      []JsonRpcError{notSignedInError, permissionDeniedError},
+	})
+	AddTypedMethod(s.dispatcher, AdminClientInfoRpcMethod, s.AdminClientInfoHandler, MethodInfo{
+		Description: "Ask a connection's client for its name, version and the methods the server can call on it (admins only)",
+		Errors:      []JsonRpcError{invalidParamsError, notSignedInError, permissionDeniedError, connectionNotFoundError, clientTimeoutError},
+		Awaits:      true,
+	})
+	AddTypedMethod(s.dispatcher, AdminFederationLinksRpcMethod, s.AdminFederationLinksHandler, MethodInfo{
+		Description: "Show the state of the links to federated servers (admins only)",
+		Errors:      []JsonRpcError{notSignedInError, permissionDeniedError},
+	})
+	AddTypedMethod(s.dispatcher, DiscoverRpcMethod, s.DiscoverHandler, MethodInfo{
+		Description: "Describe the server's methods and notifications as an OpenRPC document",
+	})
+
+	s.dispatcher.AddNotification(ChatNotificationRpcMethod, MethodInfo{Description: "A chat message sent to a room the connection's user has joined", Params: ChatMessageNotification{}})
+	s.dispatcher.AddNotification(ThreadUpdatedRpcMethod, MethodInfo{Description: "A thread in a joined room got a reply", Params: Thread{}, Feature: FeatureThreads})
+	s.dispatcher.AddNotification(MentionedRpcMethod, MethodInfo{Description: "The connection's user was mentioned in a chat message", Params: Mention{}})
+	s.dispatcher.AddNotification(TopicChangedRpcMethod, MethodInfo{Description: "The topic of a joined room changed", Params: TopicChange{}})
+	s.dispatcher.AddNotification(DirectMessageNotificationRpcMethod, MethodInfo{Description: "A user sent the connection's user a direct message", Params: DirectMessage{}})
+	s.dispatcher.AddNotification(ReadReceiptRpcMethod, MethodInfo{Description: "A member of a joined room marked it as read", Params: ReadReceipt{}})
+	s.dispatcher.AddNotification(ModeratedRpcMethod, MethodInfo{Description: "A moderation action was taken against the connection's user", Params: ModerationAction{}})
+	s.dispatcher.AddNotification(PingRpcMethod, MethodInfo{Description: "Heartbeat the client must answer with a pong request", Params: Heartbeat{}})
+	s.dispatcher.AddNotification(AnnouncementRpcMethod, MethodInfo{Description: "Server-wide announcement from an admin", Params: Announcement{}})
+	s.dispatcher.AddClientMethod(ClientInfoRpcMethod, MethodInfo{Description: "Describe the client - its name, version and the methods the server can call on it", Result: ClientInfo{}})
+}
+
+// Close storage when the server is stopped, folding its transaction log into the snapshot
+func CloseStorageOnSignal(storage Storage) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		received := <-stop
+		slog.Info("Stopping server", "signal", received.String())
+		if err := storage.Close(); err != nil {
+			slog.Error("Failed to close storage", "error", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}()
 }
 
 func main() {
+	logConfig, err := LogConfigFromEnv()
+	if err != nil {
+		slog.Error("Invalid logging settings", "error", err)
+		os.Exit(1)
+	}
+	logLevel := new(slog.LevelVar)
+	logLevel.Set(logConfig.Level.Level())
+	logConfig.Level = logLevel
+	slog.SetDefault(NewLogger(os.Stderr, logConfig))
+
+	configPath := os.Getenv("CHAT_CONFIG")
+	config, err := LoadServerConfig(configPath)
+	if err != nil {
+		slog.Error("Invalid server config", "path", configPath, "error", err)
+		os.Exit(1)
+	}
+
+	stores := NewMemoryStores()
+	if config.DataDir != "" {
+		storage, err := OpenFileStorage(config.DataDir)
+		if err == nil {
+			stores, err = NewPersistentStores(storage)
+		}
+		if err != nil {
+			slog.Error("Failed to open storage", "dir", config.DataDir, "error", err)
+			os.Exit(1)
+		}
+		CloseStorageOnSignal(storage)
+	}
+
 	dispatcher := NewDispatcher()
-	dispatcher.AddMethod("chat", ChatMessageHandler)
-	connectionService := &ConnectionService{store: NewConnectionStore()}
-	server := &Server{port: 8080, connectionService: connectionService, dispatcher: dispatcher}
+	metrics := NewMetrics()
+	connectionService := &ConnectionService{store: NewConnectionStore(), metrics: metrics}
+	messageService := &MessageService{store: stores.Messages, index: NewSearchIndex()}
+	messageService.RebuildIndex()
+	userService := NewUserService(stores.Users)
+	roomService := NewRoomService(stores.Rooms)
+	// Anonymous members are connection ids, which don't outlive the run that stored them
+	roomService.PruneMembers(func(member string) bool {
+		_, ok := userService.GetUser(member)
+		return ok
+	})
+	mentionService := &MentionService{store: NewMentionStore()}
+	moderationService := &ModerationService{store: stores.Moderation}
+	server := &Server{
+		port:              8080,
+		connectionService: connectionService,
+		messageService:    messageService,
+		userService:       userService,
+		roomService:       roomService,
+		mentionService:    mentionService,
+		moderationService: moderationService,
+		webhookService:    NewWebhookService(stores.Webhooks, DefaultWebhookConfig()),
+		rateLimiter:       NewDefaultRateLimiter(),
+		outboundConfig:    DefaultOutboundQueueConfig(),
+		heartbeatConfig:   DefaultHeartbeatConfig(),
+		metrics:           metrics,
+		metricsPort:       9090,
+		logLevel:          logLevel,
+		configPath:        configPath,
+		dispatcher:        dispatcher,
+	}
+	if config.Port > 0 {
+		server.port = config.Port
+	}
+	if config.MetricsPort > 0 {
+		server.metricsPort = config.MetricsPort
+	}
+	if err := server.ApplyConfig(config); err != nil {
+		slog.Error("Invalid server config", "path", configPath, "error", err)
+		os.Exit(1)
+	}
+	if config.Cluster != nil {
+		node := config.Cluster.NodeId
+		if node == "" {
+			node = uuid.New().String()
+		}
+		mesh, err := ListenMesh(node, config.Cluster.Listen, config.Cluster.Secret)
+		if err != nil {
+			slog.Error("Failed to join the cluster", "listen", config.Cluster.Listen, "error", err)
+			os.Exit(1)
+		}
+		server.JoinCluster(node, mesh)
+		mesh.Connect(config.Cluster.Peers, server.ClusterSnapshot)
+	}
+	if config.Federation != nil {
+		if err := server.StartFederation(*config.Federation); err != nil {
+			slog.Error("Failed to start federation", "error", err)
+			os.Exit(1)
+		}
+	}
+	server.RegisterMethods()
+	if config.IrcPort > 0 {
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", config.IrcPort))
+		if err != nil {
+			slog.Error("Failed to start the IRC gateway", "port", config.IrcPort, "error", err)
+			os.Exit(1)
+		}
+		go server.ServeIrc(listener)
+	}
 	server.Start()
 }
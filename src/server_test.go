@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Hash test passwords with a single round so signing in stays fast
+func init() {
+	PasswordHashIterations = 1
+}
+
+// Password the fake connections of a user sign in with
+func PasswordFor(name string) string {
+	return name + "-password"
+}
+
+// Server fixture with no listener - connections are added with AddFakeConnection
+func ServerFixture() *Server {
+	metrics := NewMetrics()
+	server := &Server{
+		connectionService: &ConnectionService{store: NewConnectionStore(), metrics: metrics},
+		messageService:    MessageServiceFixture(),
+		userService:       NewUserService(NewUserStore()),
+		roomService:       NewRoomService(NewRoomStore()),
+		mentionService:    &MentionService{store: NewMentionStore()},
+		moderationService: &ModerationService{store: NewModerationStore()},
+		webhookService:    NewWebhookService(NewWebhookStore(), DefaultWebhookConfig()),
+		rateLimiter:       NewRateLimiter(),
+		metrics:           metrics,
+		dispatcher:        NewDispatcher(),
+	}
+	server.RegisterMethods()
+	return server
+}
+
+// Dispatch a request as if it arrived on the connection and return the response
+func CallMethod(t testing.TB, server *Server, connection *Connection, method string, params any) JsonRpcResponse {
+	t.Helper()
+	paramsJson, _ := json.Marshal(params)
+	request := JsonRpcRequest{Id: "1", JsonRpc: JsonRpcVersion, Method: method, Params: paramsJson}
+	fakeWriter := &FakeWriter{data: make([]string, 0)}
+	server.dispatcher.Dispatch(ContextWithConnection(context.Background(), connection), request, fakeWriter)
+
+	var response JsonRpcResponse
+	if err := json.Unmarshal([]byte(fakeWriter.data[0]), &response); err != nil {
+		t.Fatalf("got invalid response [%s]", fakeWriter.data[0])
+	}
+	return response
+}
+
+// Add a fake connection to the server, signed in as the user when a name is given
+func AddFakeConnection(t testing.TB, server *Server, name string) (*Connection, *FakeNetConn) {
+	t.Helper()
+	conn := NewFakeNetConn()
+	connection := server.AcceptConnection(conn)
+
+	if name != "" {
+		if _, err := server.CreateUserHandler(ContextWithConnection(context.Background(), connection), CreateUserParams{Name: name, Password: PasswordFor(name)}); err != nil {
+			t.Fatalf("got error signing in as [%s]: %s", name, err)
+		}
+	}
+	return connection, conn
+}
+
+// Count the notifications of a method written to a fake connection
+func CountNotifications(conn *FakeNetConn, method string) int {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	count := 0
+	for _, message := range conn.messagesWrote {
+		if strings.Contains(message, `"method":"`+method+`"`) {
+			count++
+		}
+	}
+	return count
+}
+
+func TestChatMessageHandler(t *testing.T) {
+	t.Run("chat is broadcast to the room except the sender", func(t *testing.T) {
+		server := ServerFixture()
+		alice, aliceConn := AddFakeConnection(t, server, "alice")
+		_, bobConn := AddFakeConnection(t, server, "bob")
+
+		response := CallMethod(t, server, alice, ChatRpcMethod, ChatRequestParams{Msg: []byte("hello")})
+
+		AssertSuccess(t, response)
+		AssertNumberOfConnections(t, CountNotifications(bobConn, ChatNotificationRpcMethod), 1)
+		AssertNumberOfConnections(t, CountNotifications(aliceConn, ChatNotificationRpcMethod), 0)
+	})
+
+	t.Run("chat in a room the sender hasn't joined", func(t *testing.T) {
+		server := ServerFixture()
+		alice, _ := AddFakeConnection(t, server, "alice")
+		server.roomService.CreateRoom("ops", "bob")
+
+		response := CallMethod(t, server, alice, ChatRpcMethod, ChatRequestParams{Msg: []byte("hello"), Room: "ops"})
+		AssertErrorCode(t, response, NotRoomMemberErrorCode)
+	})
+
+	t.Run("replies are posted in the thread's room", func(t *testing.T) {
+		server := ServerFixture()
+		alice, _ := AddFakeConnection(t, server, "alice")
+		server.roomService.CreateRoom("dev", "alice")
+		root, _ := server.messageService.AddMessage("dev", "alice", []byte("root"), "")
+
+		response := CallMethod(t, server, alice, ChatRpcMethod, ChatRequestParams{Msg: []byte("reply"), Room: DefaultRoom, ParentId: root.Id})
+		AssertSuccess(t, response)
+		var result ChatResult
+		json.Unmarshal(response.Result, &result)
+		if result.Room != "dev" {
+			t.Errorf("got room [%s] but wanted [dev]", result.Room)
+		}
+	})
+
+	t.Run("chat without a connection is an internal error", func(t *testing.T) {
+		server := ServerFixture()
+
+		_, err := server.ChatMessageHandler(context.Background(), ChatRequestParams{Msg: []byte("hello")})
+		if !errors.Is(err, ErrNoConnection) {
+			t.Errorf("got error [%v] but wanted [%v]", err, ErrNoConnection)
+		}
+		if _, err := server.MarkReadHandler(context.Background(), MarkReadParams{Room: DefaultRoom}); !errors.Is(err, ErrNoConnection) {
+			t.Errorf("got error [%v] marking read but wanted [%v]", err, ErrNoConnection)
+		}
+		if _, err := server.DirectMessageHandler(context.Background(), DirectMessageParams{To: "bob", Msg: []byte("psst")}); !errors.Is(err, ErrNoConnection) {
+			t.Errorf("got error [%v] sending a direct message but wanted [%v]", err, ErrNoConnection)
+		}
+	})
+}
+
+// Read the responses a client gets until one has the id, skipping notifications
+func ReadResponse(t testing.TB, decoder *json.Decoder, id string) JsonRpcResponse {
+	t.Helper()
+	for {
+		var response JsonRpcResponse
+		if err := decoder.Decode(&response); err != nil {
+			t.Fatalf("got no response [%s]: %s", id, err)
+		}
+		if response.Id == id {
+			return response
+		}
+	}
+}
+
+func TestHandleConnectionMessages(t *testing.T) {
+	t.Run("requests are read however the writes split or join them", func(t *testing.T) {
+		server := ServerFixture()
+		serverEnd, clientEnd := net.Pipe()
+		defer clientEnd.Close()
+		go server.HandleConnectionMessages(server.AcceptConnection(serverEnd))
+
+		chatParams, _ := json.Marshal(ChatRequestParams{Msg: []byte(strings.Repeat("long ", 1000))})
+		chat, _ := json.Marshal(JsonRpcRequest{JsonRpc: JsonRpcVersion, Id: "1", Method: ChatRpcMethod, Params: chatParams})
+		pong, _ := json.Marshal(JsonRpcRequest{JsonRpc: JsonRpcVersion, Id: "2", Method: PongRpcMethod, Params: []byte(`{}`)})
+		go func() {
+			joined := append(append(chat, pong...), chat[:10]...)
+			clientEnd.Write(joined)
+			clientEnd.Write(chat[10:])
+		}()
+
+		clientEnd.SetReadDeadline(time.Now().Add(5 * time.Second))
+		decoder := json.NewDecoder(clientEnd)
+		AssertSuccess(t, ReadResponse(t, decoder, "1"))
+		AssertSuccess(t, ReadResponse(t, decoder, "2"))
+		AssertSuccess(t, ReadResponse(t, decoder, "1"))
+	})
+
+	t.Run("a message over the limit closes the connection", func(t *testing.T) {
+		// Just over the limit once read whole, and far over it while still being read
+		for _, size := range []int{MaxRequestBytes * 3 / 4, 2 * MaxRequestBytes} {
+			server := ServerFixture()
+			serverEnd, clientEnd := net.Pipe()
+			defer clientEnd.Close()
+			connection := server.AcceptConnection(serverEnd)
+			go server.HandleConnectionMessages(connection)
+
+			chatParams, _ := json.Marshal(ChatRequestParams{Msg: []byte(strings.Repeat("a", size))})
+			chat, _ := json.Marshal(JsonRpcRequest{JsonRpc: JsonRpcVersion, Id: "1", Method: ChatRpcMethod, Params: chatParams})
+			go clientEnd.Write(chat)
+
+			clientEnd.SetReadDeadline(time.Now().Add(5 * time.Second))
+			AssertErrorCode(t, ReadResponse(t, json.NewDecoder(clientEnd), ""), -32600)
+			AssertEventually(t, "the connection to be closed", func() bool {
+				_, ok := server.connectionService.GetConnection(connection.id)
+				return !ok
+			})
+		}
+	})
+}
+
+func TestGetThreadHandler(t *testing.T) {
+	server := ServerFixture()
+	alice, _ := AddFakeConnection(t, server, "alice")
+	bob, _ := AddFakeConnection(t, server, "bob")
+	server.roomService.CreateRoom("ops", "alice")
+	root, _ := server.messageService.AddMessage("ops", "alice", []byte("root"), "")
+	server.messageService.AddMessage("ops", "alice", []byte("reply"), root.Id)
+
+	response := CallMethod(t, server, alice, GetThreadRpcMethod, GetThreadParams{RootId: root.Id})
+	AssertSuccess(t, response)
+	var result GetThreadResult
+	json.Unmarshal(response.Result, &result)
+	if len(result.Replies) != 1 {
+		t.Errorf("got thread %+v", result)
+	}
+
+	AssertErrorCode(t, CallMethod(t, server, bob, GetThreadRpcMethod, GetThreadParams{RootId: root.Id}), NotRoomMemberErrorCode)
+	AssertErrorCode(t, CallMethod(t, server, bob, GetThreadRpcMethod, GetThreadParams{RootId: "nope"}), MessageNotFoundErrorCode)
+}
+
+func TestCreateUserHandler(t *testing.T) {
+	t.Run("users sign in again with their password", func(t *testing.T) {
+		server := ServerFixture()
+		AddFakeConnection(t, server, "alice")
+		phone, _ := AddFakeConnection(t, server, "")
+
+		response := CallMethod(t, server, phone, CreateUserRpcMethod, CreateUserParams{Name: "alice", Password: PasswordFor("alice")})
+		AssertSuccess(t, response)
+		if strings.Contains(string(response.Result), "credential") {
+			t.Errorf("got the credential in the result %s", response.Result)
+		}
+		if identity := server.userService.Identity(phone); identity != "alice" {
+			t.Errorf("got identity [%s] but wanted [alice]", identity)
+		}
+	})
+
+	t.Run("a wrong password is refused", func(t *testing.T) {
+		server := ServerFixture()
+		AddFakeConnection(t, server, "alice")
+		impostor, _ := AddFakeConnection(t, server, "")
+
+		AssertErrorCode(t, CallMethod(t, server, impostor, CreateUserRpcMethod, CreateUserParams{Name: "alice", Password: "not-her-password"}), BadCredentialsErrorCode)
+		AssertErrorCode(t, CallMethod(t, server, impostor, CreateUserRpcMethod, CreateUserParams{Name: "alice"}), -32602)
+		if identity := server.userService.Identity(impostor); identity != impostor.id {
+			t.Errorf("got identity [%s] but wanted the connection id", identity)
+		}
+	})
+
+	t.Run("users stored without a password claim one", func(t *testing.T) {
+		server := ServerFixture()
+		server.userService.store.Add(&User{Name: "alice"})
+		first, _ := AddFakeConnection(t, server, "")
+		second, _ := AddFakeConnection(t, server, "")
+
+		AssertSuccess(t, CallMethod(t, server, first, CreateUserRpcMethod, CreateUserParams{Name: "alice", Password: "first-password"}))
+		AssertErrorCode(t, CallMethod(t, server, second, CreateUserRpcMethod, CreateUserParams{Name: "alice", Password: "second-password"}), BadCredentialsErrorCode)
+	})
+}
+
+func TestGetHistoryHandler(t *testing.T) {
+	server := ServerFixture()
+	alice, _ := AddFakeConnection(t, server, "alice")
+	server.messageService.AddMessage(DefaultRoom, "alice", []byte("hello"), "")
+	server.roomService.CreateRoom("ops", "bob")
+
+	response := CallMethod(t, server, alice, GetHistoryRpcMethod, GetHistoryParams{Room: DefaultRoom})
+	AssertSuccess(t, response)
+	var result GetHistoryResult
+	json.Unmarshal(response.Result, &result)
+	if len(result.Messages) != 1 || string(result.Messages[0].Msg) != "hello" {
+		t.Errorf("got history %+v", result)
+	}
+
+	AssertErrorCode(t, CallMethod(t, server, alice, GetHistoryRpcMethod, GetHistoryParams{Room: "ops"}), NotRoomMemberErrorCode)
+}
+
+func TestSearchMessagesHandler(t *testing.T) {
+	server := ServerFixture()
+	alice, _ := AddFakeConnection(t, server, "alice")
+	server.roomService.CreateRoom("ops", "bob")
+	server.messageService.AddMessage(DefaultRoom, "alice", []byte("the deploy failed"), "")
+	server.messageService.AddMessage("ops", "bob", []byte("secret deploy keys"), "")
+
+	response := CallMethod(t, server, alice, SearchMessagesRpcMethod, SearchMessagesParams{Query: "deploy"})
+	AssertSuccess(t, response)
+	var result SearchMessagesResult
+	json.Unmarshal(response.Result, &result)
+	if result.Total != 1 || len(result.Hits) != 1 || result.Hits[0].Message.Room != DefaultRoom {
+		t.Errorf("got search result %+v", result)
+	}
+}
+
+func TestDirectMessageHandler(t *testing.T) {
+	t.Run("direct messages go only to the recipient", func(t *testing.T) {
+		server := ServerFixture()
+		alice, aliceConn := AddFakeConnection(t, server, "alice")
+		_, bobConn := AddFakeConnection(t, server, "bob")
+		_, carolConn := AddFakeConnection(t, server, "carol")
+
+		AssertSuccess(t, CallMethod(t, server, alice, DirectMessageRpcMethod, DirectMessageParams{To: "bob", Msg: []byte("psst")}))
+		AssertNumberOfConnections(t, CountNotifications(bobConn, DirectMessageNotificationRpcMethod), 1)
+		AssertNumberOfConnections(t, CountNotifications(aliceConn, DirectMessageNotificationRpcMethod), 0)
+		AssertNumberOfConnections(t, CountNotifications(carolConn, DirectMessageNotificationRpcMethod), 0)
+	})
+
+	t.Run("unknown recipients and anonymous senders are rejected", func(t *testing.T) {
+		server := ServerFixture()
+		alice, _ := AddFakeConnection(t, server, "alice")
+		anonymous, _ := AddFakeConnection(t, server, "")
+
+		AssertErrorCode(t, CallMethod(t, server, alice, DirectMessageRpcMethod, DirectMessageParams{To: "nobody", Msg: []byte("hi")}), UserNotFoundErrorCode)
+		AssertErrorCode(t, CallMethod(t, server, anonymous, DirectMessageRpcMethod, DirectMessageParams{To: "alice", Msg: []byte("hi")}), NotSignedInErrorCode)
+	})
+}
+
+func AssertErrorCode(t testing.TB, response JsonRpcResponse, code int) {
+	t.Helper()
+	if response.Error == nil {
+		t.Fatalf("got result %s but wanted error [%d]", response.Result, code)
+	}
+	if response.Error.Code != code {
+		t.Errorf("got error [%d] but wanted [%d]", response.Error.Code, code)
+	}
+}
+
+func AssertSuccess(t testing.TB, response JsonRpcResponse) {
+	t.Helper()
+	if response.Error != nil {
+		t.Fatalf("got error %s but wanted success", response.Error)
+	}
+}
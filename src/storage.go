@@ -0,0 +1,312 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Buckets the server keeps its state in
+const (
+	MetaBucket        = "meta"
+	UsersBucket       = "users"
+	RoomsBucket       = "rooms"
+	MembershipsBucket = "memberships"
+	MessagesBucket    = "messages"
+	ReceiptsBucket    = "receipts"
+	BansBucket        = "bans"
+	MutesBucket       = "mutes"
+	WebhooksBucket    = "webhooks"
+	// The moderation audit log
+	ModerationLogBucket = "moderationLog"
+	// Payloads webhooks gave up delivering
+	WebhookDeadLettersBucket = "webhookDeadLetters"
+)
+
+// Key of the schema version in the meta bucket
+const SchemaVersionKey = "schemaVersion"
+
+var ErrReadOnlyTx = errors.New("transaction is read-only")
+
+// Transactional key-value storage the persistent stores are built on - values are JSON documents kept
+// by key in named buckets
+type Storage interface {
+	// Run a read-only transaction
+	View(fn func(tx StorageTx) error) error
+	// Run a read-write transaction - it's committed when fn returns nil and rolled back otherwise
+	Update(fn func(tx StorageTx) error) error
+	Close() error
+}
+
+// A storage transaction - its writes are only seen by other transactions once it commits
+type StorageTx interface {
+	Get(bucket string, key string, value any) (bool, error)
+	Put(bucket string, key string, value any) error
+	Delete(bucket string, key string) error
+	// Call fn for each key of a bucket starting with the prefix, in key order
+	ForEach(bucket string, prefix string, fn func(key string, value json.RawMessage) error) error
+}
+
+// A write of a committed transaction - a nil value deletes the key
+type StorageOp struct {
+	Bucket string          `json:"bucket"`
+	Key    string          `json:"key"`
+	Value  json.RawMessage `json:"value,omitempty"`
+}
+
+// Keep storage in memory - writers are serialized and readers run concurrently
+type MemoryStorage struct {
+	buckets map[string]map[string]json.RawMessage
+	// Called with the writes of a transaction before they're applied, failing the transaction when it errors
+	commit func(ops []StorageOp) error
+	mu     sync.RWMutex
+}
+
+// Create a new in-memory storage
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{buckets: make(map[string]map[string]json.RawMessage)}
+}
+
+// Run a read-only transaction
+func (s *MemoryStorage) View(fn func(tx StorageTx) error) error {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return fn(&memoryTx{storage: s})
+}
+
+// Run a read-write transaction, applying its writes when fn returns nil
+func (s *MemoryStorage) Update(fn func(tx StorageTx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	tx := &memoryTx{storage: s, writes: make(map[string]map[string]json.RawMessage)}
+	if err := fn(tx); err != nil {
+		return err
+	}
+	if len(tx.ops) == 0 {
+		return nil
+	}
+	if s.commit != nil {
+		if err := s.commit(tx.ops); err != nil {
+			return err
+		}
+	}
+	s.apply(tx.ops)
+	return nil
+}
+
+// Apply the writes of a transaction
+func (s *MemoryStorage) apply(ops []StorageOp) {
+	for _, op := range ops {
+		bucket, ok := s.buckets[op.Bucket]
+		if !ok {
+			bucket = make(map[string]json.RawMessage)
+			s.buckets[op.Bucket] = bucket
+		}
+		if op.Value == nil {
+			delete(bucket, op.Key)
+		} else {
+			bucket[op.Key] = op.Value
+		}
+	}
+}
+
+// Nothing to release for memory
+func (s *MemoryStorage) Close() error {
+	return nil
+}
+
+// Transaction over a memory storage - writes are kept aside until it commits. Read-only
+// transactions have no writes map.
+type memoryTx struct {
+	storage *MemoryStorage
+	writes  map[string]map[string]json.RawMessage
+	ops     []StorageOp
+}
+
+// Look a key up, seeing the transaction's own writes
+func (tx *memoryTx) lookup(bucket string, key string) (json.RawMessage, bool) {
+	if value, ok := tx.writes[bucket][key]; ok {
+		return value, value != nil
+	}
+	value, ok := tx.storage.buckets[bucket][key]
+	return value, ok
+}
+
+// Get the value of a key, decoding it into value
+func (tx *memoryTx) Get(bucket string, key string, value any) (bool, error) {
+	raw, ok := tx.lookup(bucket, key)
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(raw, value)
+}
+
+// Set the value of a key
+func (tx *memoryTx) Put(bucket string, key string, value any) error {
+	raw, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return tx.write(bucket, key, raw)
+}
+
+// Remove a key
+func (tx *memoryTx) Delete(bucket string, key string) error {
+	return tx.write(bucket, key, nil)
+}
+
+// Record a write to apply on commit
+func (tx *memoryTx) write(bucket string, key string, value json.RawMessage) error {
+	if tx.writes == nil {
+		return ErrReadOnlyTx
+	}
+	if _, ok := tx.writes[bucket]; !ok {
+		tx.writes[bucket] = make(map[string]json.RawMessage)
+	}
+	tx.writes[bucket][key] = value
+	tx.ops = append(tx.ops, StorageOp{Bucket: bucket, Key: key, Value: value})
+	return nil
+}
+
+// Call fn for each key of a bucket starting with the prefix in key order, seeing the transaction's own writes
+func (tx *memoryTx) ForEach(bucket string, prefix string, fn func(key string, value json.RawMessage) error) error {
+	keys := make([]string, 0)
+	for key := range tx.storage.buckets[bucket] {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	for key := range tx.writes[bucket] {
+		if _, ok := tx.storage.buckets[bucket][key]; !ok && strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		if value, ok := tx.lookup(bucket, key); ok {
+			if err := fn(key, value); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Decode every value of a bucket, in key order
+func LoadBucket[T any](tx StorageTx, bucket string, fn func(value *T)) error {
+	return tx.ForEach(bucket, "", func(key string, raw json.RawMessage) error {
+		value := new(T)
+		if err := json.Unmarshal(raw, value); err != nil {
+			return fmt.Errorf("%s/%s: %w", bucket, key, err)
+		}
+		fn(value)
+		return nil
+	})
+}
+
+// Write to storage, logging and returning failures - stores only change their in-memory state once the
+// write committed, so memory never holds what storage lost
+func writeThrough(storage Storage, what string, fn func(tx StorageTx) error) error {
+	err := storage.Update(fn)
+	if err != nil {
+		slog.Error("Failed to write to storage", "what", what, "error", err)
+	}
+	return err
+}
+
+// A change to the layout of the stored data - migrations run in order, each in its own transaction
+type Migration struct {
+	Version     int
+	Description string
+	Apply       func(tx StorageTx) error
+}
+
+// Migrations of the stored data, oldest first - append new ones and never change released ones. The first
+// two only stamp the schema version, since buckets are created by their first write and nothing was stored
+// in an older shape to convert.
+var StorageMigrations = []Migration{
+	{Version: 1, Description: "Users, rooms, memberships, messages, read receipts and bans", Apply: func(tx StorageTx) error { return nil }},
+	{Version: 2, Description: "Webhooks and their dead letters", Apply: func(tx StorageTx) error { return nil }},
+}
+
+// Get the schema version of the stored data, 0 when nothing was ever stored
+func SchemaVersion(storage Storage) (int, error) {
+	version := 0
+	err := storage.View(func(tx StorageTx) error {
+		_, err := tx.Get(MetaBucket, SchemaVersionKey, &version)
+		return err
+	})
+	return version, err
+}
+
+// Run the migrations the stored data hasn't had yet - data written by a newer server is refused
+func Migrate(storage Storage, migrations []Migration) error {
+	current, err := SchemaVersion(storage)
+	if err != nil {
+		return err
+	}
+	if latest := migrations[len(migrations)-1].Version; current > latest {
+		return fmt.Errorf("stored data has schema version %d but this server only knows up to %d", current, latest)
+	}
+
+	for _, migration := range migrations {
+		if migration.Version <= current {
+			continue
+		}
+		err := storage.Update(func(tx StorageTx) error {
+			if err := migration.Apply(tx); err != nil {
+				return err
+			}
+			return tx.Put(MetaBucket, SchemaVersionKey, migration.Version)
+		})
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", migration.Version, migration.Description, err)
+		}
+		slog.Info("Migrated storage", "version", migration.Version, "description", migration.Description)
+	}
+	return nil
+}
+
+// Stores of the server's state
+type ServerStores struct {
+	Users      UserStore
+	Rooms      RoomStore
+	Messages   MessageStore
+	Moderation ModerationStore
+	Webhooks   WebhookStore
+}
+
+// Create stores that keep the server's state in memory only
+func NewMemoryStores() ServerStores {
+	return ServerStores{Users: NewUserStore(), Rooms: NewRoomStore(), Messages: NewMessageStore(), Moderation: NewModerationStore(), Webhooks: NewWebhookStore()}
+}
+
+// Bring storage up to date and create stores over it, loading what it holds
+func NewPersistentStores(storage Storage) (ServerStores, error) {
+	if err := Migrate(storage, StorageMigrations); err != nil {
+		return ServerStores{}, err
+	}
+
+	var stores ServerStores
+	var err error
+	if stores.Users, err = NewPersistentUserStore(storage); err != nil {
+		return stores, err
+	}
+	if stores.Rooms, err = NewPersistentRoomStore(storage); err != nil {
+		return stores, err
+	}
+	if stores.Messages, err = NewPersistentMessageStore(storage); err != nil {
+		return stores, err
+	}
+	if stores.Moderation, err = NewPersistentModerationStore(storage); err != nil {
+		return stores, err
+	}
+	stores.Webhooks, err = NewPersistentWebhookStore(storage)
+	return stores, err
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Stores over storage that already holds some state
+func PersistentStoresFixture(t testing.TB, storage Storage) ServerStores {
+	t.Helper()
+	stores, err := NewPersistentStores(storage)
+	AssertErrorNotNil(t, err)
+	return stores
+}
+
+// Keys of a storage bucket starting with the prefix
+func BucketKeys(t testing.TB, storage Storage, bucket string, prefix string) []string {
+	t.Helper()
+	keys := make([]string, 0)
+	storage.View(func(tx StorageTx) error {
+		return tx.ForEach(bucket, prefix, func(key string, value json.RawMessage) error {
+			keys = append(keys, key)
+			return nil
+		})
+	})
+	return keys
+}
+
+func TestStorageTransactions(t *testing.T) {
+	t.Run("writes are seen inside the transaction and after it commits", func(t *testing.T) {
+		storage := NewMemoryStorage()
+
+		err := storage.Update(func(tx StorageTx) error {
+			tx.Put(UsersBucket, "bob", User{Name: "bob"})
+			tx.Put(UsersBucket, "alice", User{Name: "alice"})
+			var user User
+			if ok, _ := tx.Get(UsersBucket, "bob", &user); !ok || user.Name != "bob" {
+				t.Errorf("got user %+v inside the transaction", user)
+			}
+			return nil
+		})
+		AssertErrorNotNil(t, err)
+
+		if keys := BucketKeys(t, storage, UsersBucket, ""); len(keys) != 2 || keys[0] != "alice" {
+			t.Errorf("got keys %v", keys)
+		}
+	})
+
+	t.Run("failed transactions are rolled back", func(t *testing.T) {
+		storage := NewMemoryStorage()
+		failed := errors.New("failed")
+
+		err := storage.Update(func(tx StorageTx) error {
+			tx.Put(UsersBucket, "bob", User{Name: "bob"})
+			return failed
+		})
+		if !errors.Is(err, failed) || len(BucketKeys(t, storage, UsersBucket, "")) != 0 {
+			t.Errorf("got error %v and keys %v", err, BucketKeys(t, storage, UsersBucket, ""))
+		}
+	})
+
+	t.Run("views can't write", func(t *testing.T) {
+		err := NewMemoryStorage().View(func(tx StorageTx) error {
+			return tx.Put(UsersBucket, "bob", User{Name: "bob"})
+		})
+		AssertServiceError(t, err, ErrReadOnlyTx)
+	})
+}
+
+func TestMigrate(t *testing.T) {
+	storage := NewMemoryStorage()
+	migrations := []Migration{
+		{Version: 1, Description: "first", Apply: func(tx StorageTx) error { return nil }},
+		{Version: 2, Description: "rename", Apply: func(tx StorageTx) error { return tx.Put(UsersBucket, "migrated", User{Name: "migrated"}) }},
+	}
+
+	AssertErrorNotNil(t, Migrate(storage, migrations[:1]))
+	AssertErrorNotNil(t, Migrate(storage, migrations))
+	if version, _ := SchemaVersion(storage); version != 2 || len(BucketKeys(t, storage, UsersBucket, "")) != 1 {
+		t.Errorf("got schema version %d", version)
+	}
+
+	if err := Migrate(storage, migrations[:1]); err == nil {
+		t.Error("got data from a newer server accepted")
+	}
+}
+
+func TestPersistentStores(t *testing.T) {
+	storage := NewMemoryStorage()
+	stores := PersistentStoresFixture(t, storage)
+	rooms := NewRoomService(stores.Rooms)
+	rooms.CreateRoom("ops", "alice")
+	rooms.JoinRoom("ops", "bob")
+	rooms.SetRole("ops", "bob", RoleModerator)
+	rooms.SetTopic("ops", "deploys")
+	rooms.CreateRoom("gone", "alice")
+	rooms.DeleteRoom("gone", "alice")
+	NewUserService(stores.Users).SignIn("c1", "alice", PasswordFor("alice"))
+	messages := &MessageService{store: stores.Messages, index: NewSearchIndex()}
+	first, _ := messages.AddMessage("ops", "alice", []byte("one"), "")
+	messages.AddMessage("ops", "bob", []byte("two"), first.Id)
+	messages.MarkRead("ops", "bob", first.Id)
+	moderation := &ModerationService{store: stores.Moderation}
+	moderation.Ban("ops", "mallory", "", time.Hour)
+	moderation.Ban("ops", "eve", "", 0)
+	moderation.Unban("ops", "eve", "")
+	moderation.Mute("ops", "bob", time.Hour)
+	moderation.Mute("ops", "eve", time.Hour)
+	moderation.Unmute("ops", "eve")
+	moderation.Record(ModerationAction{Time: time.Now().UTC(), Room: "ops", Actor: "alice", Action: ModerationActionBan, Target: "mallory"})
+	moderation.Record(ModerationAction{Time: time.Now().UTC(), Room: "ops", Actor: "alice", Action: ModerationActionMute, Target: "bob"})
+
+	reloaded := PersistentStoresFixture(t, storage)
+	rooms = NewRoomService(reloaded.Rooms)
+	if rooms.Role("ops", "bob") != RoleModerator || rooms.Topic("ops") != "deploys" || rooms.RoomExists("gone") {
+		t.Errorf("got rooms %+v", rooms.DumpRooms())
+	}
+	if keys := BucketKeys(t, storage, MembershipsBucket, "gone/"); len(keys) != 0 {
+		t.Errorf("got memberships %v of a deleted room", keys)
+	}
+	if _, ok := reloaded.Users.Get("alice"); !ok {
+		t.Error("got alice forgotten")
+	}
+	messages = &MessageService{store: reloaded.Messages, index: NewSearchIndex()}
+	messages.RebuildIndex()
+	AssertNumberOfReplies(t, messages.GetThreadSummary(first.Id).ReplyCount, 1)
+	if receipt, ok := reloaded.Messages.GetReadReceipt("ops", "bob"); !ok || receipt.MessageId != first.Id {
+		t.Errorf("got read receipt %+v", receipt)
+	}
+	if results, _ := messages.SearchMessages(SearchMessagesParams{Query: "two"}, EveryRoom); results.Total != 1 {
+		t.Errorf("got search results %+v", results)
+	}
+	if bans := reloaded.Moderation.Bans("ops"); len(bans) != 1 || bans[0].User != "mallory" || bans[0].ExpiresAt == nil {
+		t.Errorf("got bans %+v", bans)
+	}
+	reloadedModeration := &ModerationService{store: reloaded.Moderation}
+	if _, muted := reloadedModeration.IsMuted("ops", "bob"); !muted {
+		t.Error("got bob unmuted")
+	}
+	if _, muted := reloadedModeration.IsMuted("ops", "eve"); muted {
+		t.Error("got eve muted again")
+	}
+	if log := reloadedModeration.AuditLog("ops"); len(log) != 2 || log[0].Target != "mallory" || log[1].Action != ModerationActionMute {
+		t.Errorf("got audit log %+v", log)
+	}
+
+	rooms.LeaveRoom("ops", "bob")
+	if keys := BucketKeys(t, storage, MembershipsBucket, "ops/"); len(keys) != 1 || keys[0] != "ops/alice" {
+		t.Errorf("got memberships %v after bob left", keys)
+	}
+}
+
+func TestPersistentStoreWrites(t *testing.T) {
+	storage := NewMemoryStorage()
+	rooms := NewRoomService(PersistentStoresFixture(t, storage).Rooms)
+	rooms.CreateRoom("ops", "alice")
+	var written []StorageOp
+	storage.commit = func(ops []StorageOp) error {
+		written = append(written, ops...)
+		return nil
+	}
+
+	t.Run("a change writes only the keys it touches", func(t *testing.T) {
+		written = nil
+		rooms.JoinRoom("ops", "bob")
+		rooms.SetRole("ops", "bob", RoleModerator)
+		if len(written) != 2 || written[0].Key != "ops/bob" || written[1].Key != "ops/bob" {
+			t.Errorf("got writes %+v", written)
+		}
+	})
+
+	t.Run("anonymous members aren't stored", func(t *testing.T) {
+		written = nil
+		anonymous := uuid.New().String()
+		rooms.JoinRoom("ops", anonymous)
+		if len(written) != 0 || !rooms.IsMember("ops", anonymous) {
+			t.Errorf("got writes %+v", written)
+		}
+	})
+
+	t.Run("a change that can't be stored leaves memory as it was", func(t *testing.T) {
+		failed := errors.New("disk full")
+		storage.commit = func(ops []StorageOp) error { return failed }
+		stores := PersistentStoresFixture(t, storage)
+		rooms := NewRoomService(stores.Rooms)
+		messages := &MessageService{store: stores.Messages, index: NewSearchIndex()}
+		moderation := &ModerationService{store: stores.Moderation}
+
+		if err := rooms.JoinRoom("ops", "carol"); !errors.Is(err, failed) || rooms.IsMember("ops", "carol") {
+			t.Errorf("got error %v joining", err)
+		}
+		if err := rooms.SetTopic("ops", "deploys"); !errors.Is(err, failed) || rooms.Topic("ops") != "" {
+			t.Errorf("got error %v setting the topic", err)
+		}
+		if _, err := messages.AddMessage("ops", "alice", []byte("one"), ""); !errors.Is(err, failed) || stores.Messages.Count() != 0 {
+			t.Errorf("got error %v adding a message", err)
+		}
+		if _, err := moderation.Ban("ops", "mallory", "", 0); !errors.Is(err, failed) || len(stores.Moderation.Bans("ops")) != 0 {
+			t.Errorf("got error %v banning", err)
+		}
+		if _, err := NewUserService(stores.Users).SignIn("c1", "dave", PasswordFor("dave")); !errors.Is(err, failed) {
+			t.Errorf("got error %v signing in", err)
+		}
+		if _, ok := stores.Users.Get("dave"); ok {
+			t.Error("got dave registered")
+		}
+	})
+}
+
+func TestPruneMembers(t *testing.T) {
+	service := RoomServiceFixture()
+	service.JoinRoom("ops", "3f1c-connection")
+	service.JoinRoom(DefaultRoom, "3f1c-connection")
+
+	service.PruneMembers(func(member string) bool { return member == "alice" })
+	if members := service.Members("ops"); len(members) != 1 || len(service.Members(DefaultRoom)) != 0 {
+		t.Errorf("got members %v", members)
+	}
+}
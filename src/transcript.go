@@ -0,0 +1,191 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Formats of transcripts, named after their file extensions
+const (
+	TranscriptText       = "txt"
+	TranscriptJSONLines  = "jsonl"
+	TranscriptMarkdown   = "md"
+	TranscriptTimeLayout = "2006-01-02 15:04:05"
+	TranscriptDayLayout  = "2006-01-02"
+	AnonymousAuthor      = "me"
+)
+
+var TranscriptFormats = []string{TranscriptText, TranscriptJSONLines, TranscriptMarkdown}
+
+// Check whether a transcript format is known
+func ValidTranscriptFormat(format string) bool {
+	return slices.Contains(TranscriptFormats, format)
+}
+
+// Format of a transcript file going by its extension - plain text unless it's a known one
+func TranscriptFormatOf(path string) string {
+	if format := strings.TrimPrefix(filepath.Ext(path), "."); ValidTranscriptFormat(format) {
+		return format
+	}
+	return TranscriptText
+}
+
+// Heading a transcript starts with - only Markdown has one
+func TranscriptHeader(format string, title string) string {
+	if format == TranscriptMarkdown {
+		return fmt.Sprintf("# %s\n\n", title)
+	}
+	return ""
+}
+
+// Format a chat message as one line of a transcript, ending in a newline
+func TranscriptLine(format string, message *Message) string {
+	when := message.Timestamp.Local().Format(TranscriptTimeLayout)
+	switch format {
+	case TranscriptJSONLines:
+		line, _ := json.Marshal(ScriptMessage{Id: message.Id, Room: message.Room, Author: message.Author, ParentId: message.ParentId, Msg: string(message.Msg), Timestamp: message.Timestamp})
+		return string(line) + "\n"
+	case TranscriptMarkdown:
+		text := string(message.Msg)
+		if action, ok := strings.CutPrefix(text, ActionPrefix); ok {
+			return fmt.Sprintf("- `%s` #%s *%s %s*\n", when, message.Room, message.Author, action)
+		}
+		return fmt.Sprintf("- `%s` #%s **%s**: %s\n", when, message.Room, message.Author, text)
+	}
+	return fmt.Sprintf("%s [%s] %s\n", when, message.Room, FormatChatMessage(message.Author, string(message.Msg)))
+}
+
+// Appends chat messages to a transcript file in a directory, starting a new file each day
+type TranscriptLogger struct {
+	dir    string
+	format string
+	day    string
+	file   *os.File
+	mu     sync.Mutex
+}
+
+// Create a logger writing transcripts in the format to the directory, creating it if needed
+func NewTranscriptLogger(dir string, format string) (*TranscriptLogger, error) {
+	if !ValidTranscriptFormat(format) {
+		return nil, fmt.Errorf("unknown transcript format [%s], use one of %v", format, TranscriptFormats)
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &TranscriptLogger{dir: dir, format: format}, nil
+}
+
+// Path of the transcript for a day
+func (l *TranscriptLogger) Path(day string) string {
+	return filepath.Join(l.dir, fmt.Sprintf("chat-%s.%s", day, l.format))
+}
+
+// Append a message to the transcript of the day it was sent on
+func (l *TranscriptLogger) Log(message *Message) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if day := message.Timestamp.Local().Format(TranscriptDayLayout); day != l.day {
+		if err := l.open(day); err != nil {
+			return err
+		}
+	}
+	_, err := l.file.WriteString(TranscriptLine(l.format, message))
+	return err
+}
+
+// Switch to the transcript of a day, starting it with its heading when it's new
+func (l *TranscriptLogger) open(day string) error {
+	if l.file != nil {
+		l.file.Close()
+		l.file = nil
+	}
+	file, err := os.OpenFile(l.Path(day), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if info, err := file.Stat(); err == nil && info.Size() == 0 {
+		file.WriteString(TranscriptHeader(l.format, "Chat transcript "+day))
+	}
+	l.file, l.day = file, day
+	return nil
+}
+
+// Close the current transcript file
+func (l *TranscriptLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file, l.day = nil, ""
+	return err
+}
+
+// Write the whole server-side history of a room as a transcript, oldest message first, returning
+// how many messages were written
+func ExportHistory(c *JsonRpcClient, room string, format string, w io.Writer) (int, error) {
+	var pages [][]*Message
+	for before := ""; ; {
+		response := c.SendGetHistoryRequest(room, before, 0)
+		if response.Error != nil {
+			return 0, fmt.Errorf("%s", response.Error.Message)
+		}
+		var result GetHistoryResult
+		if err := json.Unmarshal(response.Result, &result); err != nil {
+			return 0, err
+		}
+		pages = append(pages, result.Messages)
+		if result.NextCursor == "" {
+			break
+		}
+		before = result.NextCursor
+	}
+
+	count := 0
+	if _, err := io.WriteString(w, TranscriptHeader(format, "Chat history of #"+room)); err != nil {
+		return 0, err
+	}
+	for i := len(pages) - 1; i >= 0; i-- {
+		for _, message := range pages[i] {
+			if _, err := io.WriteString(w, TranscriptLine(format, message)); err != nil {
+				return count, err
+			}
+			count++
+		}
+	}
+	return count, nil
+}
+
+// Export the history of a room to a file, picking the format from its extension
+func ExportHistoryFile(c *JsonRpcClient, room string, path string) (int, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o600)
+	if err != nil {
+		return 0, err
+	}
+	count, err := ExportHistory(c, room, TranscriptFormatOf(path), file)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return count, err
+}
+
+// Log every chat message the client sends and receives - messages sent before signing in are logged as from "me"
+func (l *TranscriptLogger) Follow(c *JsonRpcClient) {
+	c.SetChatObserver(func(message *Message) {
+		if message.Author == "" {
+			message.Author = AnonymousAuthor
+		}
+		if err := l.Log(message); err != nil {
+			log.Println("Failed to write the transcript", err)
+		}
+	})
+}
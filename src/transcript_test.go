@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTranscriptLine(t *testing.T) {
+	when := time.Date(2026, 3, 1, 9, 30, 0, 0, time.Local)
+	message := &Message{Id: "1", Room: "dev", Author: "alice", Msg: []byte("hello"), Timestamp: when}
+	action := &Message{Id: "2", Room: "dev", Author: "alice", Msg: []byte(ActionPrefix + "waves"), Timestamp: when}
+
+	lines := map[string][2]string{
+		TranscriptText:      {"2026-03-01 09:30:00 [dev] alice: hello\n", "2026-03-01 09:30:00 [dev] * alice waves\n"},
+		TranscriptMarkdown:  {"- `2026-03-01 09:30:00` #dev **alice**: hello\n", "- `2026-03-01 09:30:00` #dev *alice waves*\n"},
+		TranscriptJSONLines: {`"msg":"hello"`, `"msg":"/me waves"`},
+	}
+	for format, want := range lines {
+		got := [2]string{TranscriptLine(format, message), TranscriptLine(format, action)}
+		if format == TranscriptJSONLines {
+			if !strings.Contains(got[0], want[0]) || !strings.Contains(got[1], want[1]) {
+				t.Errorf("got lines %q", got)
+			}
+		} else if got != want {
+			t.Errorf("got %s lines %q but want %q", format, got, want)
+		}
+	}
+
+	if format := TranscriptFormatOf("notes/general.md"); format != TranscriptMarkdown {
+		t.Errorf("got format %s for a Markdown file", format)
+	}
+	if format := TranscriptFormatOf("general.log"); format != TranscriptText {
+		t.Errorf("got format %s for an unknown extension", format)
+	}
+}
+
+func TestTranscriptLogger(t *testing.T) {
+	t.Run("a new file is started each day", func(t *testing.T) {
+		logger, err := NewTranscriptLogger(t.TempDir(), TranscriptMarkdown)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer logger.Close()
+
+		first := time.Date(2026, 3, 1, 23, 59, 0, 0, time.Local)
+		logger.Log(&Message{Room: "dev", Author: "alice", Msg: []byte("late"), Timestamp: first})
+		logger.Log(&Message{Room: "dev", Author: "bob", Msg: []byte("later"), Timestamp: first.Add(time.Minute)})
+		logger.Log(&Message{Room: "dev", Author: "alice", Msg: []byte("still late"), Timestamp: first.Add(time.Second)})
+
+		day1, _ := os.ReadFile(logger.Path("2026-03-01"))
+		day2, _ := os.ReadFile(logger.Path("2026-03-02"))
+		if !strings.HasPrefix(string(day1), "# Chat transcript 2026-03-01\n\n") || strings.Count(string(day1), "# ") != 1 || strings.Count(string(day1), "\n- ") != 2 {
+			t.Errorf("got first day [%s]", day1)
+		}
+		if !strings.Contains(string(day2), "**bob**: later") {
+			t.Errorf("got second day [%s]", day2)
+		}
+	})
+
+	t.Run("unknown formats are refused", func(t *testing.T) {
+		if _, err := NewTranscriptLogger(t.TempDir(), "pdf"); err == nil {
+			t.Error("got a logger for an unknown format")
+		}
+	})
+
+	t.Run("sent and received messages are logged", func(t *testing.T) {
+		dir := t.TempDir()
+		logger, _ := NewTranscriptLogger(dir, TranscriptText)
+		defer logger.Close()
+		client := FakeServerClient(t, func(request JsonRpcRequest) any {
+			return ChatResult{Success: true, MessageId: "m1"}
+		})
+		logger.Follow(client)
+
+		client.SendChatRequest([]byte("hi all"))
+		files, _ := filepath.Glob(filepath.Join(dir, "chat-*.txt"))
+		if len(files) != 1 {
+			t.Fatalf("got transcripts %v", files)
+		}
+		content, _ := os.ReadFile(files[0])
+		if !strings.HasSuffix(string(content), "["+DefaultRoom+"] "+AnonymousAuthor+": hi all\n") {
+			t.Errorf("got transcript [%s]", content)
+		}
+	})
+}
+
+func TestExportHistory(t *testing.T) {
+	messages := []*Message{
+		{Id: "1", Room: "dev", Author: "alice", Msg: []byte("one")},
+		{Id: "2", Room: "dev", Author: "bob", Msg: []byte("two")},
+		{Id: "3", Room: "dev", Author: "alice", Msg: []byte("three")},
+	}
+	client := FakeServerClient(t, func(request JsonRpcRequest) any {
+		if strings.Contains(string(request.Params), `"before":"3"`) {
+			return GetHistoryResult{Room: "dev", Messages: messages[:2]}
+		}
+		return GetHistoryResult{Room: "dev", Messages: messages[2:], NextCursor: "3"}
+	})
+
+	var out bytes.Buffer
+	count, err := ExportHistory(client, "dev", TranscriptMarkdown, &out)
+	if err != nil || count != 3 {
+		t.Fatalf("got %d messages and error %v", count, err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if lines[0] != "# Chat history of #dev" || !strings.HasSuffix(lines[2], "**alice**: one") || !strings.HasSuffix(lines[4], "**alice**: three") {
+		t.Errorf("got export %q", lines)
+	}
+}
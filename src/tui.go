@@ -0,0 +1,874 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+	"unicode"
+)
+
+const (
+	SidebarWidth      = 22
+	RequestQueueSize  = 64
+	InputHistorySize  = 100
+	TimestampFormat   = "15:04"
+	UnreadMarker      = "── new messages ──"
+	ansiReset         = "\033[0m"
+	ansiBold          = "\033[1m"
+	ansiDim           = "\033[2m"
+	ansiReverse       = "\033[7m"
+	ansiRed           = "\033[31m"
+	ansiClearLine     = "\033[2K"
+	ansiHideCursor    = "\033[?25l"
+	ansiShowCursor    = "\033[?25h"
+	ansiAltScreen     = "\033[?1049h"
+	ansiMainScreen    = "\033[?1049l"
+	defaultTermWidth  = 80
+	defaultTermHeight = 24
+)
+
+// Colors senders are told apart by
+var senderColors = []string{"\033[31m", "\033[32m", "\033[33m", "\033[34m", "\033[35m", "\033[36m", "\033[91m", "\033[92m", "\033[94m", "\033[95m"}
+
+// Pick the color of a sender - the same sender always gets the same color
+func SenderColor(name string) string {
+	hash := fnv.New32a()
+	hash.Write([]byte(name))
+	return senderColors[hash.Sum32()%uint32(len(senderColors))]
+}
+
+// A line of a room's message pane - system lines have no author
+type paneLine struct {
+	time   time.Time
+	author string
+	text   string
+	action bool
+}
+
+// Messages of a room - marker is where the unread messages started when the room was shown, or -1
+type roomPane struct {
+	lines  []paneLine
+	seen   int
+	marker int
+}
+
+// Full-screen terminal UI - a sidebar with the rooms, their unread counts and the current room's members,
+// a scrolling message pane, a status line and an input line with editing and history
+type TerminalUI struct {
+	client       *JsonRpcClient
+	commands     *CommandRegistry
+	in           *bufio.Reader
+	out          io.Writer
+	width        int
+	height       int
+	rooms        []string
+	allRooms     []string
+	topics       map[string]string
+	unread       map[string]int
+	members      []string
+	panes        map[string]*roomPane
+	input        []rune
+	cursor       int
+	history      []string
+	historyIndex int
+	draft        string
+	scroll       int
+	status       string
+	requests     chan func()
+	done         chan struct{}
+	closeOnce    sync.Once
+	mu           sync.Mutex
+}
+
+// Create a terminal UI for the client running the commands typed in it - it takes over the client's notifications
+func NewTerminalUI(client *JsonRpcClient, commands *CommandRegistry, in io.Reader, out io.Writer) *TerminalUI {
+	ui := &TerminalUI{
+		client:   client,
+		commands: commands,
+		topics:   make(map[string]string),
+		in:       bufio.NewReader(in),
+		out:      out,
+		width:    defaultTermWidth,
+		height:   defaultTermHeight,
+		rooms:    []string{client.CurrentRoom()},
+		unread:   make(map[string]int),
+		panes:    make(map[string]*roomPane),
+		requests: make(chan func(), RequestQueueSize),
+		done:     make(chan struct{}),
+	}
+	client.onNotification = ui.handleNotification
+	return ui
+}
+
+// Run stty on the terminal
+func stty(tty *os.File, args ...string) (string, error) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = tty
+	out, err := cmd.Output()
+	return strings.TrimSpace(string(out)), err
+}
+
+// Put the terminal in raw mode, returning a func that restores its previous mode
+func makeRaw(tty *os.File) (func(), error) {
+	state, err := stty(tty, "-g")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := stty(tty, "raw", "-echo"); err != nil {
+		return nil, err
+	}
+	return func() { stty(tty, state) }, nil
+}
+
+// Get the width and height of the terminal
+func terminalSize(tty *os.File) (int, int, error) {
+	size, err := stty(tty, "size")
+	if err != nil {
+		return 0, 0, err
+	}
+	var rows, columns int
+	if _, err := fmt.Sscan(size, &rows, &columns); err != nil {
+		return 0, 0, err
+	}
+	return columns, rows, nil
+}
+
+// Take over the terminal until the user quits
+func (ui *TerminalUI) Run() error {
+	restore, err := makeRaw(os.Stdin)
+	if err != nil {
+		return err
+	}
+	defer restore()
+	fmt.Fprint(ui.out, ansiAltScreen)
+	defer fmt.Fprint(ui.out, ansiShowCursor+ansiMainScreen)
+
+	resized := make(chan os.Signal, 1)
+	signal.Notify(resized, syscall.SIGWINCH)
+	defer signal.Stop(resized)
+	go func() {
+		for range resized {
+			ui.resize()
+		}
+	}()
+
+	ui.resize()
+	go ui.SendRequests()
+	ui.queue(ui.refreshRooms)
+	ui.queue(ui.refreshMembers)
+	go ui.ReadInput()
+	<-ui.done
+	return nil
+}
+
+// Queue a request to the server - the server reads one request at a time off a connection,
+// so the UI sends them one after another instead of all at once
+func (ui *TerminalUI) queue(request func()) {
+	select {
+	case ui.requests <- request:
+	default:
+		log.Println("Dropping request, too many waiting to be sent")
+	}
+}
+
+// Send the queued requests until the UI stops
+func (ui *TerminalUI) SendRequests() {
+	for {
+		select {
+		case request := <-ui.requests:
+			request()
+		case <-ui.done:
+			return
+		}
+	}
+}
+
+// Read the terminal size again and redraw
+func (ui *TerminalUI) resize() {
+	width, height, err := terminalSize(os.Stdin)
+	ui.mu.Lock()
+	if err == nil && width > 0 && height > 0 {
+		ui.width, ui.height = width, height
+	}
+	ui.mu.Unlock()
+	ui.Render()
+}
+
+// Stop the UI
+func (ui *TerminalUI) Quit() {
+	ui.closeOnce.Do(func() { close(ui.done) })
+}
+
+// Get the pane of a room, creating it when the room has none
+func (ui *TerminalUI) pane(room string) *roomPane {
+	pane, ok := ui.panes[room]
+	if !ok {
+		pane = &roomPane{marker: -1}
+		ui.panes[room] = pane
+	}
+	return pane
+}
+
+// Add a line to a room's pane - lines in other rooms count as unread
+func (ui *TerminalUI) addLine(room string, line paneLine) {
+	pane := ui.pane(room)
+	pane.lines = append(pane.lines, line)
+	if room == ui.client.CurrentRoom() {
+		pane.seen = len(pane.lines)
+		if ui.scroll > 0 {
+			ui.scroll++
+		}
+		return
+	}
+	if line.author != "" {
+		ui.unread[room]++
+	}
+}
+
+// Add a system line to the current room's pane
+func (ui *TerminalUI) addSystemLine(format string, args ...any) {
+	ui.addLine(ui.client.CurrentRoom(), paneLine{time: time.Now(), text: fmt.Sprintf(format, args...)})
+}
+
+// Set the status line
+func (ui *TerminalUI) setStatus(format string, args ...any) {
+	ui.mu.Lock()
+	ui.status = fmt.Sprintf(format, args...)
+	ui.mu.Unlock()
+	ui.Render()
+}
+
+// Show a room, moving its unread messages under the new messages marker and marking it as read
+func (ui *TerminalUI) SwitchRoom(room string) {
+	ui.mu.Lock()
+	ui.client.SetCurrentRoom(room)
+	pane := ui.pane(room)
+	pane.marker = -1
+	if pane.seen < len(pane.lines) {
+		pane.marker = pane.seen
+	}
+	pane.seen = len(pane.lines)
+	unread := ui.unread[room]
+	delete(ui.unread, room)
+	ui.scroll = 0
+	if !slices.Contains(ui.rooms, room) {
+		ui.rooms = append(ui.rooms, room)
+		slices.Sort(ui.rooms)
+	}
+	ui.mu.Unlock()
+	ui.Render()
+
+	ui.queue(ui.refreshMembers)
+	if unread > 0 {
+		ui.queue(func() { ui.client.SendMarkReadRequest() })
+	}
+}
+
+// Switch to the joined room before or after the current one
+func (ui *TerminalUI) cycleRoom(step int) {
+	ui.mu.Lock()
+	rooms := slices.Clone(ui.rooms)
+	ui.mu.Unlock()
+	if len(rooms) == 0 {
+		return
+	}
+
+	index := slices.Index(rooms, ui.client.CurrentRoom())
+	ui.SwitchRoom(rooms[(index+step+len(rooms))%len(rooms)])
+}
+
+// Fetch the joined rooms and their unread counts
+func (ui *TerminalUI) refreshRooms() {
+	response := ui.client.SendListRoomsRequest()
+	var result ListRoomsResult
+	if response.Error != nil || json.Unmarshal(response.Result, &result) != nil {
+		return
+	}
+
+	ui.mu.Lock()
+	ui.rooms = make([]string, 0)
+	ui.allRooms = make([]string, 0)
+	for _, room := range result.Rooms {
+		ui.allRooms = append(ui.allRooms, room.Name)
+		ui.topics[room.Name] = room.Topic
+		if !room.Joined {
+			continue
+		}
+		ui.rooms = append(ui.rooms, room.Name)
+		if room.Name != ui.client.CurrentRoom() && room.Unread > 0 {
+			ui.unread[room.Name] = room.Unread
+		}
+	}
+	ui.mu.Unlock()
+	ui.Render()
+}
+
+// Fetch the members of the current room
+func (ui *TerminalUI) refreshMembers() {
+	response := ui.client.SendListMembersRequest(ui.client.CurrentRoom())
+	var result ListMembersResult
+	if response.Error != nil || json.Unmarshal(response.Result, &result) != nil {
+		return
+	}
+
+	ui.mu.Lock()
+	if result.Room == ui.client.CurrentRoom() {
+		ui.members = result.Members
+	}
+	ui.mu.Unlock()
+	ui.Render()
+}
+
+// Show a notification from the server
+func (ui *TerminalUI) handleNotification(notification JsonRpcNotification) {
+	ui.mu.Lock()
+	refreshMembers := false
+	switch notification.Method {
+	case ChatNotificationRpcMethod:
+		var chat ChatMessageNotification
+		if json.Unmarshal(notification.Params, &chat) != nil {
+			break
+		}
+		ui.client.rememberMessageId(chat.Id)
+		ui.client.rememberLastSeen(chat.Room, chat.Id)
+		if chat.Timestamp.IsZero() {
+			chat.Timestamp = time.Now()
+		}
+		ui.addLine(chat.Room, ui.messageLine(chat.Id, chat.ParentId, chat.Author, string(chat.Msg), chat.Timestamp))
+		refreshMembers = chat.Room == ui.client.CurrentRoom() && !slices.Contains(ui.members, chat.Author)
+	case MentionedRpcMethod:
+		var mention Mention
+		if json.Unmarshal(notification.Params, &mention) == nil {
+			ui.client.rememberMessageId(mention.MessageId)
+			fmt.Fprint(ui.out, TerminalBell)
+			ui.status = fmt.Sprintf("%s mentioned you in #%s [%s]", mention.Author, mention.Room, ShortId(mention.MessageId))
+		}
+	case ThreadUpdatedRpcMethod:
+		var thread Thread
+		if json.Unmarshal(notification.Params, &thread) == nil {
+			ui.status = fmt.Sprintf("[%s] has %d replies", ShortId(thread.RootId), thread.ReplyCount)
+		}
+	case ModeratedRpcMethod:
+		var action ModerationAction
+		if json.Unmarshal(notification.Params, &action) == nil {
+			ui.addLine(action.Room, paneLine{time: action.Time, text: fmt.Sprintf("%s: %s %s %s", action.Actor, action.Action, action.Role, action.Reason)})
+			ui.queue(ui.refreshRooms)
+		}
+	case DirectMessageNotificationRpcMethod:
+		var message DirectMessage
+		if json.Unmarshal(notification.Params, &message) == nil {
+			fmt.Fprint(ui.out, TerminalBell)
+			ui.addSystemLine("[private] %s", FormatChatMessage(message.From, string(message.Msg)))
+		}
+	case TopicChangedRpcMethod:
+		var change TopicChange
+		if json.Unmarshal(notification.Params, &change) == nil {
+			ui.topics[change.Room] = change.Topic
+			ui.addLine(change.Room, paneLine{time: change.Time, text: fmt.Sprintf("%s set the topic: %s", change.By, change.Topic)})
+		}
+	case AnnouncementRpcMethod:
+		var announcement Announcement
+		if json.Unmarshal(notification.Params, &announcement) == nil {
+			fmt.Fprint(ui.out, TerminalBell)
+			ui.addSystemLine("announcement from %s: %s", announcement.From, announcement.Msg)
+		}
+	case ReadReceiptRpcMethod:
+	default:
+		ui.status = "Notification " + notification.Method
+	}
+	if refreshMembers {
+		ui.queue(ui.refreshMembers)
+	}
+	ui.mu.Unlock()
+	ui.Render()
+}
+
+// Read keys from the terminal until the user quits
+func (ui *TerminalUI) ReadInput() {
+	defer ui.Quit()
+	for {
+		r, _, err := ui.in.ReadRune()
+		if err != nil {
+			return
+		}
+		if !ui.HandleKey(r) {
+			return
+		}
+		ui.Render()
+	}
+}
+
+// Read the rest of an escape sequence after the escape key, e.g. "[A" for the up arrow
+func (ui *TerminalUI) readEscape() string {
+	r, _, err := ui.in.ReadRune()
+	if err != nil || (r != '[' && r != 'O') {
+		return ""
+	}
+	sequence := []rune{r}
+	for {
+		r, _, err := ui.in.ReadRune()
+		if err != nil {
+			return string(sequence)
+		}
+		sequence = append(sequence, r)
+		if r >= 0x40 && r <= 0x7e {
+			return string(sequence)
+		}
+	}
+}
+
+// Handle a key, returning false when the user quits
+func (ui *TerminalUI) HandleKey(r rune) bool {
+	if r == '\x1b' {
+		ui.handleEscape(ui.readEscape())
+		return true
+	}
+
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+	switch r {
+	case '\r', '\n':
+		line := strings.TrimSpace(string(ui.input))
+		ui.input, ui.cursor, ui.historyIndex, ui.draft = nil, 0, 0, ""
+		if line == "" {
+			return true
+		}
+		ui.remember(line)
+		if line == "exit" {
+			return false
+		}
+		ui.queue(func() { ui.Submit(line) })
+	case 3: // Ctrl-C
+		return false
+	case 4: // Ctrl-D quits on an empty line
+		if len(ui.input) == 0 {
+			return false
+		}
+		ui.deleteRunes(ui.cursor, ui.cursor+1)
+	case 127, 8: // Backspace
+		if ui.cursor > 0 {
+			ui.deleteRunes(ui.cursor-1, ui.cursor)
+			ui.cursor--
+		}
+	case 1: // Ctrl-A
+		ui.cursor = 0
+	case 5: // Ctrl-E
+		ui.cursor = len(ui.input)
+	case 2: // Ctrl-B
+		ui.cursor = max(0, ui.cursor-1)
+	case 6: // Ctrl-F
+		ui.cursor = min(len(ui.input), ui.cursor+1)
+	case 11: // Ctrl-K
+		ui.input = ui.input[:ui.cursor]
+	case 21: // Ctrl-U
+		ui.deleteRunes(0, ui.cursor)
+		ui.cursor = 0
+	case 23: // Ctrl-W deletes the word before the cursor
+		start := ui.cursor
+		for start > 0 && unicode.IsSpace(ui.input[start-1]) {
+			start--
+		}
+		for start > 0 && !unicode.IsSpace(ui.input[start-1]) {
+			start--
+		}
+		ui.deleteRunes(start, ui.cursor)
+		ui.cursor = start
+	case 14: // Ctrl-N
+		go ui.cycleRoom(1)
+	case 16: // Ctrl-P
+		go ui.cycleRoom(-1)
+	case '\t':
+		ui.complete()
+	case 12: // Ctrl-L redraws
+	default:
+		if unicode.IsPrint(r) {
+			ui.input = slices.Insert(ui.input, ui.cursor, r)
+			ui.cursor++
+		}
+	}
+	return true
+}
+
+// Handle an escape sequence - arrows move the cursor and walk the history, page up and down scroll
+func (ui *TerminalUI) handleEscape(sequence string) {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+
+	pageSize := max(1, ui.height-4)
+	switch sequence[min(1, len(sequence)):] {
+	case "A":
+		ui.walkHistory(1)
+	case "B":
+		ui.walkHistory(-1)
+	case "C":
+		ui.cursor = min(len(ui.input), ui.cursor+1)
+	case "D":
+		ui.cursor = max(0, ui.cursor-1)
+	case "H", "1~":
+		ui.cursor = 0
+	case "F", "4~":
+		ui.cursor = len(ui.input)
+	case "3~":
+		ui.deleteRunes(ui.cursor, ui.cursor+1)
+	case "5~":
+		ui.scroll += pageSize
+	case "6~":
+		ui.scroll = max(0, ui.scroll-pageSize)
+	}
+}
+
+func (ui *TerminalUI) deleteRunes(from int, to int) {
+	if from < 0 || to > len(ui.input) || from >= to {
+		return
+	}
+	ui.input = slices.Delete(ui.input, from, to)
+}
+
+// Complete the word before the cursor - a single candidate is filled in, several are filled in as far as
+// they agree and listed on the status line
+func (ui *TerminalUI) complete() {
+	before := string(ui.input[:ui.cursor])
+	candidates := ui.commands.Complete(before, ui.allRooms, ui.members)
+	if len(candidates) == 0 {
+		return
+	}
+
+	start := strings.LastIndex(before, " ") + 1
+	completion := CommonPrefix(candidates)
+	if len(candidates) == 1 {
+		completion += " "
+	} else {
+		ui.status = strings.Join(candidates, " ")
+	}
+	if len(completion) < len(before)-start {
+		return
+	}
+
+	word := []rune(completion)
+	wordStart := len([]rune(before[:start]))
+	ui.input = slices.Concat(ui.input[:wordStart], word, ui.input[ui.cursor:])
+	ui.cursor = wordStart + len(word)
+}
+
+// Add a submitted line to the input history
+func (ui *TerminalUI) remember(line string) {
+	if len(ui.history) == 0 || ui.history[len(ui.history)-1] != line {
+		ui.history = append(ui.history, line)
+	}
+	if len(ui.history) > InputHistorySize {
+		ui.history = ui.history[len(ui.history)-InputHistorySize:]
+	}
+}
+
+// Move through the input history - step 1 goes back to older lines and -1 forward, back to the line being typed
+func (ui *TerminalUI) walkHistory(step int) {
+	index := ui.historyIndex + step
+	if index < 0 || index > len(ui.history) {
+		return
+	}
+	if ui.historyIndex == 0 {
+		ui.draft = string(ui.input)
+	}
+
+	ui.historyIndex = index
+	if index == 0 {
+		ui.input = []rune(ui.draft)
+	} else {
+		ui.input = []rune(ui.history[len(ui.history)-index])
+	}
+	ui.cursor = len(ui.input)
+}
+
+// Run a submitted line and show its outcome
+func (ui *TerminalUI) Submit(line string) {
+	name, args, _ := ParseCommandLine(line)
+	if name == "join" {
+		ui.setStatus("Joining %s", args)
+	}
+	command, response := ui.commands.Run(ui.client, line)
+	if command != nil && command.Name == "quit" {
+		ui.Quit()
+		return
+	}
+	if response.Error != nil {
+		ui.setStatus("%s%s%s", ansiRed, response.Error.Message, ansiReset)
+		return
+	}
+
+	ui.mu.Lock()
+	ui.status = ""
+	for _, text := range LocalResultLines(response) {
+		ui.addSystemLine("%s", text)
+	}
+	switch name {
+	case "join":
+		ui.mu.Unlock()
+		ui.SwitchRoom(ui.client.CurrentRoom())
+		ui.refreshRooms()
+		return
+	case "create", "leave", "nick":
+		ui.queue(ui.refreshRooms)
+		ui.queue(ui.refreshMembers)
+		ui.status = "Done"
+	case "thread":
+		var thread GetThreadResult
+		if json.Unmarshal(response.Result, &thread) == nil && thread.Root != nil {
+			ui.addSystemLine("thread [%s] with %d replies", ShortId(thread.Root.Id), thread.Thread.ReplyCount)
+			for _, message := range append([]*Message{thread.Root}, thread.Replies...) {
+				ui.client.rememberMessageId(message.Id)
+				ui.addSystemLine("  %s [%s] %s", message.Timestamp.Local().Format(TimestampFormat), ShortId(message.Id), FormatChatMessage(message.Author, string(message.Msg)))
+			}
+		}
+	case "history":
+		var result GetHistoryResult
+		if json.Unmarshal(response.Result, &result) == nil {
+			ui.addSystemLine("last %d messages in #%s", len(result.Messages), result.Room)
+			for _, message := range result.Messages {
+				ui.addLine(result.Room, ui.messageLine(message.Id, message.ParentId, message.Author, string(message.Msg), message.Timestamp))
+			}
+		}
+	case "search":
+		var result SearchMessagesResult
+		if json.Unmarshal(response.Result, &result) == nil {
+			ui.addSystemLine("%d matches", result.Total)
+			for _, hit := range result.Hits {
+				ui.client.rememberMessageId(hit.Message.Id)
+				ui.addSystemLine("  #%s [%s] %s: %s", hit.Message.Room, ShortId(hit.Message.Id), hit.Message.Author, hit.Snippet)
+			}
+		}
+	case "mentions":
+		var result GetMentionsResult
+		if json.Unmarshal(response.Result, &result) == nil {
+			ui.addSystemLine("%d unread mentions", len(result.Mentions))
+			for _, mention := range result.Mentions {
+				ui.client.rememberMessageId(mention.MessageId)
+				ui.addSystemLine("  #%s [%s] %s", mention.Room, ShortId(mention.MessageId), FormatChatMessage(mention.Author, string(mention.Msg)))
+			}
+		}
+	case "rooms":
+		var result ListRoomsResult
+		if json.Unmarshal(response.Result, &result) == nil {
+			for _, room := range result.Rooms {
+				ui.addSystemLine("  #%s %d members %s", room.Name, room.Members, room.Topic)
+			}
+		}
+	case "who":
+		var result ListMembersResult
+		if json.Unmarshal(response.Result, &result) == nil {
+			ui.addSystemLine("#%s members: %s", result.Room, strings.Join(result.Members, ", "))
+		}
+	case "topic":
+		var change TopicChange
+		if json.Unmarshal(response.Result, &change) == nil && change.Room != "" {
+			ui.topics[change.Room] = change.Topic
+		}
+	case "msg":
+		to, msg, _ := strings.Cut(args, " ")
+		ui.addSystemLine("[private to %s] %s", to, strings.TrimSpace(msg))
+	case "read":
+		ui.status = "Marked as read"
+	case "", "me", "reply":
+		var result ChatResult
+		if json.Unmarshal(response.Result, &result) == nil && result.MessageId != "" {
+			msg, parentId := args, ""
+			switch name {
+			case "me":
+				msg = ActionPrefix + args
+			case "reply":
+				parentId, msg, _ = strings.Cut(args, " ")
+			}
+			ui.addLine(ui.client.CurrentRoom(), ui.messageLine(result.MessageId, parentId, ui.self(), strings.TrimSpace(msg), time.Now()))
+		}
+	}
+	ui.mu.Unlock()
+	ui.Render()
+}
+
+// Build the pane line of a chat message - replies show the message they reply to and /me messages are actions
+func (ui *TerminalUI) messageLine(id string, parentId string, author string, msg string, timestamp time.Time) paneLine {
+	line := paneLine{time: timestamp, author: author}
+	if action, ok := strings.CutPrefix(msg, ActionPrefix); ok {
+		msg, line.action = action, true
+	}
+	line.text = fmt.Sprintf("[%s] %s", ShortId(id), msg)
+	if parentId != "" {
+		line.text = fmt.Sprintf("[%s] ↳ %s: %s", ShortId(id), ShortId(parentId), msg)
+	}
+	return line
+}
+
+// Name the user's own messages are shown under
+func (ui *TerminalUI) self() string {
+	if user := ui.client.User(); user != "" {
+		return user
+	}
+	return "you"
+}
+
+// Wrap text to a width, breaking at spaces where it can
+func WrapText(text string, width int) []string {
+	if width <= 0 {
+		return []string{text}
+	}
+
+	lines := make([]string, 0)
+	for _, paragraph := range strings.Split(text, "\n") {
+		runes := []rune(paragraph)
+		for len(runes) > width {
+			cut := width
+			for i := width; i > width/2; i-- {
+				if runes[i] == ' ' {
+					cut = i
+					break
+				}
+			}
+			lines = append(lines, string(runes[:cut]))
+			runes = runes[cut:]
+			if len(runes) > 0 && runes[0] == ' ' {
+				runes = runes[1:]
+			}
+		}
+		lines = append(lines, string(runes))
+	}
+	return lines
+}
+
+// Cut or pad plain text to exactly a width
+func fitText(text string, width int) string {
+	runes := []rune(text)
+	if len(runes) > width {
+		return string(runes[:width])
+	}
+	return text + strings.Repeat(" ", width-len(runes))
+}
+
+// Build the rows of the message pane, newest last, each at most width wide
+func (ui *TerminalUI) messageRows(width int) []string {
+	pane := ui.pane(ui.client.CurrentRoom())
+	rows := make([]string, 0)
+	for i, line := range pane.lines {
+		if i == pane.marker {
+			rows = append(rows, ansiRed+fitText(UnreadMarker, width)+ansiReset)
+		}
+
+		prefix := line.time.Local().Format(TimestampFormat) + " "
+		styledPrefix := ansiDim + prefix + ansiReset
+		switch {
+		case line.action:
+			prefix += "* " + line.author + " "
+			styledPrefix += "* " + SenderColor(line.author) + line.author + ansiReset + " "
+		case line.author != "":
+			prefix += line.author + ": "
+			styledPrefix += SenderColor(line.author) + ansiBold + line.author + ansiReset + ": "
+		}
+		indent := len([]rune(prefix))
+		for j, text := range WrapText(line.text, max(1, width-indent)) {
+			if line.author == "" {
+				text = ansiDim + text + ansiReset
+			} else {
+				text = HighlightMentions(text)
+			}
+			if j == 0 {
+				rows = append(rows, styledPrefix+text)
+			} else {
+				rows = append(rows, strings.Repeat(" ", indent)+text)
+			}
+		}
+	}
+	return rows
+}
+
+// Build the rows of the sidebar - the rooms with their unread counts, then the current room's members
+func (ui *TerminalUI) sidebarRows() []string {
+	rows := []string{ansiBold + fitText(" Rooms", SidebarWidth) + ansiReset}
+	current := ui.client.CurrentRoom()
+	for _, room := range ui.rooms {
+		label := "  #" + room
+		if unread := ui.unread[room]; unread > 0 {
+			label = fmt.Sprintf("%s (%d)", label, unread)
+		}
+		switch {
+		case room == current:
+			rows = append(rows, ansiReverse+fitText(label, SidebarWidth)+ansiReset)
+		case ui.unread[room] > 0:
+			rows = append(rows, ansiBold+fitText(label, SidebarWidth)+ansiReset)
+		default:
+			rows = append(rows, fitText(label, SidebarWidth))
+		}
+	}
+
+	rows = append(rows, fitText("", SidebarWidth), ansiBold+fitText(" Members ("+strconv.Itoa(len(ui.members))+")", SidebarWidth)+ansiReset)
+	for _, member := range ui.members {
+		rows = append(rows, SenderColor(member)+fitText("  "+member, SidebarWidth)+ansiReset)
+	}
+	return rows
+}
+
+// Draw the whole screen
+func (ui *TerminalUI) Render() {
+	ui.mu.Lock()
+	defer ui.mu.Unlock()
+
+	var screen strings.Builder
+	screen.WriteString(ansiHideCursor)
+	messageWidth := max(1, ui.width-SidebarWidth-1)
+	paneHeight := max(1, ui.height-3)
+
+	unread := 0
+	for _, count := range ui.unread {
+		unread += count
+	}
+	header := fmt.Sprintf(" #%s · %s", ui.client.CurrentRoom(), ui.self())
+	if topic := ui.topics[ui.client.CurrentRoom()]; topic != "" {
+		header += " · " + topic
+	}
+	if unread > 0 {
+		header += fmt.Sprintf(" · %d unread", unread)
+	}
+	if ui.scroll > 0 {
+		header += fmt.Sprintf(" · scrolled up %d", ui.scroll)
+	}
+	screen.WriteString("\033[1;1H" + ansiClearLine + ansiReverse + fitText(header, ui.width) + ansiReset)
+
+	rows := ui.messageRows(messageWidth)
+	ui.scroll = min(ui.scroll, max(0, len(rows)-paneHeight))
+	end := len(rows) - ui.scroll
+	start := max(0, end-paneHeight)
+	rows = rows[start:end]
+	sidebar := ui.sidebarRows()
+	for i := 0; i < paneHeight; i++ {
+		fmt.Fprintf(&screen, "\033[%d;1H%s", i+2, ansiClearLine)
+		if i < len(sidebar) {
+			screen.WriteString(sidebar[i])
+		} else {
+			screen.WriteString(strings.Repeat(" ", SidebarWidth))
+		}
+		screen.WriteString(ansiDim + "│" + ansiReset)
+		if offset := paneHeight - len(rows); i >= offset {
+			screen.WriteString(rows[i-offset])
+		}
+	}
+
+	fmt.Fprintf(&screen, "\033[%d;1H%s%s", ui.height-1, ansiClearLine, ui.status)
+
+	prompt := "> "
+	available := max(1, ui.width-len(prompt)-1)
+	first := max(0, ui.cursor-available)
+	visible := ui.input[first:min(len(ui.input), first+available)]
+	fmt.Fprintf(&screen, "\033[%d;1H%s%s%s", ui.height, ansiClearLine, prompt, string(visible))
+	fmt.Fprintf(&screen, "\033[%d;%dH%s", ui.height, len(prompt)+ui.cursor-first+1, ansiShowCursor)
+
+	io.WriteString(ui.out, screen.String())
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Terminal UI over a client that isn't connected
+func TerminalUIFixture() *TerminalUI {
+	client := NewJsonRpcClient(&bytes.Buffer{}, "")
+	return NewTerminalUI(client, DefaultCommands(), strings.NewReader(""), &bytes.Buffer{})
+}
+
+// Type keys into the UI
+func TypeKeys(ui *TerminalUI, keys string) {
+	for _, r := range keys {
+		ui.HandleKey(r)
+	}
+}
+
+func TestWrapText(t *testing.T) {
+	lines := WrapText("the quick brown fox jumps", 10)
+	if !reflect.DeepEqual(lines, []string{"the quick", "brown fox", "jumps"}) {
+		t.Errorf("got lines %q", lines)
+	}
+
+	lines = WrapText("abcdefghijkl", 5)
+	if !reflect.DeepEqual(lines, []string{"abcde", "fghij", "kl"}) {
+		t.Errorf("got lines %q for a word longer than the width", lines)
+	}
+}
+
+func TestInputEditing(t *testing.T) {
+	t.Run("keys edit the line at the cursor", func(t *testing.T) {
+		ui := TerminalUIFixture()
+
+		TypeKeys(ui, "hello world\x01>\x05!\x7f?")
+		if string(ui.input) != ">hello world?" {
+			t.Errorf("got input [%s]", string(ui.input))
+		}
+		TypeKeys(ui, "\x17")
+		if string(ui.input) != ">hello " {
+			t.Errorf("got input [%s] after deleting a word", string(ui.input))
+		}
+		TypeKeys(ui, "\x15")
+		if len(ui.input) != 0 || ui.cursor != 0 {
+			t.Errorf("got input [%s] after deleting the line", string(ui.input))
+		}
+	})
+
+	t.Run("history is walked back to the line being typed", func(t *testing.T) {
+		ui := TerminalUIFixture()
+		ui.remember("first")
+		ui.remember("second")
+
+		TypeKeys(ui, "draft")
+		ui.handleEscape("[A")
+		ui.handleEscape("[A")
+		if string(ui.input) != "first" {
+			t.Errorf("got input [%s] two lines back", string(ui.input))
+		}
+		ui.handleEscape("[B")
+		ui.handleEscape("[B")
+		if string(ui.input) != "draft" || ui.cursor != 5 {
+			t.Errorf("got input [%s] back at the draft", string(ui.input))
+		}
+	})
+
+	t.Run("ctrl-c and ctrl-d on an empty line quit", func(t *testing.T) {
+		ui := TerminalUIFixture()
+
+		if ui.HandleKey(3) || ui.HandleKey(4) {
+			t.Error("got the UI still running")
+		}
+		TypeKeys(ui, "x")
+		if !ui.HandleKey(4) {
+			t.Error("got ctrl-d quitting with input typed")
+		}
+	})
+}
+
+func TestUnreadMessages(t *testing.T) {
+	ui := TerminalUIFixture()
+	ui.addLine("random", paneLine{author: "bob", text: "hi"})
+	ui.addLine("random", paneLine{author: "bob", text: "there"})
+	ui.addLine(DefaultRoom, paneLine{author: "bob", text: "seen"})
+
+	if ui.unread["random"] != 2 || ui.unread[DefaultRoom] != 0 {
+		t.Errorf("got unread counts %v", ui.unread)
+	}
+
+	ui.panes["random"].seen = 1
+	ui.SwitchRoom("random")
+	if ui.unread["random"] != 0 || ui.panes["random"].marker != 1 {
+		t.Errorf("got unread %d and marker %d after switching", ui.unread["random"], ui.panes["random"].marker)
+	}
+	rows := ui.messageRows(40)
+	if len(rows) != 3 || !strings.Contains(rows[1], UnreadMarker) {
+		t.Errorf("got rows %q", rows)
+	}
+}
+
+func TestTabCompletion(t *testing.T) {
+	ui := TerminalUIFixture()
+	ui.allRooms = []string{"general", "dev", "design"}
+
+	TypeKeys(ui, "/jo\t")
+	if string(ui.input) != "/join " {
+		t.Errorf("got input [%s] after completing a command", string(ui.input))
+	}
+	TypeKeys(ui, "d\t")
+	if string(ui.input) != "/join de" || ui.status != "design dev" {
+		t.Errorf("got input [%s] and status [%s] with several rooms", string(ui.input), ui.status)
+	}
+	TypeKeys(ui, "v\t")
+	if string(ui.input) != "/join dev " {
+		t.Errorf("got input [%s] after completing a room", string(ui.input))
+	}
+}
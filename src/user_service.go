@@ -0,0 +1,360 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var (
+	ErrUserNameTaken   = errors.New("user name taken")
+	ErrInvalidUserName = errors.New("invalid user name")
+	ErrNotSignedIn     = errors.New("not signed in")
+	ErrUserNotFound    = errors.New("user not found")
+	ErrBadCredentials  = errors.New("wrong password")
+)
+
+var userNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,32}$`)
+
+// Rounds of PBKDF2 new passwords are hashed with - stored credentials keep the rounds they were hashed with
+var PasswordHashIterations = 100_000
+
+// A registered chat user - the credential is kept in storage and shared between cluster nodes but never sent to clients
+type User struct {
+	Name       string      `json:"name"`
+	CreatedAt  time.Time   `json:"createdAt"`
+	Credential *Credential `json:"credential,omitempty"`
+}
+
+// A salted PBKDF2-HMAC-SHA256 hash of a user's password
+type Credential struct {
+	Salt       string `json:"salt"`
+	Hash       string `json:"hash"`
+	Iterations int    `json:"iterations"`
+}
+
+// The user as clients see it, without the credential
+func (u *User) Profile() *User {
+	return &User{Name: u.Name, CreatedAt: u.CreatedAt}
+}
+
+// Hash a password with a new random salt
+func NewCredential(password string) *Credential {
+	salt := make([]byte, 16)
+	rand.Read(salt)
+	hash := pbkdf2SHA256([]byte(password), salt, PasswordHashIterations)
+	return &Credential{Salt: hex.EncodeToString(salt), Hash: hex.EncodeToString(hash), Iterations: PasswordHashIterations}
+}
+
+// Check a password against the credential in constant time
+func (c *Credential) Verify(password string) bool {
+	salt, err := hex.DecodeString(c.Salt)
+	if err != nil {
+		return false
+	}
+	want, err := hex.DecodeString(c.Hash)
+	if err != nil {
+		return false
+	}
+	return subtle.ConstantTimeCompare(pbkdf2SHA256([]byte(password), salt, c.Iterations), want) == 1
+}
+
+// PBKDF2 (RFC 8018) with HMAC-SHA256, producing a single 32 byte block
+func pbkdf2SHA256(password []byte, salt []byte, iterations int) []byte {
+	mac := hmac.New(sha256.New, password)
+	mac.Write(salt)
+	mac.Write(binary.BigEndian.AppendUint32(nil, 1))
+	u := mac.Sum(nil)
+	key := append([]byte(nil), u...)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range key {
+			key[j] ^= u[j]
+		}
+	}
+	return key
+}
+
+// User Data store Interface
+type UserStore interface {
+	Add(user *User) error
+	Get(name string) (*User, bool)
+	List() []*User
+}
+
+// Store users in memory with a map
+type InMemoryUserStore struct {
+	users map[string]*User
+	mu    sync.RWMutex
+}
+
+// Create a new in-memory user store
+func NewUserStore() *InMemoryUserStore {
+	users := make(map[string]*User)
+	return &InMemoryUserStore{users: users}
+}
+
+// Insert a user into the map
+func (s *InMemoryUserStore) Add(user *User) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users[user.Name] = user
+	return nil
+}
+
+// Get a user by name
+func (s *InMemoryUserStore) Get(name string) (*User, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	user, ok := s.users[name]
+	return user, ok
+}
+
+// List all users
+func (s *InMemoryUserStore) List() []*User {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	userList := make([]*User, 0, len(s.users))
+	for _, u := range s.users {
+		userList = append(userList, u)
+	}
+	return userList
+}
+
+// Store users in memory, writing them through to storage so they outlive the server
+type PersistentUserStore struct {
+	*InMemoryUserStore
+	storage Storage
+}
+
+// Create a user store over storage, loading the users it holds
+func NewPersistentUserStore(storage Storage) (*PersistentUserStore, error) {
+	s := &PersistentUserStore{InMemoryUserStore: NewUserStore(), storage: storage}
+	err := storage.View(func(tx StorageTx) error {
+		return LoadBucket(tx, UsersBucket, func(user *User) { s.InMemoryUserStore.Add(user) })
+	})
+	return s, err
+}
+
+// Insert a user and store it
+func (s *PersistentUserStore) Add(user *User) error {
+	err := writeThrough(s.storage, "user", func(tx StorageTx) error {
+		return tx.Put(UsersBucket, user.Name, user)
+	})
+	if err != nil {
+		return err
+	}
+	return s.InMemoryUserStore.Add(user)
+}
+
+// User Service for registering users and tracking which connections they are signed in on
+type UserService struct {
+	store    UserStore
+	sessions map[string]string
+	onChange func(user *User)
+	mu       sync.RWMutex
+}
+
+// Create a new user service
+func NewUserService(store UserStore) *UserService {
+	return &UserService{store: store, sessions: make(map[string]string)}
+}
+
+// Sign a connection in as the named user with its password, registering the user with the password if it doesn't exist.
+// Users stored before they had a password claim one on their next sign in, unless another connection is signed in with the name.
+func (s *UserService) SignIn(connectionId string, name string, password string) (*User, error) {
+	if !userNamePattern.MatchString(name) {
+		return nil, ErrInvalidUserName
+	}
+
+	// Hashing is slow, so the password is checked or hashed before taking the lock
+	existing, ok := s.store.Get(name)
+	var credential *Credential
+	if ok && existing.Credential != nil {
+		if !existing.Credential.Verify(password) {
+			slog.Warn("Sign in with a wrong password", "user", name)
+			return nil, ErrBadCredentials
+		}
+	} else {
+		credential = NewCredential(password)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	user, ok := s.store.Get(name)
+	if credential != nil {
+		if ok && user.Credential != nil {
+			// Registered by another connection while the password was hashed
+			return nil, ErrUserNameTaken
+		}
+		for sessionConnectionId, sessionName := range s.sessions {
+			if sessionName == name && sessionConnectionId != connectionId {
+				return nil, ErrUserNameTaken
+			}
+		}
+		createdAt := time.Now().UTC()
+		if ok {
+			createdAt = user.CreatedAt
+		} else {
+			slog.Info("Creating user", "user", name)
+		}
+		user = &User{Name: name, CreatedAt: createdAt, Credential: credential}
+		if err := s.store.Add(user); err != nil {
+			return nil, err
+		}
+		if s.onChange != nil {
+			s.onChange(user)
+		}
+	}
+
+	s.sessions[connectionId] = name
+	return user, nil
+}
+
+// Set the function told about every user registered or given a password here, e.g. to register it on other nodes
+func (s *UserService) OnChange(fn func(user *User)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = fn
+}
+
+// Check whether a user was registered with its password before another user of the same name - the
+// earlier wins, and the credential hash breaks ties, so every node settles on the same user
+func registeredFirst(user *User, other *User) bool {
+	if !user.CreatedAt.Equal(other.CreatedAt) {
+		return user.CreatedAt.Before(other.CreatedAt)
+	}
+	return user.Credential.Hash < other.Credential.Hash
+}
+
+// Register a user registered on another node, unless a user registered here first has the name. Returns
+// whether the user displaced a user with a password, whose connections here are no longer that user.
+func (s *UserService) AddRemoteUser(user *User) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	local, ok := s.store.Get(user.Name)
+	if ok && (user.Credential == nil || (local.Credential != nil && !registeredFirst(user, local))) {
+		return false
+	}
+	if err := s.store.Add(user); err != nil {
+		return false
+	}
+	return ok && local.Credential != nil
+}
+
+// List the registered users
+func (s *UserService) ListUsers() []*User {
+	return s.store.List()
+}
+
+// Record a user signed in on another node's connection - the user itself comes with its registration
+func (s *UserService) AddRemoteSession(connectionId string, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sessions[connectionId] = name
+}
+
+// Sign a connection out
+func (s *UserService) SignOut(connectionId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.sessions, connectionId)
+}
+
+// Get the name of the user signed in on a connection
+func (s *UserService) UserForConnection(connectionId string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	name, ok := s.sessions[connectionId]
+	return name, ok
+}
+
+// Get the ids of the connections a user is signed in on
+func (s *UserService) ConnectionsForUser(name string) []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	connectionIds := make([]string, 0)
+	for connectionId, sessionName := range s.sessions {
+		if sessionName == name {
+			connectionIds = append(connectionIds, connectionId)
+		}
+	}
+	return connectionIds
+}
+
+// Get a registered user
+func (s *UserService) GetUser(name string) (*User, bool) {
+	return s.store.Get(name)
+}
+
+// Identity of a connection - the signed in user name, or the connection id for anonymous connections
+func (s *UserService) Identity(connection *Connection) string {
+	if name, ok := s.UserForConnection(connection.id); ok {
+		return name
+	}
+	return connection.id
+}
+
+// Sign the connection in as a user - rooms joined while anonymous are kept under the user name
+func (s *Server) CreateUserHandler(ctx context.Context, params CreateUserParams) (*User, error) {
+	connection, ok := ConnectionFromContext(ctx)
+	if !ok {
+		return nil, ErrNoConnection
+	}
+	previous := s.userService.Identity(connection)
+	user, err := s.userService.SignIn(connection.id, params.Name, params.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	if previous == connection.id {
+		if err := s.roomService.RenameMember(previous, user.Name); err != nil {
+			return nil, err
+		}
+	}
+	s.joinDefaultRoom(connection, user.Name)
+	s.publishPresence(connection, true)
+	return user.Profile(), nil
+}
+
+// Send a direct message to the connections of a user signed in anywhere in the cluster
+func (s *Server) DirectMessageHandler(ctx context.Context, params DirectMessageParams) (ChatResult, error) {
+	connection, ok := ConnectionFromContext(ctx)
+	if !ok {
+		return ChatResult{}, ErrNoConnection
+	}
+	from, ok := s.userService.UserForConnection(connection.id)
+	if !ok {
+		return ChatResult{}, ErrNotSignedIn
+	}
+	if name, server, ok := strings.Cut(params.To, "@"); ok {
+		if s.federation == nil || server != s.federation.ServerId() {
+			return s.sendFederatedDirect(from, name, server, params.Msg)
+		}
+		params.To = name
+	}
+	if _, ok := s.userService.GetUser(params.To); !ok || !s.Online(params.To) {
+		return ChatResult{}, ErrUserNotFound
+	}
+
+	message := DirectMessage{Id: uuid.New().String(), From: from, To: params.To, Msg: params.Msg, Timestamp: time.Now().UTC()}
+	s.NotifyIdentity(params.To, DirectMessageNotificationRpcMethod, message)
+	return ChatResult{Success: true, MessageId: message.Id}, nil
+}
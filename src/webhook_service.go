@@ -0,0 +1,657 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+var ErrWebhookNotFound = errors.New("webhook not found")
+var ErrWebhookAddressBlocked = errors.New("webhook address is not public")
+var errWebhookQueueFull = errors.New("delivery queue full")
+
+// Dead letters kept per room - the oldest are dropped to make room for new ones
+const MaxWebhookDeadLetters = 100
+
+// Events a webhook subscribes to when it doesn't name any
+var WebhookEvents = []string{WebhookEventMessage, WebhookEventJoin, WebhookEventLeave, WebhookEventModeration}
+
+// Headers of a webhook request - the signature is sha256= and the hex HMAC-SHA256 of the body, keyed by the webhook's secret
+const (
+	WebhookEventHeader     = "X-Chat-Event"
+	WebhookDeliveryHeader  = "X-Chat-Delivery"
+	WebhookSignatureHeader = "X-Chat-Signature"
+)
+
+// Webhook delivery settings - failed deliveries are retried after a backoff doubling from InitialBackoff up to MaxBackoff,
+// and dead-lettered after MaxAttempts. Webhooks are only posted to public addresses unless AllowPrivateAddresses is set.
+type WebhookConfig struct {
+	Workers               int
+	QueueSize             int
+	MaxAttempts           int
+	InitialBackoff        time.Duration
+	MaxBackoff            time.Duration
+	Timeout               time.Duration
+	AllowPrivateAddresses bool
+}
+
+// Default webhook delivery settings
+func DefaultWebhookConfig() WebhookConfig {
+	return WebhookConfig{Workers: 4, QueueSize: 1024, MaxAttempts: 5, InitialBackoff: time.Second, MaxBackoff: time.Minute, Timeout: 10 * time.Second}
+}
+
+// Sign a webhook body with a secret
+func WebhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+var (
+	thisNetworkPrefix   = netip.MustParsePrefix("0.0.0.0/8")
+	sharedAddressPrefix = netip.MustParsePrefix("100.64.0.0/10")
+)
+
+// Check whether a webhook may be posted to an address - loopback, private, link-local, shared and multicast
+// addresses belong to the server's own network
+func webhookAddressAllowed(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsGlobalUnicast() && !ip.IsPrivate() && !thisNetworkPrefix.Contains(ip) && !sharedAddressPrefix.Contains(ip)
+}
+
+// Refuse to connect a webhook to an address that isn't public - checked on the resolved address, so host
+// names resolving to internal addresses are refused too
+func webhookDialControl(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil || !webhookAddressAllowed(ip) {
+		return ErrWebhookAddressBlocked
+	}
+	return nil
+}
+
+// HTTP client for webhook deliveries - it doesn't follow redirects or use proxies, either of which would get
+// around the address check
+func newWebhookClient(config WebhookConfig) *http.Client {
+	dialer := &net.Dialer{Timeout: config.Timeout}
+	if !config.AllowPrivateAddresses {
+		dialer.Control = webhookDialControl
+	}
+	return &http.Client{
+		Timeout:       config.Timeout,
+		Transport:     &http.Transport{DialContext: dialer.DialContext, TLSHandshakeTimeout: config.Timeout, IdleConnTimeout: 90 * time.Second},
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+}
+
+// Webhook data store interface - subscriptions and the log of payloads that couldn't be delivered
+type WebhookStore interface {
+	AddWebhook(webhook Webhook) error
+	RemoveWebhook(id string) (bool, error)
+	Webhooks(room string) []Webhook
+	AppendDeadLetter(deadLetter WebhookDeadLetter) error
+	DeadLetters(room string) []WebhookDeadLetter
+	RemoveRoom(room string) error
+}
+
+// Store webhooks in memory
+type InMemoryWebhookStore struct {
+	webhooks    map[string]Webhook
+	deadLetters []WebhookDeadLetter
+	mu          sync.RWMutex
+}
+
+// Create a new in-memory webhook store
+func NewWebhookStore() *InMemoryWebhookStore {
+	return &InMemoryWebhookStore{webhooks: make(map[string]Webhook), deadLetters: make([]WebhookDeadLetter, 0)}
+}
+
+// Add a webhook
+func (s *InMemoryWebhookStore) AddWebhook(webhook Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.webhooks[webhook.Id] = webhook
+	return nil
+}
+
+// Remove a webhook
+func (s *InMemoryWebhookStore) RemoveWebhook(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.webhooks[id]
+	delete(s.webhooks, id)
+	return ok, nil
+}
+
+// List the webhooks of a room, oldest first
+func (s *InMemoryWebhookStore) Webhooks(room string) []Webhook {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	webhookList := make([]Webhook, 0)
+	for _, webhook := range s.webhooks {
+		if webhook.Room == room {
+			webhookList = append(webhookList, webhook)
+		}
+	}
+	slices.SortFunc(webhookList, func(a, b Webhook) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Id, b.Id)
+	})
+	return webhookList
+}
+
+// Append a payload that couldn't be delivered to the dead-letter log
+func (s *InMemoryWebhookStore) AppendDeadLetter(deadLetter WebhookDeadLetter) error {
+	s.appendDeadLetter(deadLetter)
+	return nil
+}
+
+// Append a dead letter, returning the oldest of its room's dead letters dropped to keep MaxWebhookDeadLetters
+func (s *InMemoryWebhookStore) appendDeadLetter(deadLetter WebhookDeadLetter) []WebhookDeadLetter {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deadLetters = append(s.deadLetters, deadLetter)
+	excess := -MaxWebhookDeadLetters
+	for _, other := range s.deadLetters {
+		if other.Payload.Room == deadLetter.Payload.Room {
+			excess++
+		}
+	}
+	dropped := make([]WebhookDeadLetter, 0)
+	kept := s.deadLetters[:0]
+	for _, other := range s.deadLetters {
+		if excess > 0 && other.Payload.Room == deadLetter.Payload.Room {
+			dropped = append(dropped, other)
+			excess--
+			continue
+		}
+		kept = append(kept, other)
+	}
+	s.deadLetters = kept
+	return dropped
+}
+
+// The oldest dead letters of a room that appending a dead letter would drop to keep MaxWebhookDeadLetters
+func (s *InMemoryWebhookStore) droppedBy(deadLetter WebhookDeadLetter) []WebhookDeadLetter {
+	deadLetters := s.DeadLetters(deadLetter.Payload.Room)
+	excess := len(deadLetters) + 1 - MaxWebhookDeadLetters
+	if excess <= 0 {
+		return nil
+	}
+	return deadLetters[:excess]
+}
+
+// List the dead letters of a room, oldest first
+func (s *InMemoryWebhookStore) DeadLetters(room string) []WebhookDeadLetter {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	deadLetterList := make([]WebhookDeadLetter, 0)
+	for _, deadLetter := range s.deadLetters {
+		if deadLetter.Payload.Room == room {
+			deadLetterList = append(deadLetterList, deadLetter)
+		}
+	}
+	return deadLetterList
+}
+
+// Remove the webhooks and dead letters of a room
+func (s *InMemoryWebhookStore) RemoveRoom(room string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, webhook := range s.webhooks {
+		if webhook.Room == room {
+			delete(s.webhooks, id)
+		}
+	}
+	kept := s.deadLetters[:0]
+	for _, deadLetter := range s.deadLetters {
+		if deadLetter.Payload.Room != room {
+			kept = append(kept, deadLetter)
+		}
+	}
+	s.deadLetters = kept
+	return nil
+}
+
+// Store webhooks in memory, writing them and the dead letters through to storage so they outlive the server.
+// Changes are serialised, so what a change deletes from storage is what it then drops from memory.
+type PersistentWebhookStore struct {
+	*InMemoryWebhookStore
+	storage Storage
+	mu      sync.Mutex
+}
+
+// Create a webhook store over storage, loading the webhooks and dead letters it holds - dead letters past
+// MaxWebhookDeadLetters for their room are deleted
+func NewPersistentWebhookStore(storage Storage) (*PersistentWebhookStore, error) {
+	s := &PersistentWebhookStore{InMemoryWebhookStore: NewWebhookStore(), storage: storage}
+	dropped := make([]WebhookDeadLetter, 0)
+	err := storage.View(func(tx StorageTx) error {
+		err := LoadBucket(tx, WebhooksBucket, func(webhook *Webhook) { s.InMemoryWebhookStore.AddWebhook(*webhook) })
+		if err != nil {
+			return err
+		}
+		return LoadBucket(tx, WebhookDeadLettersBucket, func(deadLetter *WebhookDeadLetter) {
+			dropped = append(dropped, s.InMemoryWebhookStore.appendDeadLetter(*deadLetter)...)
+		})
+	})
+	if err != nil || len(dropped) == 0 {
+		return s, err
+	}
+	return s, storage.Update(func(tx StorageTx) error {
+		return deleteDeadLetters(tx, dropped)
+	})
+}
+
+// Delete dead letters from storage
+func deleteDeadLetters(tx StorageTx, deadLetters []WebhookDeadLetter) error {
+	for _, deadLetter := range deadLetters {
+		if err := tx.Delete(WebhookDeadLettersBucket, deadLetterKey(deadLetter)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Key of a dead letter - keys sort in the order the dead letters were logged
+func deadLetterKey(deadLetter WebhookDeadLetter) string {
+	return fmt.Sprintf("%019d/%s/%s", deadLetter.Time.UnixNano(), deadLetter.Payload.Id, deadLetter.Webhook)
+}
+
+// Add a webhook and store it
+func (s *PersistentWebhookStore) AddWebhook(webhook Webhook) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := writeThrough(s.storage, "webhook", func(tx StorageTx) error {
+		return tx.Put(WebhooksBucket, webhook.Id, webhook)
+	})
+	if err != nil {
+		return err
+	}
+	return s.InMemoryWebhookStore.AddWebhook(webhook)
+}
+
+// Remove a webhook from memory and storage
+func (s *PersistentWebhookStore) RemoveWebhook(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := writeThrough(s.storage, "webhook", func(tx StorageTx) error {
+		return tx.Delete(WebhooksBucket, id)
+	})
+	if err != nil {
+		return false, err
+	}
+	return s.InMemoryWebhookStore.RemoveWebhook(id)
+}
+
+// Append a dead letter and store it, deleting the ones dropped for it
+func (s *PersistentWebhookStore) AppendDeadLetter(deadLetter WebhookDeadLetter) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	dropped := s.InMemoryWebhookStore.droppedBy(deadLetter)
+	err := writeThrough(s.storage, "webhook dead letter", func(tx StorageTx) error {
+		if err := tx.Put(WebhookDeadLettersBucket, deadLetterKey(deadLetter), deadLetter); err != nil {
+			return err
+		}
+		return deleteDeadLetters(tx, dropped)
+	})
+	if err != nil {
+		return err
+	}
+	return s.InMemoryWebhookStore.AppendDeadLetter(deadLetter)
+}
+
+// Remove the webhooks and dead letters of a room from memory and storage
+func (s *PersistentWebhookStore) RemoveRoom(room string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	webhooks := s.InMemoryWebhookStore.Webhooks(room)
+	deadLetters := s.InMemoryWebhookStore.DeadLetters(room)
+	err := writeThrough(s.storage, "webhook", func(tx StorageTx) error {
+		for _, webhook := range webhooks {
+			if err := tx.Delete(WebhooksBucket, webhook.Id); err != nil {
+				return err
+			}
+		}
+		return deleteDeadLetters(tx, deadLetters)
+	})
+	if err != nil {
+		return err
+	}
+	return s.InMemoryWebhookStore.RemoveRoom(room)
+}
+
+// A payload on its way to a webhook
+type webhookDelivery struct {
+	webhook  Webhook
+	payload  WebhookPayload
+	body     []byte
+	attempts int
+}
+
+// Webhook answered with a status other than 2xx
+type webhookStatusError struct {
+	status int
+}
+
+func (e *webhookStatusError) Error() string {
+	return fmt.Sprintf("got status %d", e.status)
+}
+
+// Check whether a failed delivery is worth retrying - client errors other than timeouts and rate limits aren't
+func webhookRetryable(err error) bool {
+	var statusErr *webhookStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.status >= 500 || statusErr.status == http.StatusTooManyRequests || statusErr.status == http.StatusRequestTimeout
+	}
+	return true
+}
+
+// Describe a failed delivery for its dead letter - only statuses and a full queue are told apart, so the
+// dead-letter log can't be used to probe which hosts and ports answer
+func webhookFailure(err error) string {
+	var statusErr *webhookStatusError
+	if errors.As(err, &statusErr) || errors.Is(err, errWebhookQueueFull) {
+		return err.Error()
+	}
+	return "delivery failed"
+}
+
+// A webhook subscribed or unsubscribed on a node, replayed on the other nodes of a cluster
+type WebhookChange struct {
+	Webhook Webhook `json:"webhook"`
+	Removed bool    `json:"removed,omitempty"`
+}
+
+// Webhook Service for subscriptions and the delivery of room events to them - deliveries are queued for a
+// pool of workers, so sending events never waits on a webhook. In a cluster every node knows every
+// subscription and sends them the events of its own connections, so each event is delivered once. Dead
+// letters are kept by the node that gave up on them.
+type WebhookService struct {
+	store     WebhookStore
+	config    WebhookConfig
+	client    *http.Client
+	queue     chan *webhookDelivery
+	done      chan struct{}
+	closeOnce sync.Once
+	onChange  func(change WebhookChange)
+	mu        sync.RWMutex
+}
+
+// Create a webhook service and start its delivery workers
+func NewWebhookService(store WebhookStore, config WebhookConfig) *WebhookService {
+	s := &WebhookService{
+		store:  store,
+		config: config,
+		client: newWebhookClient(config),
+		queue:  make(chan *webhookDelivery, config.QueueSize),
+		done:   make(chan struct{}),
+	}
+	for range config.Workers {
+		go s.run()
+	}
+	return s
+}
+
+// Subscribe a URL to events of a room - all of them when none are given, signed with a new secret when none is given
+func (s *WebhookService) Add(room string, url string, events []string, secret string, createdBy string) (Webhook, error) {
+	if len(events) == 0 {
+		events = WebhookEvents
+	}
+	if secret == "" {
+		random := make([]byte, 32)
+		rand.Read(random)
+		secret = hex.EncodeToString(random)
+	}
+	webhook := Webhook{Id: uuid.New().String(), Room: room, URL: url, Events: events, Secret: secret, CreatedBy: createdBy, CreatedAt: time.Now().UTC()}
+	if err := s.store.AddWebhook(webhook); err != nil {
+		return Webhook{}, err
+	}
+	s.changed(WebhookChange{Webhook: webhook})
+	return webhook, nil
+}
+
+// Remove a webhook of a room
+func (s *WebhookService) Remove(room string, id string) error {
+	for _, webhook := range s.store.Webhooks(room) {
+		if webhook.Id == id {
+			if _, err := s.store.RemoveWebhook(id); err != nil {
+				return err
+			}
+			s.changed(WebhookChange{Webhook: webhook, Removed: true})
+			return nil
+		}
+	}
+	return ErrWebhookNotFound
+}
+
+// Set the function told about every webhook added or removed through the service, e.g. to replay it on other nodes
+func (s *WebhookService) OnChange(fn func(change WebhookChange)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onChange = fn
+}
+
+// Pass a change on
+func (s *WebhookService) changed(change WebhookChange) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.onChange != nil {
+		s.onChange(change)
+	}
+}
+
+// Apply a change made on another node
+func (s *WebhookService) ApplyChange(change WebhookChange) {
+	if change.Removed {
+		s.store.RemoveWebhook(change.Webhook.Id)
+		return
+	}
+	if !s.subscribed(change.Webhook) {
+		s.store.AddWebhook(change.Webhook)
+	}
+}
+
+// List the webhooks of rooms with their secrets, e.g. for a node joining the cluster
+func (s *WebhookService) Subscriptions(rooms []string) []Webhook {
+	webhooks := make([]Webhook, 0)
+	for _, room := range rooms {
+		webhooks = append(webhooks, s.store.Webhooks(room)...)
+	}
+	return webhooks
+}
+
+// List the webhooks of a room without their secrets
+func (s *WebhookService) List(room string) []Webhook {
+	webhooks := s.store.Webhooks(room)
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+	return webhooks
+}
+
+// Remove the webhooks and dead letters of a deleted room
+func (s *WebhookService) RemoveRoom(room string) error {
+	return s.store.RemoveRoom(room)
+}
+
+// Check whether a webhook is still subscribed
+func (s *WebhookService) subscribed(webhook Webhook) bool {
+	return slices.ContainsFunc(s.store.Webhooks(webhook.Room), func(other Webhook) bool { return other.Id == webhook.Id })
+}
+
+// List the payloads the webhooks of a room gave up delivering
+func (s *WebhookService) DeadLetters(room string) []WebhookDeadLetter {
+	return s.store.DeadLetters(room)
+}
+
+// Queue a room event for delivery to the webhooks subscribed to it
+func (s *WebhookService) Emit(payload WebhookPayload) {
+	payload.Id = uuid.New().String()
+	payload.Time = time.Now().UTC()
+	body, _ := json.Marshal(payload)
+	for _, webhook := range s.store.Webhooks(payload.Room) {
+		if slices.Contains(webhook.Events, payload.Event) {
+			s.enqueue(&webhookDelivery{webhook: webhook, payload: payload, body: body})
+		}
+	}
+}
+
+// Queue a delivery, dead-lettering it when the queue is full - nothing is queued once the service is closed
+func (s *WebhookService) enqueue(delivery *webhookDelivery) {
+	select {
+	case <-s.done:
+		return
+	default:
+	}
+	select {
+	case s.queue <- delivery:
+	default:
+		s.deadLetter(delivery, errWebhookQueueFull)
+	}
+}
+
+// Deliver queued payloads until the service is closed
+func (s *WebhookService) run() {
+	for {
+		select {
+		case <-s.done:
+			return
+		case delivery := <-s.queue:
+			s.attempt(delivery)
+		}
+	}
+}
+
+// Try a delivery once, queueing it again after a backoff when it fails and can be retried - deliveries to
+// webhooks removed since are dropped
+func (s *WebhookService) attempt(delivery *webhookDelivery) {
+	if !s.subscribed(delivery.webhook) {
+		return
+	}
+	delivery.attempts++
+	err := s.post(delivery)
+	if err == nil {
+		return
+	}
+	if delivery.attempts >= s.config.MaxAttempts || !webhookRetryable(err) {
+		s.deadLetter(delivery, err)
+		return
+	}
+	slog.Debug("Retrying webhook delivery", "webhook", delivery.webhook.Id, "attempts", delivery.attempts, "error", err)
+	time.AfterFunc(s.backoff(delivery.attempts), func() { s.enqueue(delivery) })
+}
+
+// Wait before the next attempt after a number of failed ones
+func (s *WebhookService) backoff(attempts int) time.Duration {
+	backoff := s.config.InitialBackoff << (attempts - 1)
+	if backoff <= 0 || backoff > s.config.MaxBackoff {
+		return s.config.MaxBackoff
+	}
+	return backoff
+}
+
+// POST a signed payload to a webhook
+func (s *WebhookService) post(delivery *webhookDelivery) error {
+	request, err := http.NewRequest(http.MethodPost, delivery.webhook.URL, bytes.NewReader(delivery.body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(WebhookEventHeader, delivery.payload.Event)
+	request.Header.Set(WebhookDeliveryHeader, delivery.payload.Id)
+	request.Header.Set(WebhookSignatureHeader, WebhookSignature(delivery.webhook.Secret, delivery.body))
+
+	response, err := s.client.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return &webhookStatusError{status: response.StatusCode}
+	}
+	return nil
+}
+
+// Log a payload that couldn't be delivered, unless its webhook was removed
+func (s *WebhookService) deadLetter(delivery *webhookDelivery, err error) {
+	slog.Warn("Webhook delivery failed", "webhook", delivery.webhook.Id, "url", delivery.webhook.URL, "attempts", delivery.attempts, "error", err)
+	if !s.subscribed(delivery.webhook) {
+		return
+	}
+	s.store.AppendDeadLetter(WebhookDeadLetter{Webhook: delivery.webhook.Id, URL: delivery.webhook.URL, Payload: delivery.payload, Attempts: delivery.attempts, Error: webhookFailure(err), Time: time.Now().UTC()})
+}
+
+// Stop delivering - queued and retrying deliveries are dropped
+func (s *WebhookService) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+// Subscribe a URL to a room's events
+func (s *Server) AddWebhookHandler(ctx context.Context, params AddWebhookParams) (Webhook, error) {
+	parsed, err := url.Parse(params.URL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return Webhook{}, NewInvalidParamsError(FieldError{Field: "url", Message: "must be an http or https URL"})
+	}
+	if ip, err := netip.ParseAddr(parsed.Hostname()); err == nil && !s.webhookService.config.AllowPrivateAddresses && !webhookAddressAllowed(ip) {
+		return Webhook{}, NewInvalidParamsError(FieldError{Field: "url", Message: "must be a public address"})
+	}
+	for _, event := range params.Events {
+		if !slices.Contains(WebhookEvents, event) {
+			return Webhook{}, NewInvalidParamsError(FieldError{Field: "events", Message: "must be some of " + strings.Join(WebhookEvents, ", ")})
+		}
+	}
+	return s.webhookService.Add(params.Room, params.URL, params.Events, params.Secret, s.callerIdentity(ctx))
+}
+
+// Remove a webhook of a room
+func (s *Server) RemoveWebhookHandler(ctx context.Context, params WebhookParams) (SuccessResult, error) {
+	if err := s.webhookService.Remove(params.Room, params.Id); err != nil {
+		return SuccessResult{}, err
+	}
+	return SuccessResult{Success: true}, nil
+}
+
+// List the webhooks of a room
+func (s *Server) ListWebhooksHandler(ctx context.Context, params RoomParams) (ListWebhooksResult, error) {
+	return ListWebhooksResult{Webhooks: s.webhookService.List(params.Room)}, nil
+}
+
+// Get the payloads the webhooks of a room gave up delivering
+func (s *Server) GetWebhookDeadLettersHandler(ctx context.Context, params RoomParams) (GetWebhookDeadLettersResult, error) {
+	return GetWebhookDeadLettersResult{DeadLetters: s.webhookService.DeadLetters(params.Room)}, nil
+}
@@ -0,0 +1,363 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A request a webhook receiver got
+type WebhookRequest struct {
+	Header http.Header
+	Body   []byte
+}
+
+// Webhook delivery settings with one worker and short backoffs, posting to the test's local receivers
+func WebhookConfigFixture() WebhookConfig {
+	return WebhookConfig{Workers: 1, QueueSize: 16, MaxAttempts: 3, InitialBackoff: 10 * time.Millisecond, MaxBackoff: 20 * time.Millisecond, Timeout: time.Second, AllowPrivateAddresses: true}
+}
+
+// Server delivering webhooks with the settings, stopped when the test ends
+func WebhookServerFixture(t testing.TB, config ...WebhookConfig) *Server {
+	t.Helper()
+	server := ServerFixture()
+	server.webhookService = NewWebhookService(NewWebhookStore(), append(config, WebhookConfigFixture())[0])
+	t.Cleanup(server.webhookService.Close)
+	return server
+}
+
+// Wait for the dead letters of a room to reach a count
+func AwaitDeadLetters(t testing.TB, server *Server, connection *Connection, room string, count int) []WebhookDeadLetter {
+	t.Helper()
+	var result GetWebhookDeadLettersResult
+	AssertEventually(t, "the failed deliveries to be dead-lettered", func() bool {
+		response := CallMethod(t, server, connection, GetWebhookDeadLettersRpcMethod, RoomParams{Room: room})
+		json.Unmarshal(response.Result, &result)
+		return len(result.DeadLetters) == count
+	})
+	return result.DeadLetters
+}
+
+// Fail if a webhook receiver got a request
+func AssertNoWebhook(t testing.TB, requests chan WebhookRequest) {
+	t.Helper()
+	select {
+	case request := <-requests:
+		t.Errorf("got an unexpected request [%s]", request.Body)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+// HTTP server answering webhook requests with the statuses in turn, then with 200
+func WebhookReceiverFixture(t testing.TB, statuses ...int) (string, chan WebhookRequest) {
+	t.Helper()
+	requests := make(chan WebhookRequest, 16)
+	var mu sync.Mutex
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		status := http.StatusOK
+		if len(statuses) > 0 {
+			status, statuses = statuses[0], statuses[1:]
+		}
+		mu.Unlock()
+		requests <- WebhookRequest{Header: r.Header, Body: body}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(receiver.Close)
+	return receiver.URL, requests
+}
+
+// Wait for the next webhook request, checking its signature
+func ReceiveWebhook(t testing.TB, requests chan WebhookRequest, secret string) WebhookPayload {
+	t.Helper()
+	select {
+	case request := <-requests:
+		if got, want := request.Header.Get(WebhookSignatureHeader), WebhookSignature(secret, request.Body); got != want {
+			t.Errorf("got signature %s, want %s", got, want)
+		}
+		var payload WebhookPayload
+		if err := json.Unmarshal(request.Body, &payload); err != nil {
+			t.Fatalf("got invalid payload [%s]", request.Body)
+		}
+		if request.Header.Get(WebhookEventHeader) != payload.Event || request.Header.Get(WebhookDeliveryHeader) != payload.Id {
+			t.Errorf("got headers %v for payload %+v", request.Header, payload)
+		}
+		return payload
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out waiting for a webhook request")
+		return WebhookPayload{}
+	}
+}
+
+// Add a webhook to a room through the RPC
+func AddWebhook(t testing.TB, server *Server, connection *Connection, params AddWebhookParams) Webhook {
+	t.Helper()
+	response := CallMethod(t, server, connection, AddWebhookRpcMethod, params)
+	AssertSuccess(t, response)
+	var webhook Webhook
+	json.Unmarshal(response.Result, &webhook)
+	return webhook
+}
+
+func TestWebhooks(t *testing.T) {
+	t.Run("room events are posted signed", func(t *testing.T) {
+		server := WebhookServerFixture(t)
+		url, requests := WebhookReceiverFixture(t)
+		alice, _ := AddFakeConnection(t, server, "alice")
+		bob, _ := AddFakeConnection(t, server, "bob")
+		AssertSuccess(t, CallMethod(t, server, alice, CreateChatRoomRpcMethod, RoomParams{Room: "ops"}))
+		webhook := AddWebhook(t, server, alice, AddWebhookParams{Room: "ops", URL: url})
+		if webhook.Secret == "" || len(webhook.Events) != len(WebhookEvents) {
+			t.Fatalf("got webhook %+v", webhook)
+		}
+
+		AssertSuccess(t, CallMethod(t, server, alice, JoinChatRoomRpcMethod, RoomParams{Room: "ops"}))
+		AssertSuccess(t, CallMethod(t, server, bob, JoinChatRoomRpcMethod, RoomParams{Room: "ops"}))
+		if payload := ReceiveWebhook(t, requests, webhook.Secret); payload.Event != WebhookEventJoin || payload.Room != "ops" || payload.Member != "bob" {
+			t.Errorf("got payload %+v", payload)
+		}
+		AssertSuccess(t, CallMethod(t, server, bob, ChatRpcMethod, ChatRequestParams{Room: "ops", Msg: []byte("the database is down")}))
+		if payload := ReceiveWebhook(t, requests, webhook.Secret); payload.Event != WebhookEventMessage || payload.Message == nil || payload.Message.Text != "the database is down" || payload.Message.Author != "bob" {
+			t.Errorf("got payload %+v", payload)
+		}
+		AssertSuccess(t, CallMethod(t, server, alice, KickUserRpcMethod, ModerationParams{Room: "ops", User: "bob", Reason: "panic"}))
+		if payload := ReceiveWebhook(t, requests, webhook.Secret); payload.Event != WebhookEventModeration || payload.Moderation == nil || payload.Moderation.Action != ModerationActionKick {
+			t.Errorf("got payload %+v", payload)
+		}
+		AssertSuccess(t, CallMethod(t, server, alice, ChatRpcMethod, ChatRequestParams{Msg: []byte("another room")}))
+		AssertNoWebhook(t, requests)
+	})
+
+	t.Run("webhooks only get the events they subscribe to", func(t *testing.T) {
+		server := WebhookServerFixture(t)
+		url, requests := WebhookReceiverFixture(t)
+		alice, _ := AddFakeConnection(t, server, "alice")
+		bob, _ := AddFakeConnection(t, server, "bob")
+		AssertSuccess(t, CallMethod(t, server, alice, CreateChatRoomRpcMethod, RoomParams{Room: "ops"}))
+		webhook := AddWebhook(t, server, alice, AddWebhookParams{Room: "ops", URL: url, Events: []string{WebhookEventLeave}, Secret: "s3cret"})
+
+		AssertSuccess(t, CallMethod(t, server, bob, JoinChatRoomRpcMethod, RoomParams{Room: "ops"}))
+		AssertSuccess(t, CallMethod(t, server, bob, LeaveChatRoomRpcMethod, RoomParams{Room: "ops"}))
+		if payload := ReceiveWebhook(t, requests, "s3cret"); payload.Event != WebhookEventLeave || payload.Member != "bob" {
+			t.Errorf("got payload %+v", payload)
+		}
+		if webhook.Secret != "s3cret" {
+			t.Errorf("got secret %s", webhook.Secret)
+		}
+	})
+
+	t.Run("failed deliveries are retried, then dead-lettered", func(t *testing.T) {
+		server := WebhookServerFixture(t)
+		flakyUrl, flaky := WebhookReceiverFixture(t, http.StatusInternalServerError, http.StatusTooManyRequests)
+		downUrl, down := WebhookReceiverFixture(t, http.StatusBadGateway, http.StatusBadGateway, http.StatusBadGateway)
+		goneUrl, gone := WebhookReceiverFixture(t, http.StatusNotFound)
+		alice, _ := AddFakeConnection(t, server, "alice")
+		AssertSuccess(t, CallMethod(t, server, alice, CreateChatRoomRpcMethod, RoomParams{Room: "ops"}))
+		for _, url := range []string{flakyUrl, downUrl, goneUrl} {
+			AddWebhook(t, server, alice, AddWebhookParams{Room: "ops", URL: url, Events: []string{WebhookEventMessage}, Secret: "s3cret"})
+		}
+
+		AssertSuccess(t, CallMethod(t, server, alice, ChatRpcMethod, ChatRequestParams{Room: "ops", Msg: []byte("paging")}))
+		for _, receiver := range []struct {
+			requests chan WebhookRequest
+			attempts int
+		}{{flaky, 3}, {down, 3}, {gone, 1}} {
+			first := ReceiveWebhook(t, receiver.requests, "s3cret")
+			for range receiver.attempts - 1 {
+				if retry := ReceiveWebhook(t, receiver.requests, "s3cret"); retry.Id != first.Id {
+					t.Errorf("retried payload %s as %s", first.Id, retry.Id)
+				}
+			}
+		}
+
+		attempts := map[string]int{}
+		for _, deadLetter := range AwaitDeadLetters(t, server, alice, "ops", 2) {
+			attempts[deadLetter.URL] = deadLetter.Attempts
+			if deadLetter.Payload.Message == nil || deadLetter.Payload.Message.Text != "paging" || !strings.HasPrefix(deadLetter.Error, "got status ") {
+				t.Errorf("got dead letter %+v", deadLetter)
+			}
+		}
+		if attempts[downUrl] != 3 || attempts[goneUrl] != 1 {
+			t.Errorf("got attempts %v", attempts)
+		}
+	})
+
+	t.Run("room owners manage the webhooks", func(t *testing.T) {
+		server := WebhookServerFixture(t)
+		alice, _ := AddFakeConnection(t, server, "alice")
+		bob, _ := AddFakeConnection(t, server, "bob")
+		AssertSuccess(t, CallMethod(t, server, alice, CreateChatRoomRpcMethod, RoomParams{Room: "ops"}))
+		AssertSuccess(t, CallMethod(t, server, bob, JoinChatRoomRpcMethod, RoomParams{Room: "ops"}))
+
+		AssertErrorCode(t, CallMethod(t, server, bob, AddWebhookRpcMethod, AddWebhookParams{Room: "ops", URL: "http://example.com/hook"}), PermissionDeniedErrorCode)
+		AssertErrorCode(t, CallMethod(t, server, alice, AddWebhookRpcMethod, AddWebhookParams{Room: "ops", URL: "ftp://example.com/hook"}), -32602)
+		AssertErrorCode(t, CallMethod(t, server, alice, AddWebhookRpcMethod, AddWebhookParams{Room: "ops", URL: "http://example.com/hook", Events: []string{"typing"}}), -32602)
+		webhook := AddWebhook(t, server, alice, AddWebhookParams{Room: "ops", URL: "http://example.com/hook"})
+
+		response := CallMethod(t, server, alice, ListWebhooksRpcMethod, RoomParams{Room: "ops"})
+		var result ListWebhooksResult
+		json.Unmarshal(response.Result, &result)
+		if len(result.Webhooks) != 1 || result.Webhooks[0].Id != webhook.Id || result.Webhooks[0].Secret != "" || result.Webhooks[0].CreatedBy != "alice" {
+			t.Errorf("got webhooks %+v", result)
+		}
+		AssertErrorCode(t, CallMethod(t, server, bob, ListWebhooksRpcMethod, RoomParams{Room: "ops"}), PermissionDeniedErrorCode)
+
+		AssertErrorCode(t, CallMethod(t, server, bob, RemoveWebhookRpcMethod, WebhookParams{Room: "ops", Id: webhook.Id}), PermissionDeniedErrorCode)
+		AssertErrorCode(t, CallMethod(t, server, alice, RemoveWebhookRpcMethod, WebhookParams{Room: "ops", Id: "nope"}), WebhookNotFoundErrorCode)
+		AssertSuccess(t, CallMethod(t, server, alice, RemoveWebhookRpcMethod, WebhookParams{Room: "ops", Id: webhook.Id}))
+		if webhooks := server.webhookService.List("ops"); len(webhooks) != 0 {
+			t.Errorf("got webhooks %+v after removing", webhooks)
+		}
+	})
+
+	t.Run("webhooks and dead letters outlive the server", func(t *testing.T) {
+		storage := NewMemoryStorage()
+		store, err := NewPersistentWebhookStore(storage)
+		AssertErrorNotNil(t, err)
+		store.AddWebhook(Webhook{Id: "w1", Room: "ops", URL: "http://example.com/hook", Events: WebhookEvents, Secret: "s3cret"})
+		store.AddWebhook(Webhook{Id: "w2", Room: "ops", URL: "http://example.com/other"})
+		store.RemoveWebhook("w2")
+		store.AppendDeadLetter(WebhookDeadLetter{Webhook: "w1", Payload: WebhookPayload{Id: "p1", Room: "ops"}, Attempts: 5, Time: time.Now()})
+
+		reloaded, err := NewPersistentWebhookStore(storage)
+		AssertErrorNotNil(t, err)
+		if webhooks := reloaded.Webhooks("ops"); len(webhooks) != 1 || webhooks[0].Secret != "s3cret" {
+			t.Errorf("got webhooks %+v", webhooks)
+		}
+		if deadLetters := reloaded.DeadLetters("ops"); len(deadLetters) != 1 || deadLetters[0].Attempts != 5 {
+			t.Errorf("got dead letters %+v", deadLetters)
+		}
+	})
+
+	t.Run("webhooks can't reach internal addresses", func(t *testing.T) {
+		config := WebhookConfigFixture()
+		config.AllowPrivateAddresses = false
+		config.MaxAttempts = 1
+		server := WebhookServerFixture(t, config)
+		url, requests := WebhookReceiverFixture(t)
+		alice, _ := AddFakeConnection(t, server, "alice")
+		AssertSuccess(t, CallMethod(t, server, alice, CreateChatRoomRpcMethod, RoomParams{Room: "ops"}))
+		for _, internal := range []string{"http://127.0.0.1:8080/hook", "http://10.0.0.1/hook", "http://169.254.169.254/latest", "http://[::1]/hook", "http://[::ffff:192.168.1.1]/hook"} {
+			AssertErrorCode(t, CallMethod(t, server, alice, AddWebhookRpcMethod, AddWebhookParams{Room: "ops", URL: internal}), -32602)
+		}
+
+		// A host name resolving to a loopback address is refused when connecting
+		AddWebhook(t, server, alice, AddWebhookParams{Room: "ops", URL: strings.Replace(url, "127.0.0.1", "localhost", 1), Events: []string{WebhookEventMessage}})
+		AssertSuccess(t, CallMethod(t, server, alice, ChatRpcMethod, ChatRequestParams{Room: "ops", Msg: []byte("paging")}))
+		if deadLetters := AwaitDeadLetters(t, server, alice, "ops", 1); deadLetters[0].Error != "delivery failed" {
+			t.Errorf("got dead letter %+v", deadLetters[0])
+		}
+		AssertNoWebhook(t, requests)
+
+		for address, allowed := range map[string]bool{"93.184.216.34": true, "2606:2800:220:1::": true, "100.64.0.1": false, "0.0.0.0": false, "192.168.0.1": false, "fd00::1": false, "fe80::1": false, "224.0.0.1": false} {
+			if got := webhookAddressAllowed(netip.MustParseAddr(address)); got != allowed {
+				t.Errorf("got allowed %v for %s", got, address)
+			}
+		}
+	})
+
+	t.Run("redirects aren't followed", func(t *testing.T) {
+		server := WebhookServerFixture(t)
+		url, requests := WebhookReceiverFixture(t)
+		redirect := httptest.NewServer(http.RedirectHandler(url, http.StatusFound))
+		t.Cleanup(redirect.Close)
+		alice, _ := AddFakeConnection(t, server, "alice")
+		AssertSuccess(t, CallMethod(t, server, alice, CreateChatRoomRpcMethod, RoomParams{Room: "ops"}))
+		AddWebhook(t, server, alice, AddWebhookParams{Room: "ops", URL: redirect.URL, Events: []string{WebhookEventMessage}})
+
+		AssertSuccess(t, CallMethod(t, server, alice, ChatRpcMethod, ChatRequestParams{Room: "ops", Msg: []byte("paging")}))
+		if deadLetters := AwaitDeadLetters(t, server, alice, "ops", 1); deadLetters[0].Error != "got status 302" {
+			t.Errorf("got dead letter %+v", deadLetters[0])
+		}
+		AssertNoWebhook(t, requests)
+	})
+
+	t.Run("deleting a room removes its webhooks and dead letters", func(t *testing.T) {
+		server := WebhookServerFixture(t)
+		url, _ := WebhookReceiverFixture(t, http.StatusNotFound)
+		alice, _ := AddFakeConnection(t, server, "alice")
+		AssertSuccess(t, CallMethod(t, server, alice, CreateChatRoomRpcMethod, RoomParams{Room: "ops"}))
+		AddWebhook(t, server, alice, AddWebhookParams{Room: "ops", URL: url, Events: []string{WebhookEventMessage}})
+		AssertSuccess(t, CallMethod(t, server, alice, ChatRpcMethod, ChatRequestParams{Room: "ops", Msg: []byte("paging")}))
+		AwaitDeadLetters(t, server, alice, "ops", 1)
+
+		AssertSuccess(t, CallMethod(t, server, alice, DeleteChatRoomRpcMethod, RoomParams{Room: "ops"}))
+		AssertSuccess(t, CallMethod(t, server, alice, CreateChatRoomRpcMethod, RoomParams{Room: "ops"}))
+		if webhooks, deadLetters := server.webhookService.List("ops"), server.webhookService.DeadLetters("ops"); len(webhooks) != 0 || len(deadLetters) != 0 {
+			t.Errorf("got webhooks %+v and dead letters %+v of the deleted room", webhooks, deadLetters)
+		}
+	})
+
+	t.Run("every node of a cluster delivers its own events once", func(t *testing.T) {
+		broker := NewLocalBroker()
+		t.Cleanup(func() { broker.Close() })
+		servers := []*Server{WebhookServerFixture(t), WebhookServerFixture(t)}
+		for i, server := range servers {
+			server.JoinCluster(fmt.Sprintf("node-%d", i), broker)
+		}
+		url, requests := WebhookReceiverFixture(t)
+		alice, _ := AddFakeConnection(t, servers[0], "alice")
+		bob, _ := AddFakeConnection(t, servers[1], "bob")
+		AssertSuccess(t, CallMethod(t, servers[0], alice, CreateChatRoomRpcMethod, RoomParams{Room: "ops"}))
+		webhook := AddWebhook(t, servers[0], alice, AddWebhookParams{Room: "ops", URL: url, Events: []string{WebhookEventMessage}})
+		broker.Flush()
+		AssertSuccess(t, CallMethod(t, servers[1], bob, JoinChatRoomRpcMethod, RoomParams{Room: "ops"}))
+		broker.Flush()
+
+		AssertSuccess(t, CallMethod(t, servers[1], bob, ChatRpcMethod, ChatRequestParams{Room: "ops", Msg: []byte("from node 1")}))
+		broker.Flush()
+		if payload := ReceiveWebhook(t, requests, webhook.Secret); payload.Message == nil || payload.Message.Author != "bob" {
+			t.Errorf("got payload %+v", payload)
+		}
+		AssertSuccess(t, CallMethod(t, servers[0], alice, ChatRpcMethod, ChatRequestParams{Room: "ops", Msg: []byte("from node 0")}))
+		broker.Flush()
+		if payload := ReceiveWebhook(t, requests, webhook.Secret); payload.Message == nil || payload.Message.Author != "alice" {
+			t.Errorf("got payload %+v", payload)
+		}
+		AssertNoWebhook(t, requests)
+
+		late := WebhookServerFixture(t)
+		lateBroker := NewLocalBroker()
+		t.Cleanup(func() { lateBroker.Close() })
+		late.JoinCluster("late", lateBroker)
+		late.HandleClusterEvent(servers[1].ClusterSnapshot())
+		if webhooks := late.webhookService.List("ops"); len(webhooks) != 1 || webhooks[0].Id != webhook.Id {
+			t.Errorf("got webhooks %+v on a node that joined later", webhooks)
+		}
+
+		AssertSuccess(t, CallMethod(t, servers[0], alice, RemoveWebhookRpcMethod, WebhookParams{Room: "ops", Id: webhook.Id}))
+		broker.Flush()
+		AssertSuccess(t, CallMethod(t, servers[1], bob, ChatRpcMethod, ChatRequestParams{Room: "ops", Msg: []byte("unsubscribed")}))
+		AssertNoWebhook(t, requests)
+	})
+
+	t.Run("dead letters are capped per room", func(t *testing.T) {
+		storage := NewMemoryStorage()
+		store, err := NewPersistentWebhookStore(storage)
+		AssertErrorNotNil(t, err)
+		start := time.Now()
+		for i := range MaxWebhookDeadLetters + 5 {
+			store.AppendDeadLetter(WebhookDeadLetter{Webhook: "w1", Payload: WebhookPayload{Id: fmt.Sprint(i), Room: "ops"}, Time: start.Add(time.Duration(i))})
+		}
+		store.AppendDeadLetter(WebhookDeadLetter{Webhook: "w2", Payload: WebhookPayload{Id: "other", Room: "dev"}, Time: start})
+
+		reloaded, err := NewPersistentWebhookStore(storage)
+		AssertErrorNotNil(t, err)
+		for _, s := range []WebhookStore{store, reloaded} {
+			if deadLetters := s.DeadLetters("ops"); len(deadLetters) != MaxWebhookDeadLetters || deadLetters[0].Payload.Id != "5" {
+				t.Errorf("got %d dead letters starting at %+v", len(deadLetters), deadLetters[0])
+			}
+			if deadLetters := s.DeadLetters("dev"); len(deadLetters) != 1 {
+				t.Errorf("got dead letters %+v", deadLetters)
+			}
+		}
+	})
+}